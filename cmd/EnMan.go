@@ -4,10 +4,14 @@ import (
 	"encoding/json"
 	internalenergysource "enman/internal/energysource"
 	"enman/pkg/energysource"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,16 +20,69 @@ type home struct {
 }
 
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		switch os.Args[1] {
+		case "scan":
+			os.Exit(scan(os.Args[2:]))
+		case "modbus":
+			os.Exit(modbusCli(os.Args[2:]))
+		case "simulate":
+			os.Exit(simulate(os.Args[2:]))
+		case "sniff":
+			os.Exit(sniff(os.Args[2:]))
+		default:
+			_, _ = fmt.Fprintf(os.Stderr, "unknown command %q, usage: enman [scan|modbus|simulate|sniff] [options]\n", os.Args[1])
+			os.Exit(2)
+		}
+	}
+	flags := flag.NewFlagSet("enman", flag.ExitOnError)
+	systemType := flags.String("system", "victron", "energy system type: victron, carlo-gavazzi, sunspec or registermap")
+	url := flags.String("url", "tcp://einstein.energy.cleme:502", "modbus url of the energy system, including serial settings, e.g. rtu:///dev/ttyUSB0?baud=9600&parity=N")
+	gridUnit := flags.Uint("grid", 0, "unit id of the grid meter, defaults to 31 (victron), 2 (carlo-gavazzi) or 1 (sunspec and registermap)")
+	pvUnits := flags.String("pvs", "", "comma-separated unit ids of the pv inverters")
+	gridMap := flags.String("gridmap", "", "register map file (.json, .yaml or .yml) of the grid meter, registermap systems only")
+	pvMap := flags.String("pvmap", "", "register map file (.json, .yaml or .yml) of the pv inverters, registermap systems only")
+	listen := flags.String("listen", ":8080", "address to serve the http interface at")
+	_ = flags.Parse(os.Args[1:])
+
 	gridConfig, err := energysource.NewGridConfig(230, 25, 3)
 	if err != nil {
 		panic(err)
 	}
-	var gridUnitId = uint8(31)
 	var pvUnitIds []uint8
-
-	system, err := internalenergysource.NewVictronSystem("tcp://einstein.energy.cleme:502", gridConfig, &gridUnitId, pvUnitIds)
-	//var gridUnitId = uint8(2)
-	//system, err := internalenergysource.NewCarloGavazziSystem("rtu:///dev/ttyUSB0", gridConfig, &gridUnitId, pvUnitIds)
+	for _, field := range splitList(*pvUnits) {
+		unitId, err := strconv.ParseUint(field, 10, 8)
+		if err != nil {
+			log.Fatalf("invalid pv unit id %q", field)
+		}
+		pvUnitIds = append(pvUnitIds, uint8(unitId))
+	}
+	var system *energysource.System
+	var gridUnitId = uint8(*gridUnit)
+	switch *systemType {
+	case "victron":
+		if gridUnitId == 0 {
+			gridUnitId = 31
+		}
+		system, err = internalenergysource.NewVictronSystem(*url, gridConfig, &gridUnitId, pvUnitIds)
+	case "carlo-gavazzi":
+		if gridUnitId == 0 {
+			gridUnitId = 2
+		}
+		system, err = internalenergysource.NewCarloGavazziSystem(*url, gridConfig, &gridUnitId, pvUnitIds)
+	case "sunspec":
+		if gridUnitId == 0 {
+			gridUnitId = 1
+		}
+		system, err = internalenergysource.NewSunSpecSystem(*url, gridConfig, &gridUnitId, pvUnitIds)
+	case "registermap":
+		if gridUnitId == 0 {
+			gridUnitId = 1
+		}
+		system, err = newRegisterMapSystem(*url, gridConfig, gridUnitId, *gridMap, pvUnitIds, *pvMap)
+	default:
+		log.Fatalf("unknown energy system type %q", *systemType)
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -36,12 +93,44 @@ func main() {
 	mux.HandleFunc("/api", home{system}.dataAsJson)
 
 	//http.ListenAndServe uses the default server structure.
-	err = http.ListenAndServe(":8080", mux)
+	err = http.ListenAndServe(*listen, mux)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// newRegisterMapSystem Creates a system polled as described by register map files. The grid meter is left out when no grid map is given.
+func newRegisterMapSystem(url string, gridConfig *energysource.GridConfig, gridUnitId uint8, gridMap string, pvUnitIds []uint8, pvMap string) (*energysource.System, error) {
+	var gridUnit *internalenergysource.RegisterMapUnit
+	if gridMap != "" {
+		registerMap, err := internalenergysource.LoadRegisterMap(gridMap)
+		if err != nil {
+			return nil, err
+		}
+		gridUnit = &internalenergysource.RegisterMapUnit{
+			UnitId:      gridUnitId,
+			RegisterMap: registerMap,
+		}
+	}
+	var pvUnits []*internalenergysource.RegisterMapUnit
+	if len(pvUnitIds) > 0 {
+		if pvMap == "" {
+			return nil, fmt.Errorf("pv inverters require a register map, see -pvmap")
+		}
+		registerMap, err := internalenergysource.LoadRegisterMap(pvMap)
+		if err != nil {
+			return nil, err
+		}
+		for _, unitId := range pvUnitIds {
+			pvUnits = append(pvUnits, &internalenergysource.RegisterMapUnit{
+				UnitId:      unitId,
+				RegisterMap: registerMap,
+			})
+		}
+	}
+	return internalenergysource.NewRegisterMapSystem(url, gridConfig, gridUnit, pvUnits)
+}
+
 func printUsage(system *energysource.System) {
 	ticker := time.NewTicker(time.Millisecond * 1000)
 	tickerChannel := make(chan bool)
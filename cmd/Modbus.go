@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"enman/internal/modbus"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const modbusUsage = `usage: enman modbus <read|write|watch> [options] <url> <address> [quantity|values...]
+
+Reads, writes or watches coils and registers, e.g.
+  enman modbus read -unit 2 -table input -type int32 -wordorder low -speed 9600 rtu:///dev/ttyUSB0 0x0000 3
+  enman modbus write -unit 1 -type float32 tcp://plc:502 100 12.5 -3
+  enman modbus watch -unit 31 -table input -interval 2s tcp://gx:502 2600 3
+
+read and watch take the number of values to read (defaults to 1), or the number of registers
+of string and bcd values. write takes the values to write.
+
+options:`
+
+// modbusValueTypes Lists the value types, and the number of registers of the fixed size ones.
+var modbusValueTypes = map[string]uint16{
+	"uint16":  1,
+	"int16":   1,
+	"uint32":  2,
+	"int32":   2,
+	"float32": 2,
+	"uint64":  4,
+	"int64":   4,
+	"float64": 4,
+	"string":  0,
+	"bcd":     0,
+}
+
+type modbusCommand struct {
+	action    string
+	unitId    uint
+	table     string
+	valueType string
+	hex       bool
+	interval  time.Duration
+	color     bool
+	address   uint16
+	args      []string
+	unit      *modbus.ModbusUnit
+}
+
+// modbusCli Reads, writes and watches coils and registers. Returns the exit code of the command.
+func modbusCli(args []string) int {
+	if len(args) == 0 || (args[0] != "read" && args[0] != "write" && args[0] != "watch") {
+		_, _ = fmt.Fprintln(os.Stderr, strings.SplitN(modbusUsage, "\n", 2)[0])
+		return 2
+	}
+	cmd := &modbusCommand{action: args[0]}
+	flags := flag.NewFlagSet("modbus "+cmd.action, flag.ContinueOnError)
+	flags.Usage = func() {
+		_, _ = fmt.Fprintln(flags.Output(), modbusUsage)
+		flags.PrintDefaults()
+	}
+	flags.UintVar(&cmd.unitId, "unit", 1, "unit id of the device")
+	flags.StringVar(&cmd.table, "table", "holding", "coil, discrete, holding or input")
+	flags.StringVar(&cmd.valueType, "type", "uint16", "uint16, int16, uint32, int32, float32, uint64, int64, float64, string or bcd")
+	flags.BoolVar(&cmd.hex, "hex", false, "print integers in hexadecimal")
+	endianness := flags.String("endianness", "big", "byte order within registers: big or little")
+	wordOrder := flags.String("wordorder", "high", "register order of 32 and 64-bit values: high (high word first) or low")
+	speed := flags.Uint("speed", 0, "serial link speed (rtu and ascii only, defaults to 19200)")
+	parity := flags.String("parity", "none", "serial link parity: none, even or odd (rtu and ascii only)")
+	timeout := flags.Duration("timeout", 0, "request timeout (defaults to the modbus client default)")
+	cert := flags.String("cert", "", "client certificate file (tcp+tls only)")
+	key := flags.String("key", "", "client private key file (tcp+tls only)")
+	ca := flags.String("ca", "", "file with the CA or server certificates to trust (tcp+tls only)")
+	flags.DurationVar(&cmd.interval, "interval", time.Second, "polling interval (watch only)")
+	flags.BoolVar(&cmd.color, "color", true, "highlight changed values (watch only)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if flags.NArg() < 2 || (cmd.action == "write" && flags.NArg() < 3) {
+		flags.Usage()
+		return 2
+	}
+	conf := &modbus.ClientConfiguration{
+		URL:     flags.Arg(0),
+		Speed:   *speed,
+		Timeout: *timeout,
+		// Keep watching through gateway restarts and cable swaps.
+		AutoReconnect: cmd.action == "watch",
+	}
+	err := cmd.parse(flags.Arg(1), flags.Args()[2:])
+	if err == nil {
+		conf.Parity, err = parseParity(*parity)
+	}
+	if err == nil {
+		err = loadClientTLS(conf, *cert, *key, *ca)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	client, err := modbus.NewClient(conf)
+	if err == nil {
+		err = setClientEncoding(client, *endianness, *wordOrder)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	err = client.Open()
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer client.Close()
+	cmd.unit = client.Unit(uint8(cmd.unitId))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	switch cmd.action {
+	case "read":
+		err = cmd.read(ctx)
+	case "write":
+		err = cmd.write(ctx)
+	case "watch":
+		err = cmd.watch(ctx)
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// parse Validates the options and positional arguments of the command.
+func (mc *modbusCommand) parse(address string, args []string) error {
+	if mc.unitId > 255 {
+		return fmt.Errorf("invalid unit id %d", mc.unitId)
+	}
+	switch mc.table {
+	case "coil", "discrete", "holding", "input":
+	default:
+		return fmt.Errorf("invalid table %q, expected coil, discrete, holding or input", mc.table)
+	}
+	if _, ok := modbusValueTypes[mc.valueType]; !ok {
+		return fmt.Errorf("invalid type %q", mc.valueType)
+	}
+	if mc.action == "write" && (mc.table == "discrete" || mc.table == "input") {
+		return fmt.Errorf("the %s table is read-only", mc.table)
+	}
+	value, err := strconv.ParseUint(address, 0, 16)
+	if err != nil {
+		return fmt.Errorf("invalid address %q", address)
+	}
+	mc.address = uint16(value)
+	if mc.action != "write" && len(args) > 1 {
+		return fmt.Errorf("%s takes a single quantity", mc.action)
+	}
+	mc.args = args
+	if mc.action != "write" {
+		_, err = mc.quantity()
+	}
+	return err
+}
+
+func (mc *modbusCommand) read(ctx context.Context) error {
+	values, err := mc.readValues(ctx)
+	if err != nil {
+		return err
+	}
+	mc.print(values, nil)
+	return nil
+}
+
+func (mc *modbusCommand) watch(ctx context.Context) error {
+	var previous []string
+	ticker := time.NewTicker(mc.interval)
+	defer ticker.Stop()
+	for {
+		values, err := mc.readValues(ctx)
+		if err != nil {
+			// Devices come and go, keep watching.
+			fmt.Printf("%s: %v\n", time.Now().Format("15:04:05.000"), err)
+		} else {
+			fmt.Println(time.Now().Format("15:04:05.000"))
+			mc.print(values, previous)
+			previous = values
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// print Prints the values with their address, highlighting the ones which differ from previous.
+func (mc *modbusCommand) print(values []string, previous []string) {
+	width := modbusValueTypes[mc.valueType]
+	if mc.table == "coil" || mc.table == "discrete" || width == 0 {
+		width = 1
+	}
+	for ix, value := range values {
+		address := uint32(mc.address) + uint32(ix)*uint32(width)
+		changed := previous != nil && (ix >= len(previous) || previous[ix] != value)
+		if changed && mc.color {
+			value = "\x1b[7m" + value + "\x1b[0m"
+		} else if changed {
+			value += " *"
+		}
+		fmt.Printf("%5d (0x%04x): %s\n", address, address, value)
+	}
+}
+
+// quantity Returns the quantity argument of read and watch, defaulting to 1.
+func (mc *modbusCommand) quantity() (uint16, error) {
+	if len(mc.args) == 0 {
+		return 1, nil
+	}
+	quantity, err := strconv.ParseUint(mc.args[0], 0, 16)
+	if err != nil || quantity == 0 {
+		return 0, fmt.Errorf("invalid quantity %q", mc.args[0])
+	}
+	return uint16(quantity), nil
+}
+
+// readValues Reads the values and formats them according to the value type.
+func (mc *modbusCommand) readValues(ctx context.Context) ([]string, error) {
+	quantity, err := mc.quantity()
+	if err != nil {
+		return nil, err
+	}
+	address := mc.address
+	var values []string
+	switch mc.table {
+	case "coil", "discrete":
+		var bits []bool
+		if mc.table == "coil" {
+			bits, err = mc.unit.ReadCoils(ctx, address, quantity)
+		} else {
+			bits, err = mc.unit.ReadDiscreteInputs(ctx, address, quantity)
+		}
+		for _, bit := range bits {
+			values = append(values, formatBool(bit))
+		}
+		return values, err
+	}
+	regType := modbus.HOLDING_REGISTER
+	if mc.table == "input" {
+		regType = modbus.INPUT_REGISTER
+	}
+	switch mc.valueType {
+	case "uint16":
+		var result []uint16
+		result, err = mc.unit.ReadRegisters(ctx, address, quantity, regType)
+		for _, value := range result {
+			values = append(values, mc.formatUint(uint64(value), 4))
+		}
+	case "int16":
+		var result []int16
+		result, err = mc.unit.ReadInt16s(ctx, address, quantity, regType)
+		for _, value := range result {
+			values = append(values, mc.formatInt(int64(value), 4))
+		}
+	case "uint32":
+		var result []uint32
+		result, err = mc.unit.ReadUint32s(ctx, address, quantity, regType)
+		for _, value := range result {
+			values = append(values, mc.formatUint(uint64(value), 8))
+		}
+	case "int32":
+		var result []int32
+		result, err = mc.unit.ReadInt32s(ctx, address, quantity, regType)
+		for _, value := range result {
+			values = append(values, mc.formatInt(int64(value), 8))
+		}
+	case "float32":
+		var result []float32
+		result, err = mc.unit.ReadFloat32s(ctx, address, quantity, regType)
+		for _, value := range result {
+			values = append(values, strconv.FormatFloat(float64(value), 'g', -1, 32))
+		}
+	case "uint64":
+		var result []uint64
+		result, err = mc.unit.ReadUint64s(ctx, address, quantity, regType)
+		for _, value := range result {
+			values = append(values, mc.formatUint(value, 16))
+		}
+	case "int64":
+		var result []int64
+		result, err = mc.unit.ReadInt64s(ctx, address, quantity, regType)
+		for _, value := range result {
+			values = append(values, mc.formatInt(value, 16))
+		}
+	case "float64":
+		var result []float64
+		result, err = mc.unit.ReadFloat64s(ctx, address, quantity, regType)
+		for _, value := range result {
+			values = append(values, strconv.FormatFloat(value, 'g', -1, 64))
+		}
+	case "string":
+		var result string
+		result, err = mc.unit.ReadString(ctx, address, quantity, regType)
+		values = append(values, strconv.Quote(result))
+	case "bcd":
+		var result uint64
+		result, err = mc.unit.ReadBCD(ctx, address, quantity, regType)
+		values = append(values, strconv.FormatUint(result, 10))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// write Parses the values according to the value type and writes them.
+func (mc *modbusCommand) write(ctx context.Context) error {
+	address := mc.address
+	if mc.table == "coil" {
+		var bits []bool
+		for _, arg := range mc.args {
+			bit, err := parseBool(arg)
+			if err != nil {
+				return err
+			}
+			bits = append(bits, bit)
+		}
+		if len(bits) == 1 {
+			return mc.unit.WriteCoil(ctx, address, bits[0])
+		}
+		return mc.unit.WriteCoils(ctx, address, bits)
+	}
+	switch mc.valueType {
+	case "string":
+		if len(mc.args) != 1 {
+			return fmt.Errorf("expected a single string value")
+		}
+		// Pad odd lengths, as registers hold two characters.
+		return mc.unit.WriteString(ctx, address, uint16((len(mc.args[0])+1)/2), mc.args[0])
+	case "bcd":
+		if len(mc.args) != 1 {
+			return fmt.Errorf("expected a single bcd value")
+		}
+		value, err := strconv.ParseUint(mc.args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid bcd value %q", mc.args[0])
+		}
+		// Four digits per register.
+		return mc.unit.WriteBCD(ctx, address, uint16((len(strconv.FormatUint(value, 10))+3)/4), value)
+	case "float32", "float64":
+		bits := 32
+		if mc.valueType == "float64" {
+			bits = 64
+		}
+		var values []float64
+		for _, arg := range mc.args {
+			value, err := strconv.ParseFloat(arg, bits)
+			if err != nil {
+				return fmt.Errorf("invalid %s value %q", mc.valueType, arg)
+			}
+			values = append(values, value)
+		}
+		if bits == 32 {
+			float32s := make([]float32, len(values))
+			for ix, value := range values {
+				float32s[ix] = float32(value)
+			}
+			return mc.unit.WriteFloat32s(ctx, address, float32s)
+		}
+		return mc.unit.WriteFloat64s(ctx, address, values)
+	case "int16", "int32", "int64":
+		bits := 16 * int(modbusValueTypes[mc.valueType])
+		var values []int64
+		for _, arg := range mc.args {
+			value, err := strconv.ParseInt(arg, 0, bits)
+			if err != nil {
+				return fmt.Errorf("invalid %s value %q", mc.valueType, arg)
+			}
+			values = append(values, value)
+		}
+		switch mc.valueType {
+		case "int16":
+			int16s := make([]int16, len(values))
+			for ix, value := range values {
+				int16s[ix] = int16(value)
+			}
+			if len(int16s) == 1 {
+				return mc.unit.WriteInt16(ctx, address, int16s[0])
+			}
+			return mc.unit.WriteInt16s(ctx, address, int16s)
+		case "int32":
+			int32s := make([]int32, len(values))
+			for ix, value := range values {
+				int32s[ix] = int32(value)
+			}
+			return mc.unit.WriteInt32s(ctx, address, int32s)
+		}
+		return mc.unit.WriteInt64s(ctx, address, values)
+	}
+	bits := 16 * int(modbusValueTypes[mc.valueType])
+	var values []uint64
+	for _, arg := range mc.args {
+		value, err := strconv.ParseUint(arg, 0, bits)
+		if err != nil {
+			return fmt.Errorf("invalid %s value %q", mc.valueType, arg)
+		}
+		values = append(values, value)
+	}
+	switch mc.valueType {
+	case "uint16":
+		uint16s := make([]uint16, len(values))
+		for ix, value := range values {
+			uint16s[ix] = uint16(value)
+		}
+		if len(uint16s) == 1 {
+			return mc.unit.WriteRegister(ctx, address, uint16s[0])
+		}
+		return mc.unit.WriteRegisters(ctx, address, uint16s)
+	case "uint32":
+		uint32s := make([]uint32, len(values))
+		for ix, value := range values {
+			uint32s[ix] = uint32(value)
+		}
+		return mc.unit.WriteUint32s(ctx, address, uint32s)
+	}
+	return mc.unit.WriteUint64s(ctx, address, values)
+}
+
+func (mc *modbusCommand) formatUint(value uint64, digits int) string {
+	if mc.hex {
+		return fmt.Sprintf("0x%0*x", digits, value)
+	}
+	return strconv.FormatUint(value, 10)
+}
+
+func (mc *modbusCommand) formatInt(value int64, digits int) string {
+	if mc.hex {
+		// Show the two's complement, as found in the registers.
+		return fmt.Sprintf("0x%0*x", digits, uint64(value)&(1<<(4*uint(digits))-1))
+	}
+	return strconv.FormatInt(value, 10)
+}
+
+func formatBool(value bool) string {
+	if value {
+		return "1"
+	}
+	return "0"
+}
+
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "1", "true", "on":
+		return true, nil
+	case "0", "false", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid coil value %q, expected 1, 0, true, false, on or off", value)
+}
+
+func parseParity(value string) (uint, error) {
+	parities, err := parseParities(value)
+	if err != nil {
+		return 0, err
+	}
+	if len(parities) != 1 {
+		return 0, fmt.Errorf("invalid parity %q, expected none, even or odd", value)
+	}
+	return parities[0], nil
+}
+
+// setClientEncoding Applies the endianness ("big" or "little") and word order ("high" or "low") to the client.
+func setClientEncoding(client *modbus.ModbusClient, endianness string, wordOrder string) error {
+	var e modbus.Endianness
+	var w modbus.WordOrder
+	switch strings.ToLower(endianness) {
+	case "big":
+		e = modbus.BIG_ENDIAN
+	case "little":
+		e = modbus.LITTLE_ENDIAN
+	default:
+		return fmt.Errorf("invalid endianness %q, expected big or little", endianness)
+	}
+	switch strings.ToLower(wordOrder) {
+	case "high":
+		w = modbus.HIGH_WORD_FIRST
+	case "low":
+		w = modbus.LOW_WORD_FIRST
+	default:
+		return fmt.Errorf("invalid word order %q, expected high or low", wordOrder)
+	}
+	return client.SetEncoding(e, w)
+}
+
+// loadClientTLS Loads the client key pair and trusted certificates into the configuration.
+func loadClientTLS(conf *modbus.ClientConfiguration, cert string, key string, ca string) error {
+	if (cert == "") != (key == "") {
+		return fmt.Errorf("-cert and -key must be used together")
+	}
+	if cert != "" {
+		keyPair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return fmt.Errorf("failed to load the client key pair: %w", err)
+		}
+		conf.TLSClientCert = &keyPair
+	}
+	if ca != "" {
+		pool, err := modbus.LoadCertPool(ca)
+		if err != nil {
+			return fmt.Errorf("failed to load the trusted certificates: %w", err)
+		}
+		conf.TLSRootCAs = pool
+	}
+	return nil
+}
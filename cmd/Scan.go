@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"enman/internal/modbus"
+	"enman/internal/scanner"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scan Sweeps a modbus bus for devices, see scanner.Scan. Returns the exit code of the command.
+func scan(args []string) int {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	flags.Usage = func() {
+		_, _ = fmt.Fprintln(flags.Output(), "usage: enman scan [options] <url>\n\nSweeps a modbus bus for devices, e.g. enman scan -speeds 9600,19200 -parities none,even rtu:///dev/ttyUSB0\n\noptions:")
+		flags.PrintDefaults()
+	}
+	first := flags.Uint("first", 1, "first unit id to probe")
+	last := flags.Uint("last", 247, "last unit id to probe")
+	timeout := flags.Duration("timeout", 500*time.Millisecond, "time to wait for each response")
+	speeds := flags.String("speeds", "", "comma separated serial link speeds to try (rtu and ascii only)")
+	parities := flags.String("parities", "", "comma separated parity modes to try: none, even and/or odd (rtu and ascii only)")
+	verbose := flags.Bool("v", false, "log modbus client errors")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	if *first < 1 || *last > 247 || *first > *last {
+		_, _ = fmt.Fprintf(os.Stderr, "invalid unit id range %d-%d, unit ids must be between 1 and 247 (inclusive)\n", *first, *last)
+		return 2
+	}
+	conf := &scanner.Configuration{
+		URL:         flags.Arg(0),
+		FirstUnitId: uint8(*first),
+		LastUnitId:  uint8(*last),
+		Timeout:     *timeout,
+		// Timeouts are expected while scanning, keep them out of the report.
+		Logger: log.New(io.Discard, "", 0),
+	}
+	if *verbose {
+		conf.Logger = nil
+	}
+	var err error
+	conf.Speeds, err = parseSpeeds(*speeds)
+	if err == nil {
+		conf.Parities, err = parseParities(*parities)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	results, err := scanner.Scan(ctx, conf, printScanResult)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "scan failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%d device(s) found\n", len(results))
+	return 0
+}
+
+func printScanResult(result *scanner.Result) {
+	link := ""
+	if result.Speed != 0 {
+		link = fmt.Sprintf(" @ %d bps, parity %s", result.Speed, parityName(result.Parity))
+	}
+	fmt.Printf("unit %d%s: answered in %v\n", result.UnitId, link, result.ResponseTime.Round(time.Millisecond))
+	if len(result.Identifications) == 0 {
+		fmt.Println("\tnot identified")
+	}
+	for _, identification := range result.Identifications {
+		fmt.Printf("\t%s: %s\n", identification.Method, identification.Description)
+	}
+}
+
+func parseSpeeds(value string) ([]uint, error) {
+	var speeds []uint
+	for _, field := range splitList(value) {
+		speed, err := strconv.ParseUint(field, 10, 32)
+		if err != nil || speed == 0 {
+			return nil, fmt.Errorf("invalid speed %q", field)
+		}
+		speeds = append(speeds, uint(speed))
+	}
+	return speeds, nil
+}
+
+func parseParities(value string) ([]uint, error) {
+	var parities []uint
+	for _, field := range splitList(value) {
+		switch strings.ToLower(field) {
+		case "none", "n":
+			parities = append(parities, modbus.PARITY_NONE)
+		case "even", "e":
+			parities = append(parities, modbus.PARITY_EVEN)
+		case "odd", "o":
+			parities = append(parities, modbus.PARITY_ODD)
+		default:
+			return nil, fmt.Errorf("invalid parity %q, expected none, even or odd", field)
+		}
+	}
+	return parities, nil
+}
+
+func parityName(parity uint) string {
+	switch parity {
+	case modbus.PARITY_EVEN:
+		return "even"
+	case modbus.PARITY_ODD:
+		return "odd"
+	}
+	return "none"
+}
+
+// splitList Splits a comma separated list, ignoring empty items.
+func splitList(value string) []string {
+	var fields []string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"enman/internal/modbus"
+	"enman/internal/simulator"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+)
+
+const simulateUsage = `usage: enman simulate [options] -device <type>:<unit id>[:<profile>] [-device ...]
+
+Serves simulated meters and inverters, e.g.
+  enman simulate -url tcp://[::]:5020 -device victron-grid:31 -device victron-pvinverter:20:random=0..3000
+  enman simulate -url rtu:///dev/ttyUSB1 -speed 9600 -device em24:2:script=profile.yaml -device et112:3
+
+device types: em24, em340, et112, victron-grid and victron-pvinverter.
+profiles: constant=<W>[/<W>/<W>], random=<min W>..<max W>[@<seed>] or script=<.json or .yaml file>,
+defaults to a random walk.
+
+options:`
+
+// deviceSpecs Collects the repeated -device flags.
+type deviceSpecs []string
+
+func (ds *deviceSpecs) String() string {
+	return strings.Join(*ds, ", ")
+}
+
+func (ds *deviceSpecs) Set(value string) error {
+	*ds = append(*ds, value)
+	return nil
+}
+
+// simulate Serves simulated devices until interrupted. Returns the exit code of the command.
+func simulate(args []string) int {
+	var devices deviceSpecs
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	flags.Usage = func() {
+		_, _ = fmt.Fprintln(flags.Output(), simulateUsage)
+		flags.PrintDefaults()
+	}
+	url := flags.String("url", "tcp://[::]:5020", "url to serve the devices at")
+	speed := flags.Uint("speed", 0, "serial link speed (rtu and ascii only, defaults to 19200)")
+	parity := flags.String("parity", "none", "serial link parity: none, even or odd (rtu and ascii only)")
+	flags.Var(&devices, "device", "device to simulate, may be repeated")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(devices) == 0 || flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+	sim := simulator.NewSimulator()
+	for _, spec := range devices {
+		unitId, device, err := parseDevice(spec)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		sim.AddDevice(unitId, device)
+	}
+	serverParity, err := parseParity(*parity)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	err = sim.Start(&modbus.ServerConfiguration{
+		URL:    *url,
+		Speed:  *speed,
+		Parity: serverParity,
+	})
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("simulating unit ids %v at %s, press Ctrl-C to stop\n", sim.UnitIds(), *url)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	<-signals
+	err = sim.Stop()
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// parseDevice Parses a <type>:<unit id>[:<profile>] device specification.
+func parseDevice(spec string) (uint8, simulator.Device, error) {
+	fields := strings.SplitN(spec, ":", 3)
+	if len(fields) < 2 {
+		return 0, nil, fmt.Errorf("invalid device %q, expected <type>:<unit id>[:<profile>]", spec)
+	}
+	unitId, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil || unitId == 0 || unitId > 247 {
+		return 0, nil, fmt.Errorf("invalid unit id %q, expected 1 to 247 (inclusive)", fields[1])
+	}
+	// Meters default to alternating between import and export, inverters to production only.
+	profileSpec := "random=-3000..5000"
+	if fields[0] == "victron-pvinverter" {
+		profileSpec = "random=0..4000"
+	}
+	if len(fields) == 3 {
+		profileSpec = fields[2]
+	}
+	profile, err := simulator.ParseProfile(profileSpec)
+	if err != nil {
+		return 0, nil, err
+	}
+	switch fields[0] {
+	case "em24":
+		return uint8(unitId), simulator.NewEM24(profile), nil
+	case "em340":
+		return uint8(unitId), simulator.NewEM340(profile), nil
+	case "et112":
+		return uint8(unitId), simulator.NewET112(profile), nil
+	case "victron-grid":
+		return uint8(unitId), simulator.NewVictronGrid(profile), nil
+	case "victron-pvinverter":
+		return uint8(unitId), simulator.NewVictronPvInverter(profile), nil
+	}
+	return 0, nil, fmt.Errorf("unknown device type %q", fields[0])
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"enman/internal/modbus"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+const sniffUsage = `usage: enman sniff [options]
+
+Listens to a modbus RTU bus without transmitting and prints the transactions seen, e.g.
+  enman sniff -url rtu:///dev/ttyUSB0 -speed 9600 -parity even
+  enman sniff -url "rtu:///dev/ttyUSB0?baud=9600" -format json > capture.jsonl
+
+options:`
+
+// sniffedRecord Holds a sniffed transaction as written in json format.
+type sniffedRecord struct {
+	Time         time.Time `json:"time"`
+	UnitId       uint8     `json:"unitId"`
+	FunctionCode uint8     `json:"functionCode"`
+	Function     string    `json:"function,omitempty"`
+	Addr         uint16    `json:"addr"`
+	Quantity     uint16    `json:"quantity"`
+	Registers    []uint16  `json:"registers,omitempty"`
+	Coils        []bool    `json:"coils,omitempty"`
+	Exception    string    `json:"exception,omitempty"`
+	LatencyMs    float64   `json:"latencyMs,omitempty"`
+	Request      string    `json:"request,omitempty"`
+	Response     string    `json:"response,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// sniff Prints the transactions seen on a serial bus until interrupted. Returns the exit code of the command.
+func sniff(args []string) int {
+	flags := flag.NewFlagSet("sniff", flag.ContinueOnError)
+	flags.Usage = func() {
+		_, _ = fmt.Fprintln(flags.Output(), sniffUsage)
+		flags.PrintDefaults()
+	}
+	url := flags.String("url", "rtu:///dev/ttyUSB0", "rtu url of the serial bus to listen to")
+	speed := flags.Uint("speed", 0, "serial link speed (defaults to 19200)")
+	parity := flags.String("parity", "none", "serial link parity: none, even or odd")
+	format := flags.String("format", "text", "output format: text or json (one transaction per line)")
+	gap := flags.Duration("gap", 0, "line silence ending a frame (defaults to t3.5 or 20ms, whichever is longer)")
+	timeout := flags.Duration("timeout", time.Second, "time after which a request is reported unanswered")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 || (*format != "text" && *format != "json") {
+		flags.Usage()
+		return 2
+	}
+	snifferParity, err := parseParity(*parity)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	sniffer, err := modbus.NewSniffer(&modbus.SnifferConfiguration{
+		URL:             *url,
+		Speed:           *speed,
+		Parity:          snifferParity,
+		FrameGap:        *gap,
+		ResponseTimeout: *timeout,
+	})
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	err = sniffer.Open()
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to open %s: %v\n", *url, err)
+		return 1
+	}
+	defer func() {
+		_ = sniffer.Close()
+	}()
+
+	output := printSniffedText
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		output = func(st *modbus.SniffedTransaction) {
+			_ = encoder.Encode(newSniffedRecord(st))
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err = sniffer.Run(ctx, output)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// printSniffedText Prints a sniffed transaction as a single line of text.
+func printSniffedText(st *modbus.SniffedTransaction) {
+	var sb strings.Builder
+	sb.WriteString(st.Time.Format("15:04:05.000"))
+	if st.Function == "" {
+		// Frames too broken to tell anything about.
+		_, _ = fmt.Fprintf(&sb, " %v: % x", st.Error, st.Request)
+		fmt.Println(sb.String())
+		return
+	}
+	_, _ = fmt.Fprintf(&sb, " unit %d %s", st.UnitId, st.Function)
+	if st.Quantity > 0 {
+		_, _ = fmt.Fprintf(&sb, " %d@%d", st.Quantity, st.Addr)
+	}
+	switch {
+	case st.Registers != nil:
+		_, _ = fmt.Fprintf(&sb, " %v", st.Registers)
+	case st.Coils != nil:
+		_, _ = fmt.Fprintf(&sb, " %v", st.Coils)
+	}
+	if st.Exception != nil {
+		_, _ = fmt.Fprintf(&sb, " -> %v", st.Exception)
+	}
+	if st.Response != nil {
+		_, _ = fmt.Fprintf(&sb, " (%v)", st.Latency.Round(100*time.Microsecond))
+	}
+	if st.Error != nil {
+		_, _ = fmt.Fprintf(&sb, ": %v: % x", st.Error, st.Request)
+	}
+	fmt.Println(sb.String())
+}
+
+// newSniffedRecord Converts a sniffed transaction to its json form.
+func newSniffedRecord(st *modbus.SniffedTransaction) *sniffedRecord {
+	record := &sniffedRecord{
+		Time:         st.Time,
+		UnitId:       st.UnitId,
+		FunctionCode: st.FunctionCode,
+		Function:     st.Function,
+		Addr:         st.Addr,
+		Quantity:     st.Quantity,
+		Registers:    st.Registers,
+		Coils:        st.Coils,
+		LatencyMs:    float64(st.Latency) / float64(time.Millisecond),
+		Request:      hex.EncodeToString(st.Request),
+		Response:     hex.EncodeToString(st.Response),
+	}
+	if st.Exception != nil {
+		record.Exception = st.Exception.Error()
+	}
+	if st.Error != nil {
+		record.Error = st.Error.Error()
+	}
+	return record
+}
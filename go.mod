@@ -2,5 +2,4 @@ module enman
 
 go 1.19
 
-require (
-)
+require gopkg.in/yaml.v3 v3.0.1
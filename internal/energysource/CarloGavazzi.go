@@ -1,6 +1,7 @@
 package energysource
 
 import (
+	"context"
 	"enman/internal/modbus"
 	"enman/pkg/energysource"
 	"fmt"
@@ -14,6 +15,11 @@ const (
 	em24ApplicationH          = uint16(7)
 )
 
+var (
+	carloGavazziThreePhaseRegisterMap  = mustLoadEmbeddedRegisterMap("carlogavazzi-3p")
+	carloGavazziSinglePhaseRegisterMap = mustLoadEmbeddedRegisterMap("carlogavazzi-1p")
+)
+
 type carloGavazziMeter struct {
 	meterCode string
 	meterType string
@@ -21,35 +27,37 @@ type carloGavazziMeter struct {
 
 func NewCarloGavazziSystem(modbusUrl string, gridConfig *energysource.GridConfig, gridUnitId *uint8, pvUnitIds []uint8) (*energysource.System, error) {
 	config := &ModbusConfig{
-		modbusUrl:   modbusUrl,
-		modbusSpeed: 9600,
-		timeout:     time.Millisecond * 500,
-		gridConfig:  gridConfig,
-		updateGridValues: func(client *modbus.ModbusClient, grid *modbusGrid) {
+		modbusUrl: modbusUrl,
+		// The meters' factory default, other speeds are set in the url, e.g. rtu:///dev/ttyUSB0?baud=19200.
+		modbusSpeed:  9600,
+		timeout:      time.Millisecond * 500,
+		readPlanning: *carloGavazziThreePhaseRegisterMap.plannerConfiguration(),
+		gridConfig:   gridConfig,
+		updateGridValues: func(ctx context.Context, unit *modbus.ModbusUnit, grid *modbusGrid) error {
 			if grid.modbusUnitId <= 0 {
-				return
+				return nil
 			}
 			c := &carloGavazziMeter{
 				meterCode: grid.meterCode,
 			}
-			c.updateValues(client, grid.modbusUnitId, grid.EnergyFlowBase)
+			return c.updateValues(ctx, unit, grid.planner, grid.EnergyFlowBase)
 		},
-		updatePvValues: func(client *modbus.ModbusClient, pv *modbusPv) {
+		updatePvValues: func(ctx context.Context, unit *modbus.ModbusUnit, pv *modbusPv) error {
 			if pv.modbusUnitId <= 0 {
-				return
+				return nil
 			}
 			c := &carloGavazziMeter{
 				meterCode: pv.meterCode,
 			}
-			c.updateValues(client, pv.modbusUnitId, pv.EnergyFlowBase)
+			return c.updateValues(ctx, unit, pv.planner, pv.EnergyFlowBase)
 		},
 	}
 	if gridUnitId != nil {
 		config.modbusGridConfig = &ModbusGridConfig{
 			modbusUnitId: *gridUnitId,
-			initialize: func(modbusClient *modbus.ModbusClient, grid *modbusGrid) error {
+			initialize: func(ctx context.Context, unit *modbus.ModbusUnit, grid *modbusGrid) error {
 				c := &carloGavazziMeter{}
-				err := c.initialize(modbusClient, grid.modbusUnitId)
+				err := c.initialize(ctx, unit)
 				if err != nil {
 					return err
 				}
@@ -60,13 +68,13 @@ func NewCarloGavazziSystem(modbusUrl string, gridConfig *energysource.GridConfig
 		}
 	}
 	if pvUnitIds != nil {
-		configs := make([]*ModbusPvConfig, len(pvUnitIds))
+		configs := make([]*ModbusPvConfig, 0, len(pvUnitIds))
 		for ix := 0; ix < len(pvUnitIds); ix++ {
 			configs = append(configs, &ModbusPvConfig{
 				modbusUnitId: pvUnitIds[ix],
-				initialize: func(modbusClient *modbus.ModbusClient, pv *modbusPv) error {
+				initialize: func(ctx context.Context, unit *modbus.ModbusUnit, pv *modbusPv) error {
 					c := &carloGavazziMeter{}
-					err := c.initialize(modbusClient, pv.modbusUnitId)
+					err := c.initialize(ctx, unit)
 					if err != nil {
 						return err
 					}
@@ -82,98 +90,102 @@ func NewCarloGavazziSystem(modbusUrl string, gridConfig *energysource.GridConfig
 	return system, err
 }
 
-func (c *carloGavazziMeter) initialize(modbusClient *modbus.ModbusClient, modbusUnitId uint8) error {
-	modbusClient.SetUnitId(modbusUnitId)
-	meterType, err := modbusClient.ReadRegister(0x000B, modbus.INPUT_REGISTER)
+func (c *carloGavazziMeter) initialize(ctx context.Context, unit *modbus.ModbusUnit) error {
+	meterType, err := unit.ReadRegister(ctx, 0x000B, modbus.INPUT_REGISTER)
 	if err != nil {
 		return err
 	}
 	c.meterCode = fmt.Sprintf("%d", meterType)
-	switch meterType {
+	c.meterType, _ = CarloGavazziMeterType(meterType)
+	if meterType >= 71 && meterType <= 73 {
+		// type EM24 detected. Check if application is set to 'H'.
+		application, err := unit.ReadRegister(ctx, em24ApplicationRegister, modbus.INPUT_REGISTER)
+		if err != nil {
+			return err
+		}
+		if application != em24ApplicationH {
+			// Application not set to 'H'. Check if we can update the value.
+			frontSelector, err := unit.ReadRegister(ctx, em24FrontSelectorRegister, modbus.INPUT_REGISTER)
+			if err != nil {
+				return err
+			}
+			if frontSelector == 3 {
+				println("EM24 front selector is locked. Cannot update application to 'H'. Please use the joystick " +
+					"to manually update the EM24 to 'applicatin H', or set the front selector in an unlocked position " +
+					"and reinitialize the system.")
+			} else {
+				err := unit.WriteRegister(ctx, em24ApplicationRegister, em24ApplicationH)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// CarloGavazziMeterType Returns the meter type of the given Carlo Gavazzi model code (input register 0x000B), and
+// whether the code is a known one.
+func CarloGavazziMeterType(code uint16) (string, bool) {
+	switch code {
 	case 71:
-		c.meterType = "EM24-DIN AV"
+		return "EM24-DIN AV", true
 	case 72:
-		c.meterType = "EM24-DIN AV5"
+		return "EM24-DIN AV5", true
 	case 73:
-		c.meterType = "EM24-DIN AV6"
+		return "EM24-DIN AV6", true
 	case 100:
-		c.meterType = "EM110-DIN AV7 1 x S1"
+		return "EM110-DIN AV7 1 x S1", true
 	case 101:
-		c.meterType = "EM111-DIN AV7 1 x S1"
+		return "EM111-DIN AV7 1 x S1", true
 	case 102:
-		c.meterType = "EM112-DIN AV1 1 x S1"
+		return "EM112-DIN AV1 1 x S1", true
 	case 103:
-		c.meterType = "EM111-DIN AV8 1 x S1"
+		return "EM111-DIN AV8 1 x S1", true
 	case 104:
-		c.meterType = "EM112-DIN AV0 1 x S1"
+		return "EM112-DIN AV0 1 x S1", true
 	case 110:
-		c.meterType = "EM110-DIN AV8 1 x S1"
+		return "EM110-DIN AV8 1 x S1", true
 	case 114:
-		c.meterType = "EM111-DIN AV5 1 X S1 X"
+		return "EM111-DIN AV5 1 X S1 X", true
 	case 120:
-		c.meterType = "ET112-DIN AV0 1 x S1 X"
+		return "ET112-DIN AV0 1 x S1 X", true
 	case 121:
-		c.meterType = "ET112-DIN AV1 1 x S1 X"
+		return "ET112-DIN AV1 1 x S1 X", true
 	case 331:
-		c.meterType = "EM330-DIN AV6 3"
+		return "EM330-DIN AV6 3", true
 	case 332:
-		c.meterType = "EM330-DIN AV5 3"
+		return "EM330-DIN AV5 3", true
 	case 335:
-		c.meterType = "ET330-DIN AV5 3"
+		return "ET330-DIN AV5 3", true
 	case 336:
-		c.meterType = "ET330-DIN AV6 3"
+		return "ET330-DIN AV6 3", true
 	case 340:
-		c.meterType = "EM340-DIN AV2 3 X S1 X"
+		return "EM340-DIN AV2 3 X S1 X", true
 	case 341:
-		c.meterType = "EM340-DIN AV2 3 X S1"
+		return "EM340-DIN AV2 3 X S1", true
 	case 345:
-		c.meterType = "ET340-DIN AV2 3 X S1 X"
+		return "ET340-DIN AV2 3 X S1 X", true
 	case 346:
-		c.meterType = "EM341-DIN AV2 3 X OS X"
+		return "EM341-DIN AV2 3 X OS X", true
 	case 1744:
-		c.meterType = "EM530-DIN AV5 3 X S1 X"
+		return "EM530-DIN AV5 3 X S1 X", true
 	case 1745:
-		c.meterType = "EM530-DIN AV5 3 X S1 PF A"
+		return "EM530-DIN AV5 3 X S1 PF A", true
 	case 1746:
-		c.meterType = "EM530-DIN AV5 3 X S1 PF B"
+		return "EM530-DIN AV5 3 X S1 PF B", true
 	case 1747:
-		c.meterType = "EM530-DIN AV5 3 X S1 PF C"
+		return "EM530-DIN AV5 3 X S1 PF C", true
 	case 1760:
-		c.meterType = "EM540-DIN AV2 3 X S1 X"
+		return "EM540-DIN AV2 3 X S1 X", true
 	case 1761:
-		c.meterType = "EM540-DIN AV2 3 X S1 PF A"
+		return "EM540-DIN AV2 3 X S1 PF A", true
 	case 1762:
-		c.meterType = "EM540-DIN AV2 3 X S1 PF B"
+		return "EM540-DIN AV2 3 X S1 PF B", true
 	case 1763:
-		c.meterType = "EM540-DIN AV2 3 X S1 PF C"
-	default:
-		c.meterType = fmt.Sprintf("Carlo Gavazzo %d", meterType)
+		return "EM540-DIN AV2 3 X S1 PF C", true
 	}
-	if meterType >= 71 && meterType <= 73 {
-		// type EM24 detected. Check if application is set to 'H'.
-		application, err := modbusClient.ReadRegister(em24ApplicationRegister, modbus.INPUT_REGISTER)
-		if err != nil {
-			return err
-		}
-		if application != em24ApplicationH {
-			// Application not set to 'H'. Check if we can update the value.
-			frontSelector, err := modbusClient.ReadRegister(em24FrontSelectorRegister, modbus.INPUT_REGISTER)
-			if err != nil {
-				return err
-			}
-			if frontSelector == 3 {
-				println("EM24 front selector is locked. Cannot update application to 'H'. Please use the joystick " +
-					"to manually update the EM24 to 'applicatin H', or set the front selector in an unlocked position " +
-					"and reinitialize the system.")
-			} else {
-				err := modbusClient.WriteRegister(em24ApplicationRegister, em24ApplicationH)
-				if err != nil {
-					return err
-				}
-			}
-		}
-	}
-	return nil
+	return fmt.Sprintf("Carlo Gavazzo %d", code), false
 }
 
 func (c *carloGavazziMeter) threePhase() bool {
@@ -185,24 +197,9 @@ func (c *carloGavazziMeter) threePhase() bool {
 	return false
 }
 
-func (c *carloGavazziMeter) updateValues(modbusClient *modbus.ModbusClient, modbusUnitId uint8, flow *energysource.EnergyFlowBase) {
-	modbusClient.SetUnitId(modbusUnitId)
+func (c *carloGavazziMeter) updateValues(ctx context.Context, unit *modbus.ModbusUnit, planner *modbus.ReadPlanner, flow *energysource.EnergyFlowBase) error {
 	if c.threePhase() {
-		values, _ := modbusClient.ReadRegisters(0, 5, modbus.INPUT_REGISTER)
-		_ = flow.SetVoltage(0, getValueFromRegisterResultArray(values, 0, 10, 0))
-		_ = flow.SetVoltage(1, getValueFromRegisterResultArray(values, 2, 10, 0))
-		_ = flow.SetVoltage(2, getValueFromRegisterResultArray(values, 4, 10, 0))
-		values, _ = modbusClient.ReadRegisters(12, 11, modbus.INPUT_REGISTER)
-		_ = flow.SetCurrent(0, getValueFromRegisterResultArray(values, 0, 1000, 0))
-		_ = flow.SetCurrent(1, getValueFromRegisterResultArray(values, 2, 1000, 0))
-		_ = flow.SetCurrent(2, getValueFromRegisterResultArray(values, 4, 1000, 0))
-		_ = flow.SetPower(0, getValueFromRegisterResultArray(values, 6, 10, 0))
-		_ = flow.SetPower(1, getValueFromRegisterResultArray(values, 8, 10, 0))
-		_ = flow.SetPower(2, getValueFromRegisterResultArray(values, 10, 10, 0))
-	} else {
-		values, _ := modbusClient.ReadRegisters(0, 5, modbus.INPUT_REGISTER)
-		_ = flow.SetVoltage(0, getValueFromRegisterResultArray(values, 0, 10, 0))
-		_ = flow.SetCurrent(0, getValueFromRegisterResultArray(values, 2, 1000, 0))
-		_ = flow.SetPower(0, getValueFromRegisterResultArray(values, 4, 10, 0))
+		return carloGavazziThreePhaseRegisterMap.update(ctx, unit, planner, flow)
 	}
+	return carloGavazziSinglePhaseRegisterMap.update(ctx, unit, planner, flow)
 }
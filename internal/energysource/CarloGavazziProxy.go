@@ -0,0 +1,260 @@
+package energysource
+
+import (
+	"context"
+	"enman/internal/modbus"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// carloGavazziRegisterBlock is a range of consecutive registers mirrored by the proxy.
+type carloGavazziRegisterBlock struct {
+	addr     uint16
+	quantity uint16
+}
+
+var (
+	// Instantaneous values and energy counters of three phase meters (EM24, EM340, ...).
+	carloGavazziThreePhaseBlocks = []carloGavazziRegisterBlock{
+		{addr: 0x0000, quantity: 0x0050},
+	}
+	// Instantaneous values and energy counters of single phase meters (ET112, EM111, ...).
+	carloGavazziSinglePhaseBlocks = []carloGavazziRegisterBlock{
+		{addr: 0x0000, quantity: 0x0022},
+	}
+	// Identification registers (versions, measuring system and serial number) that are
+	// read only once.
+	carloGavazziStaticBlocks = []carloGavazziRegisterBlock{
+		{addr: 0x0302, quantity: 3},
+		{addr: 0x1002, quantity: 1},
+		{addr: 0x5000, quantity: 7},
+	}
+)
+
+// CarloGavazziProxyConfig Represents the configuration of a CarloGavazziProxy.
+type CarloGavazziProxyConfig struct {
+	// SourceUrl is the modbus url the Carlo Gavazzi meters are connected to, e.g. rtu:///dev/ttyUSB0
+	SourceUrl string
+	// SourceSpeed is the serial speed of the source bus (rtu only). Defaults to 9600, a baud parameter in SourceUrl
+	// takes precedence.
+	SourceSpeed uint
+	// ServerUrl is the modbus url the proxy listens at, e.g. rtu:///dev/ttyUSB1 or tcp://[::]:502
+	ServerUrl string
+	// ServerSpeed is the serial speed of the server bus (rtu only). Defaults to 9600, a baud parameter in ServerUrl
+	// takes precedence.
+	ServerSpeed uint
+	// UnitIds maps the unit ids served by the proxy to the unit ids of the source meters.
+	UnitIds map[uint8]uint8
+	// RefreshRate is the interval at which the source meters are polled. Defaults to 1 second.
+	RefreshRate time.Duration
+}
+
+// CarloGavazziProxy Polls Carlo Gavazzi meters and serves their registers to modbus clients like a
+// Victron GX device, so they can still read the meters when the bus is in use by EnMan.
+type CarloGavazziProxy struct {
+	config  CarloGavazziProxyConfig
+	client  *modbus.ModbusClient
+	server  *modbus.ModbusServer
+	meters  map[uint8]*proxiedCarloGavazziMeter
+	stopped chan bool
+	// cancel aborts any source meter read in progress when stopping
+	cancel context.CancelFunc
+}
+
+type proxiedCarloGavazziMeter struct {
+	carloGavazziMeter
+	source     *modbus.ModbusUnit
+	lock       sync.RWMutex
+	registers  map[uint16]uint16
+	lastUpdate time.Time
+}
+
+// NewCarloGavazziProxy Constructs a new CarloGavazziProxy. The proxy does not poll nor serve any meter until
+// Start is called.
+func NewCarloGavazziProxy(config *CarloGavazziProxyConfig) (*CarloGavazziProxy, error) {
+	if len(config.UnitIds) == 0 {
+		return nil, fmt.Errorf("at least one unit id mapping must be provided")
+	}
+	proxy := &CarloGavazziProxy{
+		config: *config,
+		meters: make(map[uint8]*proxiedCarloGavazziMeter),
+	}
+	if proxy.config.SourceSpeed == 0 {
+		proxy.config.SourceSpeed = 9600
+	}
+	if proxy.config.ServerSpeed == 0 {
+		proxy.config.ServerSpeed = 9600
+	}
+	if proxy.config.RefreshRate <= 0 {
+		proxy.config.RefreshRate = time.Second
+	}
+	client, err := modbus.NewClient(&modbus.ClientConfiguration{
+		URL:     proxy.config.SourceUrl,
+		Speed:   proxy.config.SourceSpeed,
+		Timeout: time.Millisecond * 500,
+		// Meters served while the source is disconnected turn stale and are answered with an error.
+		AutoReconnect: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	proxy.client = client
+	var servedUnitIds []uint8
+	for servedUnitId, sourceUnitId := range proxy.config.UnitIds {
+		servedUnitIds = append(servedUnitIds, servedUnitId)
+		proxy.meters[servedUnitId] = &proxiedCarloGavazziMeter{
+			source:    client.Unit(sourceUnitId),
+			registers: make(map[uint16]uint16),
+		}
+	}
+	server, err := modbus.NewServer(&modbus.ServerConfiguration{
+		URL:     proxy.config.ServerUrl,
+		Speed:   proxy.config.ServerSpeed,
+		UnitIds: servedUnitIds,
+	}, proxy)
+	if err != nil {
+		return nil, err
+	}
+	proxy.server = server
+	return proxy, nil
+}
+
+// Start Identifies the source meters, reads their initial values and starts serving them.
+func (p *CarloGavazziProxy) Start() error {
+	err := p.client.Open()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, meter := range p.meters {
+		err = meter.initialize(ctx, meter.source)
+		if err != nil {
+			cancel()
+			_ = p.client.Close()
+			return err
+		}
+		for _, block := range carloGavazziStaticBlocks {
+			// Not all models provide all identification registers.
+			_ = meter.mirror(ctx, block)
+		}
+		meter.update(ctx)
+	}
+	err = p.server.Start()
+	if err != nil {
+		cancel()
+		_ = p.client.Close()
+		return err
+	}
+	p.stopped = make(chan bool)
+	p.cancel = cancel
+	go p.poll(ctx)
+	return nil
+}
+
+// Stop Stops serving and polling the meters.
+func (p *CarloGavazziProxy) Stop() error {
+	if p.stopped == nil {
+		return nil
+	}
+	p.cancel()
+	p.stopped <- true
+	p.stopped = nil
+	err := p.server.Stop()
+	if err != nil {
+		return err
+	}
+	return p.client.Close()
+}
+
+func (p *CarloGavazziProxy) poll(ctx context.Context) {
+	ticker := time.NewTicker(p.config.RefreshRate)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, meter := range p.meters {
+				meter.update(ctx)
+			}
+		case <-p.stopped:
+			return
+		}
+	}
+}
+
+// HandleCoils Carlo Gavazzi meters have no coils.
+func (p *CarloGavazziProxy) HandleCoils(*modbus.CoilsRequest) ([]bool, error) {
+	return nil, modbus.ErrIllegalFunction
+}
+
+// HandleDiscreteInputs Carlo Gavazzi meters have no discrete inputs.
+func (p *CarloGavazziProxy) HandleDiscreteInputs(*modbus.DiscreteInputsRequest) ([]bool, error) {
+	return nil, modbus.ErrIllegalFunction
+}
+
+// HandleHoldingRegisters Serves the mirrored registers. Carlo Gavazzi meters expose the same values through
+// the holding and input registers. Writes are not forwarded to the source meters.
+func (p *CarloGavazziProxy) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
+	if req.IsWrite {
+		return nil, modbus.ErrIllegalFunction
+	}
+	return p.readRegisters(req.UnitId, req.Addr, req.Quantity)
+}
+
+// HandleInputRegisters Serves the mirrored registers.
+func (p *CarloGavazziProxy) HandleInputRegisters(req *modbus.InputRegistersRequest) ([]uint16, error) {
+	return p.readRegisters(req.UnitId, req.Addr, req.Quantity)
+}
+
+func (p *CarloGavazziProxy) readRegisters(unitId uint8, addr uint16, quantity uint16) ([]uint16, error) {
+	meter, ok := p.meters[unitId]
+	if !ok {
+		// Like gateways do for devices they don't know about.
+		return nil, modbus.ErrGWPathUnavailable
+	}
+	meter.lock.RLock()
+	defer meter.lock.RUnlock()
+	// Don't serve values that are outdated, the client is better off with an error.
+	if time.Since(meter.lastUpdate) > p.config.RefreshRate*3 {
+		return nil, modbus.ErrServerDeviceFailure
+	}
+	values := make([]uint16, quantity)
+	for ix := uint16(0); ix < quantity; ix++ {
+		value, ok := meter.registers[addr+ix]
+		if !ok {
+			return nil, modbus.ErrIllegalDataAddress
+		}
+		values[ix] = value
+	}
+	return values, nil
+}
+
+// update Reads the instantaneous values and energy counters from the source meter.
+func (m *proxiedCarloGavazziMeter) update(ctx context.Context) {
+	blocks := carloGavazziSinglePhaseBlocks
+	if m.threePhase() {
+		blocks = carloGavazziThreePhaseBlocks
+	}
+	for _, block := range blocks {
+		if m.mirror(ctx, block) != nil {
+			return
+		}
+	}
+	m.lock.Lock()
+	m.lastUpdate = time.Now()
+	m.lock.Unlock()
+}
+
+// mirror Copies a block of registers from the source meter.
+func (m *proxiedCarloGavazziMeter) mirror(ctx context.Context, block carloGavazziRegisterBlock) error {
+	values, err := m.source.ReadRegisters(ctx, block.addr, block.quantity, modbus.INPUT_REGISTER)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for ix, value := range values {
+		m.registers[block.addr+uint16(ix)] = value
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package energysource
+
+import (
+	"enman/internal/modbus"
+	"enman/internal/simulator"
+	"testing"
+	"time"
+)
+
+func TestCarloGavazziProxy(t *testing.T) {
+	const sourceUrl = "tcp://localhost:5544"
+	const serverUrl = "tcp://localhost:5545"
+	sim := simulator.NewSimulator()
+	sim.AddDevice(2, simulator.NewEM24(simulator.ConstantProfile{1000, -500, 250}))
+	sim.AddDevice(3, simulator.NewET112(simulator.ConstantProfile{-800}))
+	err := sim.Start(&modbus.ServerConfiguration{URL: sourceUrl})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer func() {
+		_ = sim.Stop()
+	}()
+	proxy, err := NewCarloGavazziProxy(&CarloGavazziProxyConfig{
+		SourceUrl: sourceUrl,
+		ServerUrl: serverUrl,
+		// Served unit ids differ from those of the source meters.
+		UnitIds:     map[uint8]uint8{1: 2, 5: 3},
+		RefreshRate: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewCarloGavazziProxy() error = %v", err)
+	}
+	err = proxy.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer func() {
+		_ = proxy.Stop()
+	}()
+	client, err := modbus.NewClient(&modbus.ClientConfiguration{URL: serverUrl})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	err = client.Open()
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+
+	tests := []struct {
+		name     string
+		unitId   uint8
+		regType  modbus.RegType
+		addr     uint16
+		quantity uint16
+		want     []uint16
+		wantErr  error
+	}{
+		{
+			name:     "three phase voltages",
+			unitId:   1,
+			regType:  modbus.INPUT_REGISTER,
+			addr:     0x0000,
+			quantity: 6,
+			want:     []uint16{2300, 0, 2300, 0, 2300, 0},
+		},
+		{
+			name:     "three phase powers from holding registers",
+			unitId:   1,
+			regType:  modbus.HOLDING_REGISTER,
+			addr:     0x0012,
+			quantity: 6,
+			want:     []uint16{10000, 0, 0xec78, 0xffff, 2500, 0},
+		},
+		{
+			name:     "three phase model",
+			unitId:   1,
+			regType:  modbus.INPUT_REGISTER,
+			addr:     0x000B,
+			quantity: 1,
+			want:     []uint16{71},
+		},
+		{
+			name:     "single phase power",
+			unitId:   5,
+			regType:  modbus.INPUT_REGISTER,
+			addr:     0x0004,
+			quantity: 2,
+			want:     []uint16{0xe0c0, 0xffff},
+		},
+		{
+			name:     "single phase model",
+			unitId:   5,
+			regType:  modbus.INPUT_REGISTER,
+			addr:     0x000B,
+			quantity: 1,
+			want:     []uint16{120},
+		},
+		{
+			name:     "identification",
+			unitId:   5,
+			regType:  modbus.INPUT_REGISTER,
+			addr:     0x5000,
+			quantity: 2,
+			want:     []uint16{0x5349, 0x4d30},
+		},
+		{
+			name:     "registers not mirrored",
+			unitId:   5,
+			regType:  modbus.INPUT_REGISTER,
+			addr:     0x0030,
+			quantity: 1,
+			wantErr:  modbus.ErrIllegalDataAddress,
+		},
+		{
+			name:     "unit id not mapped",
+			unitId:   2,
+			regType:  modbus.INPUT_REGISTER,
+			addr:     0x0000,
+			quantity: 1,
+			wantErr:  modbus.ErrGWPathUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client.SetUnitId(tt.unitId)
+			got, err := client.ReadRegisters(tt.addr, tt.quantity, tt.regType)
+			if err != tt.wantErr {
+				t.Fatalf("ReadRegisters() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ReadRegisters() = %v, want %v", got, tt.want)
+			}
+			for ix := range got {
+				if got[ix] != tt.want[ix] {
+					t.Errorf("ReadRegisters() = %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+
+	// Writes are not forwarded to the meters.
+	client.SetUnitId(1)
+	err = client.WriteRegister(0x1101, 7)
+	if err != modbus.ErrIllegalFunction {
+		t.Errorf("WriteRegister() error = %v, want %v", err, modbus.ErrIllegalFunction)
+	}
+
+	// Values turn stale once the source meters can't be polled anymore.
+	_ = sim.Stop()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		_, err = client.ReadRegisters(0x0000, 2, modbus.INPUT_REGISTER)
+		if err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != modbus.ErrServerDeviceFailure {
+		t.Errorf("ReadRegisters() error = %v, want %v", err, modbus.ErrServerDeviceFailure)
+	}
+}
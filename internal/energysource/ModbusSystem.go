@@ -1,9 +1,11 @@
 package energysource
 
 import (
+	"context"
 	"enman/internal/modbus"
 	"enman/pkg/energysource"
 	"runtime"
+	"sync"
 	"time"
 )
 
@@ -12,6 +14,8 @@ type modbusGrid struct {
 	modbusUnitId uint8
 	meterCode    string
 	meterType    string
+	planner      *modbus.ReadPlanner
+	registerMap  *RegisterMap
 }
 
 type modbusPv struct {
@@ -19,33 +23,48 @@ type modbusPv struct {
 	modbusUnitId uint8
 	meterCode    string
 	meterType    string
+	planner      *modbus.ReadPlanner
+	registerMap  *RegisterMap
 }
 
 type ModbusConfig struct {
-	modbusUrl        string
-	modbusSpeed      uint16
-	timeout          time.Duration
+	// Modbus url of the system, its parameters (e.g. ?baud=19200&timeout=1s) take precedence over the settings below.
+	modbusUrl   string
+	modbusSpeed uint16
+	timeout     time.Duration
+	// Maximum number of modbus transactions in flight, > 1 enables pipelining on modbus TCP.
+	transactionWindow uint
+	// How the registers needed from each unit are batched into requests.
+	readPlanning     modbus.ReadPlannerConfiguration
 	gridConfig       *energysource.GridConfig
 	modbusGridConfig *ModbusGridConfig
 	pvConfigs        []*ModbusPvConfig
-	updateGridValues func(*modbus.ModbusClient, *modbusGrid)
-	updatePvValues   func(*modbus.ModbusClient, *modbusPv)
+	// Read the values of a unit, an error marks the values of the unit as stale until the next successful update.
+	updateGridValues func(context.Context, *modbus.ModbusUnit, *modbusGrid) error
+	updatePvValues   func(context.Context, *modbus.ModbusUnit, *modbusPv) error
 }
 
 type ModbusGridConfig struct {
 	modbusUnitId uint8
-	initialize   func(*modbus.ModbusClient, *modbusGrid) error
+	// Registers of the unit, also overrides the read planning of the system when set.
+	registerMap *RegisterMap
+	initialize  func(context.Context, *modbus.ModbusUnit, *modbusGrid) error
 }
 
 type ModbusPvConfig struct {
 	modbusUnitId uint8
-	initialize   func(*modbus.ModbusClient, *modbusPv) error
+	// Registers of the unit, also overrides the read planning of the system when set.
+	registerMap *RegisterMap
+	initialize  func(context.Context, *modbus.ModbusUnit, *modbusPv) error
 }
 
 func NewModbusSystem(config *ModbusConfig) (*energysource.System, error) {
 	modbusConfig := &modbus.ClientConfiguration{
-		URL:     config.modbusUrl,
-		Timeout: config.timeout,
+		URL:               config.modbusUrl,
+		Timeout:           config.timeout,
+		TransactionWindow: config.transactionWindow,
+		// Keep polling through dropped connections and re-plugged serial adapters.
+		AutoReconnect: true,
 	}
 	if config.modbusSpeed > 0 {
 		modbusConfig.Speed = uint(config.modbusSpeed)
@@ -61,7 +80,7 @@ func NewModbusSystem(config *ModbusConfig) (*energysource.System, error) {
 	}
 	var grid *energysource.Grid = nil
 	if config.modbusGridConfig != nil {
-		mbg, err := newModbusGrid(modbusClient, config.gridConfig, config.modbusGridConfig)
+		mbg, err := newModbusGrid(modbusClient, config.gridConfig, config.modbusGridConfig, &config.readPlanning)
 		if err != nil {
 			return nil, err
 		}
@@ -70,7 +89,7 @@ func NewModbusSystem(config *ModbusConfig) (*energysource.System, error) {
 	}
 	var pvs []*energysource.Pv = nil
 	for ix := 0; ix < len(config.pvConfigs); ix++ {
-		mbpv, err := newModbusPv(modbusClient, &energysource.PvConfig{}, config.pvConfigs[ix])
+		mbpv, err := newModbusPv(modbusClient, &energysource.PvConfig{}, config.pvConfigs[ix], &config.readPlanning)
 		if err != nil {
 			return nil, err
 		}
@@ -85,7 +104,10 @@ func NewModbusSystem(config *ModbusConfig) (*energysource.System, error) {
 func readSystemValues(client *modbus.ModbusClient, system *energysource.System, config *ModbusConfig) {
 	ticker := time.NewTicker(time.Millisecond * 250)
 	tickerChannel := make(chan bool)
+	// Cancelled when the system is garbage collected, aborting any read in progress.
+	ctx, cancel := context.WithCancel(context.Background())
 	runtime.SetFinalizer(system, func(a *energysource.System) {
+		cancel()
 		tickerChannel <- true
 		ticker.Stop()
 	})
@@ -96,33 +118,75 @@ func readSystemValues(client *modbus.ModbusClient, system *energysource.System,
 	for {
 		select {
 		case <-ticker.C:
+			// Don't bother polling while the client is reconnecting.
+			connected := client.State() == modbus.STATE_CONNECTED
+			// Units are polled concurrently, their requests share the connection when the client is pipelined.
+			var wg sync.WaitGroup
+			var gridErr error
+			pvErrs := make([]error, len(system.Pvs()))
 			if system.Grid() != nil {
 				modbusGrid, ok := (*system.Grid()).(*modbusGrid)
-				if ok {
-					config.updateGridValues(client, modbusGrid)
+				if ok && connected {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						gridErr = config.updateGridValues(ctx, client.Unit(modbusGrid.modbusUnitId), modbusGrid)
+					}()
 				}
 			}
 			if system.Pvs() != nil {
 				for ix := 0; ix < len(system.Pvs()); ix++ {
 					modbusPv, ok := (*system.Pvs()[ix]).(*modbusPv)
-					if ok {
-						config.updatePvValues(client, modbusPv)
+					if ok && connected {
+						wg.Add(1)
+						go func(ix int) {
+							defer wg.Done()
+							pvErrs[ix] = config.updatePvValues(ctx, client.Unit(modbusPv.modbusUnitId), modbusPv)
+						}(ix)
 					}
 				}
 			}
+			wg.Wait()
+			// Values can't be trusted if the connection is down, or dropped during the poll.
+			markSystemStale(system, client.State() != modbus.STATE_CONNECTED, gridErr, pvErrs)
 		case <-tickerChannel:
 			return
 		}
 	}
 }
 
-func newModbusGrid(modbusClient *modbus.ModbusClient, gridConfig *energysource.GridConfig, config *ModbusGridConfig) (*modbusGrid, error) {
+// markSystemStale Marks all values as stale when disconnected, otherwise only those of the units that failed to update.
+func markSystemStale(system *energysource.System, disconnected bool, gridErr error, pvErrs []error) {
+	if system.Grid() != nil {
+		modbusGrid, ok := (*system.Grid()).(*modbusGrid)
+		if ok {
+			modbusGrid.SetStale(disconnected || gridErr != nil)
+		}
+	}
+	for ix := 0; ix < len(system.Pvs()); ix++ {
+		modbusPv, ok := (*system.Pvs()[ix]).(*modbusPv)
+		if ok {
+			modbusPv.SetStale(disconnected || pvErrs[ix] != nil)
+		}
+	}
+}
+
+func newModbusGrid(modbusClient *modbus.ModbusClient, gridConfig *energysource.GridConfig, config *ModbusGridConfig, readPlanning *modbus.ReadPlannerConfiguration) (*modbusGrid, error) {
+	if config.registerMap != nil {
+		readPlanning = config.registerMap.plannerConfiguration()
+	}
+	planner, err := modbus.NewReadPlanner(readPlanning)
+	if err != nil {
+		return nil, err
+	}
 	mg := &modbusGrid{
 		GridBase:     energysource.NewGrid(gridConfig),
 		modbusUnitId: config.modbusUnitId,
+		planner:      planner,
+		registerMap:  config.registerMap,
 	}
 	if config.initialize != nil {
-		err := config.initialize(modbusClient, mg)
+		err = config.initialize(context.Background(), modbusClient.Unit(mg.modbusUnitId), mg)
 		if err != nil {
 			return nil, err
 		}
@@ -130,27 +194,25 @@ func newModbusGrid(modbusClient *modbus.ModbusClient, gridConfig *energysource.G
 	return mg, nil
 }
 
-func newModbusPv(modbusClient *modbus.ModbusClient, pvConfig *energysource.PvConfig, config *ModbusPvConfig) (*modbusPv, error) {
+func newModbusPv(modbusClient *modbus.ModbusClient, pvConfig *energysource.PvConfig, config *ModbusPvConfig, readPlanning *modbus.ReadPlannerConfiguration) (*modbusPv, error) {
+	if config.registerMap != nil {
+		readPlanning = config.registerMap.plannerConfiguration()
+	}
+	planner, err := modbus.NewReadPlanner(readPlanning)
+	if err != nil {
+		return nil, err
+	}
 	mpv := &modbusPv{
 		PvBase:       energysource.NewPv(pvConfig),
 		modbusUnitId: config.modbusUnitId,
+		planner:      planner,
+		registerMap:  config.registerMap,
 	}
 	if config.initialize != nil {
-		err := config.initialize(modbusClient, mpv)
+		err = config.initialize(context.Background(), modbusClient.Unit(mpv.modbusUnitId), mpv)
 		if err != nil {
 			return nil, err
 		}
 	}
 	return mpv, nil
 }
-
-func getValueFromRegisterResultArray(values []uint16, ix uint8, scaleFactor float32, defaultValue float32) float32 {
-	if values == nil {
-		return defaultValue
-	}
-	value := float32(int16(values[ix]))
-	if scaleFactor != 0 {
-		value /= scaleFactor
-	}
-	return value
-}
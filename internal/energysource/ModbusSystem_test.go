@@ -0,0 +1,160 @@
+package energysource
+
+import (
+	"enman/internal/modbus"
+	"enman/internal/simulator"
+	"enman/pkg/energysource"
+	"math"
+	"testing"
+	"time"
+)
+
+// flowValues Holds the expected power, voltage and current per line of an energy flow.
+type flowValues struct {
+	power   [3]float32
+	voltage [3]float32
+	current [3]float32
+}
+
+func TestModbusSystem_Simulated(t *testing.T) {
+	gridConfig := newTestGridConfig(t)
+	em24 := simulator.NewEM24(simulator.ConstantProfile{1000, -500, 250})
+	// The poller is expected to switch the EM24 to application 'H'.
+	em24.SetApplication(5)
+	tests := []struct {
+		name      string
+		url       string
+		devices   map[uint8]simulator.Device
+		newSystem func(url string) (*energysource.System, error)
+		grid      flowValues
+		pvs       []flowValues
+	}{
+		{
+			name: "victron",
+			url:  "tcp://localhost:5542",
+			devices: map[uint8]simulator.Device{
+				31: simulator.NewVictronGrid(simulator.ConstantProfile{1000, -500, 250}),
+				20: simulator.NewVictronPvInverter(simulator.ConstantProfile{1500, 0, -100}),
+			},
+			newSystem: func(url string) (*energysource.System, error) {
+				gridUnitId := uint8(31)
+				return NewVictronSystem(url, gridConfig, &gridUnitId, []uint8{20})
+			},
+			grid: flowValues{
+				power:   [3]float32{1000, -500, 250},
+				voltage: [3]float32{230, 230, 230},
+				current: [3]float32{4.3, -2.1, 1},
+			},
+			pvs: []flowValues{{
+				power:   [3]float32{1500, 0, 0},
+				voltage: [3]float32{230, 230, 230},
+				current: [3]float32{6.5, 0, 0},
+			}},
+		},
+		{
+			// GX devices are polled over UDP as well, without pipelining.
+			name: "victron over udp",
+			url:  "udp://localhost:5542",
+			devices: map[uint8]simulator.Device{
+				31: simulator.NewVictronGrid(simulator.ConstantProfile{1000, -500, 250}),
+				20: simulator.NewVictronPvInverter(simulator.ConstantProfile{1500, 0, -100}),
+			},
+			newSystem: func(url string) (*energysource.System, error) {
+				gridUnitId := uint8(31)
+				return NewVictronSystem(url, gridConfig, &gridUnitId, []uint8{20})
+			},
+			grid: flowValues{
+				power:   [3]float32{1000, -500, 250},
+				voltage: [3]float32{230, 230, 230},
+				current: [3]float32{4.3, -2.1, 1},
+			},
+			pvs: []flowValues{{
+				power:   [3]float32{1500, 0, 0},
+				voltage: [3]float32{230, 230, 230},
+				current: [3]float32{6.5, 0, 0},
+			}},
+		},
+		{
+			name: "carlo gavazzi",
+			url:  "tcp://localhost:5542",
+			devices: map[uint8]simulator.Device{
+				2: em24,
+				3: simulator.NewET112(simulator.ConstantProfile{-800}),
+			},
+			newSystem: func(url string) (*energysource.System, error) {
+				gridUnitId := uint8(2)
+				return NewCarloGavazziSystem(url, gridConfig, &gridUnitId, []uint8{3})
+			},
+			grid: flowValues{
+				power:   [3]float32{1000, -500, 250},
+				voltage: [3]float32{230, 230, 230},
+				current: [3]float32{4.347, 2.173, 1.086},
+			},
+			pvs: []flowValues{{
+				power:   [3]float32{-800, 0, 0},
+				voltage: [3]float32{230, 0, 0},
+				current: [3]float32{3.478, 0, 0},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim := simulator.NewSimulator()
+			for unitId, device := range tt.devices {
+				sim.AddDevice(unitId, device)
+			}
+			err := sim.Start(&modbus.ServerConfiguration{URL: tt.url})
+			if err != nil {
+				t.Fatalf("Start() error = %v", err)
+			}
+			defer func() {
+				_ = sim.Stop()
+			}()
+			system, err := tt.newSystem(tt.url)
+			if err != nil {
+				t.Fatalf("newSystem() error = %v", err)
+			}
+			// The system is polled every 250ms.
+			deadline := time.Now().Add(3 * time.Second)
+			for time.Now().Before(deadline) && (*system.Grid()).Power(0) == 0 {
+				time.Sleep(50 * time.Millisecond)
+			}
+			checkFlow(t, "grid", *system.Grid(), tt.grid)
+			if len(system.Pvs()) != len(tt.pvs) {
+				t.Fatalf("Pvs() = %d pvs, want %d", len(system.Pvs()), len(tt.pvs))
+			}
+			for ix, pv := range system.Pvs() {
+				checkFlow(t, "pv", *pv, tt.pvs[ix])
+			}
+		})
+	}
+	if em24.Application() != 7 {
+		t.Errorf("EM24 application = %d, want 7", em24.Application())
+	}
+}
+
+func newTestGridConfig(t *testing.T) *energysource.GridConfig {
+	gridConfig, err := energysource.NewGridConfig(230, 25, 3)
+	if err != nil {
+		t.Fatalf("NewGridConfig() error = %v", err)
+	}
+	return gridConfig
+}
+
+func checkFlow(t *testing.T, name string, flow energysource.EnergyFlow, want flowValues) {
+	for line := uint8(0); line < energysource.MaxPhases; line++ {
+		if got := flow.Power(line); !closeTo(got, want.power[line]) {
+			t.Errorf("%s Power(%d) = %v, want %v", name, line, got, want.power[line])
+		}
+		if got := flow.Voltage(line); !closeTo(got, want.voltage[line]) {
+			t.Errorf("%s Voltage(%d) = %v, want %v", name, line, got, want.voltage[line])
+		}
+		if got := flow.Current(line); !closeTo(got, want.current[line]) {
+			t.Errorf("%s Current(%d) = %v, want %v", name, line, got, want.current[line])
+		}
+	}
+}
+
+func closeTo(got float32, want float32) bool {
+	return math.Abs(float64(got-want)) < 0.01
+}
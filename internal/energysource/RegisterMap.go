@@ -0,0 +1,310 @@
+package energysource
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"enman/internal/modbus"
+	"enman/pkg/energysource"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed registermaps/*.yaml
+var embeddedRegisterMaps embed.FS
+
+// RegisterMap Describes the registers of a modbus device, and how they feed an EnergyFlow.
+type RegisterMap struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	// How the registers of the device may be batched into requests.
+	Planning RegisterMapPlanning `json:"planning,omitempty" yaml:"planning,omitempty"`
+	Points   []RegisterPoint     `json:"points" yaml:"points"`
+}
+
+// RegisterMapPlanning Holds the read planner settings of a device, see modbus.ReadPlannerConfiguration.
+type RegisterMapPlanning struct {
+	MaxGap                 uint16 `json:"maxGap,omitempty" yaml:"maxGap,omitempty"`
+	MaxLength              uint16 `json:"maxLength,omitempty" yaml:"maxLength,omitempty"`
+	LearnRejectedAddresses bool   `json:"learnRejectedAddresses,omitempty" yaml:"learnRejectedAddresses,omitempty"`
+}
+
+// RegisterPoint Describes a single value of a device.
+type RegisterPoint struct {
+	Name    string `json:"name" yaml:"name"`
+	Address uint16 `json:"address" yaml:"address"`
+	// "holding" or "input".
+	RegisterType string `json:"registerType" yaml:"registerType"`
+	// "int16", "uint16", "int32", "uint32", "float32", "string" or "bcd".
+	DataType string `json:"dataType" yaml:"dataType"`
+	// "highFirst" (default) or "lowFirst", only used by 32-bit data types.
+	WordOrder string `json:"wordOrder,omitempty" yaml:"wordOrder,omitempty"`
+	// Number of registers of string and bcd points, bcd points default to a single register.
+	Length uint16 `json:"length,omitempty" yaml:"length,omitempty"`
+	// Multiplier applied to numeric values, 0 leaves values as is.
+	Scale float64 `json:"scale,omitempty" yaml:"scale,omitempty"`
+	Unit  string  `json:"unit,omitempty" yaml:"unit,omitempty"`
+	// EnergyFlow field fed by the point: "power", "voltage", "current" or empty for informational points.
+	Field string `json:"field,omitempty" yaml:"field,omitempty"`
+	// Line (1 to 3) of the field fed by the point.
+	Line uint8 `json:"line,omitempty" yaml:"line,omitempty"`
+}
+
+// LoadRegisterMap Reads a register map from a JSON (.json) or YAML (.yaml, .yml) file.
+func LoadRegisterMap(path string) (*RegisterMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return ParseRegisterMap(data, "json")
+	case ".yaml", ".yml":
+		return ParseRegisterMap(data, "yaml")
+	}
+	return nil, fmt.Errorf("%s: unknown register map format, expected a .json, .yaml or .yml file", path)
+}
+
+// LoadEmbeddedRegisterMap Returns one of the register maps shipped with enman, e.g. "victron-grid".
+func LoadEmbeddedRegisterMap(name string) (*RegisterMap, error) {
+	data, err := embeddedRegisterMaps.ReadFile("registermaps/" + name + ".yaml")
+	if err != nil {
+		return nil, fmt.Errorf("unknown register map %q", name)
+	}
+	return ParseRegisterMap(data, "yaml")
+}
+
+// ParseRegisterMap Parses and validates a register map in the given format ("json" or "yaml").
+func ParseRegisterMap(data []byte, format string) (*RegisterMap, error) {
+	registerMap := &RegisterMap{}
+	switch format {
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(registerMap)
+		if err != nil {
+			return nil, err
+		}
+	case "yaml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err := decoder.Decode(registerMap)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown register map format %q", format)
+	}
+	err := registerMap.validate()
+	if err != nil {
+		return nil, err
+	}
+	return registerMap, nil
+}
+
+func mustLoadEmbeddedRegisterMap(name string) *RegisterMap {
+	registerMap, err := LoadEmbeddedRegisterMap(name)
+	if err != nil {
+		panic(err)
+	}
+	return registerMap
+}
+
+func (rm *RegisterMap) validate() error {
+	if rm.Name == "" {
+		return fmt.Errorf("register map without a name")
+	}
+	if len(rm.Points) == 0 {
+		return fmt.Errorf("register map %s: no points defined", rm.Name)
+	}
+	_, err := modbus.NewReadPlanner(rm.plannerConfiguration())
+	if err != nil {
+		return fmt.Errorf("register map %s: invalid planning: %w", rm.Name, err)
+	}
+	for ix := range rm.Points {
+		err = rm.Points[ix].validate()
+		if err != nil {
+			return fmt.Errorf("register map %s: %w", rm.Name, err)
+		}
+	}
+	return nil
+}
+
+func (rm *RegisterMap) plannerConfiguration() *modbus.ReadPlannerConfiguration {
+	return &modbus.ReadPlannerConfiguration{
+		MaxGap:                 rm.Planning.MaxGap,
+		MaxLength:              rm.Planning.MaxLength,
+		LearnRejectedAddresses: rm.Planning.LearnRejectedAddresses,
+	}
+}
+
+// update Reads all points of the map from the unit and feeds them into the flow.
+// The flow is left untouched when any of the points can't be read or decoded.
+func (rm *RegisterMap) update(ctx context.Context, unit *modbus.ModbusUnit, planner *modbus.ReadPlanner, flow *energysource.EnergyFlowBase) error {
+	for ix := range rm.Points {
+		point := &rm.Points[ix]
+		if point.Field != "" {
+			_ = planner.Need(point.regType(), point.Address, point.length())
+		}
+	}
+	registers, err := planner.Read(ctx, unit)
+	if err != nil {
+		return fmt.Errorf("register map %s: %w", rm.Name, err)
+	}
+	values := make([]float32, len(rm.Points))
+	for ix := range rm.Points {
+		point := &rm.Points[ix]
+		if point.Field == "" {
+			continue
+		}
+		registerValues, ok := registers.Registers(point.regType(), point.Address, point.length())
+		if !ok {
+			return fmt.Errorf("register map %s: point %s was not read", rm.Name, point.Name)
+		}
+		decoded, err := point.decode(registerValues)
+		if err != nil {
+			return fmt.Errorf("register map %s: %w", rm.Name, err)
+		}
+		values[ix] = float32(decoded.(float64))
+	}
+	for ix := range rm.Points {
+		point := &rm.Points[ix]
+		value := values[ix]
+		lineIx := point.Line - 1
+		switch point.Field {
+		case "power":
+			_ = flow.SetPower(lineIx, value)
+		case "voltage":
+			_ = flow.SetVoltage(lineIx, value)
+		case "current":
+			_ = flow.SetCurrent(lineIx, value)
+		}
+	}
+	return nil
+}
+
+func (rp *RegisterPoint) validate() error {
+	if rp.Name == "" {
+		return fmt.Errorf("point at address %d without a name", rp.Address)
+	}
+	switch rp.RegisterType {
+	case "holding", "input":
+	default:
+		return fmt.Errorf("point %s: unknown register type %q", rp.Name, rp.RegisterType)
+	}
+	switch rp.DataType {
+	case "int16", "uint16", "int32", "uint32", "float32":
+		if rp.Length != 0 {
+			return fmt.Errorf("point %s: length is only supported by string and bcd points", rp.Name)
+		}
+	case "string":
+		if rp.Length == 0 {
+			return fmt.Errorf("point %s: string points require a length", rp.Name)
+		}
+	case "bcd":
+		// Up to 16 digits, the most a float64 holds exactly.
+		if rp.Length > 4 {
+			return fmt.Errorf("point %s: bcd points may not be longer than 4 registers", rp.Name)
+		}
+	default:
+		return fmt.Errorf("point %s: unknown data type %q", rp.Name, rp.DataType)
+	}
+	switch rp.WordOrder {
+	case "", "highFirst", "lowFirst":
+	default:
+		return fmt.Errorf("point %s: unknown word order %q", rp.Name, rp.WordOrder)
+	}
+	if int(rp.Address)+int(rp.length()) > 0x10000 {
+		return fmt.Errorf("point %s: registers beyond address 65535", rp.Name)
+	}
+	switch rp.Field {
+	case "":
+		return nil
+	case "power", "voltage", "current":
+	default:
+		return fmt.Errorf("point %s: unknown field %q", rp.Name, rp.Field)
+	}
+	if rp.DataType == "string" {
+		return fmt.Errorf("point %s: string points can't feed the %s field", rp.Name, rp.Field)
+	}
+	if rp.Line < 1 || rp.Line > energysource.MaxPhases {
+		return fmt.Errorf("point %s: line must be between 1 and %d (inclusive), provided %d", rp.Name, energysource.MaxPhases, rp.Line)
+	}
+	return nil
+}
+
+func (rp *RegisterPoint) regType() modbus.RegType {
+	if rp.RegisterType == "input" {
+		return modbus.INPUT_REGISTER
+	}
+	return modbus.HOLDING_REGISTER
+}
+
+// length Returns the number of registers holding the point.
+func (rp *RegisterPoint) length() uint16 {
+	switch rp.DataType {
+	case "int32", "uint32", "float32":
+		return 2
+	case "string":
+		return rp.Length
+	case "bcd":
+		if rp.Length == 0 {
+			return 1
+		}
+		return rp.Length
+	}
+	return 1
+}
+
+// decode Converts the registers of the point into a string, or a float64 with the scale applied.
+func (rp *RegisterPoint) decode(values []uint16) (any, error) {
+	if len(values) != int(rp.length()) {
+		return nil, fmt.Errorf("point %s: expected %d registers, got %d", rp.Name, rp.length(), len(values))
+	}
+	var value float64
+	switch rp.DataType {
+	case "int16":
+		value = float64(int16(values[0]))
+	case "uint16":
+		value = float64(values[0])
+	case "int32":
+		value = float64(int32(rp.uint32(values)))
+	case "uint32":
+		value = float64(rp.uint32(values))
+	case "float32":
+		value = float64(math.Float32frombits(rp.uint32(values)))
+	case "string":
+		text := make([]byte, 0, 2*len(values))
+		for _, v := range values {
+			text = append(text, byte(v>>8), byte(v))
+		}
+		return strings.TrimRight(string(text), "\x00 "), nil
+	case "bcd":
+		for _, v := range values {
+			for shift := 12; shift >= 0; shift -= 4 {
+				digit := (v >> shift) & 0x0f
+				if digit > 9 {
+					return nil, fmt.Errorf("point %s: invalid bcd value 0x%04x", rp.Name, v)
+				}
+				value = value*10 + float64(digit)
+			}
+		}
+	}
+	if rp.Scale != 0 {
+		value *= rp.Scale
+	}
+	return value, nil
+}
+
+func (rp *RegisterPoint) uint32(values []uint16) uint32 {
+	if rp.WordOrder == "lowFirst" {
+		return uint32(values[1])<<16 | uint32(values[0])
+	}
+	return uint32(values[0])<<16 | uint32(values[1])
+}
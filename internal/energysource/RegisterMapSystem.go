@@ -0,0 +1,62 @@
+package energysource
+
+import (
+	"context"
+	"enman/internal/modbus"
+	"enman/pkg/energysource"
+	"fmt"
+)
+
+// RegisterMapUnit Binds a register map to the modbus unit serving it.
+type RegisterMapUnit struct {
+	UnitId      uint8
+	RegisterMap *RegisterMap
+}
+
+// NewRegisterMapSystem Creates a system of which the grid and pvs are polled as described by their register maps.
+func NewRegisterMapSystem(modbusUrl string, gridConfig *energysource.GridConfig, gridUnit *RegisterMapUnit, pvUnits []*RegisterMapUnit) (*energysource.System, error) {
+	config, err := newRegisterMapConfig(modbusUrl, gridConfig, gridUnit, pvUnits)
+	if err != nil {
+		return nil, err
+	}
+	system, err := NewModbusSystem(config)
+	return system, err
+}
+
+func newRegisterMapConfig(modbusUrl string, gridConfig *energysource.GridConfig, gridUnit *RegisterMapUnit, pvUnits []*RegisterMapUnit) (*ModbusConfig, error) {
+	config := &ModbusConfig{
+		modbusUrl:  modbusUrl,
+		gridConfig: gridConfig,
+		updateGridValues: func(ctx context.Context, unit *modbus.ModbusUnit, grid *modbusGrid) error {
+			if grid.modbusUnitId <= 0 {
+				return nil
+			}
+			return grid.registerMap.update(ctx, unit, grid.planner, grid.EnergyFlowBase)
+		},
+		updatePvValues: func(ctx context.Context, unit *modbus.ModbusUnit, pv *modbusPv) error {
+			if pv.modbusUnitId <= 0 {
+				return nil
+			}
+			return pv.registerMap.update(ctx, unit, pv.planner, pv.EnergyFlowBase)
+		},
+	}
+	if gridUnit != nil {
+		if gridUnit.RegisterMap == nil {
+			return nil, fmt.Errorf("grid unit %d has no register map", gridUnit.UnitId)
+		}
+		config.modbusGridConfig = &ModbusGridConfig{
+			modbusUnitId: gridUnit.UnitId,
+			registerMap:  gridUnit.RegisterMap,
+		}
+	}
+	for ix := 0; ix < len(pvUnits); ix++ {
+		if pvUnits[ix].RegisterMap == nil {
+			return nil, fmt.Errorf("pv unit %d has no register map", pvUnits[ix].UnitId)
+		}
+		config.pvConfigs = append(config.pvConfigs, &ModbusPvConfig{
+			modbusUnitId: pvUnits[ix].UnitId,
+			registerMap:  pvUnits[ix].RegisterMap,
+		})
+	}
+	return config, nil
+}
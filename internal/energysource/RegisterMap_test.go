@@ -0,0 +1,390 @@
+package energysource
+
+import (
+	"context"
+	"enman/internal/modbus"
+	"enman/pkg/energysource"
+	"strings"
+	"testing"
+)
+
+func TestParseRegisterMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		format  string
+		wantErr string
+	}{
+		{
+			name:   "yaml",
+			format: "yaml",
+			data: `name: meter
+planning: {maxGap: 4}
+points:
+  - {name: Power, address: 10, registerType: input, dataType: int32, field: power, line: 1}
+  - {name: Serial, address: 20, registerType: holding, dataType: string, length: 4}`,
+		},
+		{
+			name:   "json",
+			format: "json",
+			data:   `{"name": "meter", "points": [{"name": "Power", "address": 10, "registerType": "input", "dataType": "float32", "field": "power", "line": 2}]}`,
+		},
+		{
+			name:    "unknown format",
+			format:  "xml",
+			data:    `<name>meter</name>`,
+			wantErr: "unknown register map format",
+		},
+		{
+			name:    "unknown yaml field",
+			format:  "yaml",
+			data:    "name: meter\nbaud: 9600\n",
+			wantErr: "baud",
+		},
+		{
+			name:    "unknown json field",
+			format:  "json",
+			data:    `{"name": "meter", "baud": 9600}`,
+			wantErr: "baud",
+		},
+		{
+			name:    "no name",
+			format:  "yaml",
+			data:    "points:\n  - {name: Power, address: 10, registerType: input, dataType: int16}\n",
+			wantErr: "without a name",
+		},
+		{
+			name:    "no points",
+			format:  "yaml",
+			data:    "name: meter\n",
+			wantErr: "no points defined",
+		},
+		{
+			name:    "invalid planning",
+			format:  "yaml",
+			data:    "name: meter\nplanning: {maxLength: 200}\npoints:\n  - {name: Power, address: 10, registerType: input, dataType: int16}\n",
+			wantErr: "invalid planning",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registerMap, err := ParseRegisterMap([]byte(tt.data), tt.format)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseRegisterMap() error = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseRegisterMap() error = %v", err)
+			}
+			if registerMap.Name != "meter" || len(registerMap.Points) == 0 {
+				t.Errorf("ParseRegisterMap() = %+v", registerMap)
+			}
+		})
+	}
+}
+
+func TestRegisterPoint_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		point   RegisterPoint
+		wantErr string
+	}{
+		{
+			name:  "informational",
+			point: RegisterPoint{Name: "Model", Address: 11, RegisterType: "input", DataType: "uint16"},
+		},
+		{
+			name:  "field",
+			point: RegisterPoint{Name: "Power", RegisterType: "holding", DataType: "int32", WordOrder: "lowFirst", Field: "power", Line: 3},
+		},
+		{
+			name:  "bcd",
+			point: RegisterPoint{Name: "Serial", RegisterType: "holding", DataType: "bcd", Length: 4, Field: "voltage", Line: 1},
+		},
+		{
+			name:    "no name",
+			point:   RegisterPoint{Address: 11, RegisterType: "input", DataType: "uint16"},
+			wantErr: "without a name",
+		},
+		{
+			name:    "unknown register type",
+			point:   RegisterPoint{Name: "Power", RegisterType: "coil", DataType: "uint16"},
+			wantErr: "unknown register type",
+		},
+		{
+			name:    "unknown data type",
+			point:   RegisterPoint{Name: "Power", RegisterType: "input", DataType: "int64"},
+			wantErr: "unknown data type",
+		},
+		{
+			name:    "length of numeric points",
+			point:   RegisterPoint{Name: "Power", RegisterType: "input", DataType: "int32", Length: 2},
+			wantErr: "length is only supported",
+		},
+		{
+			name:    "string without length",
+			point:   RegisterPoint{Name: "Serial", RegisterType: "input", DataType: "string"},
+			wantErr: "require a length",
+		},
+		{
+			name:    "bcd too long",
+			point:   RegisterPoint{Name: "Serial", RegisterType: "input", DataType: "bcd", Length: 5},
+			wantErr: "longer than 4 registers",
+		},
+		{
+			name:    "unknown word order",
+			point:   RegisterPoint{Name: "Power", RegisterType: "input", DataType: "int32", WordOrder: "swapped"},
+			wantErr: "unknown word order",
+		},
+		{
+			name:    "beyond last address",
+			point:   RegisterPoint{Name: "Power", Address: 0xffff, RegisterType: "input", DataType: "int32"},
+			wantErr: "beyond address 65535",
+		},
+		{
+			name:    "unknown field",
+			point:   RegisterPoint{Name: "Power", RegisterType: "input", DataType: "int32", Field: "energy", Line: 1},
+			wantErr: "unknown field",
+		},
+		{
+			name:    "string field",
+			point:   RegisterPoint{Name: "Serial", RegisterType: "input", DataType: "string", Length: 2, Field: "power", Line: 1},
+			wantErr: "can't feed the power field",
+		},
+		{
+			name:    "no line",
+			point:   RegisterPoint{Name: "Power", RegisterType: "input", DataType: "int32", Field: "power"},
+			wantErr: "line must be between 1 and 3",
+		},
+		{
+			name:    "line too high",
+			point:   RegisterPoint{Name: "Power", RegisterType: "input", DataType: "int32", Field: "power", Line: 4},
+			wantErr: "line must be between 1 and 3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.point.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() error = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRegisterPoint_decode(t *testing.T) {
+	tests := []struct {
+		name    string
+		point   RegisterPoint
+		values  []uint16
+		want    any
+		wantErr bool
+	}{
+		{
+			name:   "int16",
+			point:  RegisterPoint{DataType: "int16"},
+			values: []uint16{0xfffe},
+			want:   float64(-2),
+		},
+		{
+			name:   "uint16",
+			point:  RegisterPoint{DataType: "uint16"},
+			values: []uint16{0xfffe},
+			want:   float64(65534),
+		},
+		{
+			name:   "int32 high word first",
+			point:  RegisterPoint{DataType: "int32"},
+			values: []uint16{0xffff, 0xfffe},
+			want:   float64(-2),
+		},
+		{
+			name:   "int32 low word first",
+			point:  RegisterPoint{DataType: "int32", WordOrder: "lowFirst"},
+			values: []uint16{0xfffe, 0xffff},
+			want:   float64(-2),
+		},
+		{
+			name:   "uint32 high word first",
+			point:  RegisterPoint{DataType: "uint32", WordOrder: "highFirst"},
+			values: []uint16{0x0001, 0x0002},
+			want:   float64(0x00010002),
+		},
+		{
+			name:   "uint32 low word first",
+			point:  RegisterPoint{DataType: "uint32", WordOrder: "lowFirst"},
+			values: []uint16{0x0001, 0x0002},
+			want:   float64(0x00020001),
+		},
+		{
+			name:   "float32",
+			point:  RegisterPoint{DataType: "float32"},
+			values: []uint16{0x4049, 0x0000},
+			want:   float64(3.140625),
+		},
+		{
+			name:   "scaled",
+			point:  RegisterPoint{DataType: "int32", WordOrder: "lowFirst", Scale: 0.1},
+			values: []uint16{2305, 0},
+			want:   float64(2305) * 0.1,
+		},
+		{
+			name:   "bcd",
+			point:  RegisterPoint{DataType: "bcd", Length: 2},
+			values: []uint16{0x0012, 0x3456},
+			want:   float64(123456),
+		},
+		{
+			name:   "scaled bcd",
+			point:  RegisterPoint{DataType: "bcd", Scale: 0.01},
+			values: []uint16{0x1234},
+			want:   float64(1234) * 0.01,
+		},
+		{
+			name:    "invalid bcd",
+			point:   RegisterPoint{DataType: "bcd"},
+			values:  []uint16{0x12a4},
+			wantErr: true,
+		},
+		{
+			name:   "string",
+			point:  RegisterPoint{DataType: "string", Length: 3, Scale: 10},
+			values: []uint16{0x4142, 0x4320, 0x0000},
+			want:   "ABC",
+		},
+		{
+			name:    "wrong number of registers",
+			point:   RegisterPoint{DataType: "int32"},
+			values:  []uint16{0x0001},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.point.decode(tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("decode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterMap_update(t *testing.T) {
+	const url = "tcp://localhost:5543"
+	registerMap, err := ParseRegisterMap([]byte(`name: meter
+points:
+  - {name: Voltage, address: 0, registerType: input, dataType: uint16, scale: 0.1, field: voltage, line: 1}
+  - {name: Power, address: 1, registerType: input, dataType: int32, wordOrder: lowFirst, field: power, line: 2}
+  - {name: Model, address: 3, registerType: input, dataType: uint16}
+  - {name: Current, address: 4, registerType: holding, dataType: bcd, scale: 0.01, field: current, line: 3}`), "yaml")
+	if err != nil {
+		t.Fatalf("ParseRegisterMap() error = %v", err)
+	}
+	bank, err := modbus.NewRegisterBank(&modbus.RegisterBankConfiguration{
+		Units: map[uint8]*modbus.RegisterBankUnitConfiguration{
+			1: {
+				InputRegisters:   []modbus.BankRange{{First: 0, Last: 3}},
+				HoldingRegisters: []modbus.BankRange{{First: 4, Last: 4}},
+			},
+			// Lacks the current register.
+			2: {
+				InputRegisters: []modbus.BankRange{{First: 0, Last: 3}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRegisterBank() error = %v", err)
+	}
+	for _, unitId := range []uint8{1, 2} {
+		_ = bank.SetRegisters(unitId, modbus.INPUT_REGISTER, 0, []uint16{2300, 0xfc18, 0xffff})
+	}
+	// Not a valid bcd value.
+	_ = bank.SetRegister(1, modbus.HOLDING_REGISTER, 4, 0x00fa)
+	server, err := modbus.NewServer(&modbus.ServerConfiguration{URL: url}, bank)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	err = server.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer func() {
+		_ = server.Stop()
+	}()
+	client, err := modbus.NewClient(&modbus.ClientConfiguration{URL: url})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	err = client.Open()
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+	tests := []struct {
+		name    string
+		unitId  uint8
+		current uint16
+		want    flowValues
+		wantErr bool
+	}{
+		{
+			name:    "invalid value",
+			unitId:  1,
+			current: 0x00fa,
+			wantErr: true,
+		},
+		{
+			name:    "all points read",
+			unitId:  1,
+			current: 0x1234,
+			// Fields without a point are left as is.
+			want: flowValues{
+				power:   [3]float32{1, -1000, 1},
+				voltage: [3]float32{230, 1, 1},
+				current: [3]float32{1, 1, 12.34},
+			},
+		},
+		{
+			name:    "missing register",
+			unitId:  2,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = bank.SetRegister(1, modbus.HOLDING_REGISTER, 4, tt.current)
+			planner, err := modbus.NewReadPlanner(registerMap.plannerConfiguration())
+			if err != nil {
+				t.Fatalf("NewReadPlanner() error = %v", err)
+			}
+			// Values that must survive failed updates.
+			flow := &energysource.EnergyFlowBase{}
+			for line := uint8(0); line < energysource.MaxPhases; line++ {
+				_ = flow.SetPower(line, 1)
+				_ = flow.SetVoltage(line, 1)
+				_ = flow.SetCurrent(line, 1)
+			}
+			err = registerMap.update(context.Background(), client.Unit(tt.unitId), planner, flow)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("update() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				tt.want = flowValues{power: [3]float32{1, 1, 1}, voltage: [3]float32{1, 1, 1}, current: [3]float32{1, 1, 1}}
+			}
+			checkFlow(t, "flow", flow, tt.want)
+		})
+	}
+}
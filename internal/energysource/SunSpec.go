@@ -0,0 +1,121 @@
+package energysource
+
+import (
+	"context"
+	"enman/internal/modbus"
+	"enman/internal/sunspec"
+	"enman/pkg/energysource"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// NewSunSpecSystem Creates a system of which the grid is a SunSpec meter (models 201-204) and the pvs are SunSpec
+// inverters (models 101-103 or 111-113). Grid and pv may share a unit id, e.g. for inverters with a built-in meter.
+func NewSunSpecSystem(modbusUrl string, gridConfig *energysource.GridConfig, gridUnitId *uint8, pvUnitIds []uint8) (*energysource.System, error) {
+	// Filled in while initializing the units, before polling starts.
+	devices := make(map[uint8]*sunspec.Device)
+	discover := func(ctx context.Context, unit *modbus.ModbusUnit) (*sunspec.Device, string, error) {
+		device, ok := devices[unit.UnitId()]
+		if !ok {
+			var err error
+			device, err = sunspec.Discover(ctx, unit)
+			if err != nil {
+				return nil, "", fmt.Errorf("unit %d: %w", unit.UnitId(), err)
+			}
+			devices[unit.UnitId()] = device
+		}
+		common, err := device.ReadCommon(ctx)
+		if err != nil {
+			return device, "", nil
+		}
+		return device, strings.TrimSpace(common.Manufacturer + " " + common.Model), nil
+	}
+	config := &ModbusConfig{
+		modbusUrl:  modbusUrl,
+		gridConfig: gridConfig,
+		updateGridValues: func(ctx context.Context, unit *modbus.ModbusUnit, grid *modbusGrid) error {
+			device := devices[grid.modbusUnitId]
+			if device == nil {
+				return nil
+			}
+			meter, err := device.ReadMeter(ctx)
+			if err != nil {
+				return err
+			}
+			for ix := uint8(0); ix < energysource.MaxPhases; ix++ {
+				_ = grid.SetVoltage(ix, sunSpecValue(meter.PhaseVoltage[ix]))
+				_ = grid.SetCurrent(ix, sunSpecValue(meter.PhaseCurrent[ix]))
+				_ = grid.SetPower(ix, sunSpecValue(meter.PhasePower[ix]))
+			}
+			return nil
+		},
+		updatePvValues: func(ctx context.Context, unit *modbus.ModbusUnit, pv *modbusPv) error {
+			device := devices[pv.modbusUnitId]
+			if device == nil {
+				return nil
+			}
+			inverter, err := device.ReadInverter(ctx)
+			if err != nil {
+				return err
+			}
+			for ix := uint8(0); ix < energysource.MaxPhases; ix++ {
+				_ = pv.SetVoltage(ix, sunSpecValue(inverter.PhaseVoltage[ix]))
+				_ = pv.SetCurrent(ix, sunSpecValue(inverter.PhaseCurrent[ix]))
+				// Inverter models only provide the total power, spread it over the phases of the inverter.
+				power := float32(0)
+				if ix < inverter.Phases {
+					power = sunSpecValue(inverter.Power) / float32(inverter.Phases)
+				}
+				_ = pv.SetPower(ix, power)
+			}
+			return nil
+		},
+	}
+	if gridUnitId != nil {
+		config.modbusGridConfig = &ModbusGridConfig{
+			modbusUnitId: *gridUnitId,
+			initialize: func(ctx context.Context, unit *modbus.ModbusUnit, grid *modbusGrid) error {
+				device, meterType, err := discover(ctx, unit)
+				if err != nil {
+					return err
+				}
+				meter, err := device.ReadMeter(ctx)
+				if err != nil {
+					return fmt.Errorf("unit %d: no sunspec meter found: %w", unit.UnitId(), err)
+				}
+				grid.meterCode = fmt.Sprintf("%d", meter.ModelId)
+				grid.meterType = meterType
+				return nil
+			},
+		}
+	}
+	for ix := 0; ix < len(pvUnitIds); ix++ {
+		config.pvConfigs = append(config.pvConfigs, &ModbusPvConfig{
+			modbusUnitId: pvUnitIds[ix],
+			initialize: func(ctx context.Context, unit *modbus.ModbusUnit, pv *modbusPv) error {
+				device, meterType, err := discover(ctx, unit)
+				if err != nil {
+					return err
+				}
+				inverter, err := device.ReadInverter(ctx)
+				if err != nil {
+					return fmt.Errorf("unit %d: no sunspec inverter found: %w", unit.UnitId(), err)
+				}
+				pv.meterCode = fmt.Sprintf("%d", inverter.ModelId)
+				pv.meterType = meterType
+				return nil
+			},
+		})
+	}
+	system, err := NewModbusSystem(config)
+	return system, err
+}
+
+// sunSpecValue Converts a decoded SunSpec value, reporting points the device does not implement as 0.
+func sunSpecValue(value float64) float32 {
+	if math.IsNaN(value) {
+		return 0
+	}
+	return float32(value)
+}
@@ -0,0 +1,266 @@
+package modbus
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// ':' + 2 hex chars for each of the unit id, function code, 252 data
+	// bytes and LRC + CR/LF
+	maxASCIIFrameLength int = 513
+	// the modbus over serial line spec allows up to 1s between characters
+	// of an ASCII frame
+	asciiInterCharTimeout time.Duration = 1 * time.Second
+)
+
+type asciiTransport struct {
+	logger           *logger
+	link             rtuLink
+	timeout          time.Duration
+	interCharTimeout time.Duration
+	// bus level diagnostic counters, maintained when serving requests
+	// (nil in client mode)
+	diagnostics *serialDiagnostics
+	// when set, ReadRequest() returns a timeout error once the link has
+	// been idle for longer than the timeout (e.g. to close idle TCP sessions)
+	closeOnIdle bool
+}
+
+// Returns a new ASCII transport.
+func newASCIITransport(link rtuLink, addr string, timeout time.Duration, customLogger *log.Logger) (at *asciiTransport) {
+	at = &asciiTransport{
+		logger:           newLogger(fmt.Sprintf("ascii-transport(%s)", addr), customLogger),
+		link:             link,
+		timeout:          timeout,
+		interCharTimeout: asciiInterCharTimeout,
+	}
+
+	return
+}
+
+// Closes the ascii link.
+func (at *asciiTransport) Close() (err error) {
+	err = at.link.Close()
+
+	return
+}
+
+// Runs a request across the ascii link and returns a response.
+// Cancelling ctx interrupts any i/o in flight.
+func (at *asciiTransport) ExecuteRequest(ctx context.Context, req *pdu) (res *pdu, err error) {
+	var stop func()
+
+	// set an i/o deadline on the link
+	err = at.link.SetDeadline(requestDeadline(ctx, at.timeout))
+	if err != nil {
+		return
+	}
+
+	// interrupt i/o as soon as the context is done
+	stop = watchContext(ctx, at.link)
+
+	_, err = at.link.Write(at.assembleASCIIFrame(req))
+	if err != nil {
+		stop()
+		return
+	}
+
+	res, err = at.readASCIIFrame(0)
+	stop()
+
+	// flush the remainder of responses interrupted by a cancellation,
+	// if any, so they don't get mistaken for the next response
+	if err != nil && ctx.Err() != nil {
+		discard(at.link)
+	}
+
+	if err == ErrBadLRC || err == ErrProtocolError || err == ErrShortFrame {
+		discard(at.link)
+	}
+
+	return
+}
+
+// Reads a request from the ascii link.
+// Idle periods and corrupted frames are skipped until either a valid request
+// is received or an unrecoverable i/o error occurs (e.g. the link was closed).
+func (at *asciiTransport) ReadRequest() (req *pdu, err error) {
+	for {
+		err = at.link.SetDeadline(time.Now().Add(at.timeout))
+		if err != nil {
+			return
+		}
+
+		req, err = at.readASCIIFrame(at.timeout)
+
+		// keep listening if the line was idle
+		if err == ErrRequestTimedOut || os.IsTimeout(err) {
+			if at.closeOnIdle {
+				return
+			}
+			continue
+		}
+
+		if err == ErrBadLRC && at.diagnostics != nil {
+			at.diagnostics.countBusCommError()
+		}
+
+		if err == ErrBadLRC || err == ErrProtocolError || err == ErrShortFrame {
+			// the next frame is delimited by its own start character:
+			// no need to wait for the line to go quiet
+			at.logger.Warningf("discarding invalid frame: %v", err)
+			continue
+		}
+
+		if err != nil {
+			return
+		}
+
+		if at.diagnostics != nil {
+			at.diagnostics.countBusMessage()
+		}
+
+		break
+	}
+
+	return
+}
+
+// Writes a response to the ascii link.
+func (at *asciiTransport) WriteResponse(res *pdu) (err error) {
+	_, err = at.link.Write(at.assembleASCIIFrame(res))
+
+	return
+}
+
+// Waits for, reads and decodes a frame from the ascii link.
+// Characters received outside of a frame are skipped, and a start of frame
+// character (':') always starts a new frame, dropping the current one.
+// A non-zero frameTimeout restarts the link deadline on each start of frame
+// character, so that frames starting late in an idle period are not cut short.
+func (at *asciiTransport) readASCIIFrame(frameTimeout time.Duration) (p *pdu, err error) {
+	var rxbuf []byte
+	var char []byte
+	var adu []byte
+	var started bool
+	var lastChar time.Time
+	var lrc lrc
+
+	char = make([]byte, 1)
+
+	for {
+		_, err = io.ReadFull(at.link, char)
+		if err != nil {
+			return
+		}
+
+		if char[0] == ':' {
+			if frameTimeout > 0 {
+				err = at.link.SetDeadline(time.Now().Add(frameTimeout))
+				if err != nil {
+					return
+				}
+			}
+			rxbuf = rxbuf[:0]
+			started = true
+			lastChar = time.Now()
+			continue
+		}
+
+		if !started {
+			continue
+		}
+
+		// a frame with idle periods longer than the inter-character timeout
+		// is incomplete
+		if time.Since(lastChar) > at.interCharTimeout {
+			err = ErrShortFrame
+			return
+		}
+		lastChar = time.Now()
+
+		// the frame ends with a line feed
+		if char[0] == '\n' {
+			break
+		}
+
+		rxbuf = append(rxbuf, char[0])
+
+		// never buffer more than the max allowed frame length (less the
+		// start and line feed characters)
+		if len(rxbuf) > maxASCIIFrameLength-2 {
+			if at.diagnostics != nil {
+				at.diagnostics.countBusCharacterOverrun()
+			}
+			err = ErrProtocolError
+			return
+		}
+	}
+
+	// expect a carriage return right before the line feed
+	if len(rxbuf) == 0 || rxbuf[len(rxbuf)-1] != '\r' {
+		err = ErrProtocolError
+		return
+	}
+
+	// decode the hex encoded unit id, function code, payload and LRC
+	adu, err = hex.DecodeString(string(rxbuf[:len(rxbuf)-1]))
+	if err != nil {
+		err = ErrProtocolError
+		return
+	}
+
+	if len(adu) < 3 {
+		err = ErrShortFrame
+		return
+	}
+
+	// check the LRC
+	lrc.init()
+	lrc.add(adu[:len(adu)-1])
+
+	if !lrc.isEqual(adu[len(adu)-1]) {
+		err = ErrBadLRC
+		at.logger.Warningf("bad LRC received")
+		return
+	}
+
+	p = &pdu{
+		unitId:       adu[0],
+		functionCode: adu[1],
+		payload:      adu[2 : len(adu)-1],
+	}
+
+	return
+}
+
+// Turns a PDU object into an ASCII frame (':' + hex encoded unit id,
+// function code, payload and LRC + CR/LF).
+func (at *asciiTransport) assembleASCIIFrame(p *pdu) (frame []byte) {
+	var adu []byte
+	var lrc lrc
+
+	adu = append(adu, p.unitId)
+	adu = append(adu, p.functionCode)
+	adu = append(adu, p.payload...)
+
+	// run the ADU through the LRC generator
+	lrc.init()
+	lrc.add(adu)
+
+	// append the LRC to the ADU
+	adu = append(adu, lrc.value())
+
+	frame = append(frame, ':')
+	frame = append(frame, strings.ToUpper(hex.EncodeToString(adu))...)
+	frame = append(frame, '\r', '\n')
+
+	return
+}
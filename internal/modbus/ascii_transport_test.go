@@ -0,0 +1,141 @@
+package modbus
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAssembleASCIIFrame(t *testing.T) {
+	var at *asciiTransport
+	var frame []byte
+
+	at = &asciiTransport{}
+
+	frame = at.assembleASCIIFrame(&pdu{
+		unitId:       0x01,
+		functionCode: 0x03,
+		payload:      []byte{0x00, 0x6b, 0x00, 0x03},
+	})
+
+	if string(frame) != ":0103006B00038E\r\n" {
+		t.Errorf("expected \":0103006B00038E\\r\\n\", got %q", frame)
+	}
+
+	frame = at.assembleASCIIFrame(&pdu{
+		unitId:       0xf7,
+		functionCode: 0x86,
+		payload:      []byte{0x02},
+	})
+
+	if string(frame) != ":F7860281\r\n" {
+		t.Errorf("expected \":F7860281\\r\\n\", got %q", frame)
+	}
+
+	return
+}
+
+func TestASCIITransportReadASCIIFrame(t *testing.T) {
+	var at *asciiTransport
+	var p1, p2 net.Conn
+	var txchan chan []byte
+	var err error
+	var res *pdu
+
+	txchan = make(chan []byte, 2)
+	p1, p2 = net.Pipe()
+	go feedTestPipe(t, txchan, p1)
+
+	at = newASCIITransport(p2, "", 10*time.Millisecond, nil)
+
+	// read a valid frame, preceded by line noise
+	txchan <- []byte("\x00\xff:0103006B00038E\r\n")
+	res, err = at.readASCIIFrame(0)
+	if err != nil {
+		t.Errorf("readASCIIFrame() should have succeeded, got %v", err)
+	} else {
+		if res.unitId != 0x01 {
+			t.Errorf("expected 0x01 as unit id, got 0x%02x", res.unitId)
+		}
+		if res.functionCode != 0x03 {
+			t.Errorf("expected 0x03 as function code, got 0x%02x", res.functionCode)
+		}
+		if len(res.payload) != 4 ||
+			res.payload[0] != 0x00 || res.payload[1] != 0x6b ||
+			res.payload[2] != 0x00 || res.payload[3] != 0x03 {
+			t.Errorf("expected {0x00, 0x6b, 0x00, 0x03} as payload, got %v", res.payload)
+		}
+	}
+
+	// lower case hex digits should be accepted
+	txchan <- []byte(":0103006b00038e\r\n")
+	_, err = at.readASCIIFrame(0)
+	if err != nil {
+		t.Errorf("readASCIIFrame() should have succeeded, got %v", err)
+	}
+
+	// a start character should drop the frame in progress
+	txchan <- []byte(":0103:F7860281\r\n")
+	res, err = at.readASCIIFrame(0)
+	if err != nil {
+		t.Errorf("readASCIIFrame() should have succeeded, got %v", err)
+	} else if res.unitId != 0xf7 || res.functionCode != 0x86 {
+		t.Errorf("expected unit id 0xf7 and function code 0x86, got 0x%02x and 0x%02x",
+			res.unitId, res.functionCode)
+	}
+
+	// read a frame with a bad lrc
+	txchan <- []byte(":0103006B00038F\r\n")
+	_, err = at.readASCIIFrame(0)
+	if err != ErrBadLRC {
+		t.Errorf("readASCIIFrame() should have returned ErrBadLRC, got %v", err)
+	}
+
+	// read a frame without carriage return
+	txchan <- []byte(":0103006B00038E\n")
+	_, err = at.readASCIIFrame(0)
+	if err != ErrProtocolError {
+		t.Errorf("readASCIIFrame() should have returned ErrProtocolError, got %v", err)
+	}
+
+	// read a frame with an odd number of hex digits
+	txchan <- []byte(":0103006B00038\r\n")
+	_, err = at.readASCIIFrame(0)
+	if err != ErrProtocolError {
+		t.Errorf("readASCIIFrame() should have returned ErrProtocolError, got %v", err)
+	}
+
+	// read a frame which is too short to hold a function code
+	txchan <- []byte(":0101\r\n")
+	_, err = at.readASCIIFrame(0)
+	if err != ErrShortFrame {
+		t.Errorf("readASCIIFrame() should have returned ErrShortFrame, got %v", err)
+	}
+
+	// a frame stalling for longer than the inter-character timeout
+	// should be dropped
+	at.interCharTimeout = 20 * time.Millisecond
+	txchan <- []byte(":0103")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		txchan <- []byte("006B00038E\r\n")
+	}()
+	_, err = at.readASCIIFrame(0)
+	if err != ErrShortFrame {
+		t.Errorf("readASCIIFrame() should have returned ErrShortFrame, got %v", err)
+	}
+
+	// the remainder of the frame should be skipped while waiting for
+	// the next start character
+	p2.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = at.readASCIIFrame(0)
+	if !os.IsTimeout(err) {
+		t.Errorf("readASCIIFrame() should have returned a timeout error, got %v", err)
+	}
+
+	p1.Close()
+	p2.Close()
+
+	return
+}
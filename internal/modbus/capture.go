@@ -0,0 +1,354 @@
+package modbus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Framing of the ADUs found in captures and traces.
+type frameMode string
+
+// Direction of a captured frame, as seen from the capturing end.
+type frameDirection string
+
+const (
+	// unit id, PDU and CRC (rtu, rtuovertcp and rtuoverudp)
+	rtuFrames frameMode = "rtu"
+	// MBAP header and PDU (tcp, tcp+tls and udp)
+	mbapFrames frameMode = "tcp"
+
+	frameSent     frameDirection = "sent"
+	frameReceived frameDirection = "received"
+
+	// pcap link types set aside for private use: DLT_USER0 carries rtu
+	// frames, DLT_USER1 MBAP frames
+	pcapLinkTypeRTU  uint32 = 147
+	pcapLinkTypeMBAP uint32 = 148
+
+	pcapMagic      uint32 = 0xa1b2c3d4
+	pcapMagicNanos uint32 = 0xa1b23c4d
+	pcapSnapLength uint32 = 65535
+)
+
+// Captured frame object, one per line of JSON traces.
+type traceRecord struct {
+	Time      time.Time      `json:"time"`
+	Mode      frameMode      `json:"mode"`
+	Direction frameDirection `json:"dir"`
+	Frame     string         `json:"frame"`
+}
+
+// Frame trace object, as loaded from a capture file.
+type frameTrace struct {
+	mode   frameMode
+	frames []tracedFrame
+}
+
+// Frame of a trace.
+type tracedFrame struct {
+	at        time.Time
+	direction frameDirection
+	adu       []byte
+}
+
+// Frame capture object, recording the ADUs sent and received by transports
+// along with their timestamp.
+// Captures are written either in pcap format (if the file name ends with
+// .pcap) or as JSON lines.
+// In pcap files, each packet starts with a direction byte (0x00 for sent
+// frames, 0x01 for received frames) followed by the ADU: in Wireshark, map
+// DLT_USER0 (rtu) to mbrtu and DLT_USER1 to mbtcp with a header size of 1
+// (Preferences > Protocols > DLT_USER).
+type frameCapture struct {
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	mode   frameMode
+	pcap   bool
+}
+
+// Creates (or truncates) the capture file at path.
+func openFrameCapture(path string, mode frameMode) (fc *frameCapture, err error) {
+	var file *os.File
+	var header []byte
+
+	file, err = os.Create(path)
+	if err != nil {
+		return
+	}
+
+	fc = &frameCapture{
+		file:   file,
+		writer: bufio.NewWriter(file),
+		mode:   mode,
+		pcap:   strings.HasSuffix(strings.ToLower(path), ".pcap"),
+	}
+
+	if fc.pcap {
+		// global header: magic, version 2.4, GMT, accuracy, snap length
+		// and link type
+		header = binary.LittleEndian.AppendUint32(header, pcapMagic)
+		header = binary.LittleEndian.AppendUint16(header, 2)
+		header = binary.LittleEndian.AppendUint16(header, 4)
+		header = binary.LittleEndian.AppendUint32(header, 0)
+		header = binary.LittleEndian.AppendUint32(header, 0)
+		header = binary.LittleEndian.AppendUint32(header, pcapSnapLength)
+		if mode == rtuFrames {
+			header = binary.LittleEndian.AppendUint32(header, pcapLinkTypeRTU)
+		} else {
+			header = binary.LittleEndian.AppendUint32(header, pcapLinkTypeMBAP)
+		}
+
+		_, err = fc.writer.Write(header)
+		if err == nil {
+			err = fc.writer.Flush()
+		}
+		if err != nil {
+			file.Close()
+			fc = nil
+		}
+	}
+
+	return
+}
+
+// Records a frame. Safe for concurrent use, a no-op on nil captures so that
+// transports don't have to check whether capture is enabled.
+// Write errors are ignored: a broken capture must not break the transport.
+func (fc *frameCapture) record(direction frameDirection, adu []byte) {
+	var packet []byte
+	var line []byte
+	var now time.Time
+
+	if fc == nil {
+		return
+	}
+
+	now = time.Now()
+
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	if fc.pcap {
+		// record header: timestamp, captured and original lengths
+		packet = binary.LittleEndian.AppendUint32(packet, uint32(now.Unix()))
+		packet = binary.LittleEndian.AppendUint32(packet, uint32(now.Nanosecond()/1000))
+		packet = binary.LittleEndian.AppendUint32(packet, uint32(1+len(adu)))
+		packet = binary.LittleEndian.AppendUint32(packet, uint32(1+len(adu)))
+		if direction == frameSent {
+			packet = append(packet, 0x00)
+		} else {
+			packet = append(packet, 0x01)
+		}
+		packet = append(packet, adu...)
+		fc.writer.Write(packet)
+	} else {
+		line, _ = json.Marshal(&traceRecord{
+			Time:      now,
+			Mode:      fc.mode,
+			Direction: direction,
+			Frame:     hex.EncodeToString(adu),
+		})
+		fc.writer.Write(append(line, '\n'))
+	}
+
+	// keep the capture usable should the process die
+	fc.writer.Flush()
+
+	return
+}
+
+// Closes the capture file.
+func (fc *frameCapture) Close() (err error) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	err = fc.writer.Flush()
+	if err != nil {
+		fc.file.Close()
+		return
+	}
+
+	err = fc.file.Close()
+
+	return
+}
+
+// Loads a trace from a capture file, either in pcap format or as JSON lines.
+func loadTrace(path string) (ft *frameTrace, err error) {
+	var data []byte
+
+	data, err = os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	if len(data) >= 4 && isPcapMagic(data[0:4]) {
+		ft, err = parsePcapTrace(data)
+	} else {
+		ft, err = parseJSONTrace(data)
+	}
+
+	if err == nil && len(ft.frames) == 0 {
+		err = fmt.Errorf("empty trace")
+	}
+
+	if err != nil {
+		err = fmt.Errorf("failed to load trace '%s': %v", path, err)
+	}
+
+	return
+}
+
+// Parses a pcap capture, in either byte order and with either microsecond
+// or nanosecond timestamps.
+func parsePcapTrace(data []byte) (ft *frameTrace, err error) {
+	var order binary.ByteOrder
+	var nanos bool
+	var length int
+	var sub int64
+
+	order = binary.LittleEndian
+	if !isPcapMagicInOrder(data[0:4], order) {
+		order = binary.BigEndian
+	}
+	nanos = order.Uint32(data[0:4]) == pcapMagicNanos
+
+	if len(data) < 24 {
+		err = fmt.Errorf("truncated pcap header")
+		return
+	}
+
+	ft = &frameTrace{}
+	switch order.Uint32(data[20:24]) {
+	case pcapLinkTypeRTU:
+		ft.mode = rtuFrames
+	case pcapLinkTypeMBAP:
+		ft.mode = mbapFrames
+	default:
+		err = fmt.Errorf("unsupported pcap link type %v, expected %v (rtu) or %v (tcp)",
+			order.Uint32(data[20:24]), pcapLinkTypeRTU, pcapLinkTypeMBAP)
+		return
+	}
+
+	data = data[24:]
+	for len(data) > 0 {
+		if len(data) < 16 {
+			err = fmt.Errorf("truncated pcap record header")
+			return
+		}
+
+		length = int(order.Uint32(data[8:12]))
+		if length < 2 || len(data) < 16+length {
+			err = fmt.Errorf("truncated or invalid pcap record")
+			return
+		}
+
+		sub = int64(order.Uint32(data[4:8]))
+		if !nanos {
+			sub *= 1000
+		}
+
+		ft.frames = append(ft.frames, tracedFrame{
+			at:        time.Unix(int64(order.Uint32(data[0:4])), sub),
+			direction: frameSent,
+			adu:       data[17 : 16+length],
+		})
+		if data[16] != 0x00 {
+			ft.frames[len(ft.frames)-1].direction = frameReceived
+		}
+
+		data = data[16+length:]
+	}
+
+	return
+}
+
+// Parses a JSON lines trace.
+func parseJSONTrace(data []byte) (ft *frameTrace, err error) {
+	var decoder *json.Decoder
+	var record traceRecord
+	var adu []byte
+
+	ft = &frameTrace{}
+	decoder = json.NewDecoder(bytes.NewReader(data))
+
+	for {
+		record = traceRecord{}
+		err = decoder.Decode(&record)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+
+		if record.Mode != rtuFrames && record.Mode != mbapFrames {
+			err = fmt.Errorf("invalid mode '%s', expected rtu or tcp", record.Mode)
+			return
+		}
+
+		if ft.mode == "" {
+			ft.mode = record.Mode
+		} else if record.Mode != ft.mode {
+			err = fmt.Errorf("traces may not mix rtu and tcp frames")
+			return
+		}
+
+		if record.Direction != frameSent && record.Direction != frameReceived {
+			err = fmt.Errorf("invalid direction '%s', expected sent or received", record.Direction)
+			return
+		}
+
+		adu, err = hex.DecodeString(record.Frame)
+		if err != nil || len(adu) == 0 {
+			err = fmt.Errorf("invalid frame '%s'", record.Frame)
+			return
+		}
+
+		ft.frames = append(ft.frames, tracedFrame{
+			at:        record.Time,
+			direction: record.Direction,
+			adu:       adu,
+		})
+	}
+
+	return
+}
+
+// Returns the framing of the ADUs handled by a transport type, and false if
+// the transport type doesn't support capture.
+func captureMode(tt transportType) (mode frameMode, ok bool) {
+	switch tt {
+	case modbusRTU, modbusRTUOverTCP, modbusRTUOverUDP:
+		mode, ok = rtuFrames, true
+	case modbusTCP, modbusTCPOverTLS, modbusTCPOverUDP:
+		mode, ok = mbapFrames, true
+	}
+
+	return
+}
+
+// Returns true if magic is a pcap magic number, in either byte order.
+func isPcapMagic(magic []byte) (yes bool) {
+	yes = isPcapMagicInOrder(magic, binary.LittleEndian) ||
+		isPcapMagicInOrder(magic, binary.BigEndian)
+
+	return
+}
+
+func isPcapMagicInOrder(magic []byte, order binary.ByteOrder) (yes bool) {
+	yes = order.Uint32(magic) == pcapMagic || order.Uint32(magic) == pcapMagicNanos
+
+	return
+}
@@ -0,0 +1,271 @@
+package modbus
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Returns a register bank holding 10 holding registers on unit 1.
+func newCaptureTestBank(t *testing.T, values []uint16) (rb *RegisterBank) {
+	var err error
+
+	rb, err = NewRegisterBank(&RegisterBankConfiguration{
+		Units: map[uint8]*RegisterBankUnitConfiguration{
+			1: {HoldingRegisters: []BankRange{{First: 0, Last: 9}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRegisterBank() should have succeeded, got: %v", err)
+	}
+
+	err = rb.SetRegisters(1, HOLDING_REGISTER, 0, values)
+	if err != nil {
+		t.Fatalf("SetRegisters() should have succeeded, got: %v", err)
+	}
+
+	return
+}
+
+// Runs the same exchange with a device for capture and replay purposes.
+func runCaptureTestExchange(t *testing.T, client *ModbusClient) {
+	var err error
+	var regs []uint16
+
+	regs, err = client.ReadRegisters(0, 3, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("ReadRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 3 || regs[0] != 0x1111 || regs[1] != 0x2222 || regs[2] != 0x3333 {
+		t.Errorf("expected {0x1111, 0x2222, 0x3333}, got: %v", regs)
+	}
+
+	err = client.WriteRegister(5, 0xbeef)
+	if err != nil {
+		t.Errorf("WriteRegister() should have succeeded, got: %v", err)
+	}
+
+	_, err = client.ReadRegisters(100, 1, HOLDING_REGISTER)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("ReadRegisters() should have failed with ErrIllegalDataAddress, got: %v", err)
+	}
+
+	return
+}
+
+func TestCaptureAndReplay(t *testing.T) {
+	var err error
+	var dir string
+	var server *ModbusServer
+	var client *ModbusClient
+	var trace *frameTrace
+	var expected frameDirection
+	var values = []uint16{0x1111, 0x2222, 0x3333}
+
+	dir = t.TempDir()
+
+	for _, mode := range []string{"tcp", "rtuovertcp"} {
+		// capture an exchange on both ends, in both formats
+		server, err = NewServer(&ServerConfiguration{
+			URL:     mode + "://localhost:5502",
+			Capture: filepath.Join(dir, mode+"-server.jsonl"),
+		}, newCaptureTestBank(t, values))
+		if err != nil {
+			t.Fatalf("NewServer() should have succeeded, got: %v", err)
+		}
+
+		err = server.Start()
+		if err != nil {
+			t.Fatalf("Start() should have succeeded, got: %v", err)
+		}
+
+		client, err = NewClient(&ClientConfiguration{
+			URL: mode + "://localhost:5502?capture=" + filepath.Join(dir, mode+"-client.pcap"),
+		})
+		if err != nil {
+			t.Fatalf("NewClient() should have succeeded, got: %v", err)
+		}
+
+		err = client.Open()
+		if err != nil {
+			t.Fatalf("Open() should have succeeded, got: %v", err)
+		}
+
+		runCaptureTestExchange(t, client)
+
+		err = client.Close()
+		if err != nil {
+			t.Errorf("Close() should have succeeded, got: %v", err)
+		}
+
+		// let the server capture the last response
+		time.Sleep(50 * time.Millisecond)
+		err = server.Stop()
+		if err != nil {
+			t.Errorf("Stop() should have succeeded, got: %v", err)
+		}
+
+		// both captures should hold 3 requests and their response
+		for _, file := range []string{mode + "-client.pcap", mode + "-server.jsonl"} {
+			trace, err = loadTrace(filepath.Join(dir, file))
+			if err != nil {
+				t.Fatalf("loadTrace() should have succeeded, got: %v", err)
+			}
+			if (mode == "tcp") != (trace.mode == mbapFrames) {
+				t.Errorf("%s: unexpected trace mode %v", file, trace.mode)
+			}
+			if len(trace.frames) != 6 {
+				t.Fatalf("%s: expected 6 frames, got: %v", file, len(trace.frames))
+			}
+			// clients send requests, servers receive them
+			for i, frame := range trace.frames {
+				expected = frameSent
+				if (i%2 == 0) == (file == mode+"-server.jsonl") {
+					expected = frameReceived
+				}
+				if frame.direction != expected {
+					t.Errorf("%s: expected direction %v for frame #%v, got: %v",
+						file, expected, i, frame.direction)
+				}
+			}
+		}
+
+		// replay the client side: the same exchange should yield the
+		// same results
+		client, err = NewClient(&ClientConfiguration{
+			URL: "replay://" + filepath.Join(dir, mode+"-client.pcap"),
+		})
+		if err != nil {
+			t.Fatalf("NewClient() should have succeeded, got: %v", err)
+		}
+
+		err = client.Open()
+		if err != nil {
+			t.Fatalf("Open() should have succeeded, got: %v", err)
+		}
+
+		runCaptureTestExchange(t, client)
+
+		err = client.Close()
+		if err != nil {
+			t.Errorf("Close() should have succeeded, got: %v", err)
+		}
+
+		// a different exchange should be caught
+		err = client.Open()
+		if err != nil {
+			t.Fatalf("Open() should have succeeded, got: %v", err)
+		}
+
+		_, err = client.ReadRegisters(0, 4, HOLDING_REGISTER)
+		if err != ErrReplayMismatch {
+			t.Errorf("ReadRegisters() should have failed with ErrReplayMismatch, got: %v", err)
+		}
+
+		err = client.Close()
+		if err != ErrReplayMismatch {
+			t.Errorf("Close() should have failed with ErrReplayMismatch, got: %v", err)
+		}
+
+		// replay the server side, against the same registers then against
+		// different ones
+		server, err = NewServer(&ServerConfiguration{
+			URL: "replay://" + filepath.Join(dir, mode+"-server.jsonl"),
+		}, newCaptureTestBank(t, values))
+		if err != nil {
+			t.Fatalf("NewServer() should have succeeded, got: %v", err)
+		}
+
+		err = server.Start()
+		if err != nil {
+			t.Fatalf("Start() should have succeeded, got: %v", err)
+		}
+
+		err = server.Stop()
+		if err != nil {
+			t.Errorf("Stop() should have succeeded, got: %v", err)
+		}
+
+		server, err = NewServer(&ServerConfiguration{
+			URL: "replay://" + filepath.Join(dir, mode+"-server.jsonl"),
+		}, newCaptureTestBank(t, []uint16{0x1111, 0x2222, 0x4444}))
+		if err != nil {
+			t.Fatalf("NewServer() should have succeeded, got: %v", err)
+		}
+
+		err = server.Start()
+		if err != nil {
+			t.Fatalf("Start() should have succeeded, got: %v", err)
+		}
+
+		err = server.Stop()
+		if err != ErrReplayMismatch {
+			t.Errorf("Stop() should have failed with ErrReplayMismatch, got: %v", err)
+		}
+	}
+
+	return
+}
+
+func TestLoadTrace(t *testing.T) {
+	var err error
+	var dir string
+	var trace *frameTrace
+
+	dir = t.TempDir()
+
+	// traces may not mix rtu and tcp frames
+	err = os.WriteFile(filepath.Join(dir, "mixed.jsonl"), []byte(
+		`{"time":"2024-01-01T00:00:00Z","mode":"rtu","dir":"sent","frame":"010300000001840a"}`+"\n"+
+			`{"time":"2024-01-01T00:00:01Z","mode":"tcp","dir":"received","frame":"00010000000501030200ff"}`+"\n"),
+		0644)
+	if err != nil {
+		t.Fatalf("failed to write trace: %v", err)
+	}
+
+	_, err = loadTrace(filepath.Join(dir, "mixed.jsonl"))
+	if err == nil {
+		t.Errorf("loadTrace() should have failed")
+	}
+
+	// nor be empty
+	err = os.WriteFile(filepath.Join(dir, "empty.jsonl"), nil, 0644)
+	if err != nil {
+		t.Fatalf("failed to write trace: %v", err)
+	}
+
+	_, err = loadTrace(filepath.Join(dir, "empty.jsonl"))
+	if err == nil {
+		t.Errorf("loadTrace() should have failed")
+	}
+
+	// hand-written traces are fine
+	err = os.WriteFile(filepath.Join(dir, "rtu.jsonl"), []byte(
+		`{"time":"2024-01-01T00:00:00Z","mode":"rtu","dir":"sent","frame":"010300000001840a"}`+"\n"+
+			`{"time":"2024-01-01T00:00:01Z","mode":"rtu","dir":"received","frame":"01030200ffb804"}`+"\n"),
+		0644)
+	if err != nil {
+		t.Fatalf("failed to write trace: %v", err)
+	}
+
+	trace, err = loadTrace(filepath.Join(dir, "rtu.jsonl"))
+	if err != nil {
+		t.Fatalf("loadTrace() should have succeeded, got: %v", err)
+	}
+	if trace.mode != rtuFrames || len(trace.frames) != 2 ||
+		trace.frames[1].direction != frameReceived || len(trace.frames[1].adu) != 7 {
+		t.Errorf("unexpected trace: %+v", trace)
+	}
+
+	// captures of ascii transports are not supported
+	_, err = NewClient(&ClientConfiguration{
+		URL:     "ascii:///dev/ttyUSB0",
+		Capture: filepath.Join(dir, "ascii.jsonl"),
+	})
+	if err != ErrConfigurationError {
+		t.Errorf("NewClient() should have failed with ErrConfigurationError, got: %v", err)
+	}
+
+	return
+}
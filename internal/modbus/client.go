@@ -1,11 +1,14 @@
 package modbus
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
@@ -15,6 +18,9 @@ import (
 type RegType uint
 type Endianness uint
 type WordOrder uint
+type DeviceIdCategory uint8
+type DiagnosticSubFunction uint16
+type ConnectionState uint
 
 const (
 	PARITY_NONE uint = 0
@@ -31,23 +37,110 @@ const (
 	// word order of 32-bit registers
 	HIGH_WORD_FIRST WordOrder = 1
 	LOW_WORD_FIRST  WordOrder = 2
+
+	// device identification categories (read device id codes), each
+	// category including the objects of the previous ones
+	DEVICE_ID_BASIC    DeviceIdCategory = 0x01
+	DEVICE_ID_REGULAR  DeviceIdCategory = 0x02
+	DEVICE_ID_EXTENDED DeviceIdCategory = 0x03
+
+	// device identification object ids
+	DEVICE_ID_VENDOR_NAME           uint8 = 0x00
+	DEVICE_ID_PRODUCT_CODE          uint8 = 0x01
+	DEVICE_ID_MAJOR_MINOR_REVISION  uint8 = 0x02
+	DEVICE_ID_VENDOR_URL            uint8 = 0x03
+	DEVICE_ID_PRODUCT_NAME          uint8 = 0x04
+	DEVICE_ID_MODEL_NAME            uint8 = 0x05
+	DEVICE_ID_USER_APPLICATION_NAME uint8 = 0x06
+
+	// diagnostics sub-function codes (serial line only)
+	DIAG_RETURN_QUERY_DATA           DiagnosticSubFunction = 0x0000
+	DIAG_RESTART_COMMUNICATIONS      DiagnosticSubFunction = 0x0001
+	DIAG_RETURN_DIAGNOSTIC_REGISTER  DiagnosticSubFunction = 0x0002
+	DIAG_FORCE_LISTEN_ONLY_MODE      DiagnosticSubFunction = 0x0004
+	DIAG_CLEAR_COUNTERS              DiagnosticSubFunction = 0x000a
+	DIAG_BUS_MESSAGE_COUNT           DiagnosticSubFunction = 0x000b
+	DIAG_BUS_COMM_ERROR_COUNT        DiagnosticSubFunction = 0x000c
+	DIAG_BUS_EXCEPTION_ERROR_COUNT   DiagnosticSubFunction = 0x000d
+	DIAG_SERVER_MESSAGE_COUNT        DiagnosticSubFunction = 0x000e
+	DIAG_SERVER_NO_RESPONSE_COUNT    DiagnosticSubFunction = 0x000f
+	DIAG_SERVER_NAK_COUNT            DiagnosticSubFunction = 0x0010
+	DIAG_SERVER_BUSY_COUNT           DiagnosticSubFunction = 0x0011
+	DIAG_BUS_CHARACTER_OVERRUN_COUNT DiagnosticSubFunction = 0x0012
+	DIAG_CLEAR_OVERRUN_COUNTER       DiagnosticSubFunction = 0x0014
+)
+
+const (
+	// the client is not open, either because Open() was never called
+	// or because it was closed with Close()
+	STATE_CLOSED ConnectionState = 0
+	// the transport is open and usable
+	STATE_CONNECTED ConnectionState = 1
+	// the transport failed and is being (or waiting to be) reopened
+	STATE_DISCONNECTED ConnectionState = 2
 )
 
+// individual access read device id code
+const readDeviceIdIndividual uint8 = 0x04
+
 // Modbus client configuration object.
 type ClientConfiguration struct {
 	// URL sets the client mode and target location in the form
-	// <mode>://<serial device or host:port> e.g. tcp://plc:502
+	// <mode>://<serial device or host:port>[?<parameters>] e.g. tcp://plc:502,
+	// rtu:///dev/ttyUSB0?baud=9600&parity=E&stop=1&timeout=500ms,
+	// tcp+tls://plc:802?cert=client.pem&key=client.key&ca=ca.pem or
+	// replay://testdata/trace.jsonl (see Capture).
+	// Parameters take precedence over the fields below (see
+	// applyClientParams() for the complete list).
+	// Clients of the same serial device share the port and take turns on
+	// the bus, hence must use the same serial settings (see
+	// openBusTransport()).
 	URL string
-	// Speed sets the serial link speed (in bps, rtu only)
+	// Speed sets the serial link speed (in bps, rtu and ascii only)
 	Speed uint
-	// DataBits sets the number of bits per serial character (rtu only)
+	// DataBits sets the number of bits per serial character (rtu and ascii
+	// only, defaults to 8 in rtu mode and 7 in ascii mode)
 	DataBits uint
-	// Parity sets the serial link parity mode (rtu only)
+	// Parity sets the serial link parity mode (rtu and ascii only)
 	Parity uint
-	// StopBits sets the number of serial stop bits (rtu only)
+	// StopBits sets the number of serial stop bits (rtu and ascii only)
 	StopBits uint
+	// RS485 sets the RS485 mode of the serial port (rtu and ascii only)
+	RS485 RS485Configuration
 	// Timeout sets the request timeout value
 	Timeout time.Duration
+	// TransactionWindow sets the maximum number of transactions kept in
+	// flight on the connection (tcp and tcp+tls only). Values above 1
+	// enable pipelining: requests issued concurrently (e.g. through
+	// ModbusUnit handles) go out without waiting for earlier responses,
+	// which are matched to their request by transaction id.
+	// Defaults to 1, i.e. one transaction at a time.
+	TransactionWindow uint
+	// AutoReconnect enables transparent reopening of the transport (re-dial
+	// of sockets, reopening of serial devices) when it fails, e.g. when
+	// the remote end drops the connection or a USB serial adapter is
+	// unplugged. Requests made while disconnected fail with ErrNotConnected.
+	// Without it, failed transports are left open and requests keep going
+	// through them until the client is closed and reopened.
+	AutoReconnect bool
+	// ReconnectMinDelay sets the delay before the first reconnection
+	// attempt, doubled after each failed attempt (defaults to 500ms)
+	ReconnectMinDelay time.Duration
+	// ReconnectMaxDelay caps the delay between reconnection attempts
+	// (defaults to 30s)
+	ReconnectMaxDelay time.Duration
+	// Capture sets the path of a file to record the frames sent and
+	// received to, overwritten each time the client is opened: in pcap
+	// format if the path ends with .pcap, as JSON lines otherwise (rtu,
+	// rtuovertcp, rtuoverudp, tcp, tcp+tls and udp only, see
+	// frameCapture). Traces can be fed back to a client or a server with
+	// replay://<trace file> URLs, e.g. to turn device quirks into
+	// regression tests (see replayLink).
+	Capture string
+	// OnStateChange, if set, is called on every connection state change.
+	// It may be called with the client lock held and must neither block
+	// nor call client methods other than State().
+	OnStateChange func(ConnectionState)
 	// TLSClientCert sets the client-side TLS key pair (tcp+tls only)
 	TLSClientCert *tls.Certificate
 	// TLSRootCAs sets the list of CA certificates used to authenticate
@@ -59,22 +152,67 @@ type ClientConfiguration struct {
 	Logger *log.Logger
 }
 
+// Device identification object, as returned by ReadDeviceIdentification().
+type DeviceIdentification struct {
+	// ConformityLevel is the identification conformity level reported by
+	// the device (0x01-0x03, with bit 0x80 set if individual access
+	// is supported)
+	ConformityLevel uint8
+	// Objects maps object ids (see DEVICE_ID_* constants) to their value
+	Objects map[uint8]string
+}
+
+// File record object, used by ReadFileRecords() and WriteFileRecords().
+type FileRecord struct {
+	// FileNumber is the file number (0x0001-0xffff)
+	FileNumber uint16
+	// RecordNumber is the starting record number within the file (0x0000-0x270f)
+	RecordNumber uint16
+	// RecordLength is the number of 16-bit records to read (reads only)
+	RecordLength uint16
+	// Values holds the record values (set by reads, consumed by writes)
+	Values []uint16
+}
+
+// Communication event log object, returned by GetCommEventLog().
+type CommEventLog struct {
+	// Status is 0xffff if the device is still processing a previous
+	// command, 0x0000 otherwise
+	Status uint16
+	// EventCount is the communication event counter
+	EventCount uint16
+	// MessageCount is the number of messages processed by the device
+	MessageCount uint16
+	// Events holds up to 64 events, most recent first
+	Events []byte
+}
+
 // Modbus client object.
 type ModbusClient struct {
 	conf          ClientConfiguration
 	logger        *logger
-	lock          sync.Mutex
+	lock          sync.RWMutex
 	endianness    Endianness
 	wordOrder     WordOrder
 	transport     transport
 	unitId        uint8
 	transportType transportType
+	// guards state and stopReconnect, may be taken with lock held
+	stateLock     sync.Mutex
+	state         ConnectionState
+	stopReconnect chan struct{}
+	// frame capture, set while open if enabled
+	capture *frameCapture
+	// trace played back by replay clients
+	trace *frameTrace
 }
 
 // NewClient creates, configures and returns a modbus client object.
 func NewClient(conf *ClientConfiguration) (mc *ModbusClient, err error) {
 	var clientType string
 	var splitURL []string
+	var params url.Values
+	var ok bool
 
 	mc = &ModbusClient{
 		conf: *conf,
@@ -86,9 +224,25 @@ func NewClient(conf *ClientConfiguration) (mc *ModbusClient, err error) {
 		mc.conf.URL = splitURL[1]
 	}
 
+	mc.conf.URL, params, err = splitURLParams(mc.conf.URL)
+
 	mc.logger = newLogger(
 		fmt.Sprintf("modbus-client(%s)", mc.conf.URL), conf.Logger)
 
+	if err == nil {
+		err = checkURLParams(params, clientURLParams, clientType, "client")
+	}
+
+	if err == nil {
+		err = applyClientParams(params, &mc.conf)
+	}
+
+	if err != nil {
+		mc.logger.Errorf("%v", err)
+		err = fmt.Errorf("%w: %v", ErrConfigurationError, err)
+		return
+	}
+
 	switch clientType {
 	case "rtu":
 		// set useful defaults
@@ -120,6 +274,38 @@ func NewClient(conf *ClientConfiguration) (mc *ModbusClient, err error) {
 
 		mc.transportType = modbusRTU
 
+	case "ascii":
+		if mc.conf.Speed == 0 {
+			mc.conf.Speed = 19200
+		}
+
+		// the modbus over serial line spec mandates 7-bit characters in
+		// ASCII mode, with the same parity and stop bit rules as RTU mode
+		if mc.conf.DataBits == 0 {
+			mc.conf.DataBits = 7
+		}
+
+		if mc.conf.StopBits == 0 {
+			if mc.conf.Parity == PARITY_NONE {
+				mc.conf.StopBits = 2
+			} else {
+				mc.conf.StopBits = 1
+			}
+		}
+
+		if mc.conf.Timeout == 0 {
+			mc.conf.Timeout = 1 * time.Second
+		}
+
+		mc.transportType = modbusASCII
+
+	case "asciiovertcp":
+		if mc.conf.Timeout == 0 {
+			mc.conf.Timeout = 1 * time.Second
+		}
+
+		mc.transportType = modbusASCIIOverTCP
+
 	case "rtuovertcp":
 		if mc.conf.Speed == 0 {
 			mc.conf.Speed = 19200
@@ -180,6 +366,26 @@ func NewClient(conf *ClientConfiguration) (mc *ModbusClient, err error) {
 
 		mc.transportType = modbusTCPOverUDP
 
+	case "replay":
+		// the trace sets the framing (rtu or tcp)
+		mc.trace, err = loadTrace(mc.conf.URL)
+		if err != nil {
+			mc.logger.Errorf("%v", err)
+			err = ErrConfigurationError
+			return
+		}
+
+		// inter-frame delays are kept short in rtu mode
+		if mc.conf.Speed == 0 {
+			mc.conf.Speed = 19200
+		}
+
+		if mc.conf.Timeout == 0 {
+			mc.conf.Timeout = 1 * time.Second
+		}
+
+		mc.transportType = modbusReplay
+
 	default:
 		if len(splitURL) != 2 {
 			mc.logger.Errorf("missing client type in URL '%s'", mc.conf.URL)
@@ -190,6 +396,41 @@ func NewClient(conf *ClientConfiguration) (mc *ModbusClient, err error) {
 		return
 	}
 
+	// transaction ids only exist on modbus TCP, hence pipelining is not
+	// available on other transports
+	if mc.conf.TransactionWindow > 1 &&
+		mc.transportType != modbusTCP && mc.transportType != modbusTCPOverTLS {
+		mc.logger.Errorf("transaction window of %v is not supported on %s clients",
+			mc.conf.TransactionWindow, clientType)
+		err = ErrConfigurationError
+		return
+	}
+
+	// RS485 settings only apply to local serial ports
+	if mc.transportType == modbusRTU || mc.transportType == modbusASCII {
+		err = checkRS485Configuration(&mc.conf.RS485)
+	} else if mc.conf.RS485 != (RS485Configuration{}) {
+		err = fmt.Errorf("RS485 settings are not supported on %s clients", clientType)
+	}
+
+	if _, ok = captureMode(mc.transportType); err == nil && mc.conf.Capture != "" && !ok {
+		err = fmt.Errorf("frame capture is not supported on %s clients", clientType)
+	}
+
+	if err != nil {
+		mc.logger.Errorf("%v", err)
+		err = ErrConfigurationError
+		return
+	}
+
+	if mc.conf.ReconnectMinDelay == 0 {
+		mc.conf.ReconnectMinDelay = 500 * time.Millisecond
+	}
+
+	if mc.conf.ReconnectMaxDelay == 0 {
+		mc.conf.ReconnectMaxDelay = 30 * time.Second
+	}
+
 	mc.unitId = 1
 	mc.endianness = BIG_ENDIAN
 	mc.wordOrder = HIGH_WORD_FIRST
@@ -199,131 +440,57 @@ func NewClient(conf *ClientConfiguration) (mc *ModbusClient, err error) {
 
 // Opens the underlying transport (network socket or serial line).
 func (mc *ModbusClient) Open() (err error) {
-	var spw *serialPortWrapper
-	var sock net.Conn
+	var t transport
+	var mode frameMode
 
 	mc.lock.Lock()
 	defer mc.lock.Unlock()
 
-	switch mc.transportType {
-	case modbusRTU:
-		// create a serial port wrapper object
-		spw = newSerialPortWrapper(&serialPortConfig{
-			Device:   mc.conf.URL,
-			Speed:    mc.conf.Speed,
-			DataBits: mc.conf.DataBits,
-			Parity:   mc.conf.Parity,
-			StopBits: mc.conf.StopBits,
-		})
-
-		// open the serial device
-		err = spw.Open()
-		if err != nil {
-			return
-		}
-
-		// discard potentially stale serial data
-		discard(spw)
-
-		// create the RTU transport
-		mc.transport = newRTUTransport(
-			spw, mc.conf.URL, mc.conf.Speed, mc.conf.Timeout, mc.conf.Logger)
-
-	case modbusRTUOverTCP:
-		// connect to the remote host
-		sock, err = net.DialTimeout("tcp", mc.conf.URL, 5*time.Second)
-		if err != nil {
-			return
-		}
-
-		// discard potentially stale serial data
-		discard(sock)
-
-		// create the RTU transport
-		mc.transport = newRTUTransport(
-			sock, mc.conf.URL, mc.conf.Speed, mc.conf.Timeout, mc.conf.Logger)
-
-	case modbusRTUOverUDP:
-		// open a socket to the remote host (note: no actual connection is
-		// being made as UDP is connection-less)
-		sock, err = net.DialTimeout("udp", mc.conf.URL, 5*time.Second)
-		if err != nil {
-			return
-		}
-
-		// create the RTU transport, wrapping the UDP socket in
-		// an adapter to allow the transport to read the stream of
-		// packets byte per byte
-		mc.transport = newRTUTransport(
-			newUDPSockWrapper(sock),
-			mc.conf.URL, mc.conf.Speed, mc.conf.Timeout, mc.conf.Logger)
-
-	case modbusTCP:
-		// connect to the remote host
-		sock, err = net.DialTimeout("tcp", mc.conf.URL, 5*time.Second)
+	// start capturing frames, unless reopening
+	if mc.conf.Capture != "" && mc.capture == nil {
+		mode, _ = captureMode(mc.transportType)
+		mc.capture, err = openFrameCapture(mc.conf.Capture, mode)
 		if err != nil {
 			return
 		}
+	}
 
-		// create the TCP transport
-		mc.transport = newTCPTransport(sock, mc.conf.Timeout, mc.conf.Logger)
-
-	case modbusTCPOverTLS:
-		// connect to the remote host with TLS
-		sock, err = tls.DialWithDialer(
-			&net.Dialer{
-				Deadline: time.Now().Add(15 * time.Second),
-			}, "tcp", mc.conf.URL,
-			&tls.Config{
-				Certificates: []tls.Certificate{
-					*mc.conf.TLSClientCert,
-				},
-				RootCAs: mc.conf.TLSRootCAs,
-				// mandate TLS 1.2 or higher (see R-01 of the MBAPS spec)
-				MinVersion: tls.VersionTLS12,
-			})
-		if err != nil {
-			return
-		}
+	t, err = mc.openTransport(mc.capture)
+	if err != nil {
+		return
+	}
 
-		// force the TLS handshake
-		err = sock.(*tls.Conn).Handshake()
-		if err != nil {
-			sock.Close()
-			return
-		}
+	mc.transport = t
+	mc.setState(STATE_CONNECTED)
 
-		// create the TCP transport
-		mc.transport = newTCPTransport(sock, mc.conf.Timeout, mc.conf.Logger)
+	return
+}
 
-	case modbusTCPOverUDP:
-		// open a socket to the remote host (note: no actual connection is
-		// being made as UDP is connection-less)
-		sock, err = net.DialTimeout("udp", mc.conf.URL, 5*time.Second)
-		if err != nil {
-			return
-		}
+// Closes the underlying transport.
+func (mc *ModbusClient) Close() (err error) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
 
-		// create the TCP transport, wrapping the UDP socket in
-		// an adapter to allow the transport to read the stream of
-		// packets byte per byte
-		mc.transport = newTCPTransport(
-			newUDPSockWrapper(sock), mc.conf.Timeout, mc.conf.Logger)
+	// a failed transport has already been closed
+	if mc.setState(STATE_CLOSED) != STATE_DISCONNECTED {
+		// replay transports report mismatches with the trace here
+		err = mc.transport.Close()
+	}
 
-	default:
-		// should never happen
-		err = ErrConfigurationError
+	if mc.capture != nil {
+		mc.capture.Close()
+		mc.capture = nil
 	}
 
 	return
 }
 
-// Closes the underlying transport.
-func (mc *ModbusClient) Close() (err error) {
-	mc.lock.Lock()
-	defer mc.lock.Unlock()
+// Returns the current connection state.
+func (mc *ModbusClient) State() (state ConnectionState) {
+	mc.stateLock.Lock()
+	defer mc.stateLock.Unlock()
 
-	err = mc.transport.Close()
+	state = mc.state
 
 	return
 }
@@ -338,6 +505,19 @@ func (mc *ModbusClient) SetUnitId(id uint8) {
 	return
 }
 
+// Returns a handle to the given unit id, through which requests carry their
+// own unit id and context rather than relying on the unit id set with
+// SetUnitId(). Handles are cheap and safe for concurrent use, including
+// alongside the client's own methods.
+func (mc *ModbusClient) Unit(id uint8) (mu *ModbusUnit) {
+	mu = &ModbusUnit{
+		client: mc,
+		unitId: id,
+	}
+
+	return
+}
+
 // Sets the encoding (endianness and word ordering) of subsequent requests.
 func (mc *ModbusClient) SetEncoding(endianness Endianness, wordOrder WordOrder) (err error) {
 	mc.lock.Lock()
@@ -363,488 +543,321 @@ func (mc *ModbusClient) SetEncoding(endianness Endianness, wordOrder WordOrder)
 
 // Reads multiple coils (function code 01).
 func (mc *ModbusClient) ReadCoils(addr uint16, quantity uint16) (values []bool, err error) {
-	values, err = mc.readBools(addr, quantity, false)
+	values, err = mc.defaultUnit().ReadCoils(context.Background(), addr, quantity)
 
 	return
 }
 
 // Reads a single coil (function code 01).
 func (mc *ModbusClient) ReadCoil(addr uint16) (value bool, err error) {
-	var values []bool
-
-	values, err = mc.readBools(addr, 1, false)
-	if err == nil {
-		value = values[0]
-	}
+	value, err = mc.defaultUnit().ReadCoil(context.Background(), addr)
 
 	return
 }
 
 // Reads multiple discrete inputs (function code 02).
 func (mc *ModbusClient) ReadDiscreteInputs(addr uint16, quantity uint16) (values []bool, err error) {
-	values, err = mc.readBools(addr, quantity, true)
+	values, err = mc.defaultUnit().ReadDiscreteInputs(context.Background(), addr, quantity)
 
 	return
 }
 
 // Reads a single discrete input (function code 02).
 func (mc *ModbusClient) ReadDiscreteInput(addr uint16) (value bool, err error) {
-	var values []bool
-
-	values, err = mc.readBools(addr, 1, true)
-	if err == nil {
-		value = values[0]
-	}
+	value, err = mc.defaultUnit().ReadDiscreteInput(context.Background(), addr)
 
 	return
 }
 
 // Reads multiple 16-bit registers (function code 03 or 04).
 func (mc *ModbusClient) ReadRegisters(addr uint16, quantity uint16, regType RegType) (values []uint16, err error) {
-	var mbPayload []byte
-
-	// read quantity uint16 registers, as bytes
-	mbPayload, err = mc.readRegisters(addr, quantity, regType)
-	if err != nil {
-		return
-	}
-
-	// decode payload bytes as uint16s
-	values = bytesToUint16s(mc.endianness, mbPayload)
+	values, err = mc.defaultUnit().ReadRegisters(context.Background(), addr, quantity, regType)
 
 	return
 }
 
 // Reads a single 16-bit register (function code 03 or 04).
 func (mc *ModbusClient) ReadRegister(addr uint16, regType RegType) (value uint16, err error) {
-	var values []uint16
+	value, err = mc.defaultUnit().ReadRegister(context.Background(), addr, regType)
 
-	// read 1 uint16 register, as bytes
-	values, err = mc.ReadRegisters(addr, 1, regType)
-	if err == nil {
-		value = values[0]
-	}
 	return
 }
 
 // Reads multiple 32-bit registers.
 func (mc *ModbusClient) ReadUint32s(addr uint16, quantity uint16, regType RegType) (values []uint32, err error) {
-	var mbPayload []byte
-
-	// read 2 * quantity uint16 registers, as bytes
-	mbPayload, err = mc.readRegisters(addr, quantity*2, regType)
-	if err != nil {
-		return
-	}
-
-	// decode payload bytes as uint32s
-	values = bytesToUint32s(mc.endianness, mc.wordOrder, mbPayload)
+	values, err = mc.defaultUnit().ReadUint32s(context.Background(), addr, quantity, regType)
 
 	return
 }
 
 // Reads a single 32-bit register.
 func (mc *ModbusClient) ReadUint32(addr uint16, regType RegType) (value uint32, err error) {
-	var values []uint32
-
-	values, err = mc.ReadUint32s(addr, 1, regType)
-	if err == nil {
-		value = values[0]
-	}
+	value, err = mc.defaultUnit().ReadUint32(context.Background(), addr, regType)
 
 	return
 }
 
 // Reads multiple 32-bit float registers.
 func (mc *ModbusClient) ReadFloat32s(addr uint16, quantity uint16, regType RegType) (values []float32, err error) {
-	var mbPayload []byte
-
-	// read 2 * quantity uint16 registers, as bytes
-	mbPayload, err = mc.readRegisters(addr, quantity*2, regType)
-	if err != nil {
-		return
-	}
-
-	// decode payload bytes as float32s
-	values = bytesToFloat32s(mc.endianness, mc.wordOrder, mbPayload)
+	values, err = mc.defaultUnit().ReadFloat32s(context.Background(), addr, quantity, regType)
 
 	return
 }
 
 // Reads a single 32-bit float register.
 func (mc *ModbusClient) ReadFloat32(addr uint16, regType RegType) (value float32, err error) {
-	var values []float32
-
-	values, err = mc.ReadFloat32s(addr, 1, regType)
-	if err == nil {
-		value = values[0]
-	}
+	value, err = mc.defaultUnit().ReadFloat32(context.Background(), addr, regType)
 
 	return
 }
 
 // Reads multiple 64-bit registers.
 func (mc *ModbusClient) ReadUint64s(addr uint16, quantity uint16, regType RegType) (values []uint64, err error) {
-	var mbPayload []byte
-
-	// read 4 * quantity uint16 registers, as bytes
-	mbPayload, err = mc.readRegisters(addr, quantity*4, regType)
-	if err != nil {
-		return
-	}
-
-	// decode payload bytes as uint64s
-	values = bytesToUint64s(mc.endianness, mc.wordOrder, mbPayload)
+	values, err = mc.defaultUnit().ReadUint64s(context.Background(), addr, quantity, regType)
 
 	return
 }
 
 // Reads a single 64-bit register.
 func (mc *ModbusClient) ReadUint64(addr uint16, regType RegType) (value uint64, err error) {
-	var values []uint64
-
-	values, err = mc.ReadUint64s(addr, 1, regType)
-	if err == nil {
-		value = values[0]
-	}
+	value, err = mc.defaultUnit().ReadUint64(context.Background(), addr, regType)
 
 	return
 }
 
 // Reads multiple 64-bit float registers.
 func (mc *ModbusClient) ReadFloat64s(addr uint16, quantity uint16, regType RegType) (values []float64, err error) {
-	var mbPayload []byte
-
-	// read 4 * quantity uint16 registers, as bytes
-	mbPayload, err = mc.readRegisters(addr, quantity*4, regType)
-	if err != nil {
-		return
-	}
-
-	// decode payload bytes as float64s
-	values = bytesToFloat64s(mc.endianness, mc.wordOrder, mbPayload)
+	values, err = mc.defaultUnit().ReadFloat64s(context.Background(), addr, quantity, regType)
 
 	return
 }
 
 // Reads a single 64-bit float register.
 func (mc *ModbusClient) ReadFloat64(addr uint16, regType RegType) (value float64, err error) {
-	var values []float64
-
-	values, err = mc.ReadFloat64s(addr, 1, regType)
-	if err == nil {
-		value = values[0]
-	}
+	value, err = mc.defaultUnit().ReadFloat64(context.Background(), addr, regType)
 
 	return
 }
 
-// Reads one or multiple 16-bit registers (function code 03 or 04) as bytes.
-// A per-register byteswap is performed if endianness is set to LITTLE_ENDIAN.
-func (mc *ModbusClient) ReadBytes(addr uint16, quantity uint16, regType RegType) (values []byte, err error) {
-	values, err = mc.readBytes(addr, quantity, regType, true)
+// Reads multiple 16-bit signed registers (function code 03 or 04).
+func (mc *ModbusClient) ReadInt16s(addr uint16, quantity uint16, regType RegType) (values []int16, err error) {
+	values, err = mc.defaultUnit().ReadInt16s(context.Background(), addr, quantity, regType)
 
 	return
 }
 
-// Reads one or multiple 16-bit registers (function code 03 or 04) as bytes.
-// No byte or word reordering is performed: bytes are returned exactly as they come
-// off the wire, allowing the caller to handle encoding/endianness/word order manually.
-func (mc *ModbusClient) ReadRawBytes(addr uint16, quantity uint16, regType RegType) (values []byte, err error) {
-	values, err = mc.readBytes(addr, quantity, regType, false)
+// Reads a single 16-bit signed register (function code 03 or 04).
+func (mc *ModbusClient) ReadInt16(addr uint16, regType RegType) (value int16, err error) {
+	value, err = mc.defaultUnit().ReadInt16(context.Background(), addr, regType)
 
 	return
 }
 
-// Writes a single coil (function code 05)
-func (mc *ModbusClient) WriteCoil(addr uint16, value bool) (err error) {
-	var req *pdu
-	var res *pdu
+// Reads multiple 32-bit signed registers.
+func (mc *ModbusClient) ReadInt32s(addr uint16, quantity uint16, regType RegType) (values []int32, err error) {
+	values, err = mc.defaultUnit().ReadInt32s(context.Background(), addr, quantity, regType)
 
-	mc.lock.Lock()
-	defer mc.lock.Unlock()
+	return
+}
 
-	// create and fill in the request object
-	req = &pdu{
-		unitId:       mc.unitId,
-		functionCode: fcWriteSingleCoil,
-	}
+// Reads a single 32-bit signed register.
+func (mc *ModbusClient) ReadInt32(addr uint16, regType RegType) (value int32, err error) {
+	value, err = mc.defaultUnit().ReadInt32(context.Background(), addr, regType)
 
-	// coil address
-	req.payload = uint16ToBytes(BIG_ENDIAN, addr)
-	// coil value
-	if value {
-		req.payload = append(req.payload, 0xff, 0x00)
-	} else {
-		req.payload = append(req.payload, 0x00, 0x00)
-	}
+	return
+}
 
-	// run the request across the transport and wait for a response
-	res, err = mc.executeRequest(req)
-	if err != nil {
-		return
-	}
+// Reads multiple 64-bit signed registers.
+func (mc *ModbusClient) ReadInt64s(addr uint16, quantity uint16, regType RegType) (values []int64, err error) {
+	values, err = mc.defaultUnit().ReadInt64s(context.Background(), addr, quantity, regType)
 
-	// validate the response code
-	switch {
-	case res.functionCode == req.functionCode:
-		// expect 4 bytes (2 byte of address + 2 bytes of value)
-		if len(res.payload) != 4 ||
-			// bytes 1-2 should be the coil address
-			bytesToUint16(BIG_ENDIAN, res.payload[0:2]) != addr ||
-			// bytes 3-4 should either be {0xff, 0x00} or {0x00, 0x00}
-			// depending on the coil value
-			(value == true && res.payload[2] != 0xff) ||
-			res.payload[3] != 0x00 {
-			err = ErrProtocolError
-			return
-		}
+	return
+}
 
-	case res.functionCode == (req.functionCode | 0x80):
-		if len(res.payload) != 1 {
-			err = ErrProtocolError
-			return
-		}
+// Reads a single 64-bit signed register.
+func (mc *ModbusClient) ReadInt64(addr uint16, regType RegType) (value int64, err error) {
+	value, err = mc.defaultUnit().ReadInt64(context.Background(), addr, regType)
 
-		err = mapExceptionCodeToError(res.payload[0])
+	return
+}
 
-	default:
-		err = ErrProtocolError
-		mc.logger.Warningf("unexpected response code (%v)", res.functionCode)
-	}
+// Reads quantity 16-bit registers as an ASCII string, two characters per register.
+// Trailing null bytes and spaces are trimmed.
+func (mc *ModbusClient) ReadString(addr uint16, quantity uint16, regType RegType) (value string, err error) {
+	value, err = mc.defaultUnit().ReadString(context.Background(), addr, quantity, regType)
 
 	return
 }
 
-// Writes multiple coils (function code 15)
-func (mc *ModbusClient) WriteCoils(addr uint16, values []bool) (err error) {
-	var req *pdu
-	var res *pdu
-	var quantity uint16
-	var encodedValues []byte
+// Reads quantity 16-bit registers as a packed BCD value (4 digits per register).
+func (mc *ModbusClient) ReadBCD(addr uint16, quantity uint16, regType RegType) (value uint64, err error) {
+	value, err = mc.defaultUnit().ReadBCD(context.Background(), addr, quantity, regType)
 
-	mc.lock.Lock()
-	defer mc.lock.Unlock()
-
-	quantity = uint16(len(values))
-	if quantity == 0 {
-		err = ErrUnexpectedParameters
-		mc.logger.Error("quantity of coils is 0")
-		return
-	}
+	return
+}
 
-	if quantity > 0x7b0 {
-		err = ErrUnexpectedParameters
-		mc.logger.Error("quantity of coils exceeds 1968")
-		return
-	}
+// Reads the registers spanned by the tagged fields of the struct pointed to
+// by v, starting at addr, and decodes them into it (see Unmarshal()).
+func (mc *ModbusClient) ReadStruct(addr uint16, regType RegType, v interface{}) (err error) {
+	err = mc.defaultUnit().ReadStruct(context.Background(), addr, regType, v)
 
-	if uint32(addr)+uint32(quantity)-1 > 0xffff {
-		err = ErrUnexpectedParameters
-		mc.logger.Error("end coil address is past 0xffff")
-		return
-	}
+	return
+}
 
-	encodedValues = encodeBools(values)
+// Reads one or multiple 16-bit registers (function code 03 or 04) as bytes.
+// A per-register byteswap is performed if endianness is set to LITTLE_ENDIAN.
+func (mc *ModbusClient) ReadBytes(addr uint16, quantity uint16, regType RegType) (values []byte, err error) {
+	values, err = mc.defaultUnit().ReadBytes(context.Background(), addr, quantity, regType)
 
-	// create and fill in the request object
-	req = &pdu{
-		unitId:       mc.unitId,
-		functionCode: fcWriteMultipleCoils,
-	}
+	return
+}
 
-	// start address
-	req.payload = uint16ToBytes(BIG_ENDIAN, addr)
-	// quantity
-	req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, quantity)...)
-	// byte count
-	req.payload = append(req.payload, byte(len(encodedValues)))
-	// payload
-	req.payload = append(req.payload, encodedValues...)
-
-	// run the request across the transport and wait for a response
-	res, err = mc.executeRequest(req)
-	if err != nil {
-		return
-	}
+// Reads one or multiple 16-bit registers (function code 03 or 04) as bytes.
+// No byte or word reordering is performed: bytes are returned exactly as they come
+// off the wire, allowing the caller to handle encoding/endianness/word order manually.
+func (mc *ModbusClient) ReadRawBytes(addr uint16, quantity uint16, regType RegType) (values []byte, err error) {
+	values, err = mc.defaultUnit().ReadRawBytes(context.Background(), addr, quantity, regType)
 
-	// validate the response code
-	switch {
-	case res.functionCode == req.functionCode:
-		// expect 4 bytes (2 byte of address + 2 bytes of quantity)
-		if len(res.payload) != 4 ||
-			// bytes 1-2 should be the base coil address
-			bytesToUint16(BIG_ENDIAN, res.payload[0:2]) != addr ||
-			// bytes 3-4 should be the quantity of coils
-			bytesToUint16(BIG_ENDIAN, res.payload[2:4]) != quantity {
-			err = ErrProtocolError
-			return
-		}
+	return
+}
 
-	case res.functionCode == (req.functionCode | 0x80):
-		if len(res.payload) != 1 {
-			err = ErrProtocolError
-			return
-		}
+// Writes a single coil (function code 05)
+func (mc *ModbusClient) WriteCoil(addr uint16, value bool) (err error) {
+	err = mc.defaultUnit().WriteCoil(context.Background(), addr, value)
 
-		err = mapExceptionCodeToError(res.payload[0])
+	return
+}
 
-	default:
-		err = ErrProtocolError
-		mc.logger.Warningf("unexpected response code (%v)", res.functionCode)
-	}
+// Writes multiple coils (function code 15)
+func (mc *ModbusClient) WriteCoils(addr uint16, values []bool) (err error) {
+	err = mc.defaultUnit().WriteCoils(context.Background(), addr, values)
 
 	return
 }
 
 // Writes a single 16-bit register (function code 06).
 func (mc *ModbusClient) WriteRegister(addr uint16, value uint16) (err error) {
-	var req *pdu
-	var res *pdu
-
-	mc.lock.Lock()
-	defer mc.lock.Unlock()
-
-	// create and fill in the request object
-	req = &pdu{
-		unitId:       mc.unitId,
-		functionCode: fcWriteSingleRegister,
-	}
-
-	// register address
-	req.payload = uint16ToBytes(BIG_ENDIAN, addr)
-	// register value
-	req.payload = append(req.payload, uint16ToBytes(mc.endianness, value)...)
-
-	// run the request across the transport and wait for a response
-	res, err = mc.executeRequest(req)
-	if err != nil {
-		return
-	}
-
-	// validate the response code
-	switch {
-	case res.functionCode == req.functionCode:
-		// expect 4 bytes (2 byte of address + 2 bytes of value)
-		if len(res.payload) != 4 ||
-			// bytes 1-2 should be the register address
-			bytesToUint16(BIG_ENDIAN, res.payload[0:2]) != addr ||
-			// bytes 3-4 should be the value
-			bytesToUint16(mc.endianness, res.payload[2:4]) != value {
-			err = ErrProtocolError
-			return
-		}
-
-	case res.functionCode == (req.functionCode | 0x80):
-		if len(res.payload) != 1 {
-			err = ErrProtocolError
-			return
-		}
-
-		err = mapExceptionCodeToError(res.payload[0])
-
-	default:
-		err = ErrProtocolError
-		mc.logger.Warningf("unexpected response code (%v)", res.functionCode)
-	}
+	err = mc.defaultUnit().WriteRegister(context.Background(), addr, value)
 
 	return
 }
 
 // Writes multiple 16-bit registers (function code 16).
 func (mc *ModbusClient) WriteRegisters(addr uint16, values []uint16) (err error) {
-	var payload []byte
-
-	// turn registers to bytes
-	for _, value := range values {
-		payload = append(payload, uint16ToBytes(mc.endianness, value)...)
-	}
-
-	err = mc.writeRegisters(addr, payload)
+	err = mc.defaultUnit().WriteRegisters(context.Background(), addr, values)
 
 	return
 }
 
 // Writes multiple 32-bit registers.
 func (mc *ModbusClient) WriteUint32s(addr uint16, values []uint32) (err error) {
-	var payload []byte
-
-	// turn registers to bytes
-	for _, value := range values {
-		payload = append(payload, uint32ToBytes(mc.endianness, mc.wordOrder, value)...)
-	}
-
-	err = mc.writeRegisters(addr, payload)
+	err = mc.defaultUnit().WriteUint32s(context.Background(), addr, values)
 
 	return
 }
 
 // Writes a single 32-bit register.
 func (mc *ModbusClient) WriteUint32(addr uint16, value uint32) (err error) {
-	err = mc.writeRegisters(addr, uint32ToBytes(mc.endianness, mc.wordOrder, value))
+	err = mc.defaultUnit().WriteUint32(context.Background(), addr, value)
 
 	return
 }
 
 // Writes multiple 32-bit float registers.
 func (mc *ModbusClient) WriteFloat32s(addr uint16, values []float32) (err error) {
-	var payload []byte
-
-	// turn registers to bytes
-	for _, value := range values {
-		payload = append(payload, float32ToBytes(mc.endianness, mc.wordOrder, value)...)
-	}
-
-	err = mc.writeRegisters(addr, payload)
+	err = mc.defaultUnit().WriteFloat32s(context.Background(), addr, values)
 
 	return
 }
 
 // Writes a single 32-bit float register.
 func (mc *ModbusClient) WriteFloat32(addr uint16, value float32) (err error) {
-	err = mc.writeRegisters(addr, float32ToBytes(mc.endianness, mc.wordOrder, value))
+	err = mc.defaultUnit().WriteFloat32(context.Background(), addr, value)
 
 	return
 }
 
 // Writes multiple 64-bit registers.
 func (mc *ModbusClient) WriteUint64s(addr uint16, values []uint64) (err error) {
-	var payload []byte
-
-	// turn registers to bytes
-	for _, value := range values {
-		payload = append(payload, uint64ToBytes(mc.endianness, mc.wordOrder, value)...)
-	}
-
-	err = mc.writeRegisters(addr, payload)
+	err = mc.defaultUnit().WriteUint64s(context.Background(), addr, values)
 
 	return
 }
 
 // Writes a single 64-bit register.
 func (mc *ModbusClient) WriteUint64(addr uint16, value uint64) (err error) {
-	err = mc.writeRegisters(addr, uint64ToBytes(mc.endianness, mc.wordOrder, value))
+	err = mc.defaultUnit().WriteUint64(context.Background(), addr, value)
 
 	return
 }
 
 // Writes multiple 64-bit float registers.
 func (mc *ModbusClient) WriteFloat64s(addr uint16, values []float64) (err error) {
-	var payload []byte
-
-	// turn registers to bytes
-	for _, value := range values {
-		payload = append(payload, float64ToBytes(mc.endianness, mc.wordOrder, value)...)
-	}
-
-	err = mc.writeRegisters(addr, payload)
+	err = mc.defaultUnit().WriteFloat64s(context.Background(), addr, values)
 
 	return
 }
 
 // Writes a single 64-bit float register.
 func (mc *ModbusClient) WriteFloat64(addr uint16, value float64) (err error) {
-	err = mc.writeRegisters(addr, float64ToBytes(mc.endianness, mc.wordOrder, value))
+	err = mc.defaultUnit().WriteFloat64(context.Background(), addr, value)
+
+	return
+}
+
+// Writes multiple 16-bit signed registers (function code 16).
+func (mc *ModbusClient) WriteInt16s(addr uint16, values []int16) (err error) {
+	err = mc.defaultUnit().WriteInt16s(context.Background(), addr, values)
+
+	return
+}
+
+// Writes a single 16-bit signed register (function code 06).
+func (mc *ModbusClient) WriteInt16(addr uint16, value int16) (err error) {
+	err = mc.defaultUnit().WriteInt16(context.Background(), addr, value)
+
+	return
+}
+
+// Writes multiple 32-bit signed registers.
+func (mc *ModbusClient) WriteInt32s(addr uint16, values []int32) (err error) {
+	err = mc.defaultUnit().WriteInt32s(context.Background(), addr, values)
+
+	return
+}
+
+// Writes a single 32-bit signed register.
+func (mc *ModbusClient) WriteInt32(addr uint16, value int32) (err error) {
+	err = mc.defaultUnit().WriteInt32(context.Background(), addr, value)
+
+	return
+}
+
+// Writes multiple 64-bit signed registers.
+func (mc *ModbusClient) WriteInt64s(addr uint16, values []int64) (err error) {
+	err = mc.defaultUnit().WriteInt64s(context.Background(), addr, values)
+
+	return
+}
+
+// Writes a single 64-bit signed register.
+func (mc *ModbusClient) WriteInt64(addr uint16, value int64) (err error) {
+	err = mc.defaultUnit().WriteInt64(context.Background(), addr, value)
+
+	return
+}
+
+// Writes value as an ASCII string to quantity 16-bit registers starting at
+// addr, padding it with null bytes.
+func (mc *ModbusClient) WriteString(addr uint16, quantity uint16, value string) (err error) {
+	err = mc.defaultUnit().WriteString(context.Background(), addr, quantity, value)
+
+	return
+}
+
+// Writes value as packed BCD to quantity 16-bit registers starting at addr.
+func (mc *ModbusClient) WriteBCD(addr uint16, quantity uint16, value uint64) (err error) {
+	err = mc.defaultUnit().WriteBCD(context.Background(), addr, quantity, value)
 
 	return
 }
@@ -853,7 +866,7 @@ func (mc *ModbusClient) WriteFloat64(addr uint16, value float64) (err error) {
 // A per-register byteswap is performed if endianness is set to LITTLE_ENDIAN.
 // Odd byte quantities are padded with a null byte to fall on 16-bit register boundaries.
 func (mc *ModbusClient) WriteBytes(addr uint16, values []byte) (err error) {
-	err = mc.writeBytes(addr, values, true)
+	err = mc.defaultUnit().WriteBytes(context.Background(), addr, values)
 
 	return
 }
@@ -863,328 +876,512 @@ func (mc *ModbusClient) WriteBytes(addr uint16, values []byte) (err error) {
 // allowing the caller to handle encoding/endianness/word order manually.
 // Odd byte quantities are padded with a null byte to fall on 16-bit register boundaries.
 func (mc *ModbusClient) WriteRawBytes(addr uint16, values []byte) (err error) {
-	err = mc.writeBytes(addr, values, false)
+	err = mc.defaultUnit().WriteRawBytes(context.Background(), addr, values)
 
 	return
 }
 
-/*** unexported methods ***/
-// Reads one or multiple 16-bit registers (function code 03 or 04) as bytes.
-func (mc *ModbusClient) readBytes(addr uint16, quantity uint16, regType RegType, observeEndianness bool) (values []byte, err error) {
-	var regCount uint16
+// Modifies a single 16-bit holding register using a combination of an AND mask,
+// an OR mask and the current register value (function code 22):
+// result = (current AND andMask) OR (orMask AND (NOT andMask)).
+// The modification is performed atomically by the device.
+func (mc *ModbusClient) MaskWriteRegister(addr uint16, andMask uint16, orMask uint16) (err error) {
+	err = mc.defaultUnit().MaskWriteRegister(context.Background(), addr, andMask, orMask)
 
-	// read enough registers to get the requested number of bytes
-	// (2 bytes per reg)
-	regCount = (quantity / 2) + (quantity % 2)
+	return
+}
 
-	values, err = mc.readRegisters(addr, regCount, regType)
-	if err != nil {
-		return
-	}
+// Writes multiple 16-bit holding registers starting at writeAddr, then reads
+// readQuantity holding registers starting at readAddr, in a single transaction
+// (function code 23). The write is performed before the read.
+func (mc *ModbusClient) ReadWriteRegisters(readAddr uint16, readQuantity uint16,
+	writeAddr uint16, values []uint16) (readValues []uint16, err error) {
+	readValues, err = mc.defaultUnit().ReadWriteRegisters(
+		context.Background(), readAddr, readQuantity, writeAddr, values)
 
-	// swap bytes on register boundaries if requested by the caller
-	// and endianness is set to little endian
-	if observeEndianness && mc.endianness == LITTLE_ENDIAN {
-		for i := 0; i < len(values); i += 2 {
-			values[i], values[i+1] = values[i+1], values[i]
-		}
-	}
+	return
+}
 
-	// pop the last byte on odd quantities
-	if quantity%2 == 1 {
-		values = values[0 : len(values)-1]
-	}
+// Reads the contents of the 8 exception status outputs of the remote device
+// (function code 7, serial line only).
+func (mc *ModbusClient) ReadExceptionStatus() (status uint8, err error) {
+	status, err = mc.defaultUnit().ReadExceptionStatus(context.Background())
 
 	return
 }
 
-// Writes the given slice of bytes to 16-bit registers starting at addr.
-func (mc *ModbusClient) writeBytes(addr uint16, values []byte, observeEndianness bool) (err error) {
-	// pad odd quantities to make for full registers
-	if len(values)%2 == 1 {
-		values = append(values, 0x00)
-	}
+// Runs a diagnostics sub-function (function code 8, serial line only) and
+// returns the data field of the response.
+// The data field is limited to a single 16-bit word, as the length of
+// the response could not be determined on serial lines otherwise.
+func (mc *ModbusClient) Diagnostics(subFunction DiagnosticSubFunction, data uint16) (res uint16, err error) {
+	res, err = mc.defaultUnit().Diagnostics(context.Background(), subFunction, data)
 
-	// swap bytes on register boundaries if requested by the caller
-	// and endianness is set to little endian
-	if observeEndianness && mc.endianness == LITTLE_ENDIAN {
-		for i := 0; i < len(values); i += 2 {
-			values[i], values[i+1] = values[i+1], values[i]
-		}
-	}
+	return
+}
 
-	err = mc.writeRegisters(addr, values)
+// Asks the remote device to echo data back (diagnostics sub-function 0x00).
+func (mc *ModbusClient) ReturnQueryData(data uint16) (err error) {
+	err = mc.defaultUnit().ReturnQueryData(context.Background(), data)
 
 	return
 }
 
-// Reads and returns quantity booleans.
-// Digital inputs are read if di is true, otherwise coils are read.
-func (mc *ModbusClient) readBools(addr uint16, quantity uint16, di bool) (values []bool, err error) {
-	var req *pdu
-	var res *pdu
-	var expectedLen int
+// Restarts the serial line port of the remote device, clearing its
+// communication counters and taking it out of listen only mode (diagnostics
+// sub-function 0x01). The communication event log is cleared as well if
+// clearLog is true.
+// Devices in listen only mode do not respond to this request: expect
+// ErrRequestTimedOut in that case.
+func (mc *ModbusClient) RestartCommunications(clearLog bool) (err error) {
+	err = mc.defaultUnit().RestartCommunications(context.Background(), clearLog)
 
-	mc.lock.Lock()
-	defer mc.lock.Unlock()
+	return
+}
 
-	if quantity == 0 {
-		err = ErrUnexpectedParameters
-		mc.logger.Error("quantity of coils/discrete inputs is 0")
-		return
-	}
+// Forces the remote device into listen only mode (diagnostics sub-function
+// 0x04), where it stops responding to any request but RestartCommunications().
+// As the remote device does not respond to this request, a timeout is not
+// considered an error.
+func (mc *ModbusClient) ForceListenOnlyMode() (err error) {
+	err = mc.defaultUnit().ForceListenOnlyMode(context.Background())
 
-	if quantity > 2000 {
-		err = ErrUnexpectedParameters
-		mc.logger.Error("quantity of coils/discrete inputs exceeds 2000")
-		return
-	}
+	return
+}
 
-	if uint32(addr)+uint32(quantity)-1 > 0xffff {
-		err = ErrUnexpectedParameters
-		mc.logger.Error("end coil/discrete input address is past 0xffff")
-		return
-	}
+// Clears all counters and the diagnostic register of the remote device
+// (diagnostics sub-function 0x0a).
+func (mc *ModbusClient) ClearDiagnosticCounters() (err error) {
+	err = mc.defaultUnit().ClearDiagnosticCounters(context.Background())
 
-	// create and fill in the request object
-	req = &pdu{
-		unitId: mc.unitId,
-	}
+	return
+}
 
-	if di {
-		req.functionCode = fcReadDiscreteInputs
-	} else {
-		req.functionCode = fcReadCoils
-	}
+// Reads a diagnostic counter of the remote device, e.g. DIAG_BUS_MESSAGE_COUNT
+// or DIAG_BUS_COMM_ERROR_COUNT (CRC errors), or its diagnostic register
+// (DIAG_RETURN_DIAGNOSTIC_REGISTER).
+func (mc *ModbusClient) ReadDiagnosticCounter(counter DiagnosticSubFunction) (value uint16, err error) {
+	value, err = mc.defaultUnit().ReadDiagnosticCounter(context.Background(), counter)
 
-	// start address
-	req.payload = uint16ToBytes(BIG_ENDIAN, addr)
-	// quantity
-	req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, quantity)...)
+	return
+}
 
-	// run the request across the transport and wait for a response
-	res, err = mc.executeRequest(req)
-	if err != nil {
-		return
-	}
+// Reads the status word and communication event counter of the remote device
+// (function code 11, serial line only).
+// status is 0xffff if the device is still processing a previous command,
+// 0x0000 otherwise.
+func (mc *ModbusClient) GetCommEventCounter() (status uint16, eventCount uint16, err error) {
+	status, eventCount, err = mc.defaultUnit().GetCommEventCounter(context.Background())
 
-	// validate the response code
-	switch {
-	case res.functionCode == req.functionCode:
-		// expect a payload of 1 byte (byte count) + 1 byte for 8 coils/discrete inputs)
-		expectedLen = 1
-		expectedLen += int(quantity) / 8
-		if quantity%8 != 0 {
-			expectedLen++
-		}
+	return
+}
 
-		if len(res.payload) != expectedLen {
-			err = ErrProtocolError
-			return
-		}
+// Reads the communication event log of the remote device (function code 12,
+// serial line only).
+func (mc *ModbusClient) GetCommEventLog() (eventLog *CommEventLog, err error) {
+	eventLog, err = mc.defaultUnit().GetCommEventLog(context.Background())
 
-		// validate the byte count field
-		if int(res.payload[0])+1 != expectedLen {
-			err = ErrProtocolError
-			return
-		}
+	return
+}
 
-		// turn bits into a bool slice
-		values = decodeBools(quantity, res.payload[1:])
+// Reads the description of the remote device (function code 17, serial line
+// only).
+// The returned data holds the device-specific server id, followed by the run
+// indicator status (0x00: off, 0xff: on) and any additional device-specific
+// data. As the length of the server id is device specific, it is up to the
+// caller to split those fields.
+func (mc *ModbusClient) ReportServerId() (data []byte, err error) {
+	data, err = mc.defaultUnit().ReportServerId(context.Background())
 
-	case res.functionCode == (req.functionCode | 0x80):
-		if len(res.payload) != 1 {
-			err = ErrProtocolError
-			return
-		}
+	return
+}
 
-		err = mapExceptionCodeToError(res.payload[0])
+// Reads one or more groups of file records in a single transaction
+// (function code 20). Each request must have FileNumber, RecordNumber and
+// RecordLength set, the returned records hold the values read from the device.
+func (mc *ModbusClient) ReadFileRecords(requests []FileRecord) (records []FileRecord, err error) {
+	records, err = mc.defaultUnit().ReadFileRecords(context.Background(), requests)
 
-	default:
-		err = ErrProtocolError
-		mc.logger.Warningf("unexpected response code (%v)", res.functionCode)
-	}
+	return
+}
+
+// Writes one or more groups of file records in a single transaction
+// (function code 21). Each record must have FileNumber, RecordNumber and
+// Values set (RecordLength is ignored).
+func (mc *ModbusClient) WriteFileRecords(records []FileRecord) (err error) {
+	err = mc.defaultUnit().WriteFileRecords(context.Background(), records)
+
+	return
+}
+
+// Reads the contents of a FIFO queue of 16-bit registers (function code 24).
+// addr is the FIFO pointer address, up to 31 queued values are returned.
+func (mc *ModbusClient) ReadFifoQueue(addr uint16) (values []uint16, err error) {
+	values, err = mc.defaultUnit().ReadFifoQueue(context.Background(), addr)
 
 	return
 }
 
-// Reads and returns quantity registers of type regType, as bytes.
-func (mc *ModbusClient) readRegisters(addr uint16, quantity uint16, regType RegType) (bytes []byte, err error) {
-	var req *pdu
-	var res *pdu
+// Reads all device identification objects of the given category
+// (function code 43 / MEI type 14).
+// Responses split over multiple transactions by the device ("more follows")
+// are reassembled transparently.
+func (mc *ModbusClient) ReadDeviceIdentification(category DeviceIdCategory) (di *DeviceIdentification, err error) {
+	di, err = mc.defaultUnit().ReadDeviceIdentification(context.Background(), category)
+
+	return
+}
+
+// Reads a single device identification object (function code 43 / MEI type 14,
+// individual access).
+func (mc *ModbusClient) ReadDeviceIdentificationObject(objectId uint8) (value string, err error) {
+	value, err = mc.defaultUnit().ReadDeviceIdentificationObject(context.Background(), objectId)
+
+	return
+}
 
+/*** unexported methods ***/
+// Returns a handle to the unit id set with SetUnitId().
+func (mc *ModbusClient) defaultUnit() (mu *ModbusUnit) {
 	mc.lock.Lock()
 	defer mc.lock.Unlock()
 
-	// create and fill in the request object
-	req = &pdu{
-		unitId: mc.unitId,
-	}
+	mu = mc.Unit(mc.unitId)
 
-	switch regType {
-	case HOLDING_REGISTER:
-		req.functionCode = fcReadHoldingRegisters
-	case INPUT_REGISTER:
-		req.functionCode = fcReadInputRegisters
-	default:
-		err = ErrUnexpectedParameters
-		mc.logger.Errorf("unexpected register type (%v)", regType)
-		return
-	}
+	return
+}
 
-	if quantity == 0 {
-		err = ErrUnexpectedParameters
-		mc.logger.Error("quantity of registers is 0")
+// Takes the client lock on behalf of a request: exclusively if the transport
+// runs one transaction at a time, shared if it is pipelined, in which case
+// concurrent requests only exclude configuration changes and Open()/Close().
+func (mc *ModbusClient) acquire() {
+	if mc.conf.TransactionWindow > 1 {
+		mc.lock.RLock()
+	} else {
+		mc.lock.Lock()
 	}
 
-	if quantity > 123 {
-		err = ErrUnexpectedParameters
-		mc.logger.Error("quantity of registers exceeds 123")
-	}
+	return
+}
 
-	if uint32(addr)+uint32(quantity)-1 > 0xffff {
-		err = ErrUnexpectedParameters
-		mc.logger.Error("end register address is past 0xffff")
-		return
+// Releases the client lock taken by acquire().
+func (mc *ModbusClient) release() {
+	if mc.conf.TransactionWindow > 1 {
+		mc.lock.RUnlock()
+	} else {
+		mc.lock.Unlock()
 	}
 
-	// start address
-	req.payload = uint16ToBytes(BIG_ENDIAN, addr)
-	// quantity
-	req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, quantity)...)
+	return
+}
 
-	// run the request across the transport and wait for a response
-	res, err = mc.executeRequest(req)
-	if err != nil {
-		return
+// Returns a new TCP transport for sock, pipelined if so configured.
+func (mc *ModbusClient) newTCPTransport(sock net.Conn, capture *frameCapture) (tt *tcpTransport) {
+	tt = newTCPTransport(sock, mc.conf.Timeout, mc.conf.Logger)
+	tt.capture = capture
+
+	if mc.conf.TransactionWindow > 1 {
+		tt.startPipelining(mc.conf.TransactionWindow)
 	}
 
-	// validate the response code
-	switch {
-	case res.functionCode == req.functionCode:
-		// make sure the payload length is what we expect
-		// (1 byte of length + 2 bytes per register)
-		if len(res.payload) != 1+2*int(quantity) {
-			err = ErrProtocolError
+	return
+}
+
+// Opens and returns a new transport (network socket or serial line),
+// according to the client configuration. Frames are recorded to capture,
+// if set.
+func (mc *ModbusClient) openTransport(capture *frameCapture) (t transport, err error) {
+	var bt *busTransport
+	var rt *rtuTransport
+	var tt *tcpTransport
+	var sock net.Conn
+
+	switch mc.transportType {
+	case modbusRTU, modbusASCII:
+		// open the serial device, or share it with the other clients
+		// of the same device (see openBusTransport())
+		bt, err = openBusTransport(&serialPortConfig{
+			Device:   mc.conf.URL,
+			Speed:    mc.conf.Speed,
+			DataBits: mc.conf.DataBits,
+			Parity:   mc.conf.Parity,
+			StopBits: mc.conf.StopBits,
+			RS485:    mc.conf.RS485,
+		}, mc.transportType, mc.conf.Timeout, mc.conf.Logger)
+		if err != nil {
+			return
+		}
+		if bt.rt != nil {
+			bt.rt.capture = capture
+		}
+		t = bt
+
+	case modbusRTUOverTCP:
+		// connect to the remote host
+		sock, err = net.DialTimeout("tcp", mc.conf.URL, 5*time.Second)
+		if err != nil {
+			return
+		}
+
+		// discard potentially stale serial data
+		discard(sock)
+
+		// create the RTU transport
+		rt = newRTUTransport(
+			sock, mc.conf.URL, mc.conf.Speed, mc.conf.Timeout, mc.conf.Logger)
+		rt.capture = capture
+		t = rt
+
+	case modbusRTUOverUDP:
+		// open a socket to the remote host (note: no actual connection is
+		// being made as UDP is connection-less)
+		sock, err = net.DialTimeout("udp", mc.conf.URL, 5*time.Second)
+		if err != nil {
+			return
+		}
+
+		// create the RTU transport, wrapping the UDP socket in
+		// an adapter to allow the transport to read the stream of
+		// packets byte per byte
+		rt = newRTUTransport(
+			newUDPSockWrapper(sock),
+			mc.conf.URL, mc.conf.Speed, mc.conf.Timeout, mc.conf.Logger)
+		rt.capture = capture
+		t = rt
+
+	case modbusASCIIOverTCP:
+		// connect to the remote host
+		sock, err = net.DialTimeout("tcp", mc.conf.URL, 5*time.Second)
+		if err != nil {
+			return
+		}
+
+		// discard potentially stale serial data
+		discard(sock)
+
+		// create the ASCII transport
+		t = newASCIITransport(sock, mc.conf.URL, mc.conf.Timeout, mc.conf.Logger)
+
+	case modbusTCP:
+		// connect to the remote host
+		sock, err = net.DialTimeout("tcp", mc.conf.URL, 5*time.Second)
+		if err != nil {
+			return
+		}
+
+		// create the TCP transport
+		t = mc.newTCPTransport(sock, capture)
+
+	case modbusTCPOverTLS:
+		// connect to the remote host with TLS
+		sock, err = tls.DialWithDialer(
+			&net.Dialer{
+				Deadline: time.Now().Add(15 * time.Second),
+			}, "tcp", mc.conf.URL,
+			&tls.Config{
+				Certificates: []tls.Certificate{
+					*mc.conf.TLSClientCert,
+				},
+				RootCAs: mc.conf.TLSRootCAs,
+				// mandate TLS 1.2 or higher (see R-01 of the MBAPS spec)
+				MinVersion: tls.VersionTLS12,
+			})
+		if err != nil {
 			return
 		}
 
-		// validate the byte count field
-		// (2 bytes per register * number of registers)
-		if uint(res.payload[0]) != 2*uint(quantity) {
-			err = ErrProtocolError
+		// force the TLS handshake
+		err = sock.(*tls.Conn).Handshake()
+		if err != nil {
+			sock.Close()
 			return
 		}
 
-		// remove the byte count field from the returned slice
-		bytes = res.payload[1:]
+		// create the TCP transport
+		t = mc.newTCPTransport(sock, capture)
 
-	case res.functionCode == (req.functionCode | 0x80):
-		if len(res.payload) != 1 {
-			err = ErrProtocolError
+	case modbusTCPOverUDP:
+		// open a socket to the remote host (note: no actual connection is
+		// being made as UDP is connection-less)
+		sock, err = net.DialTimeout("udp", mc.conf.URL, 5*time.Second)
+		if err != nil {
 			return
 		}
 
-		err = mapExceptionCodeToError(res.payload[0])
+		// create the TCP transport, wrapping the UDP socket in
+		// an adapter to allow the transport to read the stream of
+		// packets byte per byte
+		tt = newTCPTransport(
+			newUDPSockWrapper(sock), mc.conf.Timeout, mc.conf.Logger)
+		tt.capture = capture
+		t = tt
+
+	case modbusReplay:
+		// play the trace back from the start
+		if mc.trace.mode == rtuFrames {
+			t = newRTUTransport(
+				newReplayLink(mc.trace, mc.conf.URL, mc.logger),
+				mc.conf.URL, mc.conf.Speed, mc.conf.Timeout, mc.conf.Logger)
+		} else {
+			t = mc.newTCPTransport(
+				newReplayLink(mc.trace, mc.conf.URL, mc.logger), nil)
+		}
 
 	default:
-		err = ErrProtocolError
-		mc.logger.Warningf("unexpected response code (%v)", res.functionCode)
+		// should never happen
+		err = ErrConfigurationError
 	}
 
 	return
 }
 
-// Writes multiple registers starting from base address addr.
-// Register values are passed as bytes, each value being exactly 2 bytes.
-func (mc *ModbusClient) writeRegisters(addr uint16, values []byte) (err error) {
-	var req *pdu
-	var res *pdu
-	var payloadLength uint16
-	var quantity uint16
+// Sets the connection state, stops the reconnection loop if any and
+// notifies the state change callback. Returns the previous state.
+func (mc *ModbusClient) setState(state ConnectionState) (previous ConnectionState) {
+	mc.stateLock.Lock()
+	previous = mc.state
+	mc.state = state
+	if mc.stopReconnect != nil {
+		close(mc.stopReconnect)
+		mc.stopReconnect = nil
+	}
+	mc.stateLock.Unlock()
 
-	mc.lock.Lock()
-	defer mc.lock.Unlock()
+	if previous != state && mc.conf.OnStateChange != nil {
+		mc.conf.OnStateChange(state)
+	}
 
-	payloadLength = uint16(len(values))
-	quantity = payloadLength / 2
+	return
+}
 
-	if quantity == 0 {
-		err = ErrUnexpectedParameters
-		mc.logger.Errorf("quantity of registers is 0")
-		return
-	}
+// Handles the failure of transport t, as noticed by a request: closes it
+// and starts reopening it in the background (auto-reconnect only).
+// Only the first request to notice the failure acts on it.
+// The caller is expected to hold the client lock (see acquire()).
+func (mc *ModbusClient) handleTransportFailure(t transport, cause error) {
+	var stop chan struct{}
 
-	if quantity > 123 {
-		err = ErrUnexpectedParameters
-		mc.logger.Errorf("quantity of registers exceeds 123")
+	mc.stateLock.Lock()
+	if mc.state != STATE_CONNECTED {
+		mc.stateLock.Unlock()
 		return
 	}
+	mc.state = STATE_DISCONNECTED
+	stop = make(chan struct{})
+	mc.stopReconnect = stop
+	mc.stateLock.Unlock()
 
-	if uint32(addr)+uint32(quantity)-1 > 0xffff {
-		err = ErrUnexpectedParameters
-		mc.logger.Errorf("end register address is past 0xffff")
-		return
-	}
+	mc.logger.Warningf("transport failed: %v", cause)
+	t.Close()
 
-	// create and fill in the request object
-	req = &pdu{
-		unitId:       mc.unitId,
-		functionCode: fcWriteMultipleRegisters,
-	}
+	// the reconnection loop needs the client lock to swap the transport in,
+	// hence must run on its own goroutine
+	go mc.reconnect(stop, mc.capture)
 
-	// base address
-	req.payload = uint16ToBytes(BIG_ENDIAN, addr)
-	// quantity of registers (2 bytes per register)
-	req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, quantity)...)
-	// byte count
-	req.payload = append(req.payload, byte(payloadLength))
-	// registers value
-	req.payload = append(req.payload, values...)
-
-	// run the request across the transport and wait for a response
-	res, err = mc.executeRequest(req)
-	if err != nil {
-		return
-	}
+	return
+}
 
-	// validate the response code
-	switch {
-	case res.functionCode == req.functionCode:
-		// expect 4 bytes (2 byte of address + 2 bytes of quantity)
-		if len(res.payload) != 4 ||
-			// bytes 1-2 should be the base register address
-			bytesToUint16(BIG_ENDIAN, res.payload[0:2]) != addr ||
-			// bytes 3-4 should be the quantity of registers (2 bytes per register)
-			bytesToUint16(BIG_ENDIAN, res.payload[2:4]) != quantity {
-			err = ErrProtocolError
+// Notifies the transport failure, then reopens the transport with
+// exponential backoff until either it succeeds or stop is closed (by Open()
+// or Close()). Frames keep being recorded to capture, if set.
+func (mc *ModbusClient) reconnect(stop chan struct{}, capture *frameCapture) {
+	var t transport
+	var delay time.Duration
+	var err error
+
+	if mc.conf.OnStateChange != nil {
+		mc.conf.OnStateChange(STATE_DISCONNECTED)
+	}
+
+	delay = mc.conf.ReconnectMinDelay
+	for {
+		// add up to 50% of random jitter so that clients losing their
+		// connection at the same time don't all come back in lockstep
+		select {
+		case <-time.After(delay + time.Duration(rand.Int63n(int64(delay/2)+1))):
+		case <-stop:
 			return
 		}
 
-	case res.functionCode == (req.functionCode | 0x80):
-		if len(res.payload) != 1 {
-			err = ErrProtocolError
-			return
+		t, err = mc.openTransport(capture)
+		if err == nil {
+			break
 		}
 
-		err = mapExceptionCodeToError(res.payload[0])
+		mc.logger.Warningf("failed to reconnect: %v", err)
+
+		delay *= 2
+		if delay > mc.conf.ReconnectMaxDelay {
+			delay = mc.conf.ReconnectMaxDelay
+		}
+	}
 
+	// swap the new transport in, unless the client was closed or reopened
+	// in the meantime
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	select {
+	case <-stop:
+		t.Close()
+		return
 	default:
-		err = ErrProtocolError
-		mc.logger.Warningf("unexpected response code (%v)", res.functionCode)
 	}
 
+	mc.transport = t
+	mc.setState(STATE_CONNECTED)
+	mc.logger.Info("reconnected")
+
 	return
 }
 
-func (mc *ModbusClient) executeRequest(req *pdu) (res *pdu, err error) {
+// Runs a request across the transport.
+// The caller is expected to hold the client lock (see acquire()).
+func (mc *ModbusClient) executeRequest(ctx context.Context, req *pdu) (res *pdu, err error) {
+	var deadline time.Time
+	var ok bool
+
+	// don't bother sending the request if the context is already done
+	err = ctx.Err()
+	if err != nil {
+		return
+	}
+
+	// fail fast while the transport is being reopened
+	if mc.State() == STATE_DISCONNECTED {
+		err = ErrNotConnected
+		return
+	}
+
 	// send the request over the wire, wait for and decode the response
-	res, err = mc.transport.ExecuteRequest(req)
+	res, err = mc.transport.ExecuteRequest(ctx, req)
 	if err != nil {
+		// report cancellations and expired context deadlines as such
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
+
+		// the i/o deadline may expire slightly ahead of the context
+		// deadline it was derived from
+		deadline, ok = ctx.Deadline()
+		if ok && !time.Now().Before(deadline) {
+			err = context.DeadlineExceeded
+			return
+		}
+
 		// map i/o timeouts to ErrRequestTimedOut
 		if os.IsTimeout(err) {
 			err = ErrRequestTimedOut
 		}
+
+		// any error other than timeouts and modbus errors (e.g. bad CRC,
+		// protocol errors) means that the transport is unusable.
+		// without auto-reconnect, the transport is left as is and the
+		// next request goes through it regardless.
+		if _, ok = err.(Error); !ok && mc.conf.AutoReconnect {
+			mc.handleTransportFailure(mc.transport, err)
+		}
 		return
 	}
 
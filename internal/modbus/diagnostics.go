@@ -0,0 +1,278 @@
+package modbus
+
+import (
+	"sync"
+)
+
+const (
+	// communication event log entries (see the serial line diagnostics
+	// section of the modbus application protocol spec)
+	commEventRestart      uint8 = 0x00
+	commEventListenOnly   uint8 = 0x04
+	commEventReceive      uint8 = 0x80
+	commEventReceiveBcast uint8 = 0x40
+	commEventSend         uint8 = 0x40
+	commEventSendReadEx   uint8 = 0x01
+	commEventSendAbortEx  uint8 = 0x02
+	commEventSendBusyEx   uint8 = 0x04
+	commEventSendNAKEx    uint8 = 0x08
+	// listen only mode flag, valid for both receive and send events
+	commEventInListenOnly uint8 = 0x20
+)
+
+// Serial line diagnostics object, holding the counters, communication event
+// log and listen only mode state of an RTU server.
+// Bus level counters are updated by the transport, server level counters by
+// the server as it processes requests.
+type serialDiagnostics struct {
+	lock                     sync.Mutex
+	listenOnly               bool
+	diagnosticRegister       uint16
+	busMessageCount          uint16
+	busCommErrorCount        uint16
+	busExceptionErrorCount   uint16
+	serverMessageCount       uint16
+	serverNoResponseCount    uint16
+	serverNAKCount           uint16
+	serverBusyCount          uint16
+	busCharacterOverrunCount uint16
+	commEventCounter         uint16
+	// most recent event first
+	commEventLog []byte
+}
+
+// Counts a frame detected on the bus, regardless of its unit id.
+func (sd *serialDiagnostics) countBusMessage() {
+	sd.lock.Lock()
+	sd.busMessageCount++
+	sd.lock.Unlock()
+
+	return
+}
+
+// Counts a frame received with a bad CRC.
+func (sd *serialDiagnostics) countBusCommError() {
+	sd.lock.Lock()
+	sd.busCommErrorCount++
+	sd.lock.Unlock()
+
+	return
+}
+
+// Counts a frame too long to fit in the receive buffer.
+func (sd *serialDiagnostics) countBusCharacterOverrun() {
+	sd.lock.Lock()
+	sd.busCharacterOverrunCount++
+	sd.lock.Unlock()
+
+	return
+}
+
+// Records a request addressed to the server.
+// Returns false if the request must be ignored, i.e. if the server is in
+// listen only mode and the request does not take it out of it.
+func (sd *serialDiagnostics) receive(req *pdu) (process bool) {
+	var event uint8 = commEventReceive
+
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+
+	sd.serverMessageCount++
+
+	if req.unitId == 0 {
+		event |= commEventReceiveBcast
+	}
+	if sd.listenOnly {
+		event |= commEventInListenOnly
+	}
+	sd.logEvent(event)
+
+	// only the restart communications option sub-function ends listen
+	// only mode
+	process = !sd.listenOnly ||
+		(req.functionCode == fcDiagnostics && len(req.payload) == 4 &&
+			bytesToUint16(BIG_ENDIAN, req.payload[0:2]) == uint16(DIAG_RESTART_COMMUNICATIONS))
+
+	if !process {
+		sd.serverNoResponseCount++
+	}
+
+	return
+}
+
+// Records the outcome of a request addressed to the server.
+// res is nil if no response was sent back to the client.
+func (sd *serialDiagnostics) respond(req *pdu, res *pdu) {
+	var event uint8 = commEventSend
+	var exceptionCode uint8
+
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+
+	if res == nil {
+		sd.serverNoResponseCount++
+	}
+
+	if res != nil && res.functionCode&0x80 != 0 && len(res.payload) == 1 {
+		exceptionCode = res.payload[0]
+		sd.busExceptionErrorCount++
+
+		switch exceptionCode {
+		case exIllegalFunction, exIllegalDataAddress, exIllegalDataValue:
+			event |= commEventSendReadEx
+		case exServerDeviceFailure:
+			event |= commEventSendAbortEx
+		case exAcknowledge, exServerDeviceBusy:
+			event |= commEventSendBusyEx
+		case exNegativeAcknowledge:
+			event |= commEventSendNAKEx
+		}
+
+		if exceptionCode == exServerDeviceBusy {
+			sd.serverBusyCount++
+		}
+		if exceptionCode == exNegativeAcknowledge {
+			sd.serverNAKCount++
+		}
+	}
+
+	// the event counter covers successfully completed requests, except for
+	// the event counter and event log fetches themselves
+	if exceptionCode == 0 &&
+		req.functionCode != fcGetCommEventCounter &&
+		req.functionCode != fcGetCommEventLog {
+		sd.commEventCounter++
+	}
+
+	if sd.listenOnly {
+		event |= commEventInListenOnly
+	}
+	sd.logEvent(event)
+
+	return
+}
+
+// Restarts communications: leaves listen only mode and clears all counters,
+// as well as the event log if clearLog is true.
+// Returns true if the server was in listen only mode.
+func (sd *serialDiagnostics) restart(clearLog bool) (wasListenOnly bool) {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+
+	wasListenOnly = sd.listenOnly
+	sd.listenOnly = false
+	sd.clearCounters()
+	sd.commEventCounter = 0
+
+	if clearLog {
+		sd.commEventLog = nil
+	}
+	sd.logEvent(commEventRestart)
+
+	return
+}
+
+// Enters listen only mode.
+func (sd *serialDiagnostics) enterListenOnly() {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+
+	sd.listenOnly = true
+	sd.logEvent(commEventListenOnly)
+
+	return
+}
+
+// Clears all counters and the diagnostic register.
+func (sd *serialDiagnostics) clear() {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+
+	sd.clearCounters()
+
+	return
+}
+
+// Clears the character overrun counter.
+func (sd *serialDiagnostics) clearOverrun() {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+
+	sd.busCharacterOverrunCount = 0
+
+	return
+}
+
+// Returns the value of the diagnostic register or counter selected by
+// subFunction. ok is false if subFunction does not select a counter.
+func (sd *serialDiagnostics) counter(subFunction DiagnosticSubFunction) (value uint16, ok bool) {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+
+	ok = true
+
+	switch subFunction {
+	case DIAG_RETURN_DIAGNOSTIC_REGISTER:
+		value = sd.diagnosticRegister
+	case DIAG_BUS_MESSAGE_COUNT:
+		value = sd.busMessageCount
+	case DIAG_BUS_COMM_ERROR_COUNT:
+		value = sd.busCommErrorCount
+	case DIAG_BUS_EXCEPTION_ERROR_COUNT:
+		value = sd.busExceptionErrorCount
+	case DIAG_SERVER_MESSAGE_COUNT:
+		value = sd.serverMessageCount
+	case DIAG_SERVER_NO_RESPONSE_COUNT:
+		value = sd.serverNoResponseCount
+	case DIAG_SERVER_NAK_COUNT:
+		value = sd.serverNAKCount
+	case DIAG_SERVER_BUSY_COUNT:
+		value = sd.serverBusyCount
+	case DIAG_BUS_CHARACTER_OVERRUN_COUNT:
+		value = sd.busCharacterOverrunCount
+	default:
+		ok = false
+	}
+
+	return
+}
+
+// Returns the communication event counter and a copy of the event log,
+// most recent event first.
+func (sd *serialDiagnostics) events() (eventCount uint16, messageCount uint16, events []byte) {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+
+	eventCount = sd.commEventCounter
+	messageCount = sd.busMessageCount
+	events = append([]byte{}, sd.commEventLog...)
+
+	return
+}
+
+// Adds an event to the head of the event log, dropping the oldest event
+// if the log is full. Must be called with the lock held.
+func (sd *serialDiagnostics) logEvent(event uint8) {
+	sd.commEventLog = append([]byte{event}, sd.commEventLog...)
+	if len(sd.commEventLog) > maxCommEventLogLength {
+		sd.commEventLog = sd.commEventLog[:maxCommEventLogLength]
+	}
+
+	return
+}
+
+// Clears all counters but the event counter. Must be called with the
+// lock held.
+func (sd *serialDiagnostics) clearCounters() {
+	sd.diagnosticRegister = 0
+	sd.busMessageCount = 0
+	sd.busCommErrorCount = 0
+	sd.busExceptionErrorCount = 0
+	sd.serverMessageCount = 0
+	sd.serverNoResponseCount = 0
+	sd.serverNAKCount = 0
+	sd.serverBusyCount = 0
+	sd.busCharacterOverrunCount = 0
+
+	return
+}
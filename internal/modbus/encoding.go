@@ -3,6 +3,7 @@ package modbus
 import (
 	"encoding/binary"
 	"math"
+	"strings"
 )
 
 func uint16ToBytes(endianness Endianness, in uint16) (out []byte) {
@@ -184,6 +185,130 @@ func float64ToBytes(endianness Endianness, wordOrder WordOrder, in float64) (out
 	return
 }
 
+func bytesToInt16s(endianness Endianness, in []byte) (out []int16) {
+	for _, u16 := range bytesToUint16s(endianness, in) {
+		out = append(out, int16(u16))
+	}
+
+	return
+}
+
+func int16ToBytes(endianness Endianness, in int16) (out []byte) {
+	out = uint16ToBytes(endianness, uint16(in))
+
+	return
+}
+
+func bytesToInt32s(endianness Endianness, wordOrder WordOrder, in []byte) (out []int32) {
+	for _, u32 := range bytesToUint32s(endianness, wordOrder, in) {
+		out = append(out, int32(u32))
+	}
+
+	return
+}
+
+func int32ToBytes(endianness Endianness, wordOrder WordOrder, in int32) (out []byte) {
+	out = uint32ToBytes(endianness, wordOrder, uint32(in))
+
+	return
+}
+
+func bytesToInt64s(endianness Endianness, wordOrder WordOrder, in []byte) (out []int64) {
+	for _, u64 := range bytesToUint64s(endianness, wordOrder, in) {
+		out = append(out, int64(u64))
+	}
+
+	return
+}
+
+func int64ToBytes(endianness Endianness, wordOrder WordOrder, in int64) (out []byte) {
+	out = uint64ToBytes(endianness, wordOrder, uint64(in))
+
+	return
+}
+
+// Decodes registers as an ASCII string, two characters per register, first
+// character in the high byte (or in the low byte with LITTLE_ENDIAN).
+// Trailing null bytes and spaces, commonly used as padding, are dropped.
+func bytesToString(endianness Endianness, in []byte) (out string) {
+	var buf []byte
+
+	buf = uint16sToBytes(BIG_ENDIAN, bytesToUint16s(endianness, in))
+	out = strings.TrimRight(string(buf), "\x00 ")
+
+	return
+}
+
+// Encodes in as an ASCII string spanning quantity registers, padded with
+// null bytes. Returns ErrUnexpectedParameters if in does not fit.
+func stringToBytes(endianness Endianness, in string, quantity uint16) (out []byte, err error) {
+	if len(in) > 2*int(quantity) {
+		err = ErrUnexpectedParameters
+		return
+	}
+
+	out = make([]byte, 2*int(quantity))
+	copy(out, in)
+	out = uint16sToBytes(endianness, bytesToUint16s(BIG_ENDIAN, out))
+
+	return
+}
+
+// Decodes registers as packed BCD, four digits per register, most
+// significant digits first (or last with LOW_WORD_FIRST).
+// Returns ErrBadBCD if any nibble is not a decimal digit.
+func bytesToBCD(endianness Endianness, wordOrder WordOrder, in []byte) (out uint64, err error) {
+	var regs []uint16
+	var digit uint16
+
+	regs = bytesToUint16s(endianness, in)
+	if wordOrder == LOW_WORD_FIRST {
+		for i, j := 0, len(regs)-1; i < j; i, j = i+1, j-1 {
+			regs[i], regs[j] = regs[j], regs[i]
+		}
+	}
+
+	for _, reg := range regs {
+		for shift := 12; shift >= 0; shift -= 4 {
+			digit = (reg >> shift) & 0x0f
+			if digit > 9 {
+				err = ErrBadBCD
+				return
+			}
+			out = out*10 + uint64(digit)
+		}
+	}
+
+	return
+}
+
+// Encodes in as packed BCD spanning quantity registers.
+// Returns ErrUnexpectedParameters if in does not fit.
+func bcdToBytes(endianness Endianness, wordOrder WordOrder, in uint64, quantity uint16) (out []byte, err error) {
+	var regs []uint16
+
+	regs = make([]uint16, quantity)
+	for i := len(regs) - 1; i >= 0; i-- {
+		for shift := 0; shift <= 12; shift += 4 {
+			regs[i] |= uint16(in%10) << shift
+			in /= 10
+		}
+	}
+	if in != 0 {
+		err = ErrUnexpectedParameters
+		return
+	}
+
+	if wordOrder == LOW_WORD_FIRST {
+		for i, j := 0, len(regs)-1; i < j; i, j = i+1, j-1 {
+			regs[i], regs[j] = regs[j], regs[i]
+		}
+	}
+	out = uint16sToBytes(endianness, regs)
+
+	return
+}
+
 func encodeBools(in []bool) (out []byte) {
 	var byteCount uint
 	var i uint
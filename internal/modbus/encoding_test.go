@@ -608,3 +608,156 @@ func TestEncodeBools(t *testing.T) {
 
 	return
 }
+
+func TestBytesToInt16s(t *testing.T) {
+	var results []int16
+
+	results = bytesToInt16s(BIG_ENDIAN, []byte{0xff, 0xfe, 0x00, 0x02})
+	if len(results) != 2 {
+		t.Errorf("expected 2 values, got %v", len(results))
+	}
+	if results[0] != -2 || results[1] != 2 {
+		t.Errorf("expected {-2, 2}, got %v", results)
+	}
+
+	results = bytesToInt16s(LITTLE_ENDIAN, []byte{0xfe, 0xff, 0x02, 0x00})
+	if len(results) != 2 {
+		t.Errorf("expected 2 values, got %v", len(results))
+	}
+	if results[0] != -2 || results[1] != 2 {
+		t.Errorf("expected {-2, 2}, got %v", results)
+	}
+
+	return
+}
+
+func TestInt32ToBytes(t *testing.T) {
+	var out []byte
+	var results []int32
+
+	out = int32ToBytes(BIG_ENDIAN, HIGH_WORD_FIRST, -2)
+	if len(out) != 4 {
+		t.Errorf("expected 4 bytes, got %v", len(out))
+	}
+	if out[0] != 0xff || out[1] != 0xff || out[2] != 0xff || out[3] != 0xfe {
+		t.Errorf("expected {0xff, 0xff, 0xff, 0xfe}, got {0x%02x, 0x%02x, 0x%02x, 0x%02x}",
+			out[0], out[1], out[2], out[3])
+	}
+
+	out = int32ToBytes(BIG_ENDIAN, LOW_WORD_FIRST, -50000)
+	results = bytesToInt32s(BIG_ENDIAN, LOW_WORD_FIRST, out)
+	if len(results) != 1 || results[0] != -50000 {
+		t.Errorf("expected {-50000}, got %v", results)
+	}
+	results = bytesToInt32s(BIG_ENDIAN, HIGH_WORD_FIRST, out)
+	if len(results) != 1 || results[0] == -50000 {
+		t.Errorf("expected word order to matter, got %v", results)
+	}
+
+	return
+}
+
+func TestInt64ToBytes(t *testing.T) {
+	var out []byte
+	var results []int64
+
+	out = int64ToBytes(LITTLE_ENDIAN, HIGH_WORD_FIRST, -1234567890123)
+	if len(out) != 8 {
+		t.Errorf("expected 8 bytes, got %v", len(out))
+	}
+	results = bytesToInt64s(LITTLE_ENDIAN, HIGH_WORD_FIRST, out)
+	if len(results) != 1 || results[0] != -1234567890123 {
+		t.Errorf("expected {-1234567890123}, got %v", results)
+	}
+
+	return
+}
+
+func TestStringToBytes(t *testing.T) {
+	var out []byte
+	var err error
+
+	out, err = stringToBytes(BIG_ENDIAN, "SN123", 4)
+	if err != nil {
+		t.Errorf("stringToBytes() should have succeeded, got: %v", err)
+	}
+	if string(out) != "SN123\x00\x00\x00" {
+		t.Errorf("expected 'SN123\\x00\\x00\\x00', got: %q", out)
+	}
+	if bytesToString(BIG_ENDIAN, out) != "SN123" {
+		t.Errorf("expected 'SN123', got: %q", bytesToString(BIG_ENDIAN, out))
+	}
+
+	out, err = stringToBytes(LITTLE_ENDIAN, "SN123", 3)
+	if err != nil {
+		t.Errorf("stringToBytes() should have succeeded, got: %v", err)
+	}
+	if string(out) != "NS21\x003" {
+		t.Errorf("expected 'NS21\\x003', got: %q", out)
+	}
+	if bytesToString(LITTLE_ENDIAN, out) != "SN123" {
+		t.Errorf("expected 'SN123', got: %q", bytesToString(LITTLE_ENDIAN, out))
+	}
+
+	// trailing spaces are padding too
+	if bytesToString(BIG_ENDIAN, []byte("v1.2  ")) != "v1.2" {
+		t.Errorf("expected 'v1.2', got: %q", bytesToString(BIG_ENDIAN, []byte("v1.2  ")))
+	}
+
+	_, err = stringToBytes(BIG_ENDIAN, "SN123", 2)
+	if err != ErrUnexpectedParameters {
+		t.Errorf("stringToBytes() should have failed with ErrUnexpectedParameters, got: %v", err)
+	}
+
+	return
+}
+
+func TestBCDToBytes(t *testing.T) {
+	var out []byte
+	var result uint64
+	var err error
+
+	out, err = bcdToBytes(BIG_ENDIAN, HIGH_WORD_FIRST, 12345678, 2)
+	if err != nil {
+		t.Errorf("bcdToBytes() should have succeeded, got: %v", err)
+	}
+	if len(out) != 4 || out[0] != 0x12 || out[1] != 0x34 || out[2] != 0x56 || out[3] != 0x78 {
+		t.Errorf("expected {0x12, 0x34, 0x56, 0x78}, got: %v", out)
+	}
+
+	out, err = bcdToBytes(BIG_ENDIAN, LOW_WORD_FIRST, 12345678, 2)
+	if err != nil {
+		t.Errorf("bcdToBytes() should have succeeded, got: %v", err)
+	}
+	if len(out) != 4 || out[0] != 0x56 || out[1] != 0x78 || out[2] != 0x12 || out[3] != 0x34 {
+		t.Errorf("expected {0x56, 0x78, 0x12, 0x34}, got: %v", out)
+	}
+
+	result, err = bytesToBCD(BIG_ENDIAN, LOW_WORD_FIRST, out)
+	if err != nil {
+		t.Errorf("bytesToBCD() should have succeeded, got: %v", err)
+	}
+	if result != 12345678 {
+		t.Errorf("expected 12345678, got: %v", result)
+	}
+
+	result, err = bytesToBCD(LITTLE_ENDIAN, HIGH_WORD_FIRST, []byte{0x99, 0x00})
+	if err != nil {
+		t.Errorf("bytesToBCD() should have succeeded, got: %v", err)
+	}
+	if result != 99 {
+		t.Errorf("expected 99, got: %v", result)
+	}
+
+	_, err = bytesToBCD(BIG_ENDIAN, HIGH_WORD_FIRST, []byte{0x12, 0x3a})
+	if err != ErrBadBCD {
+		t.Errorf("bytesToBCD() should have failed with ErrBadBCD, got: %v", err)
+	}
+
+	_, err = bcdToBytes(BIG_ENDIAN, HIGH_WORD_FIRST, 12345, 1)
+	if err != ErrUnexpectedParameters {
+		t.Errorf("bcdToBytes() should have failed with ErrUnexpectedParameters, got: %v", err)
+	}
+
+	return
+}
@@ -0,0 +1,196 @@
+package modbus
+
+import (
+	"context"
+	"log"
+)
+
+// Gateway route object, mapping a range of unit ids to a downstream client.
+type GatewayRoute struct {
+	// FirstUnitId and LastUnitId set the (inclusive) range of unit ids
+	// routed to Client
+	FirstUnitId uint8
+	LastUnitId  uint8
+	// Client is the downstream client requests are forwarded to.
+	// It should be open and left with the default (big endian) encoding,
+	// as register values are forwarded as-is.
+	Client *ModbusClient
+}
+
+// Gateway configuration object.
+type GatewayConfiguration struct {
+	// Routes sets the unit id to downstream client mapping. Unit id ranges
+	// must not overlap.
+	Routes []GatewayRoute
+	// Logger provides a custom sink for log messages.
+	// If nil, messages will be written to stdout.
+	Logger *log.Logger
+}
+
+// Modbus gateway object.
+// The gateway implements the RequestHandler interface: once passed to
+// NewServer(), every incoming request is forwarded to the downstream client
+// matching its unit id, allowing e.g. multiple modbus/TCP clients to share
+// a single serial bus.
+// Writes are forwarded with the write multiple coils and write multiple
+// registers function codes (0x0f and 0x10), including those which came in
+// as single coil or single register writes (0x05 and 0x06).
+type Gateway struct {
+	conf   GatewayConfiguration
+	logger *logger
+}
+
+// NewGateway creates, configures and returns a modbus gateway object.
+func NewGateway(conf *GatewayConfiguration) (gw *Gateway, err error) {
+	gw = &Gateway{
+		conf:   *conf,
+		logger: newLogger("modbus-gateway", conf.Logger),
+	}
+
+	for i, route := range gw.conf.Routes {
+		if route.Client == nil {
+			gw.logger.Errorf("missing client for route #%v", i)
+			err = ErrConfigurationError
+			return
+		}
+
+		if route.FirstUnitId > route.LastUnitId {
+			gw.logger.Errorf("invalid unit id range %v-%v",
+				route.FirstUnitId, route.LastUnitId)
+			err = ErrConfigurationError
+			return
+		}
+
+		// make sure no unit id is routed twice
+		for _, other := range gw.conf.Routes[:i] {
+			if route.FirstUnitId <= other.LastUnitId &&
+				other.FirstUnitId <= route.LastUnitId {
+				gw.logger.Errorf("unit id range %v-%v overlaps with %v-%v",
+					route.FirstUnitId, route.LastUnitId,
+					other.FirstUnitId, other.LastUnitId)
+				err = ErrConfigurationError
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// Forwards coil requests (function codes 0x01, 0x05 and 0x0f).
+func (gw *Gateway) HandleCoils(req *CoilsRequest) (res []bool, err error) {
+	var unit *ModbusUnit
+
+	unit, err = gw.route(req.UnitId)
+	if err != nil {
+		return
+	}
+
+	// the request doesn't tell whether writes came in as 0x05 or 0x0f:
+	// forward them all as 0x0f, which covers single coils as well
+	if req.IsWrite {
+		err = unit.WriteCoils(context.Background(), req.Addr, req.Args)
+	} else {
+		res, err = unit.ReadCoils(context.Background(), req.Addr, req.Quantity)
+	}
+
+	err = gw.mapError(req.UnitId, err)
+
+	return
+}
+
+// Forwards discrete input requests (function code 0x02).
+func (gw *Gateway) HandleDiscreteInputs(req *DiscreteInputsRequest) (res []bool, err error) {
+	var unit *ModbusUnit
+
+	unit, err = gw.route(req.UnitId)
+	if err != nil {
+		return
+	}
+
+	res, err = unit.ReadDiscreteInputs(context.Background(), req.Addr, req.Quantity)
+	err = gw.mapError(req.UnitId, err)
+
+	return
+}
+
+// Forwards holding register requests (function codes 0x03, 0x06 and 0x10).
+func (gw *Gateway) HandleHoldingRegisters(req *HoldingRegistersRequest) (res []uint16, err error) {
+	var unit *ModbusUnit
+
+	unit, err = gw.route(req.UnitId)
+	if err != nil {
+		return
+	}
+
+	// writes are forwarded as 0x10, whether they came in as 0x06 or 0x10
+	// (see HandleCoils())
+	if req.IsWrite {
+		err = unit.WriteRegisters(context.Background(), req.Addr, req.Args)
+	} else {
+		res, err = unit.ReadRegisters(context.Background(), req.Addr, req.Quantity, HOLDING_REGISTER)
+	}
+
+	err = gw.mapError(req.UnitId, err)
+
+	return
+}
+
+// Forwards input register requests (function code 0x04).
+func (gw *Gateway) HandleInputRegisters(req *InputRegistersRequest) (res []uint16, err error) {
+	var unit *ModbusUnit
+
+	unit, err = gw.route(req.UnitId)
+	if err != nil {
+		return
+	}
+
+	res, err = unit.ReadRegisters(context.Background(), req.Addr, req.Quantity, INPUT_REGISTER)
+	err = gw.mapError(req.UnitId, err)
+
+	return
+}
+
+// Returns a handle to unitId on the downstream client serving it.
+// Returns ErrGWPathUnavailable if no route matches the unit id.
+func (gw *Gateway) route(unitId uint8) (unit *ModbusUnit, err error) {
+	for _, route := range gw.conf.Routes {
+		if unitId >= route.FirstUnitId && unitId <= route.LastUnitId {
+			unit = route.Client.Unit(unitId)
+			return
+		}
+	}
+
+	gw.logger.Warningf("no route to unit id %v", unitId)
+	err = ErrGWPathUnavailable
+
+	return
+}
+
+// Maps errors returned by downstream clients to errors suitable for
+// the upstream client.
+// Modbus exceptions are passed through as-is, while timeouts and transport
+// errors are reported as ErrGWTargetFailedToRespond.
+func (gw *Gateway) mapError(unitId uint8, in error) (out error) {
+	switch in {
+	case nil,
+		ErrIllegalFunction,
+		ErrIllegalDataAddress,
+		ErrIllegalDataValue,
+		ErrServerDeviceFailure,
+		ErrAcknowledge,
+		ErrServerDeviceBusy,
+		ErrMemoryParityError,
+		ErrGWPathUnavailable,
+		ErrGWTargetFailedToRespond:
+		out = in
+	case ErrUnexpectedParameters:
+		// the request could not be forwarded as is (e.g. too many registers)
+		out = ErrIllegalDataValue
+	default:
+		gw.logger.Warningf("unit id %v failed to respond: %v", unitId, in)
+		out = ErrGWTargetFailedToRespond
+	}
+
+	return
+}
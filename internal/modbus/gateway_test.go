@@ -0,0 +1,273 @@
+package modbus
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewGateway(t *testing.T) {
+	var err error
+	var client *ModbusClient
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "tcp://localhost:5502",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	// overlapping ranges should be rejected
+	_, err = NewGateway(&GatewayConfiguration{
+		Routes: []GatewayRoute{
+			{FirstUnitId: 1, LastUnitId: 10, Client: client},
+			{FirstUnitId: 10, LastUnitId: 20, Client: client},
+		},
+	})
+	if err != ErrConfigurationError {
+		t.Errorf("NewGateway() should have failed with ErrConfigurationError, got: %v", err)
+	}
+
+	// so should inverted ranges
+	_, err = NewGateway(&GatewayConfiguration{
+		Routes: []GatewayRoute{
+			{FirstUnitId: 10, LastUnitId: 1, Client: client},
+		},
+	})
+	if err != ErrConfigurationError {
+		t.Errorf("NewGateway() should have failed with ErrConfigurationError, got: %v", err)
+	}
+
+	// and routes without a client
+	_, err = NewGateway(&GatewayConfiguration{
+		Routes: []GatewayRoute{
+			{FirstUnitId: 1, LastUnitId: 1},
+		},
+	})
+	if err != ErrConfigurationError {
+		t.Errorf("NewGateway() should have failed with ErrConfigurationError, got: %v", err)
+	}
+
+	_, err = NewGateway(&GatewayConfiguration{
+		Routes: []GatewayRoute{
+			{FirstUnitId: 1, LastUnitId: 10, Client: client},
+			{FirstUnitId: 11, LastUnitId: 20, Client: client},
+		},
+	})
+	if err != nil {
+		t.Errorf("NewGateway() should have succeeded, got: %v", err)
+	}
+
+	return
+}
+
+func TestGatewayRouting(t *testing.T) {
+	var err error
+	var server *ModbusServer
+	var silentListener net.Listener
+	var c1 *ModbusClient
+	var c2 *ModbusClient
+	var gw *Gateway
+	var th *tcpTestHandler
+	var regs []uint16
+	var coils []bool
+	var capture string
+	var trace *frameTrace
+
+	// start a downstream server answering to unit id #9
+	th = &tcpTestHandler{}
+	th.input[1] = 0x1122
+	server, err = NewServer(&ServerConfiguration{
+		URL: "tcp://localhost:5502",
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	// start a downstream listener which never answers
+	silentListener, err = net.Listen("tcp", "localhost:5503")
+	if err != nil {
+		t.Errorf("failed to listen: %v", err)
+		return
+	}
+	defer silentListener.Close()
+	go func() {
+		var socks []net.Conn
+
+		for {
+			sock, err := silentListener.Accept()
+			if err != nil {
+				break
+			}
+			// hold on to the connection without ever replying
+			socks = append(socks, sock)
+		}
+
+		for _, sock := range socks {
+			sock.Close()
+		}
+	}()
+
+	// record the frames sent downstream
+	capture = filepath.Join(t.TempDir(), "downstream.jsonl")
+	c1, err = NewClient(&ClientConfiguration{
+		URL:     "tcp://localhost:5502",
+		Capture: capture,
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+	err = c1.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer c1.Close()
+
+	c2, err = NewClient(&ClientConfiguration{
+		URL:     "tcp://localhost:5503",
+		Timeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+	err = c2.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer c2.Close()
+
+	gw, err = NewGateway(&GatewayConfiguration{
+		Routes: []GatewayRoute{
+			{FirstUnitId: 1, LastUnitId: 10, Client: c1},
+			{FirstUnitId: 100, LastUnitId: 100, Client: c2},
+		},
+	})
+	if err != nil {
+		t.Errorf("NewGateway() should have succeeded, got: %v", err)
+		return
+	}
+
+	// requests to unit #9 should be forwarded to the downstream server
+	regs, err = gw.HandleInputRegisters(&InputRegistersRequest{
+		UnitId:   9,
+		Addr:     1,
+		Quantity: 1,
+	})
+	if err != nil {
+		t.Errorf("HandleInputRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 1 || regs[0] != 0x1122 {
+		t.Errorf("expected {0x1122}, got: %v", regs)
+	}
+
+	_, err = gw.HandleHoldingRegisters(&HoldingRegistersRequest{
+		UnitId:   9,
+		Addr:     2,
+		Quantity: 2,
+		IsWrite:  true,
+		Args:     []uint16{0x3344, 0x5566},
+	})
+	if err != nil {
+		t.Errorf("HandleHoldingRegisters() should have succeeded, got: %v", err)
+	}
+	if th.holding[2] != 0x3344 || th.holding[3] != 0x5566 {
+		t.Errorf("expected {0x3344, 0x5566}, got: %v", th.holding[2:4])
+	}
+
+	_, err = gw.HandleCoils(&CoilsRequest{
+		UnitId:   9,
+		Addr:     4,
+		Quantity: 1,
+		IsWrite:  true,
+		Args:     []bool{true},
+	})
+	if err != nil {
+		t.Errorf("HandleCoils() should have succeeded, got: %v", err)
+	}
+	_, err = gw.HandleHoldingRegisters(&HoldingRegistersRequest{
+		UnitId:   9,
+		Addr:     5,
+		Quantity: 1,
+		IsWrite:  true,
+		Args:     []uint16{0x7788},
+	})
+	if err != nil {
+		t.Errorf("HandleHoldingRegisters() should have succeeded, got: %v", err)
+	}
+	if th.holding[5] != 0x7788 {
+		t.Errorf("expected 0x7788, got: 0x%04x", th.holding[5])
+	}
+
+	// handlers can't tell single writes (0x05 and 0x06) from multiple
+	// writes of a single value: all writes should go out as 0x0f and 0x10
+	trace, err = loadTrace(capture)
+	if err != nil {
+		t.Fatalf("loadTrace() should have succeeded, got: %v", err)
+	}
+	if len(trace.frames) != 8 {
+		t.Fatalf("expected 8 frames, got: %v", len(trace.frames))
+	}
+	for i, fc := range []uint8{fcWriteMultipleRegisters, fcWriteMultipleCoils, fcWriteMultipleRegisters} {
+		if trace.frames[2+2*i].adu[7] != fc {
+			t.Errorf("expected function code 0x%02x for write #%v, got: 0x%02x",
+				fc, i, trace.frames[2+2*i].adu[7])
+		}
+	}
+
+	coils, err = gw.HandleCoils(&CoilsRequest{
+		UnitId:   9,
+		Addr:     3,
+		Quantity: 2,
+	})
+	if err != nil {
+		t.Errorf("HandleCoils() should have succeeded, got: %v", err)
+	}
+	if len(coils) != 2 || coils[0] || !coils[1] {
+		t.Errorf("expected {false, true}, got: %v", coils)
+	}
+
+	// exceptions returned by the downstream device should be passed through
+	_, err = gw.HandleDiscreteInputs(&DiscreteInputsRequest{
+		UnitId:   9,
+		Addr:     9,
+		Quantity: 2,
+	})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("HandleDiscreteInputs() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// downstream timeouts should map to ErrGWTargetFailedToRespond
+	_, err = gw.HandleInputRegisters(&InputRegistersRequest{
+		UnitId:   100,
+		Addr:     1,
+		Quantity: 1,
+	})
+	if err != ErrGWTargetFailedToRespond {
+		t.Errorf("HandleInputRegisters() should have returned ErrGWTargetFailedToRespond, got: %v", err)
+	}
+
+	// unknown unit ids should map to ErrGWPathUnavailable
+	_, err = gw.HandleInputRegisters(&InputRegistersRequest{
+		UnitId:   11,
+		Addr:     1,
+		Quantity: 1,
+	})
+	if err != ErrGWPathUnavailable {
+		t.Errorf("HandleInputRegisters() should have returned ErrGWPathUnavailable, got: %v", err)
+	}
+
+	return
+}
@@ -0,0 +1,34 @@
+package modbus
+
+type lrc struct {
+	lrc uint8
+}
+
+// Prepares the LRC generator for use.
+func (l *lrc) init() {
+	l.lrc = 0
+
+	return
+}
+
+// Adds the given bytes to the LRC.
+func (l *lrc) add(in []byte) {
+	for _, b := range in {
+		l.lrc += b
+	}
+
+	return
+}
+
+// Returns the LRC, i.e. the two's complement of the sum of all bytes added.
+func (l *lrc) value() (value byte) {
+	value = ^l.lrc + 1
+
+	return
+}
+
+func (l *lrc) isEqual(in byte) (yes bool) {
+	yes = (in == l.value())
+
+	return
+}
@@ -0,0 +1,37 @@
+package modbus
+
+import (
+	"testing"
+)
+
+func TestLRC(t *testing.T) {
+	var l lrc
+
+	// initialize the LRC object and make sure we get 0x00 as init value
+	l.init()
+	if l.value() != 0x00 {
+		t.Errorf("expected 0x00, saw 0x%02x", l.value())
+	}
+
+	// add a few bytes (read holding registers request), check the output
+	l.add([]byte{0x01, 0x03, 0x00, 0x6b, 0x00, 0x03})
+	if l.value() != 0x8e {
+		t.Errorf("expected 0x8e, saw 0x%02x", l.value())
+	}
+
+	if !l.isEqual(0x8e) {
+		t.Errorf("isEqual() should have returned true")
+	}
+
+	// add one extra byte, causing the sum to wrap around
+	l.add([]byte{0xf0})
+	if l.value() != 0x9e {
+		t.Errorf("expected 0x9e, saw 0x%02x", l.value())
+	}
+
+	if l.isEqual(0x8e) {
+		t.Errorf("isEqual() should have returned false")
+	}
+
+	return
+}
@@ -36,10 +36,42 @@ const (
 	fcReadWriteMultipleRegisters uint8 = 0x17
 	fcReadFifoQueue              uint8 = 0x18
 
+	// max. number of registers covered by a single read request
+	maxReadRegisterCount uint16 = 0x7d
+
 	// file access
 	fcReadFileRecord  uint8 = 0x14
 	fcWriteFileRecord uint8 = 0x15
 
+	// file record sub-request reference type (always 6)
+	fileRecordReferenceType uint8 = 0x06
+	// max. record number within a file
+	maxFileRecordNumber uint16 = 0x270f
+	// max. byte count of read file record requests and responses
+	maxFileRecordByteCount int = 0xf5
+	// max. request data length of write file record requests
+	maxFileRecordWriteByteCount int = 0xfb
+	// max. number of values returned by a FIFO queue read
+	maxFifoCount int = 31
+
+	// diagnostics (serial line only)
+	fcReadExceptionStatus uint8 = 0x07
+	fcDiagnostics         uint8 = 0x08
+	fcGetCommEventCounter uint8 = 0x0b
+	fcGetCommEventLog     uint8 = 0x0c
+	fcReportServerId      uint8 = 0x11
+
+	// max. number of events held in the communication event log
+	maxCommEventLogLength int = 64
+
+	// encapsulated interface transport
+	fcEncapsulatedInterface     uint8 = 0x2b
+	meiReadDeviceIdentification uint8 = 0x0e
+
+	// max. length of the object list of a read device identification response
+	// (253 bytes of PDU, minus 7 bytes of function code and response header)
+	maxDeviceIdObjectListLength int = 246
+
 	// exception codes
 	exIllegalFunction         uint8 = 0x01
 	exIllegalDataAddress      uint8 = 0x02
@@ -47,6 +79,7 @@ const (
 	exServerDeviceFailure     uint8 = 0x04
 	exAcknowledge             uint8 = 0x05
 	exServerDeviceBusy        uint8 = 0x06
+	exNegativeAcknowledge     uint8 = 0x07
 	exMemoryParityError       uint8 = 0x08
 	exGWPathUnavailable       uint8 = 0x0a
 	exGWTargetFailedToRespond uint8 = 0x0b
@@ -64,12 +97,19 @@ const (
 	ErrGWPathUnavailable       Error = "gateway path unavailable"
 	ErrGWTargetFailedToRespond Error = "gateway target device failed to respond"
 	ErrBadCRC                  Error = "bad crc"
+	ErrBadLRC                  Error = "bad lrc"
+	ErrBadBCD                  Error = "bad bcd value"
 	ErrShortFrame              Error = "short frame"
 	ErrProtocolError           Error = "protocol error"
 	ErrBadUnitId               Error = "bad unit id"
 	ErrBadTransactionId        Error = "bad transaction id"
 	ErrUnknownProtocolId       Error = "unknown protocol identifier"
 	ErrUnexpectedParameters    Error = "unexpected parameters"
+	ErrNotConnected            Error = "not connected"
+	ErrReplayMismatch          Error = "replay mismatch"
+
+	// returned by request handling code when the request must not be answered
+	errNoResponse Error = "no response"
 )
 
 // mapExceptionCodeToError turns a modbus exception code into a higher level Error object.
@@ -0,0 +1,298 @@
+package modbus
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Read planner configuration object.
+type ReadPlannerConfiguration struct {
+	// MaxGap sets the maximum number of unneeded registers a single request
+	// may read in order to cover two needed ranges at once (defaults to 0,
+	// i.e. only adjacent ranges are merged)
+	MaxGap uint16
+	// MaxLength sets the maximum number of registers read by a single
+	// request (defaults to, and may not exceed, 125)
+	MaxLength uint16
+	// LearnRejectedAddresses makes the planner remember which unneeded
+	// registers the device rejects: when a request spanning a gap fails
+	// with ErrIllegalDataAddress, the needed ranges it covers are read
+	// separately and the gap is never read again.
+	LearnRejectedAddresses bool
+}
+
+// Read planner object.
+// Drivers declare the registers they need from a device with Need(), then
+// call Read() to fetch them all with as few requests as possible: ranges are
+// merged when close enough to each other, and split when longer than what
+// a single request can cover.
+// A planner is meant to be kept around for the lifetime of a device, and is
+// safe for concurrent use.
+type ReadPlanner struct {
+	conf ReadPlannerConfiguration
+	lock sync.Mutex
+	// needed ranges, per register type (sorted, neither overlapping
+	// nor adjacent)
+	needed map[RegType][]registerRange
+	// unneeded addresses rejected by the device, per register type
+	rejected map[RegType]map[int]bool
+}
+
+// Register set object, holding the values returned by ReadPlanner.Read().
+type RegisterSet struct {
+	values map[RegType]map[uint16]uint16
+}
+
+// Inclusive range of register addresses.
+type registerRange struct {
+	first int
+	last  int
+}
+
+// NewReadPlanner creates, configures and returns a read planner object.
+func NewReadPlanner(conf *ReadPlannerConfiguration) (rp *ReadPlanner, err error) {
+	rp = &ReadPlanner{
+		conf:     *conf,
+		needed:   make(map[RegType][]registerRange),
+		rejected: make(map[RegType]map[int]bool),
+	}
+
+	if rp.conf.MaxLength == 0 {
+		rp.conf.MaxLength = maxReadRegisterCount
+	}
+
+	if rp.conf.MaxLength > maxReadRegisterCount {
+		err = ErrConfigurationError
+		rp = nil
+		return
+	}
+
+	return
+}
+
+// Declares quantity registers starting at addr as needed.
+// Declaring registers more than once has no effect.
+func (rp *ReadPlanner) Need(regType RegType, addr uint16, quantity uint16) (err error) {
+	var ranges []registerRange
+	var r registerRange
+	var merged []registerRange
+
+	if regType != HOLDING_REGISTER && regType != INPUT_REGISTER {
+		err = ErrUnexpectedParameters
+		return
+	}
+
+	if quantity == 0 || int(addr)+int(quantity) > 0x10000 {
+		err = ErrUnexpectedParameters
+		return
+	}
+
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	ranges = append(ranges, rp.needed[regType]...)
+	ranges = append(ranges, registerRange{
+		first: int(addr),
+		last:  int(addr) + int(quantity) - 1,
+	})
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].first < ranges[j].first
+	})
+
+	// merge overlapping and adjacent ranges
+	for _, r = range ranges {
+		if len(merged) > 0 && r.first <= merged[len(merged)-1].last+1 {
+			if r.last > merged[len(merged)-1].last {
+				merged[len(merged)-1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	rp.needed[regType] = merged
+
+	return
+}
+
+// Reads all needed registers from unit.
+// Requests are carried on even if some of them fail: rs holds the values of
+// all registers read successfully, while err holds the first error
+// encountered, if any.
+func (rp *ReadPlanner) Read(ctx context.Context, unit *ModbusUnit) (rs *RegisterSet, err error) {
+	var reqErr error
+
+	rs = &RegisterSet{
+		values: make(map[RegType]map[uint16]uint16),
+	}
+
+	for _, regType := range []RegType{HOLDING_REGISTER, INPUT_REGISTER} {
+		rs.values[regType] = make(map[uint16]uint16)
+
+		for _, req := range rp.plan(regType, 0, 0xffff) {
+			reqErr = rp.read(ctx, unit, regType, req, rs)
+			if reqErr != nil && err == nil {
+				err = reqErr
+			}
+
+			// no point in going any further
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// Returns the value of the register at addr, and whether it was read.
+func (rs *RegisterSet) Register(regType RegType, addr uint16) (value uint16, ok bool) {
+	value, ok = rs.values[regType][addr]
+
+	return
+}
+
+// Returns the values of quantity registers starting at addr. ok is false
+// (and values nil) unless all of them were read.
+func (rs *RegisterSet) Registers(regType RegType, addr uint16, quantity uint16) (values []uint16, ok bool) {
+	var value uint16
+
+	values = make([]uint16, quantity)
+	for i := range values {
+		value, ok = rs.values[regType][addr+uint16(i)]
+		if !ok {
+			values = nil
+			return
+		}
+		values[i] = value
+	}
+	ok = true
+
+	return
+}
+
+/*** unexported methods ***/
+// Runs a planned request and stores the values read into rs.
+// If the device rejects a request spanning gaps and learning is enabled,
+// the gaps are marked as rejected and the request is planned again.
+func (rp *ReadPlanner) read(ctx context.Context, unit *ModbusUnit, regType RegType,
+	req registerRange, rs *RegisterSet) (err error) {
+	var values []uint16
+
+	values, err = unit.ReadRegisters(ctx, uint16(req.first),
+		uint16(req.last-req.first+1), regType)
+	if err == nil {
+		for i, value := range values {
+			rs.values[regType][uint16(req.first+i)] = value
+		}
+		return
+	}
+
+	if err != ErrIllegalDataAddress || !rp.conf.LearnRejectedAddresses ||
+		!rp.rejectGaps(regType, req) {
+		return
+	}
+
+	unit.client.logger.Warningf("unit id %v rejected registers %v-%v, "+
+		"reading needed ranges separately", unit.unitId, req.first, req.last)
+
+	err = nil
+	for _, sub := range rp.plan(regType, req.first, req.last) {
+		err = rp.read(ctx, unit, regType, sub, rs)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Returns the requests covering all needed registers between first and last
+// (inclusive).
+func (rp *ReadPlanner) plan(regType RegType, first int, last int) (reqs []registerRange) {
+	var cur *registerRange
+	var start int
+	var end int
+	var maxLength int = int(rp.conf.MaxLength)
+
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	for _, r := range rp.needed[regType] {
+		// clip the range to the window
+		if r.last < first || r.first > last {
+			continue
+		}
+		if r.first < first {
+			r.first = first
+		}
+		if r.last > last {
+			r.last = last
+		}
+
+		for start = r.first; start <= r.last; start = cur.last + 1 {
+			if cur != nil &&
+				start-cur.last-1 <= int(rp.conf.MaxGap) &&
+				start-cur.first < maxLength &&
+				!rp.hasRejected(regType, cur.last+1, start-1) {
+				// extend the current request as far as allowed
+				end = cur.first + maxLength - 1
+			} else {
+				// start a new request
+				reqs = append(reqs, registerRange{first: start})
+				cur = &reqs[len(reqs)-1]
+				end = start + maxLength - 1
+			}
+
+			if end > r.last {
+				end = r.last
+			}
+			cur.last = end
+		}
+	}
+
+	return
+}
+
+// Returns true if any address between first and last (inclusive) was rejected.
+// The caller is expected to hold the planner lock.
+func (rp *ReadPlanner) hasRejected(regType RegType, first int, last int) (yes bool) {
+	for addr := first; addr <= last; addr++ {
+		if rp.rejected[regType][addr] {
+			yes = true
+			return
+		}
+	}
+
+	return
+}
+
+// Marks all unneeded addresses covered by req as rejected.
+// Returns false if req does not cover any unneeded address.
+func (rp *ReadPlanner) rejectGaps(regType RegType, req registerRange) (found bool) {
+	var needed bool
+
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	for addr := req.first; addr <= req.last; addr++ {
+		needed = false
+		for _, r := range rp.needed[regType] {
+			if addr >= r.first && addr <= r.last {
+				needed = true
+				break
+			}
+		}
+
+		if !needed && !rp.rejected[regType][addr] {
+			if rp.rejected[regType] == nil {
+				rp.rejected[regType] = make(map[int]bool)
+			}
+			rp.rejected[regType][addr] = true
+			found = true
+		}
+	}
+
+	return
+}
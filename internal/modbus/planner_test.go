@@ -0,0 +1,279 @@
+package modbus
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestReadPlannerPlan(t *testing.T) {
+	var rp *ReadPlanner
+	var err error
+	var reqs []registerRange
+
+	_, err = NewReadPlanner(&ReadPlannerConfiguration{
+		MaxLength: 126,
+	})
+	if err != ErrConfigurationError {
+		t.Errorf("NewReadPlanner() should have failed with ErrConfigurationError, got: %v", err)
+	}
+
+	rp, err = NewReadPlanner(&ReadPlannerConfiguration{
+		MaxGap: 4,
+	})
+	if err != nil {
+		t.Errorf("NewReadPlanner() should have succeeded, got: %v", err)
+		return
+	}
+
+	err = rp.Need(INPUT_REGISTER, 0xfffe, 3)
+	if err != ErrUnexpectedParameters {
+		t.Errorf("Need() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+
+	err = rp.Need(INPUT_REGISTER, 10, 0)
+	if err != ErrUnexpectedParameters {
+		t.Errorf("Need() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+
+	// overlapping, adjacent and duplicate ranges should be merged
+	rp.Need(INPUT_REGISTER, 10, 2)
+	rp.Need(INPUT_REGISTER, 11, 3)
+	rp.Need(INPUT_REGISTER, 14, 1)
+	rp.Need(INPUT_REGISTER, 10, 2)
+	// ranges close enough to each other should be read at once
+	rp.Need(INPUT_REGISTER, 19, 2)
+	// others should not
+	rp.Need(INPUT_REGISTER, 26, 1)
+	// ranges longer than 125 registers should be split
+	rp.Need(INPUT_REGISTER, 1000, 200)
+	// register types are planned separately
+	rp.Need(HOLDING_REGISTER, 12, 1)
+
+	reqs = rp.plan(INPUT_REGISTER, 0, 0xffff)
+	expectRequests(t, reqs, []registerRange{
+		{first: 10, last: 20},
+		{first: 26, last: 26},
+		{first: 1000, last: 1124},
+		{first: 1125, last: 1199},
+	})
+
+	reqs = rp.plan(HOLDING_REGISTER, 0, 0xffff)
+	expectRequests(t, reqs, []registerRange{
+		{first: 12, last: 12},
+	})
+
+	// merged requests should never exceed the max length either
+	rp.Need(INPUT_REGISTER, 1203, 2)
+	reqs = rp.plan(INPUT_REGISTER, 1000, 0xffff)
+	expectRequests(t, reqs, []registerRange{
+		{first: 1000, last: 1124},
+		{first: 1125, last: 1204},
+	})
+
+	// rejected addresses should never be read as part of a gap
+	rp.rejected[INPUT_REGISTER] = map[int]bool{17: true}
+	reqs = rp.plan(INPUT_REGISTER, 0, 999)
+	expectRequests(t, reqs, []registerRange{
+		{first: 10, last: 14},
+		{first: 19, last: 20},
+		{first: 26, last: 26},
+	})
+
+	return
+}
+
+func TestReadPlannerRead(t *testing.T) {
+	var server *ModbusServer
+	var client *ModbusClient
+	var th *plannerTestHandler
+	var rp *ReadPlanner
+	var rs *RegisterSet
+	var err error
+	var value uint16
+	var values []uint16
+	var ok bool
+
+	th = &plannerTestHandler{
+		tcpTestHandler: &tcpTestHandler{},
+		rejected:       map[uint16]bool{105: true},
+	}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL: "tcp://localhost:5502",
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "tcp://localhost:5502",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+	err = client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	rp, err = NewReadPlanner(&ReadPlannerConfiguration{
+		MaxGap:                 10,
+		LearnRejectedAddresses: true,
+	})
+	if err != nil {
+		t.Errorf("NewReadPlanner() should have succeeded, got: %v", err)
+		return
+	}
+
+	rp.Need(INPUT_REGISTER, 100, 3)
+	rp.Need(INPUT_REGISTER, 108, 2)
+	rp.Need(INPUT_REGISTER, 200, 1)
+
+	// the first read should hit the rejected register in the gap between
+	// 102 and 108, then read both ranges separately
+	rs, err = rp.Read(context.Background(), client.Unit(9))
+	if err != nil {
+		t.Errorf("Read() should have succeeded, got: %v", err)
+	}
+	if th.requests != 4 {
+		t.Errorf("expected 4 requests, got: %v", th.requests)
+	}
+
+	values, ok = rs.Registers(INPUT_REGISTER, 100, 3)
+	if !ok || len(values) != 3 || values[0] != 100 || values[2] != 102 {
+		t.Errorf("expected {100, 101, 102}, got: %v", values)
+	}
+
+	value, ok = rs.Register(INPUT_REGISTER, 109)
+	if !ok || value != 109 {
+		t.Errorf("expected 109, got: %v (ok: %v)", value, ok)
+	}
+
+	value, ok = rs.Register(INPUT_REGISTER, 200)
+	if !ok || value != 200 {
+		t.Errorf("expected 200, got: %v (ok: %v)", value, ok)
+	}
+
+	// registers in gaps are not part of the result
+	_, ok = rs.Register(INPUT_REGISTER, 104)
+	if ok {
+		t.Errorf("register 104 should not have been returned")
+	}
+
+	values, ok = rs.Registers(INPUT_REGISTER, 100, 4)
+	if ok || values != nil {
+		t.Errorf("Registers() should have failed, got: %v", values)
+	}
+
+	// the planner should now avoid the gap
+	th.requests = 0
+	_, err = rp.Read(context.Background(), client.Unit(9))
+	if err != nil {
+		t.Errorf("Read() should have succeeded, got: %v", err)
+	}
+	if th.requests != 3 {
+		t.Errorf("expected 3 requests, got: %v", th.requests)
+	}
+
+	// errors on needed registers should be reported, while other
+	// registers are still read
+	rp.Need(INPUT_REGISTER, 105, 1)
+	th.requests = 0
+	rs, err = rp.Read(context.Background(), client.Unit(9))
+	if err != ErrIllegalDataAddress {
+		t.Errorf("Read() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+	value, ok = rs.Register(INPUT_REGISTER, 200)
+	if !ok || value != 200 {
+		t.Errorf("expected 200, got: %v (ok: %v)", value, ok)
+	}
+
+	// requests should cover up to 125 registers
+	rp, err = NewReadPlanner(&ReadPlannerConfiguration{})
+	if err != nil {
+		t.Errorf("NewReadPlanner() should have succeeded, got: %v", err)
+		return
+	}
+	rp.Need(INPUT_REGISTER, 1000, 125)
+	th.requests = 0
+	rs, err = rp.Read(context.Background(), client.Unit(9))
+	if err != nil {
+		t.Errorf("Read() should have succeeded, got: %v", err)
+	}
+	if th.requests != 1 {
+		t.Errorf("expected 1 request, got: %v", th.requests)
+	}
+	value, ok = rs.Register(INPUT_REGISTER, 1124)
+	if !ok || value != 1124 {
+		t.Errorf("expected 1124, got: %v (ok: %v)", value, ok)
+	}
+
+	// larger reads should be rejected without reaching the device
+	th.requests = 0
+	_, err = client.ReadRegisters(1000, 126, INPUT_REGISTER)
+	if err != ErrUnexpectedParameters {
+		t.Errorf("ReadRegisters() should have failed with ErrUnexpectedParameters, got: %v", err)
+	}
+	_, err = client.ReadRegisters(1000, 0, INPUT_REGISTER)
+	if err != ErrUnexpectedParameters {
+		t.Errorf("ReadRegisters() should have failed with ErrUnexpectedParameters, got: %v", err)
+	}
+	if th.requests != 0 {
+		t.Errorf("expected no request, got: %v", th.requests)
+	}
+
+	return
+}
+
+func expectRequests(t *testing.T, reqs []registerRange, expected []registerRange) {
+	if len(reqs) != len(expected) {
+		t.Errorf("expected %v requests, got %v (%v)", len(expected), len(reqs), reqs)
+		return
+	}
+
+	for i := range expected {
+		if reqs[i] != expected[i] {
+			t.Errorf("expected %v as request #%v, got %v", expected[i], i, reqs[i])
+		}
+	}
+
+	return
+}
+
+// Serves input registers holding their own address, except for rejected
+// addresses.
+type plannerTestHandler struct {
+	*tcpTestHandler
+	lock     sync.Mutex
+	rejected map[uint16]bool
+	requests int
+}
+
+func (th *plannerTestHandler) HandleInputRegisters(req *InputRegistersRequest) (res []uint16, err error) {
+	th.lock.Lock()
+	defer th.lock.Unlock()
+
+	th.requests++
+
+	for i := 0; i < int(req.Quantity); i++ {
+		if th.rejected[req.Addr+uint16(i)] {
+			err = ErrIllegalDataAddress
+			res = nil
+			return
+		}
+		res = append(res, req.Addr+uint16(i))
+	}
+
+	return
+}
@@ -0,0 +1,827 @@
+package modbus
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+type BankAccess uint
+
+const (
+	// clients may read and write (coils and holding registers only, discrete
+	// inputs and input registers are always read-only)
+	BANK_READ_WRITE BankAccess = 0
+	// clients may only read, writes are rejected with ErrIllegalDataAddress
+	BANK_READ_ONLY BankAccess = 1
+	// client writes are rejected with ErrIllegalDataValue while the write
+	// protection of the unit is enabled (see SetWriteProtection()), which
+	// it is by default
+	BANK_WRITE_PROTECTED BankAccess = 2
+)
+
+// Register bank range object, allocating a block of coils, discrete inputs
+// or registers.
+type BankRange struct {
+	// First and Last set the (inclusive) range of addresses of the block
+	First uint16
+	Last  uint16
+	// Access sets what clients may do with the block
+	Access BankAccess
+}
+
+// Register bank unit configuration object, setting the address ranges
+// served for a unit id. Requests to addresses out of these ranges are
+// rejected with ErrIllegalDataAddress.
+type RegisterBankUnitConfiguration struct {
+	Coils            []BankRange
+	DiscreteInputs   []BankRange
+	HoldingRegisters []BankRange
+	InputRegisters   []BankRange
+}
+
+// Register bank configuration object.
+type RegisterBankConfiguration struct {
+	// Units maps unit ids to the ranges served for them. Requests to other
+	// unit ids are rejected with ErrGWPathUnavailable.
+	Units map[uint8]*RegisterBankUnitConfiguration
+	// OnCoilsWrite, if set, is called on client writes to coils, before the
+	// values are stored. Returning an error rejects the write and is sent
+	// back to the client (see RequestHandler).
+	// It is called without the bank lock held and may call bank methods.
+	// Client writes are serialized, hence callbacks never run concurrently.
+	OnCoilsWrite func(unitId uint8, addr uint16, values []bool) error
+	// OnRegistersWrite, if set, is called on client writes to holding
+	// registers, in the same way as OnCoilsWrite.
+	OnRegistersWrite func(unitId uint8, addr uint16, values []uint16) error
+	// Logger provides a custom sink for log messages.
+	// If nil, messages will be written to stdout.
+	Logger *log.Logger
+}
+
+// Register bank object.
+// The register bank implements the RequestHandler interface (as well as the
+// MaskWriteRegisterHandler and ReadWriteRegistersHandler ones): once passed
+// to NewServer(), it serves in-memory coils, discrete inputs and registers
+// for one or more unit ids, which the application updates with the Set
+// methods (e.g. SetFloat32()) regardless of client access rights.
+// Typed values are encoded with the endianness and word order set by
+// SetEncoding(), clients should read them with the same encoding.
+// The register bank is safe for concurrent use.
+type RegisterBank struct {
+	conf   RegisterBankConfiguration
+	logger *logger
+	lock   sync.RWMutex
+	// serializes client writes, which call write callbacks without holding
+	// lock, so that read-modify-write requests (e.g. mask writes) are atomic
+	// with respect to each other
+	writeLock  sync.Mutex
+	endianness Endianness
+	wordOrder  WordOrder
+	units      map[uint8]*bankUnit
+}
+
+// Coils, discrete inputs and registers of a unit id.
+type bankUnit struct {
+	coils            []*bankBlock
+	discreteInputs   []*bankBlock
+	holdingRegisters []*bankBlock
+	inputRegisters   []*bankBlock
+	writeProtected   bool
+}
+
+// Tables of a unit id.
+type bankTable uint
+
+const (
+	bankCoils bankTable = iota
+	bankDiscreteInputs
+	bankHoldingRegisters
+	bankInputRegisters
+)
+
+// Block of consecutive coils, discrete inputs or registers.
+type bankBlock struct {
+	BankRange
+	bits []bool
+	regs []uint16
+}
+
+// NewRegisterBank creates, configures and returns a register bank object,
+// with all coils, discrete inputs and registers cleared.
+func NewRegisterBank(conf *RegisterBankConfiguration) (rb *RegisterBank, err error) {
+	var unit *bankUnit
+
+	rb = &RegisterBank{
+		conf:       *conf,
+		logger:     newLogger("modbus-register-bank", conf.Logger),
+		endianness: BIG_ENDIAN,
+		wordOrder:  HIGH_WORD_FIRST,
+		units:      make(map[uint8]*bankUnit),
+	}
+
+	for unitId, unitConf := range rb.conf.Units {
+		if unitConf == nil {
+			rb.logger.Errorf("missing configuration for unit id %v", unitId)
+			err = ErrConfigurationError
+			rb = nil
+			return
+		}
+
+		unit = &bankUnit{
+			writeProtected: true,
+		}
+		for _, table := range []struct {
+			name   string
+			ranges []BankRange
+			blocks *[]*bankBlock
+			bits   bool
+		}{
+			{"coil", unitConf.Coils, &unit.coils, true},
+			{"discrete input", unitConf.DiscreteInputs, &unit.discreteInputs, true},
+			{"holding register", unitConf.HoldingRegisters, &unit.holdingRegisters, false},
+			{"input register", unitConf.InputRegisters, &unit.inputRegisters, false},
+		} {
+			*table.blocks, err = newBankBlocks(table.ranges, table.bits)
+			if err != nil {
+				rb.logger.Errorf("unit id %v: invalid %v ranges: %v", unitId, table.name, err)
+				err = ErrConfigurationError
+				rb = nil
+				return
+			}
+		}
+		rb.units[unitId] = unit
+	}
+
+	return
+}
+
+// Returns the unit ids served by the bank, in ascending order (e.g. to set
+// ServerConfiguration.UnitIds).
+func (rb *RegisterBank) UnitIds() (unitIds []uint8) {
+	for unitId := range rb.units {
+		unitIds = append(unitIds, unitId)
+	}
+	sort.Slice(unitIds, func(i, j int) bool { return unitIds[i] < unitIds[j] })
+
+	return
+}
+
+// Sets the encoding (endianness and word ordering) of typed values.
+func (rb *RegisterBank) SetEncoding(endianness Endianness, wordOrder WordOrder) (err error) {
+	if (endianness != BIG_ENDIAN && endianness != LITTLE_ENDIAN) ||
+		(wordOrder != HIGH_WORD_FIRST && wordOrder != LOW_WORD_FIRST) {
+		err = ErrUnexpectedParameters
+		return
+	}
+
+	rb.lock.Lock()
+	rb.endianness = endianness
+	rb.wordOrder = wordOrder
+	rb.lock.Unlock()
+
+	return
+}
+
+// Enables or disables the write protection of BANK_WRITE_PROTECTED ranges
+// of a unit id.
+func (rb *RegisterBank) SetWriteProtection(unitId uint8, enabled bool) (err error) {
+	var unit *bankUnit
+
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	unit, err = rb.unit(unitId)
+	if err != nil {
+		return
+	}
+	unit.writeProtected = enabled
+
+	return
+}
+
+// Sets the value of multiple coils.
+func (rb *RegisterBank) SetCoils(unitId uint8, addr uint16, values []bool) (err error) {
+	err = rb.setBits(unitId, bankCoils, addr, values)
+
+	return
+}
+
+// Sets the value of a single coil.
+func (rb *RegisterBank) SetCoil(unitId uint8, addr uint16, value bool) (err error) {
+	err = rb.setBits(unitId, bankCoils, addr, []bool{value})
+
+	return
+}
+
+// Sets the value of multiple discrete inputs.
+func (rb *RegisterBank) SetDiscreteInputs(unitId uint8, addr uint16, values []bool) (err error) {
+	err = rb.setBits(unitId, bankDiscreteInputs, addr, values)
+
+	return
+}
+
+// Sets the value of a single discrete input.
+func (rb *RegisterBank) SetDiscreteInput(unitId uint8, addr uint16, value bool) (err error) {
+	err = rb.setBits(unitId, bankDiscreteInputs, addr, []bool{value})
+
+	return
+}
+
+// Returns the value of multiple coils.
+func (rb *RegisterBank) Coils(unitId uint8, addr uint16, quantity uint16) (values []bool, err error) {
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+
+	values, err = rb.readBits(unitId, bankCoils, addr, quantity, false)
+
+	return
+}
+
+// Returns the value of multiple discrete inputs.
+func (rb *RegisterBank) DiscreteInputs(unitId uint8, addr uint16, quantity uint16) (values []bool, err error) {
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+
+	values, err = rb.readBits(unitId, bankDiscreteInputs, addr, quantity, false)
+
+	return
+}
+
+// Sets multiple registers, as raw (big endian) register values.
+func (rb *RegisterBank) SetRegisters(unitId uint8, regType RegType, addr uint16, values []uint16) (err error) {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	err = rb.writeRegs(unitId, regType, addr, values, false)
+
+	return
+}
+
+// Sets a single register, as a raw (big endian) register value.
+func (rb *RegisterBank) SetRegister(unitId uint8, regType RegType, addr uint16, value uint16) (err error) {
+	err = rb.SetRegisters(unitId, regType, addr, []uint16{value})
+
+	return
+}
+
+// Returns multiple registers, as raw (big endian) register values.
+func (rb *RegisterBank) Registers(unitId uint8, regType RegType, addr uint16, quantity uint16) (values []uint16, err error) {
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+
+	values, err = rb.readRegs(unitId, regType, addr, quantity)
+
+	return
+}
+
+// Sets a 16-bit signed integer register.
+func (rb *RegisterBank) SetInt16(unitId uint8, regType RegType, addr uint16, value int16) (err error) {
+	err = rb.setBytes(unitId, regType, addr, func(e Endianness, _ WordOrder) []byte {
+		return int16ToBytes(e, value)
+	})
+
+	return
+}
+
+// Sets a 32-bit unsigned integer (2 registers).
+func (rb *RegisterBank) SetUint32(unitId uint8, regType RegType, addr uint16, value uint32) (err error) {
+	err = rb.setBytes(unitId, regType, addr, func(e Endianness, w WordOrder) []byte {
+		return uint32ToBytes(e, w, value)
+	})
+
+	return
+}
+
+// Sets a 32-bit signed integer (2 registers).
+func (rb *RegisterBank) SetInt32(unitId uint8, regType RegType, addr uint16, value int32) (err error) {
+	err = rb.setBytes(unitId, regType, addr, func(e Endianness, w WordOrder) []byte {
+		return int32ToBytes(e, w, value)
+	})
+
+	return
+}
+
+// Sets a 32-bit float (2 registers).
+func (rb *RegisterBank) SetFloat32(unitId uint8, regType RegType, addr uint16, value float32) (err error) {
+	err = rb.setBytes(unitId, regType, addr, func(e Endianness, w WordOrder) []byte {
+		return float32ToBytes(e, w, value)
+	})
+
+	return
+}
+
+// Sets a 64-bit unsigned integer (4 registers).
+func (rb *RegisterBank) SetUint64(unitId uint8, regType RegType, addr uint16, value uint64) (err error) {
+	err = rb.setBytes(unitId, regType, addr, func(e Endianness, w WordOrder) []byte {
+		return uint64ToBytes(e, w, value)
+	})
+
+	return
+}
+
+// Sets a 64-bit signed integer (4 registers).
+func (rb *RegisterBank) SetInt64(unitId uint8, regType RegType, addr uint16, value int64) (err error) {
+	err = rb.setBytes(unitId, regType, addr, func(e Endianness, w WordOrder) []byte {
+		return int64ToBytes(e, w, value)
+	})
+
+	return
+}
+
+// Sets a 64-bit float (4 registers).
+func (rb *RegisterBank) SetFloat64(unitId uint8, regType RegType, addr uint16, value float64) (err error) {
+	err = rb.setBytes(unitId, regType, addr, func(e Endianness, w WordOrder) []byte {
+		return float64ToBytes(e, w, value)
+	})
+
+	return
+}
+
+// Sets an ASCII string spanning quantity registers, padded with null bytes.
+// Returns ErrUnexpectedParameters if value does not fit.
+func (rb *RegisterBank) SetString(unitId uint8, regType RegType, addr uint16, quantity uint16, value string) (err error) {
+	var payload []byte
+
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	payload, err = stringToBytes(rb.endianness, value, quantity)
+	if err != nil {
+		return
+	}
+	err = rb.writeRegs(unitId, regType, addr, bytesToUint16s(BIG_ENDIAN, payload), false)
+
+	return
+}
+
+// Returns a 16-bit signed integer register.
+func (rb *RegisterBank) Int16(unitId uint8, regType RegType, addr uint16) (value int16, err error) {
+	err = rb.getBytes(unitId, regType, addr, 1, func(e Endianness, _ WordOrder, payload []byte) {
+		value = bytesToInt16s(e, payload)[0]
+	})
+
+	return
+}
+
+// Returns a 32-bit unsigned integer (2 registers).
+func (rb *RegisterBank) Uint32(unitId uint8, regType RegType, addr uint16) (value uint32, err error) {
+	err = rb.getBytes(unitId, regType, addr, 2, func(e Endianness, w WordOrder, payload []byte) {
+		value = bytesToUint32s(e, w, payload)[0]
+	})
+
+	return
+}
+
+// Returns a 32-bit signed integer (2 registers).
+func (rb *RegisterBank) Int32(unitId uint8, regType RegType, addr uint16) (value int32, err error) {
+	err = rb.getBytes(unitId, regType, addr, 2, func(e Endianness, w WordOrder, payload []byte) {
+		value = bytesToInt32s(e, w, payload)[0]
+	})
+
+	return
+}
+
+// Returns a 32-bit float (2 registers).
+func (rb *RegisterBank) Float32(unitId uint8, regType RegType, addr uint16) (value float32, err error) {
+	err = rb.getBytes(unitId, regType, addr, 2, func(e Endianness, w WordOrder, payload []byte) {
+		value = bytesToFloat32s(e, w, payload)[0]
+	})
+
+	return
+}
+
+// Returns a 64-bit unsigned integer (4 registers).
+func (rb *RegisterBank) Uint64(unitId uint8, regType RegType, addr uint16) (value uint64, err error) {
+	err = rb.getBytes(unitId, regType, addr, 4, func(e Endianness, w WordOrder, payload []byte) {
+		value = bytesToUint64s(e, w, payload)[0]
+	})
+
+	return
+}
+
+// Returns a 64-bit signed integer (4 registers).
+func (rb *RegisterBank) Int64(unitId uint8, regType RegType, addr uint16) (value int64, err error) {
+	err = rb.getBytes(unitId, regType, addr, 4, func(e Endianness, w WordOrder, payload []byte) {
+		value = bytesToInt64s(e, w, payload)[0]
+	})
+
+	return
+}
+
+// Returns a 64-bit float (4 registers).
+func (rb *RegisterBank) Float64(unitId uint8, regType RegType, addr uint16) (value float64, err error) {
+	err = rb.getBytes(unitId, regType, addr, 4, func(e Endianness, w WordOrder, payload []byte) {
+		value = bytesToFloat64s(e, w, payload)[0]
+	})
+
+	return
+}
+
+// Returns an ASCII string spanning quantity registers.
+func (rb *RegisterBank) String(unitId uint8, regType RegType, addr uint16, quantity uint16) (value string, err error) {
+	err = rb.getBytes(unitId, regType, addr, quantity, func(e Endianness, _ WordOrder, payload []byte) {
+		value = bytesToString(e, payload)
+	})
+
+	return
+}
+
+// Serves coil requests (function codes 0x01, 0x05 and 0x0f).
+func (rb *RegisterBank) HandleCoils(req *CoilsRequest) (res []bool, err error) {
+	if !req.IsWrite {
+		rb.lock.RLock()
+		res, err = rb.readBits(req.UnitId, bankCoils, req.Addr, req.Quantity, false)
+		rb.lock.RUnlock()
+		return
+	}
+
+	rb.writeLock.Lock()
+	defer rb.writeLock.Unlock()
+
+	// check access rights first, so that the callback only sees valid writes
+	rb.lock.RLock()
+	_, err = rb.readBits(req.UnitId, bankCoils, req.Addr, req.Quantity, true)
+	rb.lock.RUnlock()
+	if err != nil {
+		return
+	}
+
+	if rb.conf.OnCoilsWrite != nil {
+		err = rb.conf.OnCoilsWrite(req.UnitId, req.Addr, req.Args)
+		if err != nil {
+			return
+		}
+	}
+
+	err = rb.setBits(req.UnitId, bankCoils, req.Addr, req.Args)
+
+	return
+}
+
+// Serves discrete input requests (function code 0x02).
+func (rb *RegisterBank) HandleDiscreteInputs(req *DiscreteInputsRequest) (res []bool, err error) {
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+
+	res, err = rb.readBits(req.UnitId, bankDiscreteInputs, req.Addr, req.Quantity, false)
+
+	return
+}
+
+// Serves holding register requests (function codes 0x03, 0x06 and 0x10).
+func (rb *RegisterBank) HandleHoldingRegisters(req *HoldingRegistersRequest) (res []uint16, err error) {
+	if !req.IsWrite {
+		rb.lock.RLock()
+		res, err = rb.readRegs(req.UnitId, HOLDING_REGISTER, req.Addr, req.Quantity)
+		rb.lock.RUnlock()
+		return
+	}
+
+	rb.writeLock.Lock()
+	defer rb.writeLock.Unlock()
+
+	err = rb.clientWriteRegs(req.UnitId, req.Addr, req.Args)
+
+	return
+}
+
+// Serves input register requests (function code 0x04).
+func (rb *RegisterBank) HandleInputRegisters(req *InputRegistersRequest) (res []uint16, err error) {
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+
+	res, err = rb.readRegs(req.UnitId, INPUT_REGISTER, req.Addr, req.Quantity)
+
+	return
+}
+
+// Serves mask write register requests (function code 0x16).
+func (rb *RegisterBank) HandleMaskWriteRegister(req *MaskWriteRegisterRequest) (err error) {
+	var current []uint16
+
+	// no other client write may slip in between the read and the write
+	rb.writeLock.Lock()
+	defer rb.writeLock.Unlock()
+
+	rb.lock.RLock()
+	current, err = rb.readRegs(req.UnitId, HOLDING_REGISTER, req.Addr, 1)
+	rb.lock.RUnlock()
+	if err != nil {
+		return
+	}
+
+	err = rb.clientWriteRegs(req.UnitId, req.Addr,
+		[]uint16{(current[0] & req.AndMask) | (req.OrMask & ^req.AndMask)})
+
+	return
+}
+
+// Serves read/write multiple registers requests (function code 0x17).
+func (rb *RegisterBank) HandleReadWriteRegisters(req *ReadWriteRegistersRequest) (res []uint16, err error) {
+	rb.writeLock.Lock()
+	defer rb.writeLock.Unlock()
+
+	err = rb.clientWriteRegs(req.UnitId, req.WriteAddr, req.Args)
+	if err != nil {
+		return
+	}
+
+	rb.lock.RLock()
+	res, err = rb.readRegs(req.UnitId, HOLDING_REGISTER, req.ReadAddr, req.ReadQuantity)
+	rb.lock.RUnlock()
+
+	return
+}
+
+/*** unexported methods ***/
+
+// Validates ranges and allocates a block for each.
+func newBankBlocks(ranges []BankRange, bits bool) (blocks []*bankBlock, err error) {
+	var block *bankBlock
+
+	for _, r := range ranges {
+		if r.First > r.Last {
+			err = fmt.Errorf("range 0x%04x-0x%04x ends before it starts", r.First, r.Last)
+			return
+		}
+
+		if r.Access > BANK_WRITE_PROTECTED {
+			err = fmt.Errorf("range 0x%04x-0x%04x: unknown access mode %v", r.First, r.Last, r.Access)
+			return
+		}
+
+		for _, other := range blocks {
+			if r.First <= other.Last && other.First <= r.Last {
+				err = fmt.Errorf("range 0x%04x-0x%04x overlaps with 0x%04x-0x%04x",
+					r.First, r.Last, other.First, other.Last)
+				return
+			}
+		}
+
+		block = &bankBlock{BankRange: r}
+		if bits {
+			block.bits = make([]bool, int(r.Last)-int(r.First)+1)
+		} else {
+			block.regs = make([]uint16, int(r.Last)-int(r.First)+1)
+		}
+		blocks = append(blocks, block)
+	}
+
+	return
+}
+
+// Returns the unit object of unitId. The caller must hold the lock.
+func (rb *RegisterBank) unit(unitId uint8) (unit *bankUnit, err error) {
+	var ok bool
+
+	unit, ok = rb.units[unitId]
+	if !ok {
+		err = ErrGWPathUnavailable
+	}
+
+	return
+}
+
+// Returns the register table matching regType.
+func registerTable(regType RegType) (table bankTable, err error) {
+	switch regType {
+	case HOLDING_REGISTER:
+		table = bankHoldingRegisters
+	case INPUT_REGISTER:
+		table = bankInputRegisters
+	default:
+		err = ErrUnexpectedParameters
+	}
+
+	return
+}
+
+// Returns the blocks of a table of unitId. The caller must hold the lock.
+func (rb *RegisterBank) blocks(unitId uint8, table bankTable) (unit *bankUnit, blocks []*bankBlock, err error) {
+	unit, err = rb.unit(unitId)
+	if err != nil {
+		return
+	}
+
+	switch table {
+	case bankCoils:
+		blocks = unit.coils
+	case bankDiscreteInputs:
+		blocks = unit.discreteInputs
+	case bankHoldingRegisters:
+		blocks = unit.holdingRegisters
+	case bankInputRegisters:
+		blocks = unit.inputRegisters
+	}
+
+	return
+}
+
+// Returns the block holding addr and the offset of addr within it, checking
+// client write access if write is true. Returns ErrIllegalDataAddress if
+// addr is not served. The caller must hold the lock.
+func locate(unit *bankUnit, blocks []*bankBlock, addr int, write bool) (block *bankBlock, offset int, err error) {
+	for _, block = range blocks {
+		if addr >= int(block.First) && addr <= int(block.Last) {
+			offset = addr - int(block.First)
+			if write {
+				switch {
+				case block.Access == BANK_READ_ONLY:
+					err = ErrIllegalDataAddress
+				case block.Access == BANK_WRITE_PROTECTED && unit.writeProtected:
+					err = ErrIllegalDataValue
+				}
+			}
+			return
+		}
+	}
+
+	block = nil
+	err = ErrIllegalDataAddress
+
+	return
+}
+
+// Reads coils or discrete inputs. If checkWrite is true, also checks that
+// clients may write all of them. The caller must hold the lock.
+func (rb *RegisterBank) readBits(unitId uint8, table bankTable, addr uint16, quantity uint16,
+	checkWrite bool) (values []bool, err error) {
+	var unit *bankUnit
+	var blocks []*bankBlock
+	var block *bankBlock
+	var offset int
+
+	unit, blocks, err = rb.blocks(unitId, table)
+	if err != nil {
+		return
+	}
+
+	for i := 0; i < int(quantity); i++ {
+		block, offset, err = locate(unit, blocks, int(addr)+i, checkWrite)
+		if err != nil {
+			values = nil
+			return
+		}
+		values = append(values, block.bits[offset])
+	}
+
+	return
+}
+
+// Sets coils or discrete inputs, regardless of client access rights.
+func (rb *RegisterBank) setBits(unitId uint8, table bankTable, addr uint16, values []bool) (err error) {
+	var unit *bankUnit
+	var blocks []*bankBlock
+	var block *bankBlock
+	var offset int
+
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	unit, blocks, err = rb.blocks(unitId, table)
+	if err != nil {
+		return
+	}
+
+	// make sure all addresses are served before changing anything
+	_, err = rb.readBits(unitId, table, addr, uint16(len(values)), false)
+	if err != nil {
+		return
+	}
+
+	for i, value := range values {
+		block, offset, _ = locate(unit, blocks, int(addr)+i, false)
+		block.bits[offset] = value
+	}
+
+	return
+}
+
+// Reads registers. The caller must hold the lock.
+func (rb *RegisterBank) readRegs(unitId uint8, regType RegType, addr uint16, quantity uint16) (values []uint16, err error) {
+	var table bankTable
+	var unit *bankUnit
+	var blocks []*bankBlock
+	var block *bankBlock
+	var offset int
+
+	table, err = registerTable(regType)
+	if err != nil {
+		return
+	}
+
+	unit, blocks, err = rb.blocks(unitId, table)
+	if err != nil {
+		return
+	}
+
+	for i := 0; i < int(quantity); i++ {
+		block, offset, err = locate(unit, blocks, int(addr)+i, false)
+		if err != nil {
+			values = nil
+			return
+		}
+		values = append(values, block.regs[offset])
+	}
+
+	return
+}
+
+// Writes registers, checking client access rights if checkWrite is true.
+// The caller must hold the lock (for writing).
+func (rb *RegisterBank) writeRegs(unitId uint8, regType RegType, addr uint16, values []uint16,
+	checkWrite bool) (err error) {
+	var table bankTable
+	var unit *bankUnit
+	var blocks []*bankBlock
+	var block *bankBlock
+	var offset int
+
+	table, err = registerTable(regType)
+	if err != nil {
+		return
+	}
+
+	unit, blocks, err = rb.blocks(unitId, table)
+	if err != nil {
+		return
+	}
+
+	// make sure all addresses are served (and writable) before changing anything
+	for i := range values {
+		_, _, err = locate(unit, blocks, int(addr)+i, checkWrite)
+		if err != nil {
+			return
+		}
+	}
+
+	for i, value := range values {
+		block, offset, _ = locate(unit, blocks, int(addr)+i, false)
+		block.regs[offset] = value
+	}
+
+	return
+}
+
+// Handles a client write to holding registers: checks access rights, calls
+// the write callback, then stores the values. The caller must hold the
+// client write lock.
+func (rb *RegisterBank) clientWriteRegs(unitId uint8, addr uint16, values []uint16) (err error) {
+	var unit *bankUnit
+	var blocks []*bankBlock
+
+	rb.lock.RLock()
+	unit, blocks, err = rb.blocks(unitId, bankHoldingRegisters)
+	for i := 0; err == nil && i < len(values); i++ {
+		_, _, err = locate(unit, blocks, int(addr)+i, true)
+	}
+	rb.lock.RUnlock()
+	if err != nil {
+		return
+	}
+
+	if rb.conf.OnRegistersWrite != nil {
+		err = rb.conf.OnRegistersWrite(unitId, addr, values)
+		if err != nil {
+			return
+		}
+	}
+
+	rb.lock.Lock()
+	err = rb.writeRegs(unitId, HOLDING_REGISTER, addr, values, false)
+	rb.lock.Unlock()
+
+	return
+}
+
+// Encodes a typed value with the bank encoding and stores it.
+func (rb *RegisterBank) setBytes(unitId uint8, regType RegType, addr uint16,
+	encode func(Endianness, WordOrder) []byte) (err error) {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	err = rb.writeRegs(unitId, regType, addr,
+		bytesToUint16s(BIG_ENDIAN, encode(rb.endianness, rb.wordOrder)), false)
+
+	return
+}
+
+// Reads quantity registers and passes them to decode along with the bank
+// encoding.
+func (rb *RegisterBank) getBytes(unitId uint8, regType RegType, addr uint16, quantity uint16,
+	decode func(Endianness, WordOrder, []byte)) (err error) {
+	var regs []uint16
+
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+
+	regs, err = rb.readRegs(unitId, regType, addr, quantity)
+	if err != nil {
+		return
+	}
+	decode(rb.endianness, rb.wordOrder, uint16sToBytes(BIG_ENDIAN, regs))
+
+	return
+}
@@ -0,0 +1,333 @@
+package modbus
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewRegisterBank(t *testing.T) {
+	var err error
+
+	// inverted ranges should be rejected
+	_, err = NewRegisterBank(&RegisterBankConfiguration{
+		Units: map[uint8]*RegisterBankUnitConfiguration{
+			1: {HoldingRegisters: []BankRange{{First: 10, Last: 1}}},
+		},
+	})
+	if err != ErrConfigurationError {
+		t.Errorf("NewRegisterBank() should have failed with ErrConfigurationError, got: %v", err)
+	}
+
+	// so should overlapping ones
+	_, err = NewRegisterBank(&RegisterBankConfiguration{
+		Units: map[uint8]*RegisterBankUnitConfiguration{
+			1: {Coils: []BankRange{{First: 0, Last: 10}, {First: 10, Last: 20}}},
+		},
+	})
+	if err != ErrConfigurationError {
+		t.Errorf("NewRegisterBank() should have failed with ErrConfigurationError, got: %v", err)
+	}
+
+	// and units without a configuration
+	_, err = NewRegisterBank(&RegisterBankConfiguration{
+		Units: map[uint8]*RegisterBankUnitConfiguration{1: nil},
+	})
+	if err != ErrConfigurationError {
+		t.Errorf("NewRegisterBank() should have failed with ErrConfigurationError, got: %v", err)
+	}
+
+	// the same ranges may be used in different tables and units
+	_, err = NewRegisterBank(&RegisterBankConfiguration{
+		Units: map[uint8]*RegisterBankUnitConfiguration{
+			1: {
+				Coils:            []BankRange{{First: 0, Last: 0xffff}},
+				HoldingRegisters: []BankRange{{First: 0, Last: 10}, {First: 11, Last: 20}},
+			},
+			2: {HoldingRegisters: []BankRange{{First: 0, Last: 10}}},
+		},
+	})
+	if err != nil {
+		t.Errorf("NewRegisterBank() should have succeeded, got: %v", err)
+	}
+
+	return
+}
+
+func TestRegisterBank(t *testing.T) {
+	var err error
+	var rb *RegisterBank
+	var server *ModbusServer
+	var client *ModbusClient
+	var regs []uint16
+	var coils []bool
+	var f32 float32
+	var u32 uint32
+	var str string
+	var writes []uint16
+	var errVeto = errors.New("vetoed")
+
+	rb, err = NewRegisterBank(&RegisterBankConfiguration{
+		Units: map[uint8]*RegisterBankUnitConfiguration{
+			1: {
+				Coils:          []BankRange{{First: 0, Last: 7}},
+				DiscreteInputs: []BankRange{{First: 100, Last: 101}},
+				HoldingRegisters: []BankRange{
+					{First: 0, Last: 9},
+					{First: 10, Last: 19, Access: BANK_READ_ONLY},
+					{First: 20, Last: 21, Access: BANK_WRITE_PROTECTED},
+				},
+				InputRegisters: []BankRange{{First: 0x1000, Last: 0x1003}},
+			},
+			7: {
+				HoldingRegisters: []BankRange{{First: 0, Last: 1}},
+			},
+		},
+		OnRegistersWrite: func(unitId uint8, addr uint16, values []uint16) (err error) {
+			// values of 0xdead are refused
+			for _, v := range values {
+				if v == 0xdead {
+					err = errVeto
+					return
+				}
+			}
+			writes = append(writes, addr)
+
+			return
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create register bank: %v", err)
+	}
+
+	if ids := rb.UnitIds(); len(ids) != 2 || ids[0] != 1 || ids[1] != 7 {
+		t.Errorf("expected unit ids [1 7], got: %v", ids)
+	}
+
+	// typed setters follow the bank encoding
+	err = rb.SetEncoding(LITTLE_ENDIAN, LOW_WORD_FIRST)
+	if err != nil {
+		t.Fatalf("SetEncoding() should have succeeded, got: %v", err)
+	}
+	err = rb.SetFloat32(1, INPUT_REGISTER, 0x1000, 12.5)
+	if err != nil {
+		t.Errorf("SetFloat32() should have succeeded, got: %v", err)
+	}
+	err = rb.SetUint32(1, HOLDING_REGISTER, 10, 0x11223344)
+	if err != nil {
+		t.Errorf("SetUint32() should have succeeded, got: %v", err)
+	}
+	err = rb.SetString(1, INPUT_REGISTER, 0x1002, 2, "abc")
+	if err != nil {
+		t.Errorf("SetString() should have succeeded, got: %v", err)
+	}
+	err = rb.SetDiscreteInput(1, 101, true)
+	if err != nil {
+		t.Errorf("SetDiscreteInput() should have succeeded, got: %v", err)
+	}
+
+	// setters ignore client access rights but not address ranges
+	err = rb.SetFloat32(1, INPUT_REGISTER, 0x1003, 1)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("SetFloat32() should have failed with ErrIllegalDataAddress, got: %v", err)
+	}
+	err = rb.SetRegister(3, HOLDING_REGISTER, 0, 1)
+	if err != ErrGWPathUnavailable {
+		t.Errorf("SetRegister() should have failed with ErrGWPathUnavailable, got: %v", err)
+	}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL: "tcp://localhost:5502",
+	}, rb)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	err = server.Start()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "tcp://localhost:5502",
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	err = client.Open()
+	if err != nil {
+		t.Fatalf("failed to open client: %v", err)
+	}
+	defer client.Close()
+
+	client.SetUnitId(1)
+	client.SetEncoding(LITTLE_ENDIAN, LOW_WORD_FIRST)
+
+	f32, err = client.ReadFloat32(0x1000, INPUT_REGISTER)
+	if err != nil || f32 != 12.5 {
+		t.Errorf("expected 12.5, got: %v (%v)", f32, err)
+	}
+	u32, err = client.ReadUint32(10, HOLDING_REGISTER)
+	if err != nil || u32 != 0x11223344 {
+		t.Errorf("expected 0x11223344, got: 0x%08x (%v)", u32, err)
+	}
+	str, err = client.ReadString(0x1002, 2, INPUT_REGISTER)
+	if err != nil || str != "abc" {
+		t.Errorf("expected \"abc\", got: %q (%v)", str, err)
+	}
+	coils, err = client.ReadDiscreteInputs(100, 2)
+	if err != nil || len(coils) != 2 || coils[0] || !coils[1] {
+		t.Errorf("expected [false true], got: %v (%v)", coils, err)
+	}
+
+	// reads spanning unallocated addresses should fail
+	_, err = client.ReadRegisters(0x0fff, 2, INPUT_REGISTER)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("expected ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// reads may span contiguous ranges
+	regs, err = client.ReadRegisters(8, 4, HOLDING_REGISTER)
+	if err != nil || len(regs) != 4 {
+		t.Errorf("expected 4 registers, got: %v (%v)", regs, err)
+	}
+
+	// raw register values are stored big endian
+	client.SetEncoding(BIG_ENDIAN, HIGH_WORD_FIRST)
+
+	// client writes go through the callback then land in the bank
+	err = client.WriteRegisters(2, []uint16{0x1234, 0x5678})
+	if err != nil {
+		t.Errorf("WriteRegisters() should have succeeded, got: %v", err)
+	}
+	regs, err = rb.Registers(1, HOLDING_REGISTER, 2, 2)
+	if err != nil || regs[0] != 0x1234 || regs[1] != 0x5678 {
+		t.Errorf("expected [0x1234 0x5678], got: %v (%v)", regs, err)
+	}
+	if len(writes) != 1 || writes[0] != 2 {
+		t.Errorf("expected a single callback for address 2, got: %v", writes)
+	}
+
+	// callback errors veto the write
+	err = client.WriteRegister(2, 0xdead)
+	if err != ErrServerDeviceFailure {
+		t.Errorf("expected ErrServerDeviceFailure, got: %v", err)
+	}
+	regs, _ = rb.Registers(1, HOLDING_REGISTER, 2, 1)
+	if regs[0] != 0x1234 {
+		t.Errorf("expected 0x1234, got: 0x%04x", regs[0])
+	}
+
+	// read-only ranges reject client writes
+	err = client.WriteRegister(10, 1)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("expected ErrIllegalDataAddress, got: %v", err)
+	}
+	// including writes partially overlapping them, which leave the bank untouched
+	err = client.WriteRegisters(9, []uint16{1, 2})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("expected ErrIllegalDataAddress, got: %v", err)
+	}
+	regs, _ = rb.Registers(1, HOLDING_REGISTER, 9, 1)
+	if regs[0] != 0 {
+		t.Errorf("expected 0, got: 0x%04x", regs[0])
+	}
+
+	// write-protected ranges until the protection is lifted
+	err = client.WriteRegister(20, 1)
+	if err != ErrIllegalDataValue {
+		t.Errorf("expected ErrIllegalDataValue, got: %v", err)
+	}
+	err = rb.SetWriteProtection(1, false)
+	if err != nil {
+		t.Errorf("SetWriteProtection() should have succeeded, got: %v", err)
+	}
+	err = client.WriteRegister(20, 1)
+	if err != nil {
+		t.Errorf("WriteRegister() should have succeeded, got: %v", err)
+	}
+
+	// mask write and read/write multiple registers
+	err = client.MaskWriteRegister(2, 0xff00, 0x00aa)
+	if err != nil {
+		t.Errorf("MaskWriteRegister() should have succeeded, got: %v", err)
+	}
+	regs, err = client.ReadWriteRegisters(2, 1, 4, []uint16{0x0004})
+	if err != nil || len(regs) != 1 || regs[0] != 0x12aa {
+		t.Errorf("expected [0x12aa], got: %v (%v)", regs, err)
+	}
+	regs, _ = rb.Registers(1, HOLDING_REGISTER, 4, 1)
+	if regs[0] != 0x0004 {
+		t.Errorf("expected 0x0004, got: 0x%04x", regs[0])
+	}
+
+	// coils
+	err = client.WriteCoils(1, []bool{true, true})
+	if err != nil {
+		t.Errorf("WriteCoils() should have succeeded, got: %v", err)
+	}
+	coils, err = rb.Coils(1, 0, 3)
+	if err != nil || coils[0] || !coils[1] || !coils[2] {
+		t.Errorf("expected [false true true], got: %v (%v)", coils, err)
+	}
+	err = client.WriteCoil(8, true)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("expected ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// unit ids unknown to the bank
+	client.SetUnitId(3)
+	_, err = client.ReadRegister(0, HOLDING_REGISTER)
+	if err != ErrGWPathUnavailable {
+		t.Errorf("expected ErrGWPathUnavailable, got: %v", err)
+	}
+
+	return
+}
+
+func TestRegisterBankConcurrentMaskWrites(t *testing.T) {
+	var err error
+	var rb *RegisterBank
+	var wg sync.WaitGroup
+	var regs []uint16
+
+	rb, err = NewRegisterBank(&RegisterBankConfiguration{
+		Units: map[uint8]*RegisterBankUnitConfiguration{
+			1: {HoldingRegisters: []BankRange{{First: 0, Last: 0}}},
+		},
+		// widen the window between the read and the write of mask writes
+		OnRegistersWrite: func(unitId uint8, addr uint16, values []uint16) error {
+			time.Sleep(time.Millisecond)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRegisterBank() should have succeeded, got: %v", err)
+	}
+
+	// each mask write sets its own bit: none of them should be lost
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(bit uint16) {
+			defer wg.Done()
+			err := rb.HandleMaskWriteRegister(&MaskWriteRegisterRequest{
+				UnitId:  1,
+				Addr:    0,
+				AndMask: ^bit,
+				OrMask:  bit,
+			})
+			if err != nil {
+				t.Errorf("HandleMaskWriteRegister() should have succeeded, got: %v", err)
+			}
+		}(1 << i)
+	}
+	wg.Wait()
+
+	regs, err = rb.Registers(1, HOLDING_REGISTER, 0, 1)
+	if err != nil || regs[0] != 0xffff {
+		t.Errorf("expected 0xffff, got: %v (%v)", regs, err)
+	}
+
+	return
+}
@@ -0,0 +1,163 @@
+package modbus
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Replay link object, standing in for a socket or a serial port to feed a
+// recorded trace back into a transport, frame by frame and without delay.
+// Writes must match the next frame sent in the trace, while reads return
+// the frames received in the trace once all previous frames were played.
+// Reads time out immediately when the trace expects a frame to be sent next,
+// or when the trace is exhausted, just as if the remote end went silent.
+type replayLink struct {
+	lock   sync.Mutex
+	logger *logger
+	trace  *frameTrace
+	path   string
+	// index of the next frame to play
+	next int
+	// unread part of the frame being received
+	rxbuf []byte
+	// first mismatch seen, if any
+	err error
+}
+
+// Returns a new replay link over trace (loaded from path).
+func newReplayLink(trace *frameTrace, path string, l *logger) (rl *replayLink) {
+	rl = &replayLink{
+		logger: l,
+		trace:  trace,
+		path:   path,
+	}
+
+	return
+}
+
+// Returns the recorded frames received in a row, as if they came off the wire.
+func (rl *replayLink) Read(buf []byte) (n int, err error) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if len(rl.rxbuf) == 0 {
+		if rl.next >= len(rl.trace.frames) || rl.trace.frames[rl.next].direction != frameReceived {
+			err = os.ErrDeadlineExceeded
+			return
+		}
+
+		rl.rxbuf = rl.trace.frames[rl.next].adu
+		rl.next++
+	}
+
+	n = copy(buf, rl.rxbuf)
+	rl.rxbuf = rl.rxbuf[n:]
+
+	return
+}
+
+// Checks buf against the next frame sent in the trace.
+func (rl *replayLink) Write(buf []byte) (n int, err error) {
+	var frame tracedFrame
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if rl.next >= len(rl.trace.frames) {
+		rl.logger.Errorf("replay: unexpected frame % x past the end of the trace", buf)
+		err = rl.mismatch()
+		return
+	}
+
+	frame = rl.trace.frames[rl.next]
+	if frame.direction != frameSent {
+		rl.logger.Errorf("replay: unexpected frame % x, expected to receive % x (recorded at %v)",
+			buf, frame.adu, frame.at)
+		err = rl.mismatch()
+		return
+	}
+
+	if !bytes.Equal(buf, frame.adu) {
+		rl.logger.Errorf("replay: sent frame % x, expected % x (recorded at %v)",
+			buf, frame.adu, frame.at)
+		err = rl.mismatch()
+		return
+	}
+
+	// frames left unread are dropped, as a transport would not read them
+	// any more
+	rl.rxbuf = nil
+	rl.next++
+	n = len(buf)
+
+	return
+}
+
+// Returns ErrReplayMismatch if any frame didn't match the trace or if part
+// of the trace was left unplayed.
+func (rl *replayLink) Close() (err error) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if rl.err == nil && rl.next < len(rl.trace.frames) {
+		rl.logger.Errorf("replay: %v of %v frames left unplayed",
+			len(rl.trace.frames)-rl.next, len(rl.trace.frames))
+		rl.err = ErrReplayMismatch
+	}
+	err = rl.err
+
+	return
+}
+
+// Deadlines are irrelevant since reads never block.
+func (rl *replayLink) SetDeadline(deadline time.Time) (err error) {
+	return
+}
+
+func (rl *replayLink) SetReadDeadline(deadline time.Time) (err error) {
+	return
+}
+
+func (rl *replayLink) SetWriteDeadline(deadline time.Time) (err error) {
+	return
+}
+
+func (rl *replayLink) LocalAddr() (addr net.Addr) {
+	addr = replayAddr(rl.path)
+
+	return
+}
+
+func (rl *replayLink) RemoteAddr() (addr net.Addr) {
+	addr = replayAddr(rl.path)
+
+	return
+}
+
+// Records the first mismatch and returns ErrReplayMismatch.
+func (rl *replayLink) mismatch() (err error) {
+	err = ErrReplayMismatch
+	if rl.err == nil {
+		rl.err = err
+	}
+
+	return
+}
+
+// Address of a replay link, i.e. the path of its trace.
+type replayAddr string
+
+func (ra replayAddr) Network() (network string) {
+	network = "replay"
+
+	return
+}
+
+func (ra replayAddr) String() (addr string) {
+	addr = string(ra)
+
+	return
+}
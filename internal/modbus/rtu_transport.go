@@ -1,14 +1,19 @@
 package modbus
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"time"
 )
 
 const (
 	maxRTUFrameLength int = 256
+	// returned when reading requests off a bus shared with other devices,
+	// on responses sent by these devices
+	errForeignResponse Error = "response of another device"
 )
 
 type rtuTransport struct {
@@ -18,6 +23,14 @@ type rtuTransport struct {
 	lastActivity time.Time
 	t35          time.Duration
 	t1           time.Duration
+	// bus level diagnostic counters, maintained when serving requests
+	// (nil in client mode)
+	diagnostics *serialDiagnostics
+	// when serving requests, give up on idle links (network sessions)
+	// rather than waiting for the next request (serial lines)
+	closeOnIdle bool
+	// records the frames sent and received, if set
+	capture *frameCapture
 }
 
 type rtuLink interface {
@@ -56,17 +69,23 @@ func (rt *rtuTransport) Close() (err error) {
 }
 
 // Runs a request across the rtu link and returns a response.
-func (rt *rtuTransport) ExecuteRequest(req *pdu) (res *pdu, err error) {
+// Cancelling ctx interrupts any i/o in flight.
+func (rt *rtuTransport) ExecuteRequest(ctx context.Context, req *pdu) (res *pdu, err error) {
 	var ts time.Time
 	var t time.Duration
 	var n int
+	var frame []byte
+	var stop func()
 
 	// set an i/o deadline on the link
-	err = rt.link.SetDeadline(time.Now().Add(rt.timeout))
+	err = rt.link.SetDeadline(requestDeadline(ctx, rt.timeout))
 	if err != nil {
 		return
 	}
 
+	// interrupt i/o as soon as the context is done
+	stop = watchContext(ctx, rt.link)
+
 	// if the line was active less than 3.5 char times ago,
 	// let t3.5 expire before transmitting
 	t = time.Since(rt.lastActivity.Add(rt.t35))
@@ -78,10 +97,13 @@ func (rt *rtuTransport) ExecuteRequest(req *pdu) (res *pdu, err error) {
 
 	// build an RTU ADU out of the request object and
 	// send the final ADU+CRC on the wire
-	n, err = rt.link.Write(rt.assembleRTUFrame(req))
+	frame = rt.assembleRTUFrame(req)
+	n, err = rt.link.Write(frame)
 	if err != nil {
+		stop()
 		return
 	}
+	rt.capture.record(frameSent, frame)
 
 	// estimate how long the serial line was busy for.
 	// note that on most platforms, Write() will be buffered and return
@@ -93,6 +115,13 @@ func (rt *rtuTransport) ExecuteRequest(req *pdu) (res *pdu, err error) {
 
 	// read the response back from the wire
 	res, err = rt.readRTUFrame()
+	stop()
+
+	// flush the remainder of responses interrupted by a cancellation,
+	// if any, so they don't get mistaken for the next response
+	if err != nil && ctx.Err() != nil {
+		discard(rt.link)
+	}
 
 	if err == ErrBadCRC || err == ErrProtocolError || err == ErrShortFrame {
 		// wait for and flush any data coming off the link to allow
@@ -110,23 +139,81 @@ func (rt *rtuTransport) ExecuteRequest(req *pdu) (res *pdu, err error) {
 }
 
 // Reads a request from the rtu link.
+// Idle periods, corrupted frames, frames carrying unknown function codes and
+// responses of other devices are skipped until either a valid request is
+// received or an unrecoverable i/o error occurs (e.g. the link was closed).
 func (rt *rtuTransport) ReadRequest() (req *pdu, err error) {
-	// reading requests from RTU links is currently unsupported
-	err = fmt.Errorf("unimplemented")
+	for {
+		req, err = rt.readRTURequestFrame()
+
+		// keep listening if the line was idle
+		if err == ErrRequestTimedOut || os.IsTimeout(err) {
+			if rt.closeOnIdle {
+				return
+			}
+			continue
+		}
+
+		if err == ErrBadCRC && rt.diagnostics != nil {
+			rt.diagnostics.countBusCommError()
+		}
+
+		// responses of other devices sharing the bus are none of our business
+		if err == errForeignResponse {
+			if rt.diagnostics != nil {
+				rt.diagnostics.countBusMessage()
+			}
+			continue
+		}
+
+		if err == ErrBadCRC || err == ErrProtocolError || err == ErrShortFrame {
+			rt.logger.Warningf("discarding invalid frame: %v", err)
+			// flush the rest of the frame to allow the transport to re-sync
+			// on the next one
+			err = rt.discardFrame()
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		if err != nil {
+			return
+		}
+
+		// mark the end of the request
+		rt.lastActivity = time.Now()
+
+		if rt.diagnostics != nil {
+			rt.diagnostics.countBusMessage()
+		}
+
+		break
+	}
 
 	return
 }
 
 // Writes a response to the rtu link.
 func (rt *rtuTransport) WriteResponse(res *pdu) (err error) {
+	var t time.Duration
 	var n int
+	var frame []byte
+
+	// let t3.5 expire after the end of the request before replying
+	t = time.Since(rt.lastActivity.Add(rt.t35))
+	if t < 0 {
+		time.Sleep(t * (-1))
+	}
 
 	// build an RTU ADU out of the request object and
 	// send the final ADU+CRC on the wire
-	n, err = rt.link.Write(rt.assembleRTUFrame(res))
+	frame = rt.assembleRTUFrame(res)
+	n, err = rt.link.Write(frame)
 	if err != nil {
 		return
 	}
+	rt.capture.record(frameSent, frame)
 
 	rt.lastActivity = time.Now().Add(rt.t1 * time.Duration(n))
 
@@ -138,6 +225,7 @@ func (rt *rtuTransport) readRTUFrame() (res *pdu, err error) {
 	var rxbuf []byte
 	var byteCount int
 	var bytesNeeded int
+	var bytesReceived int
 	var crc crc
 
 	rxbuf = make([]byte, maxRTUFrameLength)
@@ -159,6 +247,27 @@ func (rt *rtuTransport) readRTUFrame() (res *pdu, err error) {
 		return
 	}
 
+	// read device identification responses end with a variable-length
+	// object list, which has to be walked before reaching the CRC
+	if rxbuf[1] == fcEncapsulatedInterface {
+		bytesNeeded, err = rt.readDeviceIdObjectList(rxbuf, bytesNeeded)
+		if err != nil {
+			return
+		}
+		bytesReceived = bytesNeeded
+	}
+
+	// read FIFO queue responses carry a 2-byte byte count field: read its
+	// low byte to figure out how many further bytes to read
+	if rxbuf[1] == fcReadFifoQueue {
+		err = rt.readFrameBytes(rxbuf[3:4])
+		if err != nil {
+			return
+		}
+		bytesReceived = 1
+		bytesNeeded = 1 + int(bytesToUint16(BIG_ENDIAN, rxbuf[2:4]))
+	}
+
 	// we need to read 2 additional bytes of CRC after the payload
 	bytesNeeded += 2
 
@@ -168,16 +277,21 @@ func (rt *rtuTransport) readRTUFrame() (res *pdu, err error) {
 		return
 	}
 
-	byteCount, err = io.ReadFull(rt.link, rxbuf[3:3+bytesNeeded])
+	byteCount, err = io.ReadFull(rt.link, rxbuf[3+bytesReceived:3+bytesNeeded])
 	if err != nil && err != io.ErrUnexpectedEOF {
 		return
 	}
-	if byteCount != bytesNeeded {
-		rt.logger.Warningf("expected %v bytes, received %v", bytesNeeded, byteCount)
+	if byteCount != bytesNeeded-bytesReceived {
+		rt.logger.Warningf("expected %v bytes, received %v",
+			bytesNeeded-bytesReceived, byteCount)
 		err = ErrShortFrame
 		return
 	}
 
+	// corrupted frames are captured too, as they may be what a capture
+	// is after
+	rt.capture.record(frameReceived, rxbuf[0:3+bytesNeeded])
+
 	// compute the CRC on the entire frame, excluding the CRC
 	crc.init()
 	crc.add(rxbuf[0 : 3+bytesNeeded-2])
@@ -198,6 +312,231 @@ func (rt *rtuTransport) readRTUFrame() (res *pdu, err error) {
 	return
 }
 
+// Reads the fixed-size fields (fixedLength bytes) and the object list of a read
+// device identification response into rxbuf, right after the 3-byte header.
+// Returns the number of bytes read.
+func (rt *rtuTransport) readDeviceIdObjectList(rxbuf []byte, fixedLength int) (byteCount int, err error) {
+	var objectCount int
+	var objectLength int
+
+	err = rt.readFrameBytes(rxbuf[3 : 3+fixedLength])
+	if err != nil {
+		return
+	}
+	byteCount = fixedLength
+
+	// the number of objects is the last fixed-size field
+	objectCount = int(rxbuf[3+fixedLength-1])
+
+	for i := 0; i < objectCount; i++ {
+		// object id and object length, leaving room for the CRC
+		if 3+byteCount+2+2 > maxRTUFrameLength {
+			err = ErrProtocolError
+			return
+		}
+
+		err = rt.readFrameBytes(rxbuf[3+byteCount : 3+byteCount+2])
+		if err != nil {
+			return
+		}
+		objectLength = int(rxbuf[3+byteCount+1])
+		byteCount += 2
+
+		// object value
+		if 3+byteCount+objectLength+2 > maxRTUFrameLength {
+			err = ErrProtocolError
+			return
+		}
+
+		err = rt.readFrameBytes(rxbuf[3+byteCount : 3+byteCount+objectLength])
+		if err != nil {
+			return
+		}
+		byteCount += objectLength
+	}
+
+	return
+}
+
+// Waits for, reads and decodes a request frame from the rtu link.
+// As other devices may share the bus, frames are delimited by trying both the
+// request and the response lengths implied by their header: the frame ends
+// with the first candidate length carrying a valid CRC (see nextRTUFrame()).
+// Responses of other devices are reported as errForeignResponse.
+func (rt *rtuTransport) readRTURequestFrame() (req *pdu, err error) {
+	var rxbuf []byte
+	var maybeRequest bool
+	var maybeResponse bool
+	var requestLength int
+	var responseLength int
+	var badCRC bool
+	var crc crc
+
+	rxbuf = make([]byte, 2, maxRTUFrameLength)
+
+	// wait for the first byte of a frame to come in
+	err = rt.link.SetDeadline(time.Now().Add(rt.timeout))
+	if err != nil {
+		return
+	}
+
+	_, err = io.ReadFull(rt.link, rxbuf[0:1])
+	if err != nil {
+		return
+	}
+
+	// the rest of the frame is expected to follow without any idle period
+	err = rt.link.SetDeadline(time.Now().Add(rt.timeout))
+	if err != nil {
+		return
+	}
+
+	// read the function code
+	err = rt.readFrameBytes(rxbuf[1:2])
+	if err != nil {
+		return
+	}
+
+	// frames carrying unknown function codes can't be delimited
+	_, err = expectedRequestHeaderLength(rxbuf[1])
+	maybeRequest = err == nil
+	_, err = expectedResponseLenth(rxbuf[1], 0)
+	maybeResponse = err == nil
+	err = nil
+	if !maybeRequest && !maybeResponse {
+		err = ErrProtocolError
+		return
+	}
+
+	for {
+		// candidate lengths are 0 until enough of the header came in
+		if maybeRequest {
+			requestLength = rtuRequestFrameLength(rxbuf)
+		}
+		if maybeResponse {
+			responseLength = rtuResponseFrameLength(rxbuf)
+		}
+
+		if len(rxbuf) >= 4 &&
+			(len(rxbuf) == requestLength || len(rxbuf) == responseLength) {
+			crc.init()
+			crc.add(rxbuf[0 : len(rxbuf)-2])
+			if crc.isEqual(rxbuf[len(rxbuf)-2], rxbuf[len(rxbuf)-1]) {
+				break
+			}
+			badCRC = true
+		}
+
+		// keep reading while a candidate may still end the frame, but never
+		// more than the max allowed frame length
+		if len(rxbuf) < maxRTUFrameLength &&
+			(rtuCandidatePending(maybeRequest, requestLength, len(rxbuf)) ||
+				rtuCandidatePending(maybeResponse, responseLength, len(rxbuf))) {
+			rxbuf = rxbuf[0 : len(rxbuf)+1]
+			err = rt.readFrameBytes(rxbuf[len(rxbuf)-1:])
+			if err == nil {
+				continue
+			}
+			rxbuf = rxbuf[0 : len(rxbuf)-1]
+			// frames ending short of a longer candidate are only short if
+			// no other candidate had a chance to match
+			if err != ErrShortFrame {
+				return
+			}
+		}
+
+		switch {
+		case len(rxbuf) == maxRTUFrameLength ||
+			requestLength > maxRTUFrameLength || responseLength > maxRTUFrameLength:
+			if rt.diagnostics != nil {
+				rt.diagnostics.countBusCharacterOverrun()
+			}
+			err = ErrProtocolError
+		case badCRC:
+			rt.capture.record(frameReceived, rxbuf)
+			err = ErrBadCRC
+		default:
+			err = ErrShortFrame
+		}
+
+		return
+	}
+
+	// a response of another device, which happens to be as long as the
+	// request it answers (e.g. write single register) is taken as a request
+	if len(rxbuf) != requestLength {
+		err = errForeignResponse
+		return
+	}
+
+	rt.capture.record(frameReceived, rxbuf)
+
+	req = &pdu{
+		unitId:       rxbuf[0],
+		functionCode: rxbuf[1],
+		// pass the request fields as payload, without the CRC
+		payload: rxbuf[2 : len(rxbuf)-2],
+	}
+
+	return
+}
+
+// Returns true if a frame of length bytes may still turn out to be of the
+// candidate length, i.e. if the candidate is either unknown yet or longer.
+func rtuCandidatePending(possible bool, candidateLength int, length int) (pending bool) {
+	pending = possible && (candidateLength == 0 || length < candidateLength) &&
+		candidateLength <= maxRTUFrameLength
+
+	return
+}
+
+// Reads and drops anything coming off the link until it went quiet for t3.5,
+// i.e. until the end of the current frame.
+func (rt *rtuTransport) discardFrame() (err error) {
+	var rxbuf = make([]byte, maxRTUFrameLength)
+	var n int
+
+	for {
+		err = rt.link.SetDeadline(time.Now().Add(rt.t35))
+		if err != nil {
+			return
+		}
+
+		// serial ports may return early without any data, keep waiting
+		// until either data comes in or the deadline passes
+		for n == 0 && err == nil {
+			n, err = rt.link.Read(rxbuf)
+		}
+		if err == ErrRequestTimedOut || os.IsTimeout(err) {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		n = 0
+	}
+}
+
+// Reads exactly len(buf) bytes of an incoming frame from the rtu link.
+// Partial reads caused by a timeout are reported as ErrShortFrame.
+func (rt *rtuTransport) readFrameBytes(buf []byte) (err error) {
+	var byteCount int
+
+	byteCount, err = io.ReadFull(rt.link, buf)
+	if byteCount == len(buf) {
+		err = nil
+		return
+	}
+
+	if err == ErrRequestTimedOut || os.IsTimeout(err) || err == io.ErrUnexpectedEOF {
+		rt.logger.Warningf("expected %v bytes, received %v", len(buf), byteCount)
+		err = ErrShortFrame
+	}
+
+	return
+}
+
 // Turns a PDU object into bytes.
 func (rt *rtuTransport) assembleRTUFrame(p *pdu) (adu []byte) {
 	var crc crc
@@ -222,8 +561,21 @@ func expectedResponseLenth(responseCode uint8, responseLength uint8) (byteCount
 	case fcReadHoldingRegisters,
 		fcReadInputRegisters,
 		fcReadCoils,
-		fcReadDiscreteInputs:
+		fcReadDiscreteInputs,
+		fcReadWriteMultipleRegisters,
+		fcReadFileRecord,
+		fcWriteFileRecord,
+		fcGetCommEventLog,
+		fcReportServerId:
 		byteCount = int(responseLength)
+	case fcReadExceptionStatus:
+		// the output data byte is the only byte of payload
+		byteCount = 0
+	case fcDiagnostics,
+		fcGetCommEventCounter:
+		// sub-function (2 bytes) + data (2 bytes), or
+		// status (2 bytes) + event count (2 bytes)
+		byteCount = 3
 	case fcWriteSingleRegister,
 		fcWriteMultipleRegisters,
 		fcWriteSingleCoil,
@@ -231,6 +583,15 @@ func expectedResponseLenth(responseCode uint8, responseLength uint8) (byteCount
 		byteCount = 3
 	case fcMaskWriteRegister:
 		byteCount = 5
+	case fcReadFifoQueue:
+		// low byte of the byte count field (the rest of the response is
+		// variable-length, see readRTUFrame())
+		byteCount = 1
+	case fcEncapsulatedInterface:
+		// read device id code, conformity level, more follows, next object id
+		// and number of objects (the object list is variable-length, see
+		// readDeviceIdObjectList())
+		byteCount = 5
 	case fcReadHoldingRegisters | 0x80,
 		fcReadInputRegisters | 0x80,
 		fcReadCoils | 0x80,
@@ -239,8 +600,67 @@ func expectedResponseLenth(responseCode uint8, responseLength uint8) (byteCount
 		fcWriteMultipleRegisters | 0x80,
 		fcWriteSingleCoil | 0x80,
 		fcWriteMultipleCoils | 0x80,
-		fcMaskWriteRegister | 0x80:
+		fcMaskWriteRegister | 0x80,
+		fcReadWriteMultipleRegisters | 0x80,
+		fcReadFileRecord | 0x80,
+		fcWriteFileRecord | 0x80,
+		fcReadFifoQueue | 0x80,
+		fcReadExceptionStatus | 0x80,
+		fcDiagnostics | 0x80,
+		fcGetCommEventCounter | 0x80,
+		fcGetCommEventLog | 0x80,
+		fcReportServerId | 0x80,
+		fcEncapsulatedInterface | 0x80:
+		byteCount = 0
+	default:
+		err = ErrProtocolError
+	}
+
+	return
+}
+
+// Computes the length of the fixed-size fields following the function code
+// of a modbus RTU request.
+func expectedRequestHeaderLength(functionCode uint8) (byteCount int, err error) {
+	switch functionCode {
+	case fcReadCoils,
+		fcReadDiscreteInputs,
+		fcReadHoldingRegisters,
+		fcReadInputRegisters,
+		fcWriteSingleCoil,
+		fcWriteSingleRegister:
+		// address (2 bytes) + quantity or value (2 bytes)
+		byteCount = 4
+	case fcWriteMultipleCoils,
+		fcWriteMultipleRegisters:
+		// address (2 bytes) + quantity (2 bytes) + byte count (1 byte)
+		byteCount = 5
+	case fcMaskWriteRegister:
+		// address (2 bytes) + AND mask (2 bytes) + OR mask (2 bytes)
+		byteCount = 6
+	case fcReadWriteMultipleRegisters:
+		// read address (2 bytes) + read quantity (2 bytes) + write address
+		// (2 bytes) + write quantity (2 bytes) + byte count (1 byte)
+		byteCount = 9
+	case fcReadFileRecord,
+		fcWriteFileRecord:
+		// byte count (1 byte)
+		byteCount = 1
+	case fcReadFifoQueue:
+		// FIFO pointer address (2 bytes)
+		byteCount = 2
+	case fcReadExceptionStatus,
+		fcGetCommEventCounter,
+		fcGetCommEventLog,
+		fcReportServerId:
+		// no payload
 		byteCount = 0
+	case fcDiagnostics:
+		// sub-function (2 bytes) + data (2 bytes)
+		byteCount = 4
+	case fcEncapsulatedInterface:
+		// MEI type (1 byte) + read device id code (1 byte) + object id (1 byte)
+		byteCount = 3
 	default:
 		err = ErrProtocolError
 	}
@@ -248,6 +668,24 @@ func expectedResponseLenth(responseCode uint8, responseLength uint8) (byteCount
 	return
 }
 
+// Computes the length of the variable-size data following the header of a
+// modbus RTU request (see expectedRequestHeaderLength()).
+func expectedRequestDataLength(functionCode uint8, header []byte) (byteCount int) {
+	switch functionCode {
+	case fcWriteMultipleCoils,
+		fcWriteMultipleRegisters,
+		fcReadWriteMultipleRegisters,
+		fcReadFileRecord,
+		fcWriteFileRecord:
+		// the last header byte holds the byte count
+		byteCount = int(header[len(header)-1])
+	default:
+		byteCount = 0
+	}
+
+	return
+}
+
 // Discards the contents of the link's rx buffer, eating up to 1kB of data.
 // Note that on a serial line, this call may block for up to serialConf.Timeout
 // i.e. 10ms.
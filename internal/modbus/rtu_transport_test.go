@@ -143,6 +143,135 @@ func TestRTUTransportReadRTUFrame(t *testing.T) {
 	return
 }
 
+func TestRTUTransportReadRequest(t *testing.T) {
+	var rt *rtuTransport
+	var p1, p2 net.Conn
+	var txchan chan []byte
+	var err error
+	var req *pdu
+
+	txchan = make(chan []byte, 4)
+	p1, p2 = net.Pipe()
+	go feedTestPipe(t, txchan, p1)
+
+	rt = newRTUTransport(p2, "", 19200, 10*time.Millisecond, nil)
+
+	// push a frame with a bad crc
+	txchan <- []byte{
+		0x31, 0x03, // unit id and function code
+		0x00, 0x10, // base address
+		0x00, 0x02, // quantity
+		0xaa, 0xbb, // CRC
+	}
+	req, err = rt.readRTURequestFrame()
+	if err != ErrBadCRC {
+		t.Errorf("readRTURequestFrame() should have returned ErrBadCRC, got %v", err)
+	}
+
+	// push a valid read holding registers request
+	txchan <- []byte{
+		0x31, 0x03, // unit id and function code
+		0x00, 0x10, // base address
+		0x00, 0x02, // quantity
+		0xc0, 0x3e, // CRC
+	}
+
+	req, err = rt.ReadRequest()
+	if err != nil {
+		t.Errorf("ReadRequest() should have succeeded, got %v", err)
+	}
+	if req.unitId != 0x31 {
+		t.Errorf("expected 0x31 as unit id, got 0x%02x", req.unitId)
+	}
+	if req.functionCode != 0x03 {
+		t.Errorf("expected 0x03 as function code, got 0x%02x", req.functionCode)
+	}
+	if len(req.payload) != 4 {
+		t.Errorf("expected a length of 4, got %v", len(req.payload))
+	}
+	for i, b := range []byte{
+		0x00, 0x10,
+		0x00, 0x02,
+	} {
+		if req.payload[i] != b {
+			t.Errorf("expected 0x%02x at position %v, got 0x%02x",
+				b, i, req.payload[i])
+		}
+	}
+
+	// responses of other devices sharing the bus should be skipped, without
+	// being mistaken for corrupted requests
+	rt.diagnostics = &serialDiagnostics{}
+	txchan <- []byte{
+		0x05, 0x03, // unit id and function code
+		0x04,       // byte count
+		0x00, 0x01, // register #1
+		0x00, 0x02, // register #2
+		0x6f, 0xf2, // CRC
+	}
+	txchan <- []byte{
+		0x05, 0x10, // unit id and function code
+		0x00, 0x01, // base address
+		0x00, 0x02, // quantity
+		0x11, 0x8c, // CRC
+	}
+	txchan <- []byte{
+		0x31, 0x03, // unit id and function code
+		0x00, 0x10, // base address
+		0x00, 0x02, // quantity
+		0xc0, 0x3e, // CRC
+	}
+
+	req, err = rt.ReadRequest()
+	if err != nil {
+		t.Errorf("ReadRequest() should have succeeded, got %v", err)
+	}
+	if req == nil || req.unitId != 0x31 || req.functionCode != 0x03 {
+		t.Errorf("expected a read holding registers request from unit 0x31, got %v", req)
+	}
+	if rt.diagnostics.busCommErrorCount != 0 || rt.diagnostics.busMessageCount != 3 {
+		t.Errorf("expected no comm error and 3 bus messages, got: %v, %v",
+			rt.diagnostics.busCommErrorCount, rt.diagnostics.busMessageCount)
+	}
+	rt.diagnostics = nil
+
+	// push a write multiple registers request, carrying a byte count
+	txchan <- []byte{
+		0x01, 0x10, // unit id and function code
+		0x00, 0x01, // base address
+		0x00, 0x02, // quantity
+		0x04,       // byte count
+		0x00, 0x0a, // register #1
+		0x01, 0x02, // register #2
+		0x92, 0x30, // CRC
+	}
+
+	req, err = rt.ReadRequest()
+	if err != nil {
+		t.Errorf("ReadRequest() should have succeeded, got %v", err)
+	}
+	if req.unitId != 0x01 {
+		t.Errorf("expected 0x01 as unit id, got 0x%02x", req.unitId)
+	}
+	if req.functionCode != 0x10 {
+		t.Errorf("expected 0x10 as function code, got 0x%02x", req.functionCode)
+	}
+	if len(req.payload) != 9 {
+		t.Errorf("expected a length of 9, got %v", len(req.payload))
+	}
+
+	// closing the link should cause ReadRequest() to return an error
+	p1.Close()
+	req, err = rt.ReadRequest()
+	if req != nil || err == nil {
+		t.Errorf("ReadRequest() should have failed, got {%v, %v}", req, err)
+	}
+
+	p2.Close()
+
+	return
+}
+
 func feedTestPipe(t *testing.T, in chan []byte, out io.WriteCloser) {
 	var err error
 	var txbuf []byte
@@ -2,15 +2,49 @@ package modbus
 
 import (
 	"enman/internal/serial"
+	"fmt"
+	"sync"
 	"time"
 )
 
+// the kernel caps RTS delays to 100ms
+const maxRTSDelay = 100 * time.Millisecond
+
+// RS485 configuration object (rtu and ascii only, linux only).
+// When enabled, the serial driver toggles the RTS line around each
+// transmission to switch the direction of half-duplex RS485 transceivers,
+// which is required by adapters lacking automatic direction control.
+type RS485Configuration struct {
+	// Enabled puts the serial port in RS485 mode
+	Enabled bool
+	// DelayRtsBeforeSend sets the delay between RTS switching to its
+	// send level and the start of transmission (whole milliseconds,
+	// up to 100ms)
+	DelayRtsBeforeSend time.Duration
+	// DelayRtsAfterSend sets the delay between the end of transmission
+	// and RTS switching back to its receive level (whole milliseconds,
+	// up to 100ms)
+	DelayRtsAfterSend time.Duration
+	// RtsHighDuringSend drives RTS high while sending
+	RtsHighDuringSend bool
+	// RtsHighAfterSend drives RTS high after sending, i.e. while receiving.
+	// Exactly one of RtsHighDuringSend and RtsHighAfterSend may be set,
+	// RtsHighDuringSend is assumed if neither is.
+	RtsHighAfterSend bool
+	// RxDuringTx keeps the receiver enabled while sending (i.e. echoes
+	// transmitted bytes back on adapters looping them)
+	RxDuringTx bool
+}
+
 // serialPortWrapper wraps a serial.Port (i.e. physical port) to
 // 1) satisfy the rtuLink interface and
 // 2) add Read() deadline/timeout support.
 type serialPortWrapper struct {
-	conf     *serialPortConfig
-	port     serial.Port
+	conf *serialPortConfig
+	port serial.Port
+	// the deadline may be moved by another goroutine while a read is
+	// in progress (see watchContext())
+	lock     sync.Mutex
 	deadline time.Time
 }
 
@@ -20,6 +54,7 @@ type serialPortConfig struct {
 	DataBits uint
 	Parity   uint
 	StopBits uint
+	RS485    RS485Configuration
 }
 
 func newSerialPortWrapper(conf *serialPortConfig) (spw *serialPortWrapper) {
@@ -49,6 +84,14 @@ func (spw *serialPortWrapper) Open() (err error) {
 		Parity:   parity,
 		StopBits: int(spw.conf.StopBits),
 		Timeout:  10 * time.Millisecond,
+		RS485: serial.RS485Config{
+			Enabled:            spw.conf.RS485.Enabled,
+			DelayRtsBeforeSend: spw.conf.RS485.DelayRtsBeforeSend,
+			DelayRtsAfterSend:  spw.conf.RS485.DelayRtsAfterSend,
+			RtsHighDuringSend:  spw.conf.RS485.RtsHighDuringSend,
+			RtsHighAfterSend:   spw.conf.RS485.RtsHighAfterSend,
+			RxDuringTx:         spw.conf.RS485.RxDuringTx,
+		},
 	})
 
 	return
@@ -76,8 +119,14 @@ func (spw *serialPortWrapper) Close() (err error) {
 // as many times as necessary until either enough bytes have been read or an
 // error is returned (ErrRequestTimedOut or any other i/o error).
 func (spw *serialPortWrapper) Read(rxbuf []byte) (cnt int, err error) {
+	var deadline time.Time
+
+	spw.lock.Lock()
+	deadline = spw.deadline
+	spw.lock.Unlock()
+
 	// return a timeout error if the deadline has passed
-	if time.Now().After(spw.deadline) {
+	if time.Now().After(deadline) {
 		err = ErrRequestTimedOut
 		return
 	}
@@ -100,7 +149,38 @@ func (spw *serialPortWrapper) Write(txbuf []byte) (cnt int, err error) {
 
 // Saves the i/o deadline (only used by Read).
 func (spw *serialPortWrapper) SetDeadline(deadline time.Time) (err error) {
+	spw.lock.Lock()
 	spw.deadline = deadline
+	spw.lock.Unlock()
+
+	return
+}
+
+// Checks RS485 settings and fills in the default RTS level.
+func checkRS485Configuration(rc *RS485Configuration) (err error) {
+	if !rc.Enabled {
+		if *rc != (RS485Configuration{}) {
+			err = fmt.Errorf("RS485 settings require RS485 mode to be enabled")
+		}
+		return
+	}
+
+	for _, delay := range []time.Duration{rc.DelayRtsBeforeSend, rc.DelayRtsAfterSend} {
+		if delay < 0 || delay > maxRTSDelay || delay%time.Millisecond != 0 {
+			err = fmt.Errorf("invalid RTS delay %v, expected whole milliseconds up to %v",
+				delay, maxRTSDelay)
+			return
+		}
+	}
+
+	if rc.RtsHighDuringSend && rc.RtsHighAfterSend {
+		err = fmt.Errorf("RTS cannot be high both during and after send")
+		return
+	}
+
+	if !rc.RtsHighAfterSend {
+		rc.RtsHighDuringSend = true
+	}
 
 	return
 }
@@ -0,0 +1,289 @@
+package modbus
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Registry of the serial buses opened by clients, indexed by device.
+// Clients created for the same serial device (e.g. two energy systems polling
+// different meters on /dev/ttyUSB0) share the port and take turns on the
+// bus rather than opening the device twice and corrupting each other's
+// frames.
+var serialBuses = struct {
+	lock  sync.Mutex
+	buses map[string]*serialBus
+}{
+	buses: make(map[string]*serialBus),
+}
+
+// Serial bus object, shared by all clients of a serial device.
+type serialBus struct {
+	conf    serialPortConfig
+	mode    transportType
+	link    rtuLink
+	arbiter busArbiter
+	// number of open client transports, the port is closed with the last one
+	users int
+	// end of the last rtu frame seen on the bus, handed over from one
+	// client transport to the next (guarded by the arbiter)
+	lastActivity time.Time
+}
+
+// Per-client transport over a shared serial bus.
+type busTransport struct {
+	bus       *serialBus
+	transport transport
+	// set in rtu mode, to carry the inter-frame gap across clients
+	rt     *rtuTransport
+	closed sync.Once
+}
+
+// Bus arbiter object, granting access to the bus one request at a time,
+// control writes first and polling reads in the order they were made.
+type busArbiter struct {
+	lock   sync.Mutex
+	busy   bool
+	writes []chan struct{}
+	reads  []chan struct{}
+}
+
+// Returns a transport over the serial bus of conf.Device, opening the port
+// if no other client did already. All clients of a device must use the same
+// mode and serial settings, timeouts may differ.
+func openBusTransport(conf *serialPortConfig, mode transportType, timeout time.Duration,
+	customLogger *log.Logger) (bt *busTransport, err error) {
+	var bus *serialBus
+	var spw *serialPortWrapper
+	var ok bool
+
+	serialBuses.lock.Lock()
+	defer serialBuses.lock.Unlock()
+
+	bus, ok = serialBuses.buses[conf.Device]
+	if ok {
+		if bus.mode != mode || bus.conf != *conf {
+			err = fmt.Errorf("%s is already in use with other settings", conf.Device)
+			return
+		}
+	} else {
+		// open the serial device
+		spw = newSerialPortWrapper(conf)
+		err = spw.Open()
+		if err != nil {
+			return
+		}
+
+		// discard potentially stale serial data
+		discard(spw)
+
+		bus = &serialBus{
+			conf: *conf,
+			mode: mode,
+			link: spw,
+		}
+
+		serialBuses.buses[conf.Device] = bus
+	}
+
+	bus.users++
+
+	bt = &busTransport{
+		bus: bus,
+	}
+
+	// the port is closed by the bus rather than by client transports
+	if mode == modbusASCII {
+		bt.transport = newASCIITransport(
+			busLink{bus.link}, conf.Device, timeout, customLogger)
+	} else {
+		bt.rt = newRTUTransport(
+			busLink{bus.link}, conf.Device, conf.Speed, timeout, customLogger)
+		bt.transport = bt.rt
+	}
+
+	return
+}
+
+// Releases the bus, closing the serial port if this was its last user.
+func (bt *busTransport) Close() (err error) {
+	bt.closed.Do(func() {
+		serialBuses.lock.Lock()
+		defer serialBuses.lock.Unlock()
+
+		bt.bus.users--
+		if bt.bus.users > 0 {
+			return
+		}
+
+		// failed buses are closed already (see fail())
+		if serialBuses.buses[bt.bus.conf.Device] != bt.bus {
+			return
+		}
+		delete(serialBuses.buses, bt.bus.conf.Device)
+		err = bt.bus.link.Close()
+	})
+
+	return
+}
+
+// Waits for the bus to be available, then runs a request across it.
+func (bt *busTransport) ExecuteRequest(ctx context.Context, req *pdu) (res *pdu, err error) {
+	var ok bool
+
+	err = bt.bus.arbiter.acquire(ctx, isControlRequest(req))
+	if err != nil {
+		return
+	}
+	defer bt.bus.arbiter.release()
+
+	// let t3.5 expire after the last frame, whichever client sent it
+	if bt.rt != nil && bt.rt.lastActivity.Before(bt.bus.lastActivity) {
+		bt.rt.lastActivity = bt.bus.lastActivity
+	}
+
+	res, err = bt.transport.ExecuteRequest(ctx, req)
+
+	if bt.rt != nil {
+		bt.bus.lastActivity = bt.rt.lastActivity
+	}
+
+	// i/o errors other than timeouts (e.g. an unplugged USB adapter) leave
+	// the port unusable for all clients (see executeRequest())
+	if err != nil && ctx.Err() == nil && !os.IsTimeout(err) {
+		if _, ok = err.(Error); !ok {
+			bt.bus.fail()
+		}
+	}
+
+	return
+}
+
+// Client transports never read requests.
+func (bt *busTransport) ReadRequest() (req *pdu, err error) {
+	err = ErrUnexpectedParameters
+
+	return
+}
+
+// Client transports never write responses.
+func (bt *busTransport) WriteResponse(res *pdu) (err error) {
+	err = ErrUnexpectedParameters
+
+	return
+}
+
+// Removes a failed bus from the registry and closes its port, so that the
+// requests of other clients fail as well and reconnecting clients open the
+// device anew.
+func (bus *serialBus) fail() {
+	serialBuses.lock.Lock()
+	defer serialBuses.lock.Unlock()
+
+	if serialBuses.buses[bus.conf.Device] != bus {
+		return
+	}
+	delete(serialBuses.buses, bus.conf.Device)
+	bus.link.Close()
+
+	return
+}
+
+// Waits for the bus to be granted, either to a control write (priority set)
+// or to a read. Returns the context error if ctx is done first.
+func (ba *busArbiter) acquire(ctx context.Context, priority bool) (err error) {
+	var grant chan struct{}
+
+	ba.lock.Lock()
+	if !ba.busy {
+		ba.busy = true
+		ba.lock.Unlock()
+		return
+	}
+
+	grant = make(chan struct{})
+	if priority {
+		ba.writes = append(ba.writes, grant)
+	} else {
+		ba.reads = append(ba.reads, grant)
+	}
+	ba.lock.Unlock()
+
+	select {
+	case <-grant:
+	case <-ctx.Done():
+		ba.lock.Lock()
+		if removeGrant(&ba.writes, grant) || removeGrant(&ba.reads, grant) {
+			ba.lock.Unlock()
+		} else {
+			// the bus was granted in the meantime: pass it on
+			ba.lock.Unlock()
+			ba.release()
+		}
+		err = ctx.Err()
+	}
+
+	return
+}
+
+// Hands the bus over to the next waiting request, control writes first.
+func (ba *busArbiter) release() {
+	var grant chan struct{}
+
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	switch {
+	case len(ba.writes) > 0:
+		grant, ba.writes = ba.writes[0], ba.writes[1:]
+	case len(ba.reads) > 0:
+		grant, ba.reads = ba.reads[0], ba.reads[1:]
+	default:
+		ba.busy = false
+		return
+	}
+	close(grant)
+
+	return
+}
+
+// Removes grant from queue, returns false if it was not queued.
+func removeGrant(queue *[]chan struct{}, grant chan struct{}) (removed bool) {
+	for i := range *queue {
+		if (*queue)[i] == grant {
+			*queue = append((*queue)[:i], (*queue)[i+1:]...)
+			removed = true
+			return
+		}
+	}
+
+	return
+}
+
+// Returns true if req changes the state of the device, as opposed to
+// polling it.
+func isControlRequest(req *pdu) (control bool) {
+	switch req.functionCode {
+	case fcWriteSingleCoil, fcWriteMultipleCoils,
+		fcWriteSingleRegister, fcWriteMultipleRegisters,
+		fcMaskWriteRegister, fcReadWriteMultipleRegisters,
+		fcWriteFileRecord:
+		control = true
+	}
+
+	return
+}
+
+// Serial port of a bus as seen by client transports, which may not close it.
+type busLink struct {
+	rtuLink
+}
+
+// Leaves the port open, see busTransport.Close().
+func (bl busLink) Close() (err error) {
+	return
+}
@@ -0,0 +1,208 @@
+package modbus
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBusArbiter(t *testing.T) {
+	var ba busArbiter
+	var err error
+	var order []string
+	var orderLock sync.Mutex
+	var wg sync.WaitGroup
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	// waits for n requests to be queued
+	waitQueued := func(n int) {
+		for {
+			ba.lock.Lock()
+			queued := len(ba.writes) + len(ba.reads)
+			ba.lock.Unlock()
+			if queued == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// queues a request, then records when it is granted the bus
+	queue := func(name string, priority bool) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ba.acquire(context.Background(), priority); err != nil {
+				t.Errorf("acquire() should have succeeded, got: %v", err)
+				return
+			}
+			orderLock.Lock()
+			order = append(order, name)
+			orderLock.Unlock()
+			ba.release()
+		}()
+	}
+
+	// the bus is granted right away when free
+	err = ba.acquire(context.Background(), false)
+	if err != nil {
+		t.Fatalf("acquire() should have succeeded, got: %v", err)
+	}
+
+	queue("read 1", false)
+	waitQueued(1)
+	queue("read 2", false)
+	waitQueued(2)
+
+	// requests giving up while queued leave the queue
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	err = ba.acquire(ctx, true)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got: %v", err)
+	}
+	waitQueued(2)
+
+	// control writes overtake reads
+	queue("write", true)
+	waitQueued(3)
+
+	ba.release()
+	wg.Wait()
+
+	if len(order) != 3 || order[0] != "write" || order[1] != "read 1" || order[2] != "read 2" {
+		t.Errorf("expected [write read 1 read 2], got: %v", order)
+	}
+	if ba.busy {
+		t.Errorf("expected the bus to be free")
+	}
+
+	return
+}
+
+func TestSharedSerialBus(t *testing.T) {
+	var err error
+	var rb *RegisterBank
+	var server *ModbusServer
+	var c1 *ModbusClient
+	var c2 *ModbusClient
+	var c3 *ModbusClient
+	var p1, p2 net.Conn
+	var wg sync.WaitGroup
+	var device = "/dev/ttyBUSTEST0"
+
+	rb, err = NewRegisterBank(&RegisterBankConfiguration{
+		Units: map[uint8]*RegisterBankUnitConfiguration{
+			1: {HoldingRegisters: []BankRange{{First: 0, Last: 0}}},
+			2: {HoldingRegisters: []BankRange{{First: 0, Last: 0}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create register bank: %v", err)
+	}
+	rb.SetRegister(1, HOLDING_REGISTER, 0, 0x1111)
+	rb.SetRegister(2, HOLDING_REGISTER, 0, 0x2222)
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:     "rtu://" + device,
+		UnitIds: rb.UnitIds(),
+	}, rb)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	// stand in for the serial port with a pipe to the server
+	p1, p2 = net.Pipe()
+	defer p2.Close()
+	go server.handleTransport(
+		newRTUTransport(p2, "", 19200, 100*time.Millisecond, nil), "", "")
+
+	serialBuses.lock.Lock()
+	serialBuses.buses[device] = &serialBus{
+		conf: serialPortConfig{
+			Device:   device,
+			Speed:    19200,
+			DataBits: 8,
+			Parity:   PARITY_NONE,
+			StopBits: 2,
+		},
+		mode: modbusRTU,
+		link: p1,
+	}
+	serialBuses.lock.Unlock()
+
+	// both clients share the port, with their own timeout
+	for _, client := range []**ModbusClient{&c1, &c2} {
+		*client, err = NewClient(&ClientConfiguration{
+			URL:     "rtu://" + device,
+			Timeout: 200 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+		err = (*client).Open()
+		if err != nil {
+			t.Fatalf("Open() should have succeeded, got: %v", err)
+		}
+	}
+
+	// clients using other settings are turned away
+	c3, err = NewClient(&ClientConfiguration{
+		URL: "rtu://" + device + "?baud=9600",
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	err = c3.Open()
+	if err == nil {
+		t.Errorf("Open() should have failed")
+	}
+
+	// concurrent requests take turns on the bus
+	for i, client := range []*ModbusClient{c1, c2} {
+		wg.Add(1)
+		go func(unit *ModbusUnit, expected uint16) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				reg, err := unit.ReadRegister(context.Background(), 0, HOLDING_REGISTER)
+				if err != nil || reg != expected {
+					t.Errorf("expected 0x%04x, got: 0x%04x (%v)", expected, reg, err)
+					return
+				}
+				if j%5 == 0 {
+					err = unit.WriteRegister(context.Background(), 0, expected)
+					if err != nil {
+						t.Errorf("WriteRegister() should have succeeded, got: %v", err)
+						return
+					}
+				}
+			}
+		}(client.Unit(uint8(i+1)), uint16(0x1111*(i+1)))
+	}
+	wg.Wait()
+
+	// the port is closed along with the last client
+	c1.Close()
+	serialBuses.lock.Lock()
+	if serialBuses.buses[device] == nil {
+		t.Errorf("expected the bus to stay open")
+	}
+	serialBuses.lock.Unlock()
+
+	c2.Close()
+	serialBuses.lock.Lock()
+	if serialBuses.buses[device] != nil {
+		t.Errorf("expected the bus to be closed")
+	}
+	serialBuses.lock.Unlock()
+
+	_, err = p1.Write([]byte{0x00})
+	if err == nil {
+		t.Errorf("expected the port to be closed")
+	}
+
+	return
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -20,13 +21,44 @@ var modbusRoleOID asn1.ObjectIdentifier = asn1.ObjectIdentifier{
 
 // Server configuration object.
 type ServerConfiguration struct {
-	// URL defines where to listen at e.g. tcp://[::]:502
+	// URL defines where to listen at e.g. tcp://[::]:502, udp://[::]:502,
+	// rtuovertcp://[::]:5020, asciiovertcp://[::]:5021 or
+	// rtu:///dev/ttyUSB0?baud=9600&unitids=1,2,
+	// optionally followed by parameters which take precedence over the
+	// fields below (see applyServerParams() for the complete list).
+	// replay://<trace file> URLs play the requests of a trace to the
+	// handler instead, Stop() then returns ErrReplayMismatch unless all
+	// responses matched the trace (see Capture).
 	URL string
+	// Speed sets the serial link speed (in bps, rtu and ascii only)
+	Speed uint
+	// DataBits sets the number of bits per serial character (rtu and ascii
+	// only, defaults to 8 in rtu mode and 7 in ascii mode)
+	DataBits uint
+	// Parity sets the serial link parity mode (rtu and ascii only)
+	Parity uint
+	// StopBits sets the number of serial stop bits (rtu and ascii only)
+	StopBits uint
+	// RS485 sets the RS485 mode of the serial port (rtu and ascii only)
+	RS485 RS485Configuration
+	// UnitIds sets the unit ids the server answers to (rtu and ascii only).
+	// Requests addressed to any other unit id are silently ignored, as
+	// other devices may share the serial bus. Broadcast requests (unit id 0)
+	// are passed to the handler but never answered.
+	UnitIds []uint8
 	// Timeout sets the idle session timeout (client connections will
-	// be closed if idle for this long)
+	// be closed if idle for this long). On serial lines, it sets the maximum
+	// time allowed to receive a complete request frame.
 	Timeout time.Duration
 	// MaxClients sets the maximum number of concurrent client connections
+	// (tcp, tcp+tls, rtuovertcp and asciiovertcp) or of datagrams served
+	// at once (udp and rtuoverudp)
 	MaxClients uint
+	// Capture sets the path of a file to record the frames of all clients
+	// to, overwritten each time the server is started (rtu, rtuovertcp,
+	// rtuoverudp, tcp, tcp+tls and udp only, see
+	// ClientConfiguration.Capture)
+	Capture string
 	// TLSServerCert sets the server-side TLS key pair (tcp+tls only)
 	TLSServerCert *tls.Certificate
 	// TLSClientCAs sets the list of CA certificates used to authenticate
@@ -81,6 +113,68 @@ type InputRegistersRequest struct {
 	Quantity   uint16 // the number of consecutive registers covered by this request
 }
 
+// Request object passed to the mask write register handler.
+type MaskWriteRegisterRequest struct {
+	ClientAddr string // the source (client) IP address
+	ClientRole string // the client role as encoded in the client certificate (tcp+tls only)
+	UnitId     uint8  // the requested unit id (slave id)
+	Addr       uint16 // the holding register address
+	AndMask    uint16 // the AND mask to apply to the current register value
+	OrMask     uint16 // the OR mask to apply to the current register value
+}
+
+// Request object passed to the read/write multiple registers handler.
+type ReadWriteRegistersRequest struct {
+	ClientAddr    string   // the source (client) IP address
+	ClientRole    string   // the client role as encoded in the client certificate (tcp+tls only)
+	UnitId        uint8    // the requested unit id (slave id)
+	ReadAddr      uint16   // the base holding register address to read from
+	ReadQuantity  uint16   // the number of consecutive registers to read
+	WriteAddr     uint16   // the base holding register address to write to
+	WriteQuantity uint16   // the number of consecutive registers to write
+	Args          []uint16 // a slice of register values to be set, ordered from
+	// WriteAddr to WriteAddr + WriteQuantity - 1
+}
+
+// Request object passed to the file record handler.
+type FileRecordsRequest struct {
+	ClientAddr string       // the source (client) IP address
+	ClientRole string       // the client role as encoded in the client certificate (tcp+tls only)
+	UnitId     uint8        // the requested unit id (slave id)
+	IsWrite    bool         // true if the request is a write, false if a read
+	Records    []FileRecord // the requested groups of records, in request order.
+	// Values is only set on writes.
+}
+
+// Request object passed to the FIFO queue handler.
+type FifoQueueRequest struct {
+	ClientAddr string // the source (client) IP address
+	ClientRole string // the client role as encoded in the client certificate (tcp+tls only)
+	UnitId     uint8  // the requested unit id (slave id)
+	Addr       uint16 // the FIFO pointer address
+}
+
+// Request object passed to the exception status handler.
+type ExceptionStatusRequest struct {
+	ClientAddr string // the source (client) address
+	ClientRole string // always empty (serial line only)
+	UnitId     uint8  // the requested unit id (slave id)
+}
+
+// Request object passed to the server id handler.
+type ServerIdRequest struct {
+	ClientAddr string // the source (client) address
+	ClientRole string // always empty (serial line only)
+	UnitId     uint8  // the requested unit id (slave id)
+}
+
+// Request object passed to the device identification handler.
+type DeviceIdentificationRequest struct {
+	ClientAddr string // the source (client) IP address
+	ClientRole string // the client role as encoded in the client certificate (tcp+tls only)
+	UnitId     uint8  // the requested unit id (slave id)
+}
+
 // The RequestHandler interface should be implemented by the handler
 // object passed to NewServer (see reqHandler in NewServer()).
 // After decoding and validating an incoming request, the server will
@@ -139,16 +233,155 @@ type RequestHandler interface {
 	HandleInputRegisters(req *InputRegistersRequest) (res []uint16, err error)
 }
 
+// The MaskWriteRegisterHandler interface can optionally be implemented by
+// RequestHandler objects to perform mask write register operations atomically.
+// If the handler passed to NewServer() does not implement it, the server falls
+// back to reading and writing the register through HandleHoldingRegisters(),
+// which is not atomic.
+type MaskWriteRegisterHandler interface {
+	// HandleMaskWriteRegister handles the mask write register (0x16) function
+	// code. The handler is expected to set the register value to
+	// (current AND AndMask) OR (OrMask AND (NOT AndMask)).
+	//
+	// Expected return values:
+	// - err:	either nil if no error occurred, a modbus error (see
+	//		mapErrorToExceptionCode() in modbus.go for a complete list),
+	//		or any other error.
+	HandleMaskWriteRegister(req *MaskWriteRegisterRequest) (err error)
+}
+
+// The ReadWriteRegistersHandler interface can optionally be implemented by
+// RequestHandler objects to perform read/write multiple registers operations
+// atomically.
+// If the handler passed to NewServer() does not implement it, the server falls
+// back to a write followed by a read through HandleHoldingRegisters().
+type ReadWriteRegistersHandler interface {
+	// HandleReadWriteRegisters handles the read/write multiple registers (0x17)
+	// function code. The write operation must be performed before the read.
+	//
+	// Expected return values:
+	// - res:	a slice of ReadQuantity uint16 containing the register values
+	//		to be sent back to the client,
+	// - err:	either nil if no error occurred, a modbus error (see
+	//		mapErrorToExceptionCode() in modbus.go for a complete list),
+	//		or any other error.
+	HandleReadWriteRegisters(req *ReadWriteRegistersRequest) (res []uint16, err error)
+}
+
+// The FileRecordHandler interface can optionally be implemented by
+// RequestHandler objects to expose file records.
+// If the handler passed to NewServer() does not implement it, read and write
+// file record requests are rejected with an illegal function exception.
+type FileRecordHandler interface {
+	// HandleFileRecords handles the read file record (0x14) and write file
+	// record (0x15) function codes. All groups of records of a request
+	// are passed to a single call, allowing the handler to process them
+	// atomically.
+	//
+	// Expected return values:
+	// - res:	on reads, a slice holding, for each requested group in
+	//		request order, a slice of RecordLength uint16 containing the
+	//		record values to be sent back to the client.
+	//		Ignored on writes.
+	// - err:	either nil if no error occurred, a modbus error (see
+	//		mapErrorToExceptionCode() in modbus.go for a complete list),
+	//		or any other error.
+	HandleFileRecords(req *FileRecordsRequest) (res [][]uint16, err error)
+}
+
+// The FifoQueueHandler interface can optionally be implemented by
+// RequestHandler objects to expose FIFO queues.
+// If the handler passed to NewServer() does not implement it, read FIFO queue
+// requests are rejected with an illegal function exception.
+type FifoQueueHandler interface {
+	// HandleFifoQueue handles the read FIFO queue (0x18) function code.
+	//
+	// Expected return values:
+	// - res:	a slice of up to 31 uint16 containing the queued values,
+	//		in queue order. Returning more than 31 values yields an
+	//		illegal data value exception.
+	// - err:	either nil if no error occurred, a modbus error (see
+	//		mapErrorToExceptionCode() in modbus.go for a complete list),
+	//		or any other error.
+	HandleFifoQueue(req *FifoQueueRequest) (res []uint16, err error)
+}
+
+// The ExceptionStatusHandler interface can optionally be implemented by
+// RequestHandler objects to publish the 8 exception status outputs of the
+// device (rtu only).
+// If the handler passed to NewServer() does not implement it, read exception
+// status requests are rejected with an illegal function exception.
+type ExceptionStatusHandler interface {
+	// HandleExceptionStatus handles the read exception status (0x07)
+	// function code.
+	//
+	// Expected return values:
+	// - status:	the exception status outputs, one bit per output.
+	// - err:	either nil if no error occurred, a modbus error (see
+	//		mapErrorToExceptionCode() in modbus.go for a complete list),
+	//		or any other error.
+	HandleExceptionStatus(req *ExceptionStatusRequest) (status uint8, err error)
+}
+
+// The ServerIdHandler interface can optionally be implemented by
+// RequestHandler objects to describe the device (rtu only).
+// If the handler passed to NewServer() does not implement it, report server id
+// requests are rejected with an illegal function exception.
+type ServerIdHandler interface {
+	// HandleServerId handles the report server id (0x11) function code.
+	//
+	// Expected return values:
+	// - serverId:	the device-specific server id.
+	// - running:	the run indicator status.
+	// - additionalData:	any additional device-specific data, sent after
+	//		the run indicator status. Up to 250 bytes along with the
+	//		server id.
+	// - err:	either nil if no error occurred, a modbus error (see
+	//		mapErrorToExceptionCode() in modbus.go for a complete list),
+	//		or any other error.
+	HandleServerId(req *ServerIdRequest) (serverId []byte, running bool, additionalData []byte, err error)
+}
+
+// The DeviceIdentificationHandler interface can optionally be implemented
+// by RequestHandler objects to publish device identification objects.
+// If the handler passed to NewServer() does not implement it, read device
+// identification requests are rejected with an illegal function exception.
+type DeviceIdentificationHandler interface {
+	// HandleDeviceIdentification handles the read device identification
+	// (0x2b / MEI type 0x0e) function code.
+	// A DeviceIdentificationRequest object is passed to the handler (see above).
+	//
+	// Expected return values:
+	// - res:	a map of all objects published by the device, indexed by
+	//		object id (see DEVICE_ID_* constants). Objects 0x00-0x02
+	//		(vendor name, product code and revision) are mandatory.
+	//		Access modes, categories and multi-part responses are
+	//		handled by the server.
+	// - err:	either nil if no error occurred, a modbus error (see
+	//		mapErrorToExceptionCode() in modbus.go for a complete list),
+	//		or any other error.
+	HandleDeviceIdentification(req *DeviceIdentificationRequest) (res map[uint8]string, err error)
+}
+
 // Modbus server object.
 type ModbusServer struct {
-	conf          ServerConfiguration
-	logger        *logger
-	lock          sync.Mutex
-	started       bool
-	handler       RequestHandler
-	tcpListener   net.Listener
-	tcpClients    []net.Conn
-	transportType transportType
+	conf            ServerConfiguration
+	logger          *logger
+	lock            sync.Mutex
+	started         bool
+	handler         RequestHandler
+	tcpListener     net.Listener
+	tcpClients      []net.Conn
+	udpSock         net.PacketConn
+	serialTransport transport
+	transportType   transportType
+	// frame capture, set while started if enabled
+	capture *frameCapture
+	// trace played back by replay servers, and the end of playback
+	trace      *frameTrace
+	replayDone chan struct{}
+	// serial line counters and event log (rtu and ascii only)
+	diagnostics *serialDiagnostics
 }
 
 // Returns a new modbus server.
@@ -158,6 +391,8 @@ func NewServer(conf *ServerConfiguration, reqHandler RequestHandler) (
 	ms *ModbusServer, err error) {
 	var serverType string
 	var splitURL []string
+	var params url.Values
+	var ok bool
 
 	ms = &ModbusServer{
 		conf:    *conf,
@@ -170,9 +405,25 @@ func NewServer(conf *ServerConfiguration, reqHandler RequestHandler) (
 		ms.conf.URL = splitURL[1]
 	}
 
+	ms.conf.URL, params, err = splitURLParams(ms.conf.URL)
+
 	ms.logger = newLogger(
 		fmt.Sprintf("modbus-server(%s)", ms.conf.URL), ms.conf.Logger)
 
+	if err == nil {
+		err = checkURLParams(params, serverURLParams, serverType, "server")
+	}
+
+	if err == nil {
+		err = applyServerParams(params, &ms.conf)
+	}
+
+	if err != nil {
+		ms.logger.Errorf("%v", err)
+		err = fmt.Errorf("%w: %v", ErrConfigurationError, err)
+		return
+	}
+
 	if ms.conf.URL == "" {
 		ms.logger.Errorf("missing host part in URL '%s'", conf.URL)
 		err = ErrConfigurationError
@@ -180,6 +431,54 @@ func NewServer(conf *ServerConfiguration, reqHandler RequestHandler) (
 	}
 
 	switch serverType {
+	case "rtu", "ascii":
+		// set useful defaults (see NewClient())
+		if ms.conf.Speed == 0 {
+			ms.conf.Speed = 19200
+		}
+
+		if ms.conf.DataBits == 0 {
+			if serverType == "ascii" {
+				ms.conf.DataBits = 7
+			} else {
+				ms.conf.DataBits = 8
+			}
+		}
+
+		if ms.conf.StopBits == 0 {
+			if ms.conf.Parity == PARITY_NONE {
+				ms.conf.StopBits = 2
+			} else {
+				ms.conf.StopBits = 1
+			}
+		}
+
+		if ms.conf.Timeout == 0 {
+			ms.conf.Timeout = 1 * time.Second
+		}
+
+		// a slave on a serial bus must only answer requests addressed to it
+		if len(ms.conf.UnitIds) == 0 {
+			ms.logger.Errorf("missing unit ids")
+			err = ErrConfigurationError
+			return
+		}
+
+		for _, unitId := range ms.conf.UnitIds {
+			if unitId == 0 || unitId > 247 {
+				ms.logger.Errorf("invalid unit id %v", unitId)
+				err = ErrConfigurationError
+				return
+			}
+		}
+
+		if serverType == "ascii" {
+			ms.transportType = modbusASCII
+		} else {
+			ms.transportType = modbusRTU
+		}
+		ms.diagnostics = &serialDiagnostics{}
+
 	case "tcp":
 		if ms.conf.Timeout == 0 {
 			ms.conf.Timeout = 120 * time.Second
@@ -191,6 +490,60 @@ func NewServer(conf *ServerConfiguration, reqHandler RequestHandler) (
 
 		ms.transportType = modbusTCP
 
+	case "rtuovertcp":
+		// the speed of the serial line on the other end of the
+		// connection sets the inter-frame delays
+		if ms.conf.Speed == 0 {
+			ms.conf.Speed = 19200
+		}
+
+		if ms.conf.Timeout == 0 {
+			ms.conf.Timeout = 120 * time.Second
+		}
+
+		if ms.conf.MaxClients == 0 {
+			ms.conf.MaxClients = 10
+		}
+
+		ms.transportType = modbusRTUOverTCP
+
+	case "asciiovertcp":
+		if ms.conf.Timeout == 0 {
+			ms.conf.Timeout = 120 * time.Second
+		}
+
+		if ms.conf.MaxClients == 0 {
+			ms.conf.MaxClients = 10
+		}
+
+		ms.transportType = modbusASCIIOverTCP
+
+	case "udp":
+		if ms.conf.Timeout == 0 {
+			ms.conf.Timeout = 1 * time.Second
+		}
+
+		if ms.conf.MaxClients == 0 {
+			ms.conf.MaxClients = 10
+		}
+
+		ms.transportType = modbusTCPOverUDP
+
+	case "rtuoverudp":
+		if ms.conf.Speed == 0 {
+			ms.conf.Speed = 19200
+		}
+
+		if ms.conf.Timeout == 0 {
+			ms.conf.Timeout = 1 * time.Second
+		}
+
+		if ms.conf.MaxClients == 0 {
+			ms.conf.MaxClients = 10
+		}
+
+		ms.transportType = modbusRTUOverUDP
+
 	case "tcp+tls":
 		if ms.conf.Timeout == 0 {
 			ms.conf.Timeout = 120 * time.Second
@@ -217,16 +570,54 @@ func NewServer(conf *ServerConfiguration, reqHandler RequestHandler) (
 
 		ms.transportType = modbusTCPOverTLS
 
+	case "replay":
+		// the trace sets the framing (rtu or tcp)
+		ms.trace, err = loadTrace(ms.conf.URL)
+		if err != nil {
+			ms.logger.Errorf("%v", err)
+			err = ErrConfigurationError
+			return
+		}
+
+		if ms.conf.Speed == 0 {
+			ms.conf.Speed = 19200
+		}
+
+		if ms.conf.Timeout == 0 {
+			ms.conf.Timeout = 1 * time.Second
+		}
+
+		ms.transportType = modbusReplay
+
 	default:
 		err = ErrConfigurationError
 		return
 	}
 
+	// RS485 settings only apply to local serial ports (see NewClient())
+	if ms.transportType == modbusRTU || ms.transportType == modbusASCII {
+		err = checkRS485Configuration(&ms.conf.RS485)
+	} else if ms.conf.RS485 != (RS485Configuration{}) {
+		err = fmt.Errorf("RS485 settings are not supported on %s servers", serverType)
+	}
+
+	if _, ok = captureMode(ms.transportType); err == nil && ms.conf.Capture != "" && !ok {
+		err = fmt.Errorf("frame capture is not supported on %s servers", serverType)
+	}
+
+	if err != nil {
+		ms.logger.Errorf("%v", err)
+		err = ErrConfigurationError
+		return
+	}
+
 	return
 }
 
 // Starts accepting client connections.
 func (ms *ModbusServer) Start() (err error) {
+	var mode frameMode
+
 	ms.lock.Lock()
 	defer ms.lock.Unlock()
 
@@ -234,8 +625,63 @@ func (ms *ModbusServer) Start() (err error) {
 		return
 	}
 
+	if ms.conf.Capture != "" {
+		mode, _ = captureMode(ms.transportType)
+		ms.capture, err = openFrameCapture(ms.conf.Capture, mode)
+		if err != nil {
+			return
+		}
+	}
+
+	// close the capture if the server fails to start
+	defer func() {
+		if err != nil && ms.capture != nil {
+			ms.capture.Close()
+			ms.capture = nil
+		}
+	}()
+
 	switch ms.transportType {
-	case modbusTCP, modbusTCPOverTLS:
+	case modbusRTU, modbusASCII:
+		var spw *serialPortWrapper
+
+		// create a serial port wrapper object
+		spw = newSerialPortWrapper(&serialPortConfig{
+			Device:   ms.conf.URL,
+			Speed:    ms.conf.Speed,
+			DataBits: ms.conf.DataBits,
+			Parity:   ms.conf.Parity,
+			StopBits: ms.conf.StopBits,
+			RS485:    ms.conf.RS485,
+		})
+
+		// open the serial device
+		err = spw.Open()
+		if err != nil {
+			return
+		}
+
+		// discard potentially stale serial data
+		discard(spw)
+
+		// let the transport maintain bus level diagnostic counters
+		if ms.transportType == modbusASCII {
+			at := newASCIITransport(
+				spw, ms.conf.URL, ms.conf.Timeout, ms.conf.Logger)
+			at.diagnostics = ms.diagnostics
+			ms.serialTransport = at
+		} else {
+			rt := newRTUTransport(
+				spw, ms.conf.URL, ms.conf.Speed, ms.conf.Timeout, ms.conf.Logger)
+			rt.diagnostics = ms.diagnostics
+			rt.capture = ms.capture
+			ms.serialTransport = rt
+		}
+
+		// serve requests coming off the serial line in a goroutine
+		go ms.handleTransport(ms.serialTransport, ms.conf.URL, "")
+
+	case modbusTCP, modbusTCPOverTLS, modbusRTUOverTCP, modbusASCIIOverTCP:
 		// bind to a TCP socket
 		ms.tcpListener, err = net.Listen("tcp", ms.conf.URL)
 		if err != nil {
@@ -243,7 +689,41 @@ func (ms *ModbusServer) Start() (err error) {
 		}
 
 		// accept client connections in a goroutine
-		go ms.acceptTCPClients()
+		go ms.acceptTCPClients(ms.capture)
+
+	case modbusTCPOverUDP, modbusRTUOverUDP:
+		// bind to a UDP socket
+		ms.udpSock, err = net.ListenPacket("udp", ms.conf.URL)
+		if err != nil {
+			return
+		}
+
+		// serve incoming datagrams in a goroutine
+		go ms.serveUDPDatagrams(ms.capture)
+
+	case modbusReplay:
+		var t transport
+
+		// play the trace back from the start, as a single client
+		// connection ending with the trace (see replayLink)
+		if ms.trace.mode == rtuFrames {
+			rt := newRTUTransport(
+				newReplayLink(ms.trace, ms.conf.URL, ms.logger),
+				ms.conf.URL, ms.conf.Speed, ms.conf.Timeout, ms.conf.Logger)
+			rt.closeOnIdle = true
+			t = rt
+		} else {
+			t = newTCPTransport(
+				newReplayLink(ms.trace, ms.conf.URL, ms.logger),
+				ms.conf.Timeout, ms.conf.Logger)
+		}
+
+		ms.serialTransport = t
+		ms.replayDone = make(chan struct{})
+		go func() {
+			ms.handleTransport(t, ms.conf.URL, "")
+			close(ms.replayDone)
+		}()
 
 	default:
 		err = ErrConfigurationError
@@ -266,7 +746,8 @@ func (ms *ModbusServer) Stop() (err error) {
 
 	ms.started = false
 
-	if ms.transportType == modbusTCP || ms.transportType == modbusTCPOverTLS {
+	if ms.transportType == modbusTCP || ms.transportType == modbusTCPOverTLS ||
+		ms.transportType == modbusRTUOverTCP || ms.transportType == modbusASCIIOverTCP {
 		// close the server socket if we're listening over TCP
 		err = ms.tcpListener.Close()
 
@@ -276,13 +757,35 @@ func (ms *ModbusServer) Stop() (err error) {
 		}
 	}
 
+	if ms.transportType == modbusTCPOverUDP || ms.transportType == modbusRTUOverUDP {
+		// close the server socket if we're listening over UDP
+		err = ms.udpSock.Close()
+	}
+
+	if ms.onSerialLine() {
+		// close the serial line
+		err = ms.serialTransport.Close()
+	}
+
+	if ms.transportType == modbusReplay {
+		// playback never blocks, wait for it to end before checking
+		// the outcome
+		<-ms.replayDone
+		err = ms.serialTransport.Close()
+	}
+
+	if ms.capture != nil {
+		ms.capture.Close()
+		ms.capture = nil
+	}
+
 	return
 }
 
 // Accepts new client connections if the configured connection limit allows it.
 // Each connection is served from a dedicated goroutine to allow for concurrent
-// connections.
-func (ms *ModbusServer) acceptTCPClients() {
+// connections. Frames are recorded to capture, if set.
+func (ms *ModbusServer) acceptTCPClients(capture *frameCapture) {
 	var sock net.Conn
 	var err error
 	var accepted bool
@@ -312,7 +815,7 @@ func (ms *ModbusServer) acceptTCPClients() {
 
 		if accepted {
 			// spin a client handler goroutine to serve the new client
-			go ms.handleTCPClient(sock)
+			go ms.handleTCPClient(sock, capture)
 		} else {
 			ms.logger.Warningf("max. number of concurrent connections "+
 				"reached, rejecting %v", sock.RemoteAddr())
@@ -325,11 +828,65 @@ func (ms *ModbusServer) acceptTCPClients() {
 	return
 }
 
+// Reads datagrams off the UDP socket, each expected to carry a single request.
+// Each datagram is served from a dedicated goroutine, so that slow requests
+// don't hold up other clients. Up to MaxClients datagrams are served at once,
+// further datagrams are left in the socket buffer until a goroutine is done.
+// Frames are recorded to capture, if set.
+func (ms *ModbusServer) serveUDPDatagrams(capture *frameCapture) {
+	var handlers chan struct{}
+	var rxbuf []byte
+	var n int
+	var addr net.Addr
+	var conn *udpDatagramConn
+	var t transport
+	var err error
+
+	handlers = make(chan struct{}, ms.conf.MaxClients)
+
+	for {
+		rxbuf = make([]byte, maxTCPFrameLength)
+
+		n, addr, err = ms.udpSock.ReadFrom(rxbuf)
+		if err != nil {
+			// if the server socket has just been closed, return here as
+			// this goroutine isn't going to see any new datagram
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			ms.logger.Warningf("failed to read datagram: %v", err)
+			continue
+		}
+
+		conn = newUDPDatagramConn(ms.udpSock, addr, rxbuf[:n])
+
+		// once the request is served, the transport hits the end of the
+		// datagram and handleTransport() returns
+		if ms.transportType == modbusRTUOverUDP {
+			rt := newRTUTransport(conn, addr.String(),
+				ms.conf.Speed, ms.conf.Timeout, ms.conf.Logger)
+			rt.capture = capture
+			t = rt
+		} else {
+			tt := newTCPTransport(conn, ms.conf.Timeout, ms.conf.Logger)
+			tt.capture = capture
+			t = tt
+		}
+
+		// wait for a free slot before serving the datagram
+		handlers <- struct{}{}
+		go func(t transport, addr string) {
+			ms.handleTransport(t, addr, "")
+			<-handlers
+		}(t, addr.String())
+	}
+}
+
 // Handles a TCP client connection.
 // Once handleTransport() returns (i.e. the connection has either closed, timed
 // out, or an unrecoverable error happened), the TCP socket is closed and removed
 // from the list of active client connections.
-func (ms *ModbusServer) handleTCPClient(sock net.Conn) {
+func (ms *ModbusServer) handleTCPClient(sock net.Conn, capture *frameCapture) {
 	var err error
 	var clientRole string
 	var tlsSock net.Conn
@@ -337,9 +894,9 @@ func (ms *ModbusServer) handleTCPClient(sock net.Conn) {
 	switch ms.transportType {
 	case modbusTCP:
 		// serve modbus requests over the raw TCP connection
-		ms.handleTransport(
-			newTCPTransport(sock, ms.conf.Timeout, ms.conf.Logger),
-			sock.RemoteAddr().String(), "")
+		tt := newTCPTransport(sock, ms.conf.Timeout, ms.conf.Logger)
+		tt.capture = capture
+		ms.handleTransport(tt, sock.RemoteAddr().String(), "")
 
 	case modbusTCPOverTLS:
 		// start TLS negotiation over the raw TCP connection
@@ -349,11 +906,28 @@ func (ms *ModbusServer) handleTCPClient(sock net.Conn) {
 				sock.RemoteAddr().String(), err)
 		} else {
 			// serve modbus requests over the TLS tunnel
-			ms.handleTransport(
-				newTCPTransport(tlsSock, ms.conf.Timeout, ms.conf.Logger),
-				sock.RemoteAddr().String(), clientRole)
+			tt := newTCPTransport(tlsSock, ms.conf.Timeout, ms.conf.Logger)
+			tt.capture = capture
+			ms.handleTransport(tt, sock.RemoteAddr().String(), clientRole)
 		}
 
+	case modbusRTUOverTCP:
+		// serve RTU framed modbus requests over the raw TCP connection,
+		// closing it once idle as any other TCP session
+		rt := newRTUTransport(sock, sock.RemoteAddr().String(),
+			ms.conf.Speed, ms.conf.Timeout, ms.conf.Logger)
+		rt.closeOnIdle = true
+		rt.capture = capture
+		ms.handleTransport(rt, sock.RemoteAddr().String(), "")
+
+	case modbusASCIIOverTCP:
+		// serve ASCII framed modbus requests over the raw TCP connection,
+		// closing it once idle as any other TCP session
+		at := newASCIITransport(sock, sock.RemoteAddr().String(),
+			ms.conf.Timeout, ms.conf.Logger)
+		at.closeOnIdle = true
+		ms.handleTransport(at, sock.RemoteAddr().String(), "")
+
 	default:
 		ms.logger.Errorf("unimplemented transport type %v", ms.transportType)
 	}
@@ -391,6 +965,17 @@ func (ms *ModbusServer) handleTransport(t transport, clientAddr string, clientRo
 			return
 		}
 
+		// on serial lines, silently ignore requests addressed to other devices
+		if !ms.servesUnitId(req.unitId) {
+			continue
+		}
+
+		// on serial lines, keep track of the request for diagnostics
+		// purposes and stay silent while in listen only mode
+		if ms.diagnostics != nil && !ms.diagnostics.receive(req) {
+			continue
+		}
+
 		switch req.functionCode {
 		case fcReadCoils, fcReadDiscreteInputs:
 			var coils []bool
@@ -755,34 +1340,177 @@ func (ms *ModbusServer) handleTransport(t transport, clientAddr string, clientRo
 			res.payload = append(res.payload,
 				uint16ToBytes(BIG_ENDIAN, quantity)...)
 
-		default:
-			res = &pdu{
-				// reply with the request target unit ID
-				unitId: req.unitId,
-				// set the error bit
-				functionCode: (0x80 | req.functionCode),
-				// set the exception code to illegal function to indicate that
-				// the server does not know how to handle this function code.
-				payload: []byte{exIllegalFunction},
+		case fcMaskWriteRegister:
+			var andMask uint16
+			var orMask uint16
+
+			if len(req.payload) != 6 {
+				err = ErrProtocolError
+				break
 			}
-		}
 
-		// if there was no error processing the request but the response is nil
-		// (which should never happen), emit a server failure exception code
-		// and log an error
-		if err == nil && res == nil {
-			err = ErrServerDeviceFailure
-			ms.logger.Errorf("internal server error (req: %v, res: %v, err: %v)",
-				req, res, err)
-		}
+			// decode address and mask fields
+			addr = bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+			andMask = bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+			orMask = bytesToUint16(BIG_ENDIAN, req.payload[4:6])
 
-		// map go errors to modbus errors, unless the error is a protocol error,
-		// in which case close the transport and return.
-		if err != nil {
-			if err == ErrProtocolError {
-				ms.logger.Warningf(
-					"protocol error, closing link (client address: '%s')",
-					clientAddr)
+			// invoke the handler
+			err = ms.maskWriteRegister(&MaskWriteRegisterRequest{
+				ClientAddr: clientAddr,
+				ClientRole: clientRole,
+				UnitId:     req.unitId,
+				Addr:       addr,
+				AndMask:    andMask,
+				OrMask:     orMask,
+			})
+			if err != nil {
+				break
+			}
+
+			// assemble a response PDU, echoing the request
+			res = &pdu{
+				unitId:       req.unitId,
+				functionCode: req.functionCode,
+				payload:      req.payload,
+			}
+
+		case fcReadWriteMultipleRegisters:
+			var regs []uint16
+			var writeAddr uint16
+			var writeQuantity uint16
+			var expectedLen int
+
+			if len(req.payload) < 11 {
+				err = ErrProtocolError
+				break
+			}
+
+			// decode address and quantity fields
+			addr = bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+			quantity = bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+			writeAddr = bytesToUint16(BIG_ENDIAN, req.payload[4:6])
+			writeQuantity = bytesToUint16(BIG_ENDIAN, req.payload[6:8])
+
+			// ensure the reply never exceeds the maximum PDU length and we
+			// never read or write past 0xffff
+			if quantity > 0x007d || quantity == 0 ||
+				writeQuantity > 0x0079 || writeQuantity == 0 {
+				err = ErrProtocolError
+				break
+			}
+			if uint32(addr)+uint32(quantity)-1 > 0xffff ||
+				uint32(writeAddr)+uint32(writeQuantity)-1 > 0xffff {
+				err = ErrIllegalDataAddress
+				break
+			}
+
+			// validate the byte count field (2 bytes per register)
+			expectedLen = int(writeQuantity) * 2
+
+			if req.payload[8] != uint8(expectedLen) {
+				err = ErrProtocolError
+				break
+			}
+
+			// make sure we have enough bytes
+			if len(req.payload)-9 != expectedLen {
+				err = ErrProtocolError
+				break
+			}
+
+			// invoke the handler
+			regs, err = ms.readWriteRegisters(&ReadWriteRegistersRequest{
+				ClientAddr:    clientAddr,
+				ClientRole:    clientRole,
+				UnitId:        req.unitId,
+				ReadAddr:      addr,
+				ReadQuantity:  quantity,
+				WriteAddr:     writeAddr,
+				WriteQuantity: writeQuantity,
+				Args:          bytesToUint16s(BIG_ENDIAN, req.payload[9:]),
+			})
+
+			// make sure the handler returned the expected number of items
+			if err == nil && len(regs) != int(quantity) {
+				ms.logger.Errorf("handler returned %v 16-bit values, "+
+					"expected %v", len(regs), quantity)
+				err = ErrServerDeviceFailure
+				break
+			}
+
+			if err != nil {
+				break
+			}
+
+			// assemble a response PDU
+			res = &pdu{
+				unitId:       req.unitId,
+				functionCode: req.functionCode,
+				// byte count (2 bytes per register)
+				payload: []byte{uint8(len(regs) * 2)},
+			}
+
+			// register values
+			res.payload = append(res.payload,
+				uint16sToBytes(BIG_ENDIAN, regs)...)
+
+		case fcReadExceptionStatus, fcDiagnostics, fcGetCommEventCounter,
+			fcGetCommEventLog, fcReportServerId:
+			res, err = ms.handleSerialDiagnostics(req, clientAddr)
+
+		case fcReadFileRecord, fcWriteFileRecord:
+			res, err = ms.handleFileRecords(req, clientAddr, clientRole)
+
+		case fcReadFifoQueue:
+			res, err = ms.handleFifoQueue(req, clientAddr, clientRole)
+
+		case fcEncapsulatedInterface:
+			res, err = ms.handleDeviceIdentification(req, clientAddr, clientRole)
+
+		default:
+			res = &pdu{
+				// reply with the request target unit ID
+				unitId: req.unitId,
+				// set the error bit
+				functionCode: (0x80 | req.functionCode),
+				// set the exception code to illegal function to indicate that
+				// the server does not know how to handle this function code.
+				payload: []byte{exIllegalFunction},
+			}
+		}
+
+		// some requests (e.g. force listen only mode) are never answered
+		if err == errNoResponse {
+			ms.diagnostics.respond(req, nil)
+			req = nil
+			res = nil
+			continue
+		}
+
+		// if there was no error processing the request but the response is nil
+		// (which should never happen), emit a server failure exception code
+		// and log an error
+		if err == nil && res == nil {
+			err = ErrServerDeviceFailure
+			ms.logger.Errorf("internal server error (req: %v, res: %v, err: %v)",
+				req, res, err)
+		}
+
+		// serial lines are shared and cannot be closed on a per-client basis:
+		// report protocol errors as illegal data values instead.
+		if err == ErrProtocolError && ms.onSerialLine() {
+			ms.logger.Warningf("protocol error (function code: 0x%02x)",
+				req.functionCode)
+			err = ErrIllegalDataValue
+		}
+
+		// map go errors to modbus errors, unless the error is a protocol error,
+		// in which case close the transport and return.
+		if err != nil {
+			if err == ErrProtocolError {
+				ms.logger.Warningf(
+					"protocol error, closing link (client address: '%s')",
+					clientAddr)
 				t.Close()
 				return
 			} else {
@@ -794,6 +1522,20 @@ func (ms *ModbusServer) handleTransport(t transport, clientAddr string, clientRo
 			}
 		}
 
+		// broadcast requests (serial lines only) are never answered
+		if ms.onSerialLine() && req.unitId == 0 {
+			res = nil
+		}
+
+		if ms.diagnostics != nil {
+			ms.diagnostics.respond(req, res)
+		}
+
+		if res == nil {
+			req = nil
+			continue
+		}
+
 		// write the response to the transport
 		err = t.WriteResponse(res)
 		if err != nil {
@@ -809,6 +1551,637 @@ func (ms *ModbusServer) handleTransport(t transport, clientAddr string, clientRo
 	return
 }
 
+// Passes a mask write register request to the handler, emulating it with a
+// read and a write of the holding register if the handler does not support it.
+func (ms *ModbusServer) maskWriteRegister(req *MaskWriteRegisterRequest) (err error) {
+	var handler MaskWriteRegisterHandler
+	var ok bool
+	var regs []uint16
+
+	handler, ok = ms.handler.(MaskWriteRegisterHandler)
+	if ok {
+		err = handler.HandleMaskWriteRegister(req)
+		return
+	}
+
+	regs, err = ms.handler.HandleHoldingRegisters(&HoldingRegistersRequest{
+		ClientAddr: req.ClientAddr,
+		ClientRole: req.ClientRole,
+		UnitId:     req.UnitId,
+		Addr:       req.Addr,
+		Quantity:   1,
+	})
+	if err != nil {
+		return
+	}
+	if len(regs) != 1 {
+		ms.logger.Errorf("handler returned %v 16-bit values, expected 1", len(regs))
+		err = ErrServerDeviceFailure
+		return
+	}
+
+	_, err = ms.handler.HandleHoldingRegisters(&HoldingRegistersRequest{
+		ClientAddr: req.ClientAddr,
+		ClientRole: req.ClientRole,
+		UnitId:     req.UnitId,
+		Addr:       req.Addr,
+		Quantity:   1,
+		IsWrite:    true,
+		Args:       []uint16{(regs[0] & req.AndMask) | (req.OrMask &^ req.AndMask)},
+	})
+
+	return
+}
+
+// Passes a read/write multiple registers request to the handler, emulating it
+// with a write followed by a read of holding registers if the handler does
+// not support it.
+func (ms *ModbusServer) readWriteRegisters(req *ReadWriteRegistersRequest) (res []uint16, err error) {
+	var handler ReadWriteRegistersHandler
+	var ok bool
+
+	handler, ok = ms.handler.(ReadWriteRegistersHandler)
+	if ok {
+		res, err = handler.HandleReadWriteRegisters(req)
+		return
+	}
+
+	_, err = ms.handler.HandleHoldingRegisters(&HoldingRegistersRequest{
+		ClientAddr: req.ClientAddr,
+		ClientRole: req.ClientRole,
+		UnitId:     req.UnitId,
+		Addr:       req.WriteAddr,
+		Quantity:   req.WriteQuantity,
+		IsWrite:    true,
+		Args:       req.Args,
+	})
+	if err != nil {
+		return
+	}
+
+	res, err = ms.handler.HandleHoldingRegisters(&HoldingRegistersRequest{
+		ClientAddr: req.ClientAddr,
+		ClientRole: req.ClientRole,
+		UnitId:     req.UnitId,
+		Addr:       req.ReadAddr,
+		Quantity:   req.ReadQuantity,
+	})
+
+	return
+}
+
+// Handles the serial line diagnostics function codes (read exception status,
+// diagnostics, get comm event counter/log and report server id), backed by
+// the counters and event log maintained by the server.
+func (ms *ModbusServer) handleSerialDiagnostics(req *pdu, clientAddr string) (
+	res *pdu, err error) {
+	var ok bool
+	var subFunction DiagnosticSubFunction
+	var data uint16
+	var eventCount uint16
+	var messageCount uint16
+	var events []byte
+
+	// these function codes only apply to serial lines
+	if ms.diagnostics == nil {
+		err = ErrIllegalFunction
+		return
+	}
+
+	// expect no payload, except for diagnostics requests which carry a
+	// sub-function and a 16-bit data field
+	if (req.functionCode == fcDiagnostics && len(req.payload) != 4) ||
+		(req.functionCode != fcDiagnostics && len(req.payload) != 0) {
+		err = ErrProtocolError
+		return
+	}
+
+	res = &pdu{
+		unitId:       req.unitId,
+		functionCode: req.functionCode,
+	}
+
+	switch req.functionCode {
+	case fcReadExceptionStatus:
+		var handler ExceptionStatusHandler
+		var status uint8
+
+		handler, ok = ms.handler.(ExceptionStatusHandler)
+		if !ok {
+			err = ErrIllegalFunction
+			break
+		}
+
+		status, err = handler.HandleExceptionStatus(&ExceptionStatusRequest{
+			ClientAddr: clientAddr,
+			UnitId:     req.unitId,
+		})
+		if err != nil {
+			break
+		}
+
+		res.payload = []byte{status}
+
+	case fcDiagnostics:
+		subFunction = DiagnosticSubFunction(bytesToUint16(BIG_ENDIAN, req.payload[0:2]))
+		data = bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+
+		switch subFunction {
+		case DIAG_RETURN_QUERY_DATA:
+			// echo the data field back
+
+		case DIAG_RESTART_COMMUNICATIONS:
+			if data != 0x0000 && data != 0xff00 {
+				err = ErrIllegalDataValue
+				break
+			}
+
+			// devices in listen only mode restart without responding
+			if ms.diagnostics.restart(data == 0xff00) {
+				err = errNoResponse
+			}
+
+		case DIAG_FORCE_LISTEN_ONLY_MODE:
+			if data != 0x0000 {
+				err = ErrIllegalDataValue
+				break
+			}
+
+			ms.diagnostics.enterListenOnly()
+			err = errNoResponse
+
+		case DIAG_CLEAR_COUNTERS:
+			if data != 0x0000 {
+				err = ErrIllegalDataValue
+				break
+			}
+
+			ms.diagnostics.clear()
+
+		case DIAG_CLEAR_OVERRUN_COUNTER:
+			if data != 0x0000 {
+				err = ErrIllegalDataValue
+				break
+			}
+
+			ms.diagnostics.clearOverrun()
+
+		default:
+			data, ok = ms.diagnostics.counter(subFunction)
+			if !ok {
+				err = ErrIllegalFunction
+				break
+			}
+
+			if bytesToUint16(BIG_ENDIAN, req.payload[2:4]) != 0x0000 {
+				err = ErrIllegalDataValue
+				break
+			}
+		}
+
+		if err != nil {
+			break
+		}
+
+		// echo the sub-function, followed by the data field
+		res.payload = uint16ToBytes(BIG_ENDIAN, uint16(subFunction))
+		res.payload = append(res.payload, uint16ToBytes(BIG_ENDIAN, data)...)
+
+	case fcGetCommEventCounter:
+		eventCount, _, _ = ms.diagnostics.events()
+
+		// status (never busy) and event count
+		res.payload = uint16ToBytes(BIG_ENDIAN, 0x0000)
+		res.payload = append(res.payload, uint16ToBytes(BIG_ENDIAN, eventCount)...)
+
+	case fcGetCommEventLog:
+		eventCount, messageCount, events = ms.diagnostics.events()
+
+		// byte count, status (never busy), event count, message count and events
+		res.payload = []byte{uint8(6 + len(events))}
+		res.payload = append(res.payload, uint16ToBytes(BIG_ENDIAN, 0x0000)...)
+		res.payload = append(res.payload, uint16ToBytes(BIG_ENDIAN, eventCount)...)
+		res.payload = append(res.payload, uint16ToBytes(BIG_ENDIAN, messageCount)...)
+		res.payload = append(res.payload, events...)
+
+	case fcReportServerId:
+		var handler ServerIdHandler
+		var serverId []byte
+		var running bool
+		var additionalData []byte
+
+		handler, ok = ms.handler.(ServerIdHandler)
+		if !ok {
+			err = ErrIllegalFunction
+			break
+		}
+
+		serverId, running, additionalData, err = handler.HandleServerId(&ServerIdRequest{
+			ClientAddr: clientAddr,
+			UnitId:     req.unitId,
+		})
+		if err != nil {
+			break
+		}
+
+		// make sure the response fits in a single PDU
+		if len(serverId)+len(additionalData) > 250 {
+			ms.logger.Errorf("handler returned %v bytes of server id and "+
+				"additional data, max. 250", len(serverId)+len(additionalData))
+			err = ErrServerDeviceFailure
+			break
+		}
+
+		// byte count, server id, run indicator status and additional data
+		res.payload = []byte{uint8(len(serverId) + 1 + len(additionalData))}
+		res.payload = append(res.payload, serverId...)
+		if running {
+			res.payload = append(res.payload, 0xff)
+		} else {
+			res.payload = append(res.payload, 0x00)
+		}
+		res.payload = append(res.payload, additionalData...)
+	}
+
+	if err != nil {
+		res = nil
+	}
+
+	return
+}
+
+// Decodes and validates a read or write file record request, calls the file
+// record handler and assembles the response.
+func (ms *ModbusServer) handleFileRecords(req *pdu, clientAddr string, clientRole string) (
+	res *pdu, err error) {
+	var handler FileRecordHandler
+	var ok bool
+	var isWrite bool
+	var byteCount int
+	var subRequestLength int
+	var responseLength int
+	var pos int
+	var record FileRecord
+	var records []FileRecord
+	var values [][]uint16
+
+	handler, ok = ms.handler.(FileRecordHandler)
+	if !ok {
+		err = ErrIllegalFunction
+		return
+	}
+
+	isWrite = (req.functionCode == fcWriteFileRecord)
+
+	// expect a byte count field followed by as many bytes of sub-requests
+	if len(req.payload) < 1 {
+		err = ErrProtocolError
+		return
+	}
+
+	byteCount = int(req.payload[0])
+	if len(req.payload) != 1+byteCount {
+		err = ErrProtocolError
+		return
+	}
+
+	// reads carry 7 bytes per sub-request, writes carry at least 9
+	if (!isWrite && (byteCount < 0x07 || byteCount > maxFileRecordByteCount || byteCount%7 != 0)) ||
+		(isWrite && (byteCount < 0x09 || byteCount > maxFileRecordWriteByteCount)) {
+		err = ErrIllegalDataValue
+		return
+	}
+
+	pos = 1
+	for pos < len(req.payload) {
+		// reference type, file number, record number and record length
+		if len(req.payload)-pos < 7 {
+			err = ErrProtocolError
+			return
+		}
+
+		record = FileRecord{
+			FileNumber:   bytesToUint16(BIG_ENDIAN, req.payload[pos+1:pos+3]),
+			RecordNumber: bytesToUint16(BIG_ENDIAN, req.payload[pos+3:pos+5]),
+			RecordLength: bytesToUint16(BIG_ENDIAN, req.payload[pos+5:pos+7]),
+		}
+		subRequestLength = 7
+
+		if req.payload[pos] != fileRecordReferenceType ||
+			record.FileNumber == 0 ||
+			record.RecordNumber > maxFileRecordNumber {
+			err = ErrIllegalDataAddress
+			return
+		}
+
+		if record.RecordLength == 0 {
+			err = ErrIllegalDataValue
+			return
+		}
+
+		if uint32(record.RecordNumber)+uint32(record.RecordLength)-1 >
+			uint32(maxFileRecordNumber) {
+			err = ErrIllegalDataAddress
+			return
+		}
+
+		if isWrite {
+			// record data (2 bytes per record)
+			subRequestLength += 2 * int(record.RecordLength)
+			if len(req.payload)-pos < subRequestLength {
+				err = ErrProtocolError
+				return
+			}
+
+			record.Values = bytesToUint16s(BIG_ENDIAN,
+				req.payload[pos+7:pos+subRequestLength])
+		} else {
+			// each sub-response takes 2 bytes of header and 2 bytes per record
+			responseLength += 2 + 2*int(record.RecordLength)
+		}
+
+		records = append(records, record)
+		pos += subRequestLength
+	}
+
+	// make sure the response fits in a single PDU
+	if responseLength > maxFileRecordByteCount {
+		err = ErrIllegalDataValue
+		return
+	}
+
+	// invoke the handler
+	values, err = handler.HandleFileRecords(&FileRecordsRequest{
+		ClientAddr: clientAddr,
+		ClientRole: clientRole,
+		UnitId:     req.unitId,
+		IsWrite:    isWrite,
+		Records:    records,
+	})
+	if err != nil {
+		return
+	}
+
+	if isWrite {
+		// assemble a response PDU, echoing the request
+		res = &pdu{
+			unitId:       req.unitId,
+			functionCode: req.functionCode,
+			payload:      req.payload,
+		}
+
+		return
+	}
+
+	// make sure the handler returned the expected number of items
+	if len(values) != len(records) {
+		ms.logger.Errorf("handler returned %v groups of records, expected %v",
+			len(values), len(records))
+		err = ErrServerDeviceFailure
+		return
+	}
+
+	// assemble a response PDU
+	res = &pdu{
+		unitId:       req.unitId,
+		functionCode: req.functionCode,
+		// response data length
+		payload: []byte{uint8(responseLength)},
+	}
+
+	for i, record := range records {
+		if len(values[i]) != int(record.RecordLength) {
+			ms.logger.Errorf("handler returned %v records in group #%v, "+
+				"expected %v", len(values[i]), i, record.RecordLength)
+			err = ErrServerDeviceFailure
+			res = nil
+			return
+		}
+
+		// sub-response length (reference type and record data), reference type
+		// and record data
+		res.payload = append(res.payload,
+			uint8(1+2*len(values[i])), fileRecordReferenceType)
+		res.payload = append(res.payload,
+			uint16sToBytes(BIG_ENDIAN, values[i])...)
+	}
+
+	return
+}
+
+// Decodes and validates a read FIFO queue request, calls the FIFO queue
+// handler and assembles the response.
+func (ms *ModbusServer) handleFifoQueue(req *pdu, clientAddr string, clientRole string) (
+	res *pdu, err error) {
+	var handler FifoQueueHandler
+	var ok bool
+	var values []uint16
+
+	handler, ok = ms.handler.(FifoQueueHandler)
+	if !ok {
+		err = ErrIllegalFunction
+		return
+	}
+
+	// expect a FIFO pointer address
+	if len(req.payload) != 2 {
+		err = ErrProtocolError
+		return
+	}
+
+	// invoke the handler
+	values, err = handler.HandleFifoQueue(&FifoQueueRequest{
+		ClientAddr: clientAddr,
+		ClientRole: clientRole,
+		UnitId:     req.unitId,
+		Addr:       bytesToUint16(BIG_ENDIAN, req.payload[0:2]),
+	})
+	if err != nil {
+		return
+	}
+
+	// the spec mandates an illegal data value exception when more than
+	// 31 values are queued
+	if len(values) > maxFifoCount {
+		err = ErrIllegalDataValue
+		return
+	}
+
+	// assemble a response PDU
+	res = &pdu{
+		unitId:       req.unitId,
+		functionCode: req.functionCode,
+	}
+
+	// byte count (FIFO count field and 2 bytes per value), FIFO count and
+	// queued values
+	res.payload = uint16ToBytes(BIG_ENDIAN, uint16(2+2*len(values)))
+	res.payload = append(res.payload,
+		uint16ToBytes(BIG_ENDIAN, uint16(len(values)))...)
+	res.payload = append(res.payload,
+		uint16sToBytes(BIG_ENDIAN, values)...)
+
+	return
+}
+
+// Decodes and validates a read device identification request, calls the
+// device identification handler and assembles the response.
+// Objects are sent in ascending order of object id, as many as fit in a single
+// PDU: the client is then expected to ask for the remaining objects.
+func (ms *ModbusServer) handleDeviceIdentification(req *pdu, clientAddr string, clientRole string) (
+	res *pdu, err error) {
+	var handler DeviceIdentificationHandler
+	var ok bool
+	var readDeviceIdCode uint8
+	var objectId uint8
+	var lastObjectId uint8
+	var conformityLevel uint8
+	var objects map[uint8]string
+	var value string
+	var objectList []byte
+	var objectCount uint8
+	var moreFollows uint8
+	var nextObjectId uint8
+
+	handler, ok = ms.handler.(DeviceIdentificationHandler)
+	if !ok {
+		err = ErrIllegalFunction
+		return
+	}
+
+	// expect MEI type, read device id code and object id
+	if len(req.payload) != 3 {
+		err = ErrProtocolError
+		return
+	}
+
+	// read device identification is the only supported MEI type
+	if req.payload[0] != meiReadDeviceIdentification {
+		err = ErrIllegalFunction
+		return
+	}
+
+	readDeviceIdCode = req.payload[1]
+	objectId = req.payload[2]
+
+	switch readDeviceIdCode {
+	case uint8(DEVICE_ID_BASIC):
+		lastObjectId = DEVICE_ID_MAJOR_MINOR_REVISION
+	case uint8(DEVICE_ID_REGULAR):
+		lastObjectId = 0x7f
+	case uint8(DEVICE_ID_EXTENDED), readDeviceIdIndividual:
+		lastObjectId = 0xff
+	default:
+		err = ErrIllegalDataValue
+		return
+	}
+
+	objects, err = handler.HandleDeviceIdentification(&DeviceIdentificationRequest{
+		ClientAddr: clientAddr,
+		ClientRole: clientRole,
+		UnitId:     req.unitId,
+	})
+	if err != nil {
+		return
+	}
+
+	// the conformity level is derived from the categories of the published
+	// objects. Individual access is always supported (bit 0x80).
+	conformityLevel = uint8(DEVICE_ID_BASIC)
+	for id := range objects {
+		if id >= 0x80 {
+			conformityLevel = uint8(DEVICE_ID_EXTENDED)
+		} else if id > DEVICE_ID_MAJOR_MINOR_REVISION &&
+			conformityLevel < uint8(DEVICE_ID_REGULAR) {
+			conformityLevel = uint8(DEVICE_ID_REGULAR)
+		}
+
+		// every object must fit in a single response
+		if len(objects[id]) > maxDeviceIdObjectListLength-2 {
+			ms.logger.Errorf("device identification object 0x%02x is %v bytes long, "+
+				"max. %v", id, len(objects[id]), maxDeviceIdObjectListLength-2)
+			err = ErrServerDeviceFailure
+			return
+		}
+	}
+	conformityLevel |= 0x80
+
+	if readDeviceIdCode == readDeviceIdIndividual {
+		value, ok = objects[objectId]
+		if !ok {
+			err = ErrIllegalDataAddress
+			return
+		}
+
+		objectList = append(objectList, objectId, uint8(len(value)))
+		objectList = append(objectList, value...)
+		objectCount = 1
+	} else {
+		// restart from the first object if the requested one is unknown
+		if _, ok = objects[objectId]; !ok || objectId > lastObjectId {
+			objectId = 0
+		}
+
+		for id := int(objectId); id <= int(lastObjectId); id++ {
+			value, ok = objects[uint8(id)]
+			if !ok {
+				continue
+			}
+
+			// let the client know where to resume if the response is full
+			if len(objectList)+2+len(value) > maxDeviceIdObjectListLength {
+				moreFollows = 0xff
+				nextObjectId = uint8(id)
+				break
+			}
+
+			objectList = append(objectList, uint8(id), uint8(len(value)))
+			objectList = append(objectList, value...)
+			objectCount++
+		}
+	}
+
+	// assemble a response PDU
+	res = &pdu{
+		unitId:       req.unitId,
+		functionCode: req.functionCode,
+		payload: []byte{
+			meiReadDeviceIdentification, readDeviceIdCode, conformityLevel,
+			moreFollows, nextObjectId, objectCount,
+		},
+	}
+	res.payload = append(res.payload, objectList...)
+
+	return
+}
+
+// onSerialLine returns true if the server listens on a serial line (rtu or
+// ascii), where the bus is shared with other devices.
+func (ms *ModbusServer) onSerialLine() (yes bool) {
+	yes = ms.transportType == modbusRTU || ms.transportType == modbusASCII
+
+	return
+}
+
+// servesUnitId returns true if requests addressed to unitId should be handled.
+// Only serial line servers filter on unit ids: over TCP, it is up to the
+// handler to reject requests for unknown unit ids.
+func (ms *ModbusServer) servesUnitId(unitId uint8) (yes bool) {
+	if !ms.onSerialLine() || unitId == 0 {
+		yes = true
+		return
+	}
+
+	for _, id := range ms.conf.UnitIds {
+		if id == unitId {
+			yes = true
+			return
+		}
+	}
+
+	return
+}
+
 // startTLS performs a full TLS handshake (with client authentication) on tcpSock
 // and returns a 'wrapped' clear-text socket suitable for use by the TCP transport.
 func (ms *ModbusServer) startTLS(tcpSock net.Conn) (
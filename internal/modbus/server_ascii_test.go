@@ -0,0 +1,178 @@
+package modbus
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestASCIIServer(t *testing.T) {
+	var server *ModbusServer
+	var client *ModbusClient
+	var th *tcpTestHandler
+	var p1, p2 net.Conn
+	var err error
+	var regs []uint16
+	var coils []bool
+
+	th = &tcpTestHandler{}
+
+	// a serial line server must be given the list of unit ids to answer to
+	_, err = NewServer(&ServerConfiguration{
+		URL: "ascii:///dev/ttyUSB0",
+	}, th)
+	if err != ErrConfigurationError {
+		t.Errorf("NewServer() should have failed with ErrConfigurationError, got: %v", err)
+	}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:     "ascii:///dev/ttyUSB0",
+		UnitIds: []uint8{9},
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+	if server.conf.DataBits != 7 {
+		t.Errorf("expected 7 data bits, got: %v", server.conf.DataBits)
+	}
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "ascii:///dev/ttyUSB0",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+	if client.conf.DataBits != 7 {
+		t.Errorf("expected 7 data bits, got: %v", client.conf.DataBits)
+	}
+
+	// wire the client and the server together over a pipe rather than
+	// a physical serial line
+	p1, p2 = net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	client.transport = newASCIITransport(p1, "", 100*time.Millisecond, nil)
+	go server.handleTransport(
+		newASCIITransport(p2, "", 100*time.Millisecond, nil), "", "")
+
+	client.SetUnitId(9)
+
+	err = client.WriteRegisters(0x0002, []uint16{0x1234, 0x5678})
+	if err != nil {
+		t.Errorf("WriteRegisters() should have succeeded, got: %v", err)
+	}
+
+	regs, err = client.ReadRegisters(0x0002, 2, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("ReadRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 2 || regs[0] != 0x1234 || regs[1] != 0x5678 {
+		t.Errorf("expected {0x1234, 0x5678}, got: %v", regs)
+	}
+
+	err = client.WriteCoil(0x0003, true)
+	if err != nil {
+		t.Errorf("WriteCoil() should have succeeded, got: %v", err)
+	}
+
+	coils, err = client.ReadCoils(0x0002, 2)
+	if err != nil {
+		t.Errorf("ReadCoils() should have succeeded, got: %v", err)
+	}
+	if len(coils) != 2 || coils[0] || !coils[1] {
+		t.Errorf("expected {false, true}, got: %v", coils)
+	}
+
+	// out of range requests should yield an exception response
+	_, err = client.ReadRegisters(0x0009, 2, INPUT_REGISTER)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("ReadRegisters() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// requests addressed to other devices on the bus should be ignored
+	client.SetUnitId(10)
+	_, err = client.ReadRegisters(0x0002, 1, HOLDING_REGISTER)
+	if err != ErrRequestTimedOut {
+		t.Errorf("ReadRegisters() should have returned ErrRequestTimedOut, got: %v", err)
+	}
+
+	// the server should keep on serving once the line went quiet
+	client.SetUnitId(9)
+	regs, err = client.ReadRegisters(0x0003, 1, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("ReadRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 1 || regs[0] != 0x5678 {
+		t.Errorf("expected {0x5678}, got: %v", regs)
+	}
+
+	return
+}
+
+func TestASCIIOverTCPServer(t *testing.T) {
+	var server *ModbusServer
+	var client *ModbusClient
+	var th *tcpTestHandler
+	var err error
+	var regs []uint16
+
+	th = &tcpTestHandler{}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:     "asciiovertcp://localhost:5502?maxclients=2",
+		Timeout: 100 * time.Millisecond,
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+	if server.conf.MaxClients != 2 {
+		t.Errorf("expected 2 max clients, got: %v", server.conf.MaxClients)
+	}
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "asciiovertcp://localhost:5502",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+	err = client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	client.SetUnitId(9)
+
+	err = client.WriteRegister(0x0004, 0xabcd)
+	if err != nil {
+		t.Errorf("WriteRegister() should have succeeded, got: %v", err)
+	}
+
+	regs, err = client.ReadRegisters(0x0004, 1, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("ReadRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 1 || regs[0] != 0xabcd {
+		t.Errorf("expected {0xabcd}, got: %v", regs)
+	}
+
+	// idle sessions should be closed by the server
+	time.Sleep(300 * time.Millisecond)
+	_, err = client.ReadRegisters(0x0004, 1, HOLDING_REGISTER)
+	if err == nil {
+		t.Errorf("ReadRegisters() should have failed")
+	}
+
+	return
+}
@@ -0,0 +1,486 @@
+package modbus
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRTUServer(t *testing.T) {
+	var server *ModbusServer
+	var client *ModbusClient
+	var th *tcpTestHandler
+	var p1, p2 net.Conn
+	var err error
+	var regs []uint16
+
+	th = &tcpTestHandler{}
+
+	// a serial line server must be given the list of unit ids to answer to
+	_, err = NewServer(&ServerConfiguration{
+		URL: "rtu:///dev/ttyUSB0",
+	}, th)
+	if err != ErrConfigurationError {
+		t.Errorf("NewServer() should have failed with ErrConfigurationError, got: %v", err)
+	}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:     "rtu:///dev/ttyUSB0",
+		UnitIds: []uint8{9},
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "rtu:///dev/ttyUSB0",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	// wire the client and the server together over a pipe rather than
+	// a physical serial line
+	p1, p2 = net.Pipe()
+	client.transport = newRTUTransport(p1, "", 19200, 100*time.Millisecond, nil)
+	go server.handleTransport(
+		newRTUTransport(p2, "", 19200, 100*time.Millisecond, nil), "", "")
+
+	client.SetUnitId(9)
+
+	err = client.WriteRegisters(0x0002, []uint16{0x1234, 0x5678})
+	if err != nil {
+		t.Errorf("WriteRegisters() should have succeeded, got: %v", err)
+	}
+
+	regs, err = client.ReadRegisters(0x0002, 2, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("ReadRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 2 || regs[0] != 0x1234 || regs[1] != 0x5678 {
+		t.Errorf("expected {0x1234, 0x5678}, got: %v", regs)
+	}
+
+	err = client.MaskWriteRegister(0x0002, 0xff00, 0x00aa)
+	if err != nil {
+		t.Errorf("MaskWriteRegister() should have succeeded, got: %v", err)
+	}
+
+	regs, err = client.ReadWriteRegisters(0x0002, 2, 0x0003, []uint16{0x9abc})
+	if err != nil {
+		t.Errorf("ReadWriteRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 2 || regs[0] != 0x12aa || regs[1] != 0x9abc {
+		t.Errorf("expected {0x12aa, 0x9abc}, got: %v", regs)
+	}
+
+	// out of range requests should yield an exception response
+	_, err = client.ReadRegisters(0x0009, 2, INPUT_REGISTER)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("ReadRegisters() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// requests addressed to other devices on the bus should be ignored
+	client.SetUnitId(10)
+	_, err = client.ReadRegisters(0x0002, 1, HOLDING_REGISTER)
+	if err != ErrRequestTimedOut {
+		t.Errorf("ReadRegisters() should have returned ErrRequestTimedOut, got: %v", err)
+	}
+
+	// broadcast requests should never be answered
+	client.SetUnitId(0)
+	err = client.WriteCoil(0x0001, true)
+	if err != ErrRequestTimedOut {
+		t.Errorf("WriteCoil() should have returned ErrRequestTimedOut, got: %v", err)
+	}
+
+	p1.Close()
+	p2.Close()
+
+	return
+}
+
+func TestRTUServerDeviceIdentification(t *testing.T) {
+	var server *ModbusServer
+	var client *ModbusClient
+	var p1, p2 net.Conn
+	var err error
+	var di *DeviceIdentification
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:     "rtu:///dev/ttyUSB0",
+		UnitIds: []uint8{9},
+	}, &deviceIdTestHandler{})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "rtu:///dev/ttyUSB0",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	p1, p2 = net.Pipe()
+	client.transport = newRTUTransport(p1, "", 19200, 100*time.Millisecond, nil)
+	go server.handleTransport(
+		newRTUTransport(p2, "", 19200, 100*time.Millisecond, nil), "", "")
+
+	client.SetUnitId(9)
+
+	// extended objects span multiple (variable-length) frames
+	di, err = client.ReadDeviceIdentification(DEVICE_ID_EXTENDED)
+	if err != nil {
+		t.Errorf("ReadDeviceIdentification() should have succeeded, got: %v", err)
+		return
+	}
+	if len(di.Objects) != 7 {
+		t.Errorf("expected 7 objects, got: %v", len(di.Objects))
+	}
+	if di.Objects[DEVICE_ID_VENDOR_NAME] != "Machnos" {
+		t.Errorf("expected 'Machnos', got: '%v'", di.Objects[DEVICE_ID_VENDOR_NAME])
+	}
+	if len(di.Objects[0x82]) != 200 {
+		t.Errorf("expected object 0x82 to be 200 bytes long, got: %v",
+			len(di.Objects[0x82]))
+	}
+
+	p1.Close()
+	p2.Close()
+
+	return
+}
+
+func TestRTUServerFileRecordsAndFifoQueue(t *testing.T) {
+	var server *ModbusServer
+	var client *ModbusClient
+	var fh *fileTestHandler
+	var p1, p2 net.Conn
+	var err error
+	var records []FileRecord
+	var values []uint16
+
+	fh = &fileTestHandler{}
+	fh.fifo = []uint16{0x01b8, 0x1284, 0x0000}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:     "rtu:///dev/ttyUSB0",
+		UnitIds: []uint8{9},
+	}, fh)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "rtu:///dev/ttyUSB0",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	p1, p2 = net.Pipe()
+	client.transport = newRTUTransport(p1, "", 19200, 100*time.Millisecond, nil)
+	go server.handleTransport(
+		newRTUTransport(p2, "", 19200, 100*time.Millisecond, nil), "", "")
+
+	client.SetUnitId(9)
+
+	err = client.WriteFileRecords([]FileRecord{
+		{FileNumber: 3, RecordNumber: 2, Values: []uint16{0x1111, 0x2222}},
+		{FileNumber: 4, RecordNumber: 14, Values: []uint16{0x3333, 0x4444}},
+	})
+	if err != nil {
+		t.Errorf("WriteFileRecords() should have succeeded, got: %v", err)
+	}
+
+	records, err = client.ReadFileRecords([]FileRecord{
+		{FileNumber: 4, RecordNumber: 15, RecordLength: 1},
+		{FileNumber: 3, RecordNumber: 1, RecordLength: 3},
+	})
+	if err != nil {
+		t.Errorf("ReadFileRecords() should have succeeded, got: %v", err)
+	}
+	if len(records) != 2 ||
+		len(records[0].Values) != 1 || records[0].Values[0] != 0x4444 ||
+		len(records[1].Values) != 3 || records[1].Values[0] != 0x0000 ||
+		records[1].Values[1] != 0x1111 || records[1].Values[2] != 0x2222 {
+		t.Errorf("unexpected records: %v", records)
+	}
+
+	// FIFO queue responses carry a 2-byte byte count
+	values, err = client.ReadFifoQueue(0x04de)
+	if err != nil {
+		t.Errorf("ReadFifoQueue() should have succeeded, got: %v", err)
+	}
+	if len(values) != 3 || values[0] != 0x01b8 || values[1] != 0x1284 || values[2] != 0x0000 {
+		t.Errorf("expected {0x01b8, 0x1284, 0x0000}, got: %v", values)
+	}
+
+	fh.fifo = nil
+	values, err = client.ReadFifoQueue(0x04de)
+	if err != nil {
+		t.Errorf("ReadFifoQueue() should have succeeded, got: %v", err)
+	}
+	if len(values) != 0 {
+		t.Errorf("expected an empty queue, got: %v", values)
+	}
+
+	p1.Close()
+	p2.Close()
+
+	return
+}
+
+func TestRTUServerDiagnostics(t *testing.T) {
+	var server *ModbusServer
+	var client *ModbusClient
+	var p1, p2 net.Conn
+	var rt *rtuTransport
+	var err error
+	var status uint8
+	var serverId []byte
+	var value uint16
+	var status16 uint16
+	var eventCount uint16
+	var eventLog *CommEventLog
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:     "rtu:///dev/ttyUSB0",
+		UnitIds: []uint8{9},
+	}, &diagnosticsTestHandler{})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "rtu:///dev/ttyUSB0",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	p1, p2 = net.Pipe()
+	client.transport = newRTUTransport(p1, "", 19200, 100*time.Millisecond, nil)
+	rt = newRTUTransport(p2, "", 19200, 100*time.Millisecond, nil)
+	rt.diagnostics = server.diagnostics
+	go server.handleTransport(rt, "", "")
+
+	client.SetUnitId(9)
+
+	err = client.ReturnQueryData(0xa537)
+	if err != nil {
+		t.Errorf("ReturnQueryData() should have succeeded, got: %v", err)
+	}
+
+	status, err = client.ReadExceptionStatus()
+	if err != nil {
+		t.Errorf("ReadExceptionStatus() should have succeeded, got: %v", err)
+	}
+	if status != 0x6d {
+		t.Errorf("expected 0x6d, got: 0x%02x", status)
+	}
+
+	serverId, err = client.ReportServerId()
+	if err != nil {
+		t.Errorf("ReportServerId() should have succeeded, got: %v", err)
+	}
+	// server id, run indicator status and additional data
+	if string(serverId) != "EM24\xffv1.2" {
+		t.Errorf("expected 'EM24\\xffv1.2', got: %v", serverId)
+	}
+
+	_, err = client.ReadRegisters(0x0009, 2, INPUT_REGISTER)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("ReadRegisters() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// 4 requests so far, plus the counter request itself
+	value, err = client.ReadDiagnosticCounter(DIAG_BUS_MESSAGE_COUNT)
+	if err != nil || value != 5 {
+		t.Errorf("expected a bus message count of 5, got: %v (err: %v)", value, err)
+	}
+
+	value, err = client.ReadDiagnosticCounter(DIAG_BUS_EXCEPTION_ERROR_COUNT)
+	if err != nil || value != 1 {
+		t.Errorf("expected a bus exception error count of 1, got: %v (err: %v)", value, err)
+	}
+
+	_, err = client.ReadDiagnosticCounter(DIAG_CLEAR_COUNTERS)
+	if err != ErrUnexpectedParameters {
+		t.Errorf("ReadDiagnosticCounter() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+
+	// frames with a bad CRC should be counted as communication errors
+	p1.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = p1.Write([]byte{0x09, 0x07, 0x00, 0x00})
+	if err != nil {
+		t.Errorf("failed to write to the pipe: %v", err)
+	}
+	// let the server flush its rx buffer
+	time.Sleep(200 * time.Millisecond)
+
+	value, err = client.ReadDiagnosticCounter(DIAG_BUS_COMM_ERROR_COUNT)
+	if err != nil || value != 1 {
+		t.Errorf("expected a bus comm error count of 1, got: %v (err: %v)", value, err)
+	}
+
+	// frames too long for the receive buffer should be counted as overruns
+	p1.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = p1.Write([]byte{0x09, 0x10, 0x00, 0x00, 0x00, 0x7f, 0xff})
+	if err != nil {
+		t.Errorf("failed to write to the pipe: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	value, err = client.ReadDiagnosticCounter(DIAG_BUS_CHARACTER_OVERRUN_COUNT)
+	if err != nil || value != 1 {
+		t.Errorf("expected a bus character overrun count of 1, got: %v (err: %v)", value, err)
+	}
+
+	// in listen only mode, the server should stop responding to anything but
+	// restart communications requests (which do not get a response either)
+	err = client.ForceListenOnlyMode()
+	if err != nil {
+		t.Errorf("ForceListenOnlyMode() should have succeeded, got: %v", err)
+	}
+
+	_, err = client.ReadRegisters(0x0001, 1, HOLDING_REGISTER)
+	if err != ErrRequestTimedOut {
+		t.Errorf("ReadRegisters() should have returned ErrRequestTimedOut, got: %v", err)
+	}
+
+	err = client.RestartCommunications(false)
+	if err != ErrRequestTimedOut {
+		t.Errorf("RestartCommunications() should have returned ErrRequestTimedOut, got: %v", err)
+	}
+
+	err = client.ReturnQueryData(0x1234)
+	if err != nil {
+		t.Errorf("ReturnQueryData() should have succeeded, got: %v", err)
+	}
+
+	err = client.ClearDiagnosticCounters()
+	if err != nil {
+		t.Errorf("ClearDiagnosticCounters() should have succeeded, got: %v", err)
+	}
+
+	// restart, query data and clear counters requests
+	status16, eventCount, err = client.GetCommEventCounter()
+	if err != nil {
+		t.Errorf("GetCommEventCounter() should have succeeded, got: %v", err)
+	}
+	if status16 != 0x0000 || eventCount != 3 {
+		t.Errorf("expected a status of 0x0000 and an event count of 3, got: 0x%04x, %v",
+			status16, eventCount)
+	}
+
+	eventLog, err = client.GetCommEventLog()
+	if err != nil {
+		t.Errorf("GetCommEventLog() should have succeeded, got: %v", err)
+		return
+	}
+	if eventLog.EventCount != 3 || eventLog.MessageCount != 2 {
+		t.Errorf("expected an event count of 3 and a message count of 2, got: %v, %v",
+			eventLog.EventCount, eventLog.MessageCount)
+	}
+	if len(eventLog.Events) < 10 ||
+		string(eventLog.Events[0:10]) !=
+			string([]byte{0x80, 0x40, 0x80, 0x40, 0x80, 0x40, 0x80, 0x40, 0x00, 0xa0}) {
+		t.Errorf("unexpected event log: %x", eventLog.Events)
+	}
+
+	p1.Close()
+	p2.Close()
+
+	return
+}
+
+type diagnosticsTestHandler struct {
+	tcpTestHandler
+}
+
+func (dh *diagnosticsTestHandler) HandleExceptionStatus(req *ExceptionStatusRequest) (status uint8, err error) {
+	status = 0x6d
+
+	return
+}
+
+func (dh *diagnosticsTestHandler) HandleServerId(req *ServerIdRequest) (serverId []byte, running bool, additionalData []byte, err error) {
+	serverId = []byte("EM24")
+	running = true
+	additionalData = []byte("v1.2")
+
+	return
+}
+
+func TestRTUOverTCPServer(t *testing.T) {
+	var server *ModbusServer
+	var client *ModbusClient
+	var th *tcpTestHandler
+	var err error
+	var regs []uint16
+
+	th = &tcpTestHandler{}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:     "rtuovertcp://localhost:5502",
+		Timeout: 100 * time.Millisecond,
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "rtuovertcp://localhost:5502",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+	err = client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	client.SetUnitId(9)
+
+	err = client.WriteRegister(0x0004, 0xabcd)
+	if err != nil {
+		t.Errorf("WriteRegister() should have succeeded, got: %v", err)
+	}
+
+	regs, err = client.ReadRegisters(0x0004, 1, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("ReadRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 1 || regs[0] != 0xabcd {
+		t.Errorf("expected {0xabcd}, got: %v", regs)
+	}
+
+	// idle sessions should be closed by the server
+	time.Sleep(300 * time.Millisecond)
+	_, err = client.ReadRegisters(0x0004, 1, HOLDING_REGISTER)
+	if err == nil {
+		t.Errorf("ReadRegisters() should have failed")
+	}
+
+	return
+}
@@ -1,6 +1,7 @@
 package modbus
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
@@ -656,3 +657,573 @@ func (th *tcpTestHandler) HandleInputRegisters(req *InputRegistersRequest) (res
 
 	return
 }
+
+func TestTCPServerDeviceIdentification(t *testing.T) {
+	var server *ModbusServer
+	var client *ModbusClient
+	var err error
+	var di *DeviceIdentification
+	var value string
+
+	// a handler without device identification support
+	server, err = NewServer(&ServerConfiguration{
+		URL: "tcp://localhost:5502",
+	}, &tcpTestHandler{})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "tcp://localhost:5502",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	err = client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+
+	_, err = client.ReadDeviceIdentification(DEVICE_ID_BASIC)
+	if err != ErrIllegalFunction {
+		t.Errorf("ReadDeviceIdentification() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	client.Close()
+	server.Stop()
+
+	// a handler publishing basic, regular and extended objects
+	server, err = NewServer(&ServerConfiguration{
+		URL: "tcp://localhost:5502",
+	}, &deviceIdTestHandler{})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	err = client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	client.SetUnitId(9)
+
+	// basic objects only
+	di, err = client.ReadDeviceIdentification(DEVICE_ID_BASIC)
+	if err != nil {
+		t.Errorf("ReadDeviceIdentification() should have succeeded, got: %v", err)
+		return
+	}
+	if di.ConformityLevel != 0x83 {
+		t.Errorf("expected a conformity level of 0x83, got: 0x%02x", di.ConformityLevel)
+	}
+	if len(di.Objects) != 3 ||
+		di.Objects[DEVICE_ID_VENDOR_NAME] != "Machnos" ||
+		di.Objects[DEVICE_ID_PRODUCT_CODE] != "EM24" ||
+		di.Objects[DEVICE_ID_MAJOR_MINOR_REVISION] != "1.2" {
+		t.Errorf("unexpected basic objects: %v", di.Objects)
+	}
+
+	// regular objects include the basic ones
+	di, err = client.ReadDeviceIdentification(DEVICE_ID_REGULAR)
+	if err != nil {
+		t.Errorf("ReadDeviceIdentification() should have succeeded, got: %v", err)
+		return
+	}
+	if len(di.Objects) != 4 || di.Objects[DEVICE_ID_PRODUCT_NAME] != "Energy meter" {
+		t.Errorf("unexpected regular objects: %v", di.Objects)
+	}
+
+	// extended objects don't fit in a single response
+	di, err = client.ReadDeviceIdentification(DEVICE_ID_EXTENDED)
+	if err != nil {
+		t.Errorf("ReadDeviceIdentification() should have succeeded, got: %v", err)
+		return
+	}
+	if len(di.Objects) != 7 {
+		t.Errorf("expected 7 objects, got: %v", len(di.Objects))
+	}
+	for id := uint8(0x80); id < 0x83; id++ {
+		if len(di.Objects[id]) != 200 {
+			t.Errorf("expected object 0x%02x to be 200 bytes long, got: %v",
+				id, len(di.Objects[id]))
+		}
+	}
+
+	// individual access
+	value, err = client.ReadDeviceIdentificationObject(DEVICE_ID_PRODUCT_CODE)
+	if err != nil {
+		t.Errorf("ReadDeviceIdentificationObject() should have succeeded, got: %v", err)
+	}
+	if value != "EM24" {
+		t.Errorf("expected 'EM24', got: '%v'", value)
+	}
+
+	_, err = client.ReadDeviceIdentificationObject(DEVICE_ID_MODEL_NAME)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("ReadDeviceIdentificationObject() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	return
+}
+
+type deviceIdTestHandler struct {
+	tcpTestHandler
+}
+
+func (dh *deviceIdTestHandler) HandleDeviceIdentification(req *DeviceIdentificationRequest) (res map[uint8]string, err error) {
+	res = map[uint8]string{
+		DEVICE_ID_VENDOR_NAME:          "Machnos",
+		DEVICE_ID_PRODUCT_CODE:         "EM24",
+		DEVICE_ID_MAJOR_MINOR_REVISION: "1.2",
+		DEVICE_ID_PRODUCT_NAME:         "Energy meter",
+		0x80:                           strings.Repeat("a", 200),
+		0x81:                           strings.Repeat("b", 200),
+		0x82:                           strings.Repeat("c", 200),
+	}
+
+	return
+}
+
+func TestTCPServerMaskWriteAndReadWriteRegisters(t *testing.T) {
+	var server *ModbusServer
+	var client *ModbusClient
+	var th *tcpTestHandler
+	var err error
+	var regs []uint16
+
+	th = &tcpTestHandler{}
+	th.holding[1] = 0x0012
+
+	// the test handler implements neither MaskWriteRegisterHandler nor
+	// ReadWriteRegistersHandler: the server should emulate them
+	server, err = NewServer(&ServerConfiguration{
+		URL: "tcp://localhost:5502",
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "tcp://localhost:5502",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	err = client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	client.SetUnitId(9)
+
+	// example from the modbus application protocol spec:
+	// (0x0012 AND 0x00f2) OR (0x0025 AND (NOT 0x00f2)) = 0x0017
+	err = client.MaskWriteRegister(0x0001, 0x00f2, 0x0025)
+	if err != nil {
+		t.Errorf("MaskWriteRegister() should have succeeded, got: %v", err)
+	}
+	if th.holding[1] != 0x0017 {
+		t.Errorf("expected 0x0017, got: 0x%04x", th.holding[1])
+	}
+
+	err = client.MaskWriteRegister(0x0010, 0x00f2, 0x0025)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("MaskWriteRegister() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// the write should happen before the read
+	regs, err = client.ReadWriteRegisters(0x0001, 3, 0x0002, []uint16{0x1111, 0x2222})
+	if err != nil {
+		t.Errorf("ReadWriteRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 3 || regs[0] != 0x0017 || regs[1] != 0x1111 || regs[2] != 0x2222 {
+		t.Errorf("expected {0x0017, 0x1111, 0x2222}, got: %v", regs)
+	}
+
+	_, err = client.ReadWriteRegisters(0x0001, 1, 0x0009, []uint16{0x1111, 0x2222})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("ReadWriteRegisters() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	_, err = client.ReadWriteRegisters(0x0001, 0, 0x0002, []uint16{0x1111})
+	if err != ErrUnexpectedParameters {
+		t.Errorf("ReadWriteRegisters() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+
+	return
+}
+
+func TestTCPServerFileRecordsAndFifoQueue(t *testing.T) {
+	var server *ModbusServer
+	var client *ModbusClient
+	var fh *fileTestHandler
+	var err error
+	var records []FileRecord
+	var values []uint16
+
+	fh = &fileTestHandler{}
+	fh.files[3][9] = 0x0d0e
+	fh.files[3][10] = 0x0f10
+	fh.files[4][1] = 0x0102
+	fh.files[4][2] = 0x0304
+	fh.fifo = []uint16{0x01b8, 0x1284}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL: "tcp://localhost:5502",
+	}, fh)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "tcp://localhost:5502",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	err = client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	client.SetUnitId(9)
+
+	// example from the modbus application protocol spec: two groups of
+	// records in a single request
+	records, err = client.ReadFileRecords([]FileRecord{
+		{FileNumber: 4, RecordNumber: 1, RecordLength: 2},
+		{FileNumber: 3, RecordNumber: 9, RecordLength: 2},
+	})
+	if err != nil {
+		t.Errorf("ReadFileRecords() should have succeeded, got: %v", err)
+	}
+	if len(records) != 2 {
+		t.Errorf("expected 2 records, got: %v", len(records))
+	} else {
+		if len(records[0].Values) != 2 ||
+			records[0].Values[0] != 0x0102 || records[0].Values[1] != 0x0304 {
+			t.Errorf("expected {0x0102, 0x0304}, got: %v", records[0].Values)
+		}
+		if len(records[1].Values) != 2 ||
+			records[1].Values[0] != 0x0d0e || records[1].Values[1] != 0x0f10 {
+			t.Errorf("expected {0x0d0e, 0x0f10}, got: %v", records[1].Values)
+		}
+	}
+
+	err = client.WriteFileRecords([]FileRecord{
+		{FileNumber: 4, RecordNumber: 7, Values: []uint16{0x06af, 0x04be, 0x100d}},
+		{FileNumber: 3, RecordNumber: 0, Values: []uint16{0x1234}},
+	})
+	if err != nil {
+		t.Errorf("WriteFileRecords() should have succeeded, got: %v", err)
+	}
+	if fh.files[4][7] != 0x06af || fh.files[4][8] != 0x04be ||
+		fh.files[4][9] != 0x100d || fh.files[3][0] != 0x1234 {
+		t.Errorf("unexpected file contents: %v, %v", fh.files[3], fh.files[4])
+	}
+
+	// records past the end of the file should yield an exception
+	_, err = client.ReadFileRecords([]FileRecord{
+		{FileNumber: 4, RecordNumber: 15, RecordLength: 2},
+	})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("ReadFileRecords() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// file number 0 is not valid
+	_, err = client.ReadFileRecords([]FileRecord{
+		{FileNumber: 0, RecordNumber: 1, RecordLength: 2},
+	})
+	if err != ErrUnexpectedParameters {
+		t.Errorf("ReadFileRecords() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+
+	values, err = client.ReadFifoQueue(0x04de)
+	if err != nil {
+		t.Errorf("ReadFifoQueue() should have succeeded, got: %v", err)
+	}
+	if len(values) != 2 || values[0] != 0x01b8 || values[1] != 0x1284 {
+		t.Errorf("expected {0x01b8, 0x1284}, got: %v", values)
+	}
+
+	// queues holding more than 31 values should yield an exception
+	fh.fifo = make([]uint16, 32)
+	_, err = client.ReadFifoQueue(0x04de)
+	if err != ErrIllegalDataValue {
+		t.Errorf("ReadFifoQueue() should have returned ErrIllegalDataValue, got: %v", err)
+	}
+
+	_, err = client.ReadFifoQueue(0x0001)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("ReadFifoQueue() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	return
+}
+
+// fileTestHandler exposes two files (#3 and #4) of 16 records each, as well as
+// a FIFO queue at address 0x04de.
+type fileTestHandler struct {
+	tcpTestHandler
+	files [5][16]uint16
+	fifo  []uint16
+}
+
+func (fh *fileTestHandler) HandleFileRecords(req *FileRecordsRequest) (res [][]uint16, err error) {
+	var values []uint16
+
+	for _, record := range req.Records {
+		if record.FileNumber < 3 || record.FileNumber > 4 ||
+			int(record.RecordNumber)+int(record.RecordLength) > 16 {
+			err = ErrIllegalDataAddress
+			return
+		}
+	}
+
+	for _, record := range req.Records {
+		values = fh.files[record.FileNumber][record.RecordNumber : record.RecordNumber+record.RecordLength]
+		if req.IsWrite {
+			copy(values, record.Values)
+		} else {
+			res = append(res, append([]uint16{}, values...))
+		}
+	}
+
+	return
+}
+
+func (fh *fileTestHandler) HandleFifoQueue(req *FifoQueueRequest) (res []uint16, err error) {
+	if req.Addr != 0x04de {
+		err = ErrIllegalDataAddress
+		return
+	}
+
+	res = fh.fifo
+
+	return
+}
+
+func TestTCPClientReconnect(t *testing.T) {
+	var err error
+	var server *ModbusServer
+	var client *ModbusClient
+	var th *tcpTestHandler
+	var states chan ConnectionState
+	var state ConnectionState
+	var regs []uint16
+
+	th = &tcpTestHandler{}
+	th.holding[1] = 0x1234
+
+	server, err = NewServer(&ServerConfiguration{
+		URL: "tcp://localhost:5502",
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+
+	states = make(chan ConnectionState, 10)
+	client, err = NewClient(&ClientConfiguration{
+		URL:               "tcp://localhost:5502",
+		AutoReconnect:     true,
+		ReconnectMinDelay: 10 * time.Millisecond,
+		ReconnectMaxDelay: 50 * time.Millisecond,
+		OnStateChange: func(state ConnectionState) {
+			states <- state
+		},
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	if client.State() != STATE_CLOSED {
+		t.Errorf("expected STATE_CLOSED, got: %v", client.State())
+	}
+
+	err = client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	client.SetUnitId(9)
+
+	if state = <-states; state != STATE_CONNECTED {
+		t.Errorf("expected STATE_CONNECTED, got: %v", state)
+	}
+
+	regs, err = client.ReadRegisters(1, 1, HOLDING_REGISTER)
+	if err != nil || len(regs) != 1 || regs[0] != 0x1234 {
+		t.Errorf("ReadRegisters() should have returned {0x1234}, got: %v, %v", regs, err)
+	}
+
+	// drop the connection: the next request should fail and the client
+	// should report the transport failure
+	server.Stop()
+
+	_, err = client.ReadRegisters(1, 1, HOLDING_REGISTER)
+	if err == nil {
+		t.Errorf("ReadRegisters() should have failed")
+	}
+
+	if state = <-states; state != STATE_DISCONNECTED {
+		t.Errorf("expected STATE_DISCONNECTED, got: %v", state)
+	}
+
+	// requests made while the server is down should fail right away
+	_, err = client.ReadRegisters(1, 1, HOLDING_REGISTER)
+	if err != ErrNotConnected {
+		t.Errorf("ReadRegisters() should have returned ErrNotConnected, got: %v", err)
+	}
+
+	// bring the server back up and wait for the client to reconnect
+	server, err = NewServer(&ServerConfiguration{
+		URL: "tcp://localhost:5502",
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	select {
+	case state = <-states:
+		if state != STATE_CONNECTED {
+			t.Errorf("expected STATE_CONNECTED, got: %v", state)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("client failed to reconnect")
+		return
+	}
+
+	regs, err = client.ReadRegisters(1, 1, HOLDING_REGISTER)
+	if err != nil || len(regs) != 1 || regs[0] != 0x1234 {
+		t.Errorf("ReadRegisters() should have returned {0x1234}, got: %v, %v", regs, err)
+	}
+
+	err = client.Close()
+	if err != nil {
+		t.Errorf("Close() should have succeeded, got: %v", err)
+	}
+
+	if state = <-states; state != STATE_CLOSED {
+		t.Errorf("expected STATE_CLOSED, got: %v", state)
+	}
+
+	return
+}
+
+func TestTCPClientWithoutReconnect(t *testing.T) {
+	var err error
+	var server *ModbusServer
+	var client *ModbusClient
+	var th *tcpTestHandler
+
+	th = &tcpTestHandler{}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL: "tcp://localhost:5502",
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "tcp://localhost:5502",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+	err = client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+
+	// without auto-reconnect, transport failures should not lock the
+	// client out: requests keep going through the transport
+	server.Stop()
+
+	_, err = client.ReadRegisters(1, 1, HOLDING_REGISTER)
+	if err == nil {
+		t.Errorf("ReadRegisters() should have failed")
+	}
+
+	if client.State() != STATE_CONNECTED {
+		t.Errorf("expected STATE_CONNECTED, got: %v", client.State())
+	}
+
+	_, err = client.ReadRegisters(1, 1, HOLDING_REGISTER)
+	if err == nil || err == ErrNotConnected {
+		t.Errorf("ReadRegisters() should have failed with an i/o error, got: %v", err)
+	}
+
+	err = client.Close()
+	if err != nil {
+		t.Errorf("Close() should have succeeded, got: %v", err)
+	}
+
+	return
+}
@@ -0,0 +1,172 @@
+package modbus
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUDPServer(t *testing.T) {
+	var server *ModbusServer
+	var client *ModbusClient
+	var th *tcpTestHandler
+	var err error
+	var regs []uint16
+
+	for _, mode := range []string{"udp", "rtuoverudp"} {
+		th = &tcpTestHandler{}
+		th.input[1] = 0x1122
+
+		server, err = NewServer(&ServerConfiguration{
+			URL: mode + "://localhost:5502",
+		}, th)
+		if err != nil {
+			t.Errorf("failed to create %s server: %v", mode, err)
+			return
+		}
+		err = server.Start()
+		if err != nil {
+			t.Errorf("failed to start %s server: %v", mode, err)
+			return
+		}
+
+		client, err = NewClient(&ClientConfiguration{
+			URL: mode + "://localhost:5502",
+		})
+		if err != nil {
+			t.Errorf("failed to create %s client: %v", mode, err)
+			server.Stop()
+			return
+		}
+		err = client.Open()
+		if err != nil {
+			t.Errorf("failed to open %s client: %v", mode, err)
+			server.Stop()
+			return
+		}
+
+		client.SetUnitId(9)
+
+		// each request should be served from its own datagram
+		err = client.WriteRegisters(0x0002, []uint16{0x1234, 0x5678})
+		if err != nil {
+			t.Errorf("%s: WriteRegisters() should have succeeded, got: %v", mode, err)
+		}
+
+		regs, err = client.ReadRegisters(0x0002, 2, HOLDING_REGISTER)
+		if err != nil {
+			t.Errorf("%s: ReadRegisters() should have succeeded, got: %v", mode, err)
+		}
+		if len(regs) != 2 || regs[0] != 0x1234 || regs[1] != 0x5678 {
+			t.Errorf("%s: expected {0x1234, 0x5678}, got: %v", mode, regs)
+		}
+
+		regs, err = client.ReadRegisters(0x0001, 1, INPUT_REGISTER)
+		if err != nil {
+			t.Errorf("%s: ReadRegisters() should have succeeded, got: %v", mode, err)
+		}
+		if len(regs) != 1 || regs[0] != 0x1122 {
+			t.Errorf("%s: expected {0x1122}, got: %v", mode, regs)
+		}
+
+		// exceptions should make it back to the client
+		_, err = client.ReadRegisters(0x0009, 2, INPUT_REGISTER)
+		if err != ErrIllegalDataAddress {
+			t.Errorf("%s: ReadRegisters() should have returned ErrIllegalDataAddress, got: %v",
+				mode, err)
+		}
+
+		client.Close()
+		server.Stop()
+	}
+
+	return
+}
+
+func TestUDPServerMaxClients(t *testing.T) {
+	var server *ModbusServer
+	var th *udpTestHandler
+	var wg sync.WaitGroup
+	var err error
+
+	th = &udpTestHandler{tcpTestHandler: &tcpTestHandler{}}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL: "udp://localhost:5502?maxclients=2",
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	// datagrams beyond maxclients should wait for a request to be served
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			client, err := NewClient(&ClientConfiguration{
+				URL:     "udp://localhost:5502",
+				Timeout: 2 * time.Second,
+			})
+			if err != nil {
+				t.Errorf("failed to create client: %v", err)
+				return
+			}
+			err = client.Open()
+			if err != nil {
+				t.Errorf("failed to open client: %v", err)
+				return
+			}
+			defer client.Close()
+
+			client.SetUnitId(9)
+			_, err = client.ReadRegisters(0x0001, 1, INPUT_REGISTER)
+			if err != nil {
+				t.Errorf("ReadRegisters() should have succeeded, got: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	th.lock.Lock()
+	defer th.lock.Unlock()
+	if th.maxActive != 2 {
+		t.Errorf("expected up to 2 requests served at once, got: %v", th.maxActive)
+	}
+
+	return
+}
+
+// Serves input registers slowly, keeping track of the number of requests
+// served at once.
+type udpTestHandler struct {
+	*tcpTestHandler
+	lock      sync.Mutex
+	active    int
+	maxActive int
+}
+
+func (th *udpTestHandler) HandleInputRegisters(req *InputRegistersRequest) (res []uint16, err error) {
+	th.lock.Lock()
+	th.active++
+	if th.active > th.maxActive {
+		th.maxActive = th.active
+	}
+	th.lock.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+	res, err = th.tcpTestHandler.HandleInputRegisters(req)
+
+	th.lock.Lock()
+	th.active--
+	th.lock.Unlock()
+
+	return
+}
@@ -0,0 +1,582 @@
+package modbus
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// URL parameters accepted by sniffers (see clientURLParams).
+var snifferURLParams = map[string][]string{
+	"baud":     {"rtu"},
+	"databits": {"rtu"},
+	"parity":   {"rtu"},
+	"stop":     {"rtu"},
+}
+
+// Sniffer configuration object.
+type SnifferConfiguration struct {
+	// URL sets the serial device to listen on, in the form
+	// rtu://<serial device>[?<parameters>] e.g. rtu:///dev/ttyUSB0?baud=9600
+	// (see ClientConfiguration.URL for serial parameters)
+	URL string
+	// Speed sets the serial link speed (in bps, defaults to 19200)
+	Speed uint
+	// DataBits sets the number of bits per serial character (defaults to 8)
+	DataBits uint
+	// Parity sets the serial link parity mode
+	Parity uint
+	// StopBits sets the number of serial stop bits (defaults to 2 without
+	// parity, 1 otherwise)
+	StopBits uint
+	// FrameGap sets the line silence ending a burst of frames, defaults to
+	// t3.5 or 20ms, whichever is longer, as USB adapters deliver bytes in
+	// bursts. Frames running into each other are split by their length
+	// and CRC.
+	FrameGap time.Duration
+	// ResponseTimeout sets how long to wait for the response to a request
+	// before reporting it unanswered (defaults to 1s)
+	ResponseTimeout time.Duration
+	// Logger provides a custom sink for log messages.
+	// If nil, messages will be written to stdout.
+	Logger *log.Logger
+}
+
+// Bus transaction object, as reported by the sniffer.
+// Frames which cannot be paired (frames with a bad CRC, responses to
+// requests which were not seen) are reported alone in Request, along with
+// an Error.
+type SniffedTransaction struct {
+	// Time is the time the request was seen at
+	Time time.Time
+	// UnitId is the unit id the request was addressed to (0 for broadcasts)
+	UnitId uint8
+	// FunctionCode is the function code of the request
+	FunctionCode uint8
+	// Function is the name of the function code e.g. "read holding registers"
+	Function string
+	// Addr and Quantity are the first address and the number of coils or
+	// registers covered by the request, if applicable
+	Addr     uint16
+	Quantity uint16
+	// Registers and Coils hold the values read or written, if applicable
+	Registers []uint16
+	Coils     []bool
+	// Exception is the exception returned by the device, if any
+	Exception error
+	// Latency is the delay between the request and the response
+	Latency time.Duration
+	// Request and Response hold the raw frames, including the CRC
+	Request  []byte
+	Response []byte
+	// Error reports bus level problems: ErrBadCRC, ErrRequestTimedOut if
+	// the request went unanswered or ErrProtocolError for stray frames and
+	// frames whose byte count is inconsistent
+	Error error
+}
+
+// Modbus RTU sniffer object.
+// The sniffer listens on a serial bus without ever transmitting, pairs
+// requests with their response and decodes them into transactions.
+type Sniffer struct {
+	conf   SnifferConfiguration
+	logger *logger
+	link   rtuLink
+	// request awaiting its response
+	pending *SniffedTransaction
+}
+
+// NewSniffer creates, configures and returns a modbus RTU sniffer object.
+func NewSniffer(conf *SnifferConfiguration) (s *Sniffer, err error) {
+	var snifferType string
+	var splitURL []string
+	var params url.Values
+
+	s = &Sniffer{
+		conf: *conf,
+	}
+
+	splitURL = strings.SplitN(s.conf.URL, "://", 2)
+	if len(splitURL) == 2 {
+		snifferType = splitURL[0]
+		s.conf.URL = splitURL[1]
+	}
+
+	s.conf.URL, params, err = splitURLParams(s.conf.URL)
+
+	s.logger = newLogger(
+		fmt.Sprintf("modbus-sniffer(%s)", s.conf.URL), conf.Logger)
+
+	if err == nil && snifferType != "rtu" {
+		err = fmt.Errorf("unsupported sniffer type '%s', expected rtu", snifferType)
+	}
+
+	if err == nil {
+		err = checkURLParams(params, snifferURLParams, snifferType, "sniffer")
+	}
+
+	if err == nil {
+		err = applySerialParams(params, &s.conf.Speed, &s.conf.DataBits, &s.conf.Parity, &s.conf.StopBits)
+	}
+
+	if err != nil {
+		s.logger.Errorf("%v", err)
+		err = fmt.Errorf("%w: %v", ErrConfigurationError, err)
+		return
+	}
+
+	// set useful defaults (see NewClient())
+	if s.conf.Speed == 0 {
+		s.conf.Speed = 19200
+	}
+
+	if s.conf.DataBits == 0 {
+		s.conf.DataBits = 8
+	}
+
+	if s.conf.StopBits == 0 {
+		if s.conf.Parity == PARITY_NONE {
+			s.conf.StopBits = 2
+		} else {
+			s.conf.StopBits = 1
+		}
+	}
+
+	if s.conf.FrameGap == 0 {
+		s.conf.FrameGap = (serialCharTime(s.conf.Speed) * 35) / 10
+		if s.conf.FrameGap < 20*time.Millisecond {
+			s.conf.FrameGap = 20 * time.Millisecond
+		}
+	}
+
+	if s.conf.ResponseTimeout == 0 {
+		s.conf.ResponseTimeout = 1 * time.Second
+	}
+
+	return
+}
+
+// Opens the serial device.
+func (s *Sniffer) Open() (err error) {
+	var spw *serialPortWrapper
+
+	spw = newSerialPortWrapper(&serialPortConfig{
+		Device:   s.conf.URL,
+		Speed:    s.conf.Speed,
+		DataBits: s.conf.DataBits,
+		Parity:   s.conf.Parity,
+		StopBits: s.conf.StopBits,
+	})
+
+	err = spw.Open()
+	if err != nil {
+		return
+	}
+
+	s.link = spw
+
+	return
+}
+
+// Closes the serial device.
+func (s *Sniffer) Close() (err error) {
+	err = s.link.Close()
+
+	return
+}
+
+// Listens to the bus until ctx is done or an i/o error occurs, passing each
+// transaction to found as soon as it is complete. Returns nil once ctx is
+// done.
+func (s *Sniffer) Run(ctx context.Context, found func(*SniffedTransaction)) (err error) {
+	var rxbuf = make([]byte, maxRTUFrameLength)
+	var buf []byte
+	var times []time.Time
+	var lastByte time.Time
+	var deadline time.Time
+	var now time.Time
+	var length int
+	var n int
+
+	for ctx.Err() == nil {
+		// wake up when the line went silent for long enough, or
+		// periodically to expire requests and watch ctx
+		deadline = time.Now().Add(100 * time.Millisecond)
+		if len(buf) > 0 {
+			deadline = lastByte.Add(s.conf.FrameGap)
+		}
+
+		err = s.link.SetDeadline(deadline)
+		if err != nil {
+			return
+		}
+
+		n, err = s.link.Read(rxbuf)
+		now = time.Now()
+		if err != nil && err != ErrRequestTimedOut && !os.IsTimeout(err) {
+			return
+		}
+		err = nil
+
+		for i := 0; i < n; i++ {
+			buf = append(buf, rxbuf[i])
+			times = append(times, now)
+		}
+		if n > 0 {
+			lastByte = now
+		}
+
+		// busy buses may never go silent for long: handle frames as soon
+		// as they are complete
+		for length = nextRTUFrame(buf); length > 0; length = nextRTUFrame(buf) {
+			s.handleFrame(buf[0:length], times[0], found)
+			buf, times = buf[length:], times[length:]
+		}
+
+		// whatever is left once the line went silent (or piled up) is
+		// garbage, possibly followed by valid frames
+		if len(buf) > 0 && (now.Sub(lastByte) >= s.conf.FrameGap || len(buf) > 2*maxRTUFrameLength) {
+			s.handleFrames(buf, times, found)
+			buf, times = nil, nil
+		}
+
+		// report requests which went unanswered
+		if s.pending != nil && now.Sub(s.pending.Time) > s.conf.ResponseTimeout {
+			s.pending.Error = ErrRequestTimedOut
+			found(s.pending)
+			s.pending = nil
+		}
+	}
+
+	return
+}
+
+/*** unexported methods ***/
+
+// Splits leftover bytes into frames and handles them in turn.
+func (s *Sniffer) handleFrames(buf []byte, times []time.Time, found func(*SniffedTransaction)) {
+	var offset int
+
+	for _, frame := range splitRTUFrames(buf) {
+		s.handleFrame(frame, times[offset], found)
+		offset += len(frame)
+	}
+
+	return
+}
+
+// Pairs a frame with the pending request, or makes it the pending request.
+func (s *Sniffer) handleFrame(frame []byte, at time.Time, found func(*SniffedTransaction)) {
+	var p *pdu
+	var crc crc
+
+	if len(frame) < 4 {
+		found(&SniffedTransaction{Time: at, Request: frame, Error: ErrShortFrame})
+		return
+	}
+
+	crc.init()
+	crc.add(frame[0 : len(frame)-2])
+	if !crc.isEqual(frame[len(frame)-2], frame[len(frame)-1]) {
+		found(&SniffedTransaction{Time: at, Request: frame, Error: ErrBadCRC})
+		return
+	}
+
+	p = &pdu{
+		unitId:       frame[0],
+		functionCode: frame[1],
+		payload:      frame[2 : len(frame)-2],
+	}
+
+	// responses come from the unit the pending request was sent to,
+	// and carry the same function code (or the exception bit)
+	if s.pending != nil && p.unitId == s.pending.UnitId &&
+		p.functionCode&0x7f == s.pending.FunctionCode &&
+		rtuResponseFrameLength(frame) == len(frame) {
+		s.pending.Response = frame
+		s.pending.Latency = at.Sub(s.pending.Time)
+		decodeSniffedResponse(s.pending, p)
+		found(s.pending)
+		s.pending = nil
+		return
+	}
+
+	if rtuRequestFrameLength(frame) != len(frame) {
+		found(&SniffedTransaction{
+			Time:         at,
+			UnitId:       p.unitId,
+			FunctionCode: p.functionCode & 0x7f,
+			Function:     functionName(p.functionCode & 0x7f),
+			Request:      frame,
+			Error:        ErrProtocolError,
+		})
+		return
+	}
+
+	// a new request means the pending one will never be answered
+	if s.pending != nil {
+		s.pending.Error = ErrRequestTimedOut
+		found(s.pending)
+		s.pending = nil
+	}
+
+	s.pending = &SniffedTransaction{
+		Time:         at,
+		UnitId:       p.unitId,
+		FunctionCode: p.functionCode,
+		Function:     functionName(p.functionCode),
+		Request:      frame,
+	}
+	decodeSniffedRequest(s.pending, p)
+
+	// broadcasts are never answered
+	if p.unitId == 0x00 {
+		found(s.pending)
+		s.pending = nil
+	}
+
+	return
+}
+
+// Decodes the addresses and values carried by a request.
+func decodeSniffedRequest(st *SniffedTransaction, req *pdu) {
+	var fields []uint16
+
+	if len(req.payload) >= 4 {
+		fields = bytesToUint16s(BIG_ENDIAN, req.payload[0:4])
+	}
+
+	switch req.functionCode {
+	case fcReadCoils, fcReadDiscreteInputs,
+		fcReadHoldingRegisters, fcReadInputRegisters,
+		fcReadWriteMultipleRegisters:
+		st.Addr = fields[0]
+		st.Quantity = fields[1]
+
+	case fcWriteSingleCoil:
+		st.Addr = fields[0]
+		st.Quantity = 1
+		st.Coils = []bool{fields[1] == 0xff00}
+
+	case fcWriteSingleRegister:
+		st.Addr = fields[0]
+		st.Quantity = 1
+		st.Registers = []uint16{fields[1]}
+
+	case fcWriteMultipleCoils:
+		st.Addr = fields[0]
+		st.Quantity = fields[1]
+		if len(req.payload[5:])*8 < int(st.Quantity) {
+			st.Error = ErrProtocolError
+			return
+		}
+		st.Coils = decodeBools(st.Quantity, req.payload[5:])
+
+	case fcWriteMultipleRegisters:
+		st.Addr = fields[0]
+		st.Quantity = fields[1]
+		if len(req.payload[5:]) != 2*int(st.Quantity) {
+			st.Error = ErrProtocolError
+			return
+		}
+		st.Registers = bytesToUint16s(BIG_ENDIAN, req.payload[5:])
+
+	case fcMaskWriteRegister:
+		// AND and OR masks
+		st.Addr = fields[0]
+		st.Quantity = 1
+		st.Registers = bytesToUint16s(BIG_ENDIAN, req.payload[2:6])
+	}
+
+	return
+}
+
+// Decodes the values or the exception carried by a response.
+func decodeSniffedResponse(st *SniffedTransaction, res *pdu) {
+	if res.functionCode&0x80 != 0 {
+		st.Exception = mapExceptionCodeToError(res.payload[0])
+		return
+	}
+
+	switch res.functionCode {
+	case fcReadCoils, fcReadDiscreteInputs:
+		// the byte count must match the quantity of the request
+		if len(res.payload[1:]) != (int(st.Quantity)+7)/8 {
+			st.Error = ErrProtocolError
+			return
+		}
+		st.Coils = decodeBools(st.Quantity, res.payload[1:])
+
+	case fcReadHoldingRegisters, fcReadInputRegisters,
+		fcReadWriteMultipleRegisters:
+		if len(res.payload[1:]) != 2*int(st.Quantity) {
+			st.Error = ErrProtocolError
+			return
+		}
+		st.Registers = bytesToUint16s(BIG_ENDIAN, res.payload[1:])
+	}
+
+	return
+}
+
+// Splits bytes which could not be framed as they came in (see Run()) into
+// rtu frames, skipping over garbage until a valid frame is found. Garbage
+// is returned as frames of its own.
+func splitRTUFrames(buf []byte) (frames [][]byte) {
+	var length int
+	var skip int
+
+	for len(buf) > 0 {
+		length = nextRTUFrame(buf)
+
+		if length == 0 {
+			// look for the next valid frame
+			for skip = 1; skip < len(buf) && nextRTUFrame(buf[skip:]) == 0; skip++ {
+			}
+			length = skip
+		}
+
+		frames = append(frames, buf[0:length])
+		buf = buf[length:]
+	}
+
+	return
+}
+
+// Returns the length of the CRC-valid request or response frame at the start
+// of buf, or 0 if buf doesn't start with a complete, valid frame.
+func nextRTUFrame(buf []byte) (length int) {
+	var crc crc
+
+	for _, candidate := range []int{rtuRequestFrameLength(buf), rtuResponseFrameLength(buf)} {
+		if candidate < 4 || candidate > len(buf) {
+			continue
+		}
+
+		crc.init()
+		crc.add(buf[0 : candidate-2])
+		if crc.isEqual(buf[candidate-2], buf[candidate-1]) {
+			length = candidate
+			return
+		}
+	}
+
+	return
+}
+
+// Returns the length of the rtu request frame at the start of buf, or 0 if
+// buf doesn't start with a known request.
+func rtuRequestFrameLength(buf []byte) (length int) {
+	var headerLength int
+	var err error
+
+	if len(buf) < 2 {
+		return
+	}
+
+	headerLength, err = expectedRequestHeaderLength(buf[1])
+	if err != nil || len(buf) < 2+headerLength {
+		return
+	}
+
+	// unit id, function code, header, data and CRC
+	length = 2 + headerLength + expectedRequestDataLength(buf[1], buf[2:2+headerLength]) + 2
+
+	return
+}
+
+// Returns the length of the rtu response frame at the start of buf, or 0 if
+// buf doesn't start with a known response.
+func rtuResponseFrameLength(buf []byte) (length int) {
+	var byteCount int
+	var objectCount int
+	var err error
+
+	if len(buf) < 3 {
+		return
+	}
+
+	byteCount, err = expectedResponseLenth(buf[1], buf[2])
+	if err != nil {
+		return
+	}
+
+	switch buf[1] {
+	case fcReadFifoQueue:
+		// 2-byte byte count (see readRTUFrame())
+		if len(buf) < 4 {
+			return
+		}
+		byteCount = 1 + int(bytesToUint16(BIG_ENDIAN, buf[2:4]))
+
+	case fcEncapsulatedInterface:
+		// walk the object list (see readDeviceIdObjectList())
+		if len(buf) < 3+byteCount {
+			return
+		}
+		objectCount = int(buf[3+byteCount-1])
+		for i := 0; i < objectCount; i++ {
+			if len(buf) < 3+byteCount+2 {
+				return
+			}
+			byteCount += 2 + int(buf[3+byteCount+1])
+		}
+	}
+
+	// unit id, function code, length/exception code, payload and CRC
+	length = 3 + byteCount + 2
+
+	return
+}
+
+// Returns a readable name for a function code.
+func functionName(functionCode uint8) (name string) {
+	switch functionCode {
+	case fcReadCoils:
+		name = "read coils"
+	case fcReadDiscreteInputs:
+		name = "read discrete inputs"
+	case fcReadHoldingRegisters:
+		name = "read holding registers"
+	case fcReadInputRegisters:
+		name = "read input registers"
+	case fcWriteSingleCoil:
+		name = "write single coil"
+	case fcWriteSingleRegister:
+		name = "write single register"
+	case fcReadExceptionStatus:
+		name = "read exception status"
+	case fcDiagnostics:
+		name = "diagnostics"
+	case fcGetCommEventCounter:
+		name = "get comm event counter"
+	case fcGetCommEventLog:
+		name = "get comm event log"
+	case fcWriteMultipleCoils:
+		name = "write multiple coils"
+	case fcWriteMultipleRegisters:
+		name = "write multiple registers"
+	case fcReportServerId:
+		name = "report server id"
+	case fcReadFileRecord:
+		name = "read file record"
+	case fcWriteFileRecord:
+		name = "write file record"
+	case fcMaskWriteRegister:
+		name = "mask write register"
+	case fcReadWriteMultipleRegisters:
+		name = "read/write multiple registers"
+	case fcReadFifoQueue:
+		name = "read fifo queue"
+	case fcEncapsulatedInterface:
+		name = "encapsulated interface"
+	default:
+		name = fmt.Sprintf("function 0x%02x", functionCode)
+	}
+
+	return
+}
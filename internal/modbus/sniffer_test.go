@@ -0,0 +1,225 @@
+package modbus
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewSniffer(t *testing.T) {
+	var s *Sniffer
+	var err error
+
+	s, err = NewSniffer(&SnifferConfiguration{
+		URL: "rtu:///dev/ttyUSB0?baud=9600&parity=E",
+	})
+	if err != nil {
+		t.Errorf("NewSniffer() should have succeeded, got: %v", err)
+	}
+	if s.conf.URL != "/dev/ttyUSB0" {
+		t.Errorf("expected /dev/ttyUSB0 as device, got: %v", s.conf.URL)
+	}
+	if s.conf.Speed != 9600 || s.conf.Parity != PARITY_EVEN || s.conf.StopBits != 1 {
+		t.Errorf("unexpected serial settings: %+v", s.conf)
+	}
+	if s.conf.FrameGap != 20*time.Millisecond {
+		t.Errorf("expected a 20ms frame gap, got: %v", s.conf.FrameGap)
+	}
+	if s.conf.ResponseTimeout != 1*time.Second {
+		t.Errorf("expected a 1s response timeout, got: %v", s.conf.ResponseTimeout)
+	}
+
+	_, err = NewSniffer(&SnifferConfiguration{
+		URL: "tcp://localhost:502",
+	})
+	if !errors.Is(err, ErrConfigurationError) {
+		t.Errorf("NewSniffer() should have failed with ErrConfigurationError, got: %v", err)
+	}
+
+	_, err = NewSniffer(&SnifferConfiguration{
+		URL: "rtu:///dev/ttyUSB0?timeout=1s",
+	})
+	if !errors.Is(err, ErrConfigurationError) {
+		t.Errorf("NewSniffer() should have failed with ErrConfigurationError, got: %v", err)
+	}
+
+	return
+}
+
+func TestSplitRTUFrames(t *testing.T) {
+	var rt *rtuTransport
+	var req []byte
+	var res []byte
+	var frames [][]byte
+
+	rt = &rtuTransport{}
+
+	req = rt.assembleRTUFrame(&pdu{
+		unitId:       0x01,
+		functionCode: fcReadHoldingRegisters,
+		payload:      []byte{0x00, 0x10, 0x00, 0x02},
+	})
+	res = rt.assembleRTUFrame(&pdu{
+		unitId:       0x01,
+		functionCode: fcReadHoldingRegisters,
+		payload:      []byte{0x04, 0x11, 0x22, 0x33, 0x44},
+	})
+
+	// garbage, followed by a request and its response
+	frames = splitRTUFrames(append(append([]byte{0xaa, 0xbb}, req...), res...))
+	if len(frames) != 3 {
+		t.Fatalf("expected 3 frames, got: %v", len(frames))
+	}
+	if len(frames[0]) != 2 {
+		t.Errorf("expected 2 bytes of garbage, got: %v", len(frames[0]))
+	}
+	if len(frames[1]) != len(req) {
+		t.Errorf("expected %v bytes of request, got: %v", len(req), len(frames[1]))
+	}
+	if len(frames[2]) != len(res) {
+		t.Errorf("expected %v bytes of response, got: %v", len(res), len(frames[2]))
+	}
+
+	// a truncated response
+	frames = splitRTUFrames(res[0:5])
+	if len(frames) != 1 || len(frames[0]) != 5 {
+		t.Errorf("expected a single, 5-byte frame, got: %v", frames)
+	}
+
+	return
+}
+
+func TestSniffer(t *testing.T) {
+	var s *Sniffer
+	var rt *rtuTransport
+	var p1, p2 net.Conn
+	var txchan chan []byte
+	var found chan *SniffedTransaction
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var st *SniffedTransaction
+	var err error
+
+	s, err = NewSniffer(&SnifferConfiguration{
+		URL:             "rtu:///dev/null",
+		ResponseTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewSniffer() should have succeeded, got: %v", err)
+	}
+
+	txchan = make(chan []byte, 4)
+	found = make(chan *SniffedTransaction, 8)
+	p1, p2 = net.Pipe()
+	go feedTestPipe(t, txchan, p1)
+	s.link = p2
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx, func(st *SniffedTransaction) {
+		found <- st
+	})
+
+	rt = &rtuTransport{}
+
+	// a read holding registers request, answered in the same burst
+	txchan <- append(
+		rt.assembleRTUFrame(&pdu{
+			unitId:       0x05,
+			functionCode: fcReadHoldingRegisters,
+			payload:      []byte{0x00, 0x10, 0x00, 0x02},
+		}),
+		rt.assembleRTUFrame(&pdu{
+			unitId:       0x05,
+			functionCode: fcReadHoldingRegisters,
+			payload:      []byte{0x04, 0x11, 0x22, 0x33, 0x44},
+		})...)
+
+	st = <-found
+	if st.Error != nil {
+		t.Errorf("expected no error, got: %v", st.Error)
+	}
+	if st.UnitId != 0x05 || st.FunctionCode != fcReadHoldingRegisters ||
+		st.Function != "read holding registers" {
+		t.Errorf("unexpected unit id/function: %v/%v", st.UnitId, st.Function)
+	}
+	if st.Addr != 0x10 || st.Quantity != 2 {
+		t.Errorf("expected 2 registers at 0x0010, got: %v at 0x%04x", st.Quantity, st.Addr)
+	}
+	if len(st.Registers) != 2 || st.Registers[0] != 0x1122 || st.Registers[1] != 0x3344 {
+		t.Errorf("expected {0x1122, 0x3344}, got: %v", st.Registers)
+	}
+	if len(st.Request) != 8 || len(st.Response) != 9 {
+		t.Errorf("expected 8 and 9 bytes of request/response, got: %v and %v",
+			len(st.Request), len(st.Response))
+	}
+
+	// a write single coil request, answered by an exception
+	txchan <- rt.assembleRTUFrame(&pdu{
+		unitId:       0x07,
+		functionCode: fcWriteSingleCoil,
+		payload:      []byte{0x00, 0x03, 0xff, 0x00},
+	})
+	txchan <- rt.assembleRTUFrame(&pdu{
+		unitId:       0x07,
+		functionCode: fcWriteSingleCoil | 0x80,
+		payload:      []byte{exIllegalDataAddress},
+	})
+
+	st = <-found
+	if st.Error != nil {
+		t.Errorf("expected no error, got: %v", st.Error)
+	}
+	if st.Exception != ErrIllegalDataAddress {
+		t.Errorf("expected ErrIllegalDataAddress, got: %v", st.Exception)
+	}
+	if st.Addr != 0x03 || len(st.Coils) != 1 || !st.Coils[0] {
+		t.Errorf("expected coil 0x0003 to be set, got: %v at 0x%04x", st.Coils, st.Addr)
+	}
+
+	// a write multiple registers request, never answered
+	txchan <- rt.assembleRTUFrame(&pdu{
+		unitId:       0x09,
+		functionCode: fcWriteMultipleRegisters,
+		payload:      []byte{0x00, 0x20, 0x00, 0x01, 0x02, 0xca, 0xfe},
+	})
+
+	st = <-found
+	if st.Error != ErrRequestTimedOut {
+		t.Errorf("expected ErrRequestTimedOut, got: %v", st.Error)
+	}
+	if len(st.Registers) != 1 || st.Registers[0] != 0xcafe {
+		t.Errorf("expected {0xcafe}, got: %v", st.Registers)
+	}
+	if st.Response != nil {
+		t.Errorf("expected no response, got: %v", st.Response)
+	}
+
+	// a frame with a bad crc
+	txchan <- []byte{0x05, 0x03, 0x00, 0x10, 0x00, 0x02, 0x00, 0x00}
+
+	st = <-found
+	if st.Error != ErrBadCRC {
+		t.Errorf("expected ErrBadCRC, got: %v", st.Error)
+	}
+
+	// a response to a request which was not seen
+	txchan <- rt.assembleRTUFrame(&pdu{
+		unitId:       0x05,
+		functionCode: fcReadInputRegisters,
+		payload:      []byte{0x02, 0x00, 0x01},
+	})
+
+	st = <-found
+	if st.Error != ErrProtocolError {
+		t.Errorf("expected ErrProtocolError, got: %v", st.Error)
+	}
+
+	cancel()
+	p1.Close()
+	p2.Close()
+
+	return
+}
@@ -1,10 +1,12 @@
 package modbus
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -18,6 +20,15 @@ type tcpTransport struct {
 	socket    net.Conn
 	timeout   time.Duration
 	lastTxnId uint16
+
+	// pipelining state (client side only, see startPipelining())
+	window  chan struct{}
+	lock    sync.Mutex
+	pending map[uint16]chan *pdu
+	readErr error
+
+	// records the frames sent and received, if set
+	capture *frameCapture
 }
 
 // Returns a new TCP transport.
@@ -31,6 +42,20 @@ func newTCPTransport(socket net.Conn, timeout time.Duration, customLogger *log.L
 	return
 }
 
+// Switches the transport to pipelined mode, where up to window transactions
+// may be in flight at once and ExecuteRequest() is safe for concurrent use.
+// Responses are read by a dedicated goroutine and dispatched to the matching
+// request by transaction id, which lets the transport cope with devices
+// answering out of order.
+func (tt *tcpTransport) startPipelining(window uint) {
+	tt.window = make(chan struct{}, window)
+	tt.pending = make(map[uint16]chan *pdu)
+
+	go tt.readResponses()
+
+	return
+}
+
 // Closes the underlying tcp socket.
 func (tt *tcpTransport) Close() (err error) {
 	err = tt.socket.Close()
@@ -39,17 +64,29 @@ func (tt *tcpTransport) Close() (err error) {
 }
 
 // Runs a request across the socket and returns a response.
-func (tt *tcpTransport) ExecuteRequest(req *pdu) (res *pdu, err error) {
+// Cancelling ctx interrupts any i/o in flight.
+func (tt *tcpTransport) ExecuteRequest(ctx context.Context, req *pdu) (res *pdu, err error) {
+	var stop func()
+
+	if tt.window != nil {
+		res, err = tt.executePipelinedRequest(ctx, req)
+		return
+	}
+
 	// set an i/o deadline on the socket (read and write)
-	err = tt.socket.SetDeadline(time.Now().Add(tt.timeout))
+	err = tt.socket.SetDeadline(requestDeadline(ctx, tt.timeout))
 	if err != nil {
 		return
 	}
 
+	// interrupt i/o as soon as the context is done
+	stop = watchContext(ctx, tt.socket)
+	defer stop()
+
 	// increase the transaction ID counter
 	tt.lastTxnId++
 
-	_, err = tt.socket.Write(tt.assembleMBAPFrame(tt.lastTxnId, req))
+	err = tt.writeFrame(tt.assembleMBAPFrame(tt.lastTxnId, req))
 	if err != nil {
 		return
 	}
@@ -59,6 +96,138 @@ func (tt *tcpTransport) ExecuteRequest(req *pdu) (res *pdu, err error) {
 	return
 }
 
+// Runs a request in pipelined mode: sends it as soon as a slot is available
+// in the transaction window, then waits for the reader goroutine to hand
+// over the matching response.
+// Since the socket is shared by all transactions in flight, timeouts and
+// cancellations are enforced with timers rather than socket deadlines: a
+// request giving up simply forgets its transaction id, and a late response
+// is discarded by the reader.
+func (tt *tcpTransport) executePipelinedRequest(ctx context.Context, req *pdu) (res *pdu, err error) {
+	var txnId uint16
+	var resChan chan *pdu
+	var deadline time.Time
+	var timer *time.Timer
+	var ok bool
+
+	deadline = requestDeadline(ctx, tt.timeout)
+	timer = time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	// wait for a slot in the transaction window
+	select {
+	case tt.window <- struct{}{}:
+	case <-timer.C:
+		err = ErrRequestTimedOut
+		return
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	}
+	defer func() { <-tt.window }()
+
+	tt.lock.Lock()
+	// the connection is unusable once the reader has failed
+	if tt.readErr != nil {
+		err = tt.readErr
+		tt.lock.Unlock()
+		return
+	}
+
+	// pick the next transaction id which is not in flight
+	for {
+		tt.lastTxnId++
+		if _, ok = tt.pending[tt.lastTxnId]; !ok {
+			break
+		}
+	}
+	txnId = tt.lastTxnId
+	resChan = make(chan *pdu, 1)
+	tt.pending[txnId] = resChan
+
+	// writes are serialized by the lock so that frames never interleave
+	err = tt.socket.SetWriteDeadline(deadline)
+	if err == nil {
+		err = tt.writeFrame(tt.assembleMBAPFrame(txnId, req))
+	}
+	if err != nil {
+		delete(tt.pending, txnId)
+	}
+	tt.lock.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	select {
+	case res, ok = <-resChan:
+		// a closed channel means that the reader failed
+		if !ok {
+			tt.lock.Lock()
+			err = tt.readErr
+			tt.lock.Unlock()
+		}
+		return
+	case <-timer.C:
+		err = ErrRequestTimedOut
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// give up on the transaction
+	tt.lock.Lock()
+	delete(tt.pending, txnId)
+	tt.lock.Unlock()
+
+	return
+}
+
+// Reads responses off the socket and dispatches them to pending requests
+// until the socket fails or is closed, at which point all pending requests
+// are failed.
+func (tt *tcpTransport) readResponses() {
+	var res *pdu
+	var txnId uint16
+	var resChan chan *pdu
+	var ok bool
+	var err error
+
+	for {
+		res, txnId, err = tt.readMBAPFrame()
+
+		// ignore unknown protocol identifiers
+		if err == ErrUnknownProtocolId {
+			continue
+		}
+
+		tt.lock.Lock()
+		if err != nil {
+			tt.readErr = err
+			for id, c := range tt.pending {
+				close(c)
+				delete(tt.pending, id)
+			}
+			tt.lock.Unlock()
+			break
+		}
+
+		resChan, ok = tt.pending[txnId]
+		if ok {
+			delete(tt.pending, txnId)
+			resChan <- res
+		}
+		tt.lock.Unlock()
+
+		// ignore unknown transaction identifiers, e.g. late responses
+		// to requests which timed out
+		if !ok {
+			tt.logger.Warningf("received unexpected transaction id 0x%04x", txnId)
+		}
+	}
+
+	return
+}
+
 // Reads a request from the socket.
 func (tt *tcpTransport) ReadRequest() (req *pdu, err error) {
 	var txnId uint16
@@ -82,7 +251,7 @@ func (tt *tcpTransport) ReadRequest() (req *pdu, err error) {
 
 // Writes a response to the socket.
 func (tt *tcpTransport) WriteResponse(res *pdu) (err error) {
-	_, err = tt.socket.Write(tt.assembleMBAPFrame(tt.lastTxnId, res))
+	err = tt.writeFrame(tt.assembleMBAPFrame(tt.lastTxnId, res))
 	if err != nil {
 		return
 	}
@@ -90,6 +259,18 @@ func (tt *tcpTransport) WriteResponse(res *pdu) (err error) {
 	return
 }
 
+// Writes a frame to the socket and captures it.
+func (tt *tcpTransport) writeFrame(frame []byte) (err error) {
+	_, err = tt.socket.Write(frame)
+	if err != nil {
+		return
+	}
+
+	tt.capture.record(frameSent, frame)
+
+	return
+}
+
 // Reads as many MBAP+modbus frames as necessary until either the response
 // matching tt.lastTxnId is received or an error occurs.
 func (tt *tcpTransport) readResponse() (res *pdu, err error) {
@@ -126,6 +307,7 @@ func (tt *tcpTransport) readResponse() (res *pdu, err error) {
 // Reads an entire frame (MBAP header + modbus PDU) from the socket.
 func (tt *tcpTransport) readMBAPFrame() (p *pdu, txnId uint16, err error) {
 	var rxbuf []byte
+	var header []byte
 	var bytesNeeded int
 	var protocolId uint16
 	var unitId uint8
@@ -163,12 +345,17 @@ func (tt *tcpTransport) readMBAPFrame() (p *pdu, txnId uint16, err error) {
 	}
 
 	// read the PDU
+	header = rxbuf
 	rxbuf = make([]byte, bytesNeeded)
 	_, err = io.ReadFull(tt.socket, rxbuf)
 	if err != nil {
 		return
 	}
 
+	if tt.capture != nil {
+		tt.capture.record(frameReceived, append(header, rxbuf...))
+	}
+
 	// validate the protocol identifier
 	if protocolId != 0x0000 {
 		err = ErrUnknownProtocolId
@@ -1,8 +1,11 @@
 package modbus
 
 import (
+	"context"
 	"io"
 	"net"
+	"os"
+	"sync"
 	"testing"
 	"time"
 )
@@ -368,3 +371,136 @@ func TestTCPTransportWriteResponse(t *testing.T) {
 
 	return
 }
+
+func TestTCPTransportPipelining(t *testing.T) {
+	var tt *tcpTransport
+	var dev *tcpTransport
+	var p1, p2 net.Conn
+	var wg sync.WaitGroup
+	var res *pdu
+	var err error
+
+	p1, p2 = net.Pipe()
+	defer p1.Close()
+
+	tt = newTCPTransport(p1, 1*time.Second, nil)
+	tt.startPipelining(2)
+
+	// a device answering requests in reverse order, two at a time
+	dev = newTCPTransport(p2, 1*time.Second, nil)
+	go func() {
+		var reqs []*pdu
+		var txnIds []uint16
+		var req *pdu
+		var txnId uint16
+		var err error
+
+		for round := 0; round < 2; round++ {
+			reqs = nil
+			txnIds = nil
+
+			for i := 0; i < 2; i++ {
+				req, txnId, err = dev.readMBAPFrame()
+				if err != nil {
+					t.Errorf("failed to read request: %v", err)
+					return
+				}
+				reqs = append(reqs, req)
+				txnIds = append(txnIds, txnId)
+			}
+
+			// the window is full: no other request should come through
+			p2.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			_, _, err = dev.readMBAPFrame()
+			if !os.IsTimeout(err) {
+				t.Errorf("expected a timeout error, got: %v", err)
+			}
+			p2.SetReadDeadline(time.Time{})
+
+			for i := 1; i >= 0; i-- {
+				// echo the request payload back
+				_, err = p2.Write(dev.assembleMBAPFrame(txnIds[i], reqs[i]))
+				if err != nil {
+					t.Errorf("failed to write response: %v", err)
+					return
+				}
+			}
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i byte) {
+			var res *pdu
+			var err error
+
+			defer wg.Done()
+
+			res, err = tt.ExecuteRequest(context.Background(), &pdu{
+				unitId:       0x01,
+				functionCode: 0x04,
+				payload:      []byte{0x00, i},
+			})
+			if err != nil {
+				t.Errorf("ExecuteRequest() should have succeeded, got: %v", err)
+				return
+			}
+			if len(res.payload) != 2 || res.payload[1] != i {
+				t.Errorf("expected response to request #%v, got: %v", i, res.payload)
+			}
+		}(byte(i))
+	}
+	wg.Wait()
+
+	// a request left unanswered should time out without affecting the
+	// next one, the late response being discarded
+	tt.timeout = 50 * time.Millisecond
+	go func() {
+		var req *pdu
+		var txnId uint16
+		var err error
+
+		for i := 0; i < 2; i++ {
+			req, txnId, err = dev.readMBAPFrame()
+			if err != nil {
+				t.Errorf("failed to read request: %v", err)
+				return
+			}
+			if i == 0 {
+				time.Sleep(100 * time.Millisecond)
+			}
+			p2.Write(dev.assembleMBAPFrame(txnId, req))
+		}
+
+		// hang up
+		p2.Close()
+	}()
+
+	_, err = tt.ExecuteRequest(context.Background(), &pdu{
+		unitId: 0x01, functionCode: 0x04, payload: []byte{0x00, 0x01},
+	})
+	if err != ErrRequestTimedOut {
+		t.Errorf("ExecuteRequest() should have returned ErrRequestTimedOut, got: %v", err)
+	}
+
+	tt.timeout = 1 * time.Second
+	res, err = tt.ExecuteRequest(context.Background(), &pdu{
+		unitId: 0x01, functionCode: 0x04, payload: []byte{0x00, 0x02},
+	})
+	if err != nil {
+		t.Errorf("ExecuteRequest() should have succeeded, got: %v", err)
+	} else if res.payload[1] != 0x02 {
+		t.Errorf("expected response to request #2, got: %v", res.payload)
+	}
+
+	// once the connection is gone, requests should fail right away
+	time.Sleep(50 * time.Millisecond)
+	_, err = tt.ExecuteRequest(context.Background(), &pdu{
+		unitId: 0x01, functionCode: 0x04, payload: []byte{0x00, 0x03},
+	})
+	if err != io.EOF {
+		t.Errorf("ExecuteRequest() should have returned io.EOF, got: %v", err)
+	}
+
+	return
+}
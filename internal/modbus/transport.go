@@ -1,19 +1,83 @@
 package modbus
 
+import (
+	"context"
+	"time"
+)
+
 type transportType uint
 
 const (
-	modbusRTU        transportType = 1
-	modbusRTUOverTCP transportType = 2
-	modbusRTUOverUDP transportType = 3
-	modbusTCP        transportType = 4
-	modbusTCPOverTLS transportType = 5
-	modbusTCPOverUDP transportType = 6
+	modbusRTU          transportType = 1
+	modbusRTUOverTCP   transportType = 2
+	modbusRTUOverUDP   transportType = 3
+	modbusTCP          transportType = 4
+	modbusTCPOverTLS   transportType = 5
+	modbusTCPOverUDP   transportType = 6
+	modbusASCII        transportType = 7
+	modbusASCIIOverTCP transportType = 8
+	modbusReplay       transportType = 9
 )
 
 type transport interface {
 	Close() error
-	ExecuteRequest(*pdu) (*pdu, error)
+	ExecuteRequest(context.Context, *pdu) (*pdu, error)
 	ReadRequest() (*pdu, error)
 	WriteResponse(*pdu) error
 }
+
+// deadliner is satisfied by both net.Conn and rtuLink objects.
+type deadliner interface {
+	SetDeadline(time.Time) error
+}
+
+// Returns the i/o deadline of a request, i.e. timeout from now or the
+// context deadline, whichever comes first.
+func requestDeadline(ctx context.Context, timeout time.Duration) (deadline time.Time) {
+	var ctxDeadline time.Time
+	var ok bool
+
+	deadline = time.Now().Add(timeout)
+
+	ctxDeadline, ok = ctx.Deadline()
+	if ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	return
+}
+
+// Interrupts any i/o in flight on link as soon as ctx is done, by moving the
+// link deadline to the past.
+// The returned stop function must be called once the request is complete:
+// it waits for the watcher to exit, so that it cannot tamper with the
+// deadline of subsequent requests.
+func watchContext(ctx context.Context, link deadliner) (stop func()) {
+	var done chan struct{}
+	var exited chan struct{}
+
+	// contexts which can never be cancelled need no watcher
+	if ctx.Done() == nil {
+		stop = func() {}
+		return
+	}
+
+	done = make(chan struct{})
+	exited = make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			link.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+		close(exited)
+	}()
+
+	stop = func() {
+		close(done)
+		<-exited
+	}
+
+	return
+}
@@ -1,6 +1,7 @@
 package modbus
 
 import (
+	"bytes"
 	"net"
 	"time"
 )
@@ -100,3 +101,65 @@ func (usw *udpSockWrapper) RemoteAddr() (addr net.Addr) {
 
 	return
 }
+
+// udpDatagramConn presents a single datagram received on a server socket
+// as a connection, allowing transports to serve it as they would a stream:
+// reads consume the datagram then return io.EOF, while writes are sent back
+// to the source of the datagram.
+type udpDatagramConn struct {
+	sock  net.PacketConn
+	addr  net.Addr
+	rxbuf *bytes.Reader
+}
+
+func newUDPDatagramConn(sock net.PacketConn, addr net.Addr, datagram []byte) (udc *udpDatagramConn) {
+	udc = &udpDatagramConn{
+		sock:  sock,
+		addr:  addr,
+		rxbuf: bytes.NewReader(datagram),
+	}
+
+	return
+}
+
+func (udc *udpDatagramConn) Read(buf []byte) (rlen int, err error) {
+	rlen, err = udc.rxbuf.Read(buf)
+
+	return
+}
+
+func (udc *udpDatagramConn) Write(buf []byte) (wlen int, err error) {
+	wlen, err = udc.sock.WriteTo(buf, udc.addr)
+
+	return
+}
+
+// Closing a datagram connection is a no-op, as the server socket is shared.
+func (udc *udpDatagramConn) Close() (err error) {
+	return
+}
+
+// Deadlines are irrelevant since reads never block.
+func (udc *udpDatagramConn) SetDeadline(deadline time.Time) (err error) {
+	return
+}
+
+func (udc *udpDatagramConn) SetReadDeadline(deadline time.Time) (err error) {
+	return
+}
+
+func (udc *udpDatagramConn) SetWriteDeadline(deadline time.Time) (err error) {
+	return
+}
+
+func (udc *udpDatagramConn) LocalAddr() (addr net.Addr) {
+	addr = udc.sock.LocalAddr()
+
+	return
+}
+
+func (udc *udpDatagramConn) RemoteAddr() (addr net.Addr) {
+	addr = udc.addr
+
+	return
+}
@@ -0,0 +1,2076 @@
+package modbus
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// Modbus unit handle object, bound to a single unit id of a ModbusClient
+// (see ModbusClient.Unit()).
+// Every request takes a context: cancelling it (or letting its deadline
+// expire) interrupts any i/o in flight, in which case the context error is
+// returned. The client's Timeout setting still applies on top of the
+// context deadline.
+// Requests are serialized at the client level: handles bound to different
+// unit ids may be used concurrently.
+type ModbusUnit struct {
+	client *ModbusClient
+	unitId uint8
+}
+
+// Returns the unit id the handle is bound to.
+func (mu *ModbusUnit) UnitId() (id uint8) {
+	id = mu.unitId
+
+	return
+}
+
+// Reads multiple coils (function code 01).
+func (mu *ModbusUnit) ReadCoils(ctx context.Context, addr uint16, quantity uint16) (values []bool, err error) {
+	values, err = mu.readBools(ctx, addr, quantity, false)
+
+	return
+}
+
+// Reads a single coil (function code 01).
+func (mu *ModbusUnit) ReadCoil(ctx context.Context, addr uint16) (value bool, err error) {
+	var values []bool
+
+	values, err = mu.readBools(ctx, addr, 1, false)
+	if err == nil {
+		value = values[0]
+	}
+
+	return
+}
+
+// Reads multiple discrete inputs (function code 02).
+func (mu *ModbusUnit) ReadDiscreteInputs(ctx context.Context, addr uint16, quantity uint16) (values []bool, err error) {
+	values, err = mu.readBools(ctx, addr, quantity, true)
+
+	return
+}
+
+// Reads a single discrete input (function code 02).
+func (mu *ModbusUnit) ReadDiscreteInput(ctx context.Context, addr uint16) (value bool, err error) {
+	var values []bool
+
+	values, err = mu.readBools(ctx, addr, 1, true)
+	if err == nil {
+		value = values[0]
+	}
+
+	return
+}
+
+// Reads multiple 16-bit registers (function code 03 or 04).
+func (mu *ModbusUnit) ReadRegisters(ctx context.Context, addr uint16, quantity uint16, regType RegType) (values []uint16, err error) {
+	var mbPayload []byte
+
+	// read quantity uint16 registers, as bytes
+	mbPayload, err = mu.readRegisters(ctx, addr, quantity, regType)
+	if err != nil {
+		return
+	}
+
+	// decode payload bytes as uint16s
+	values = bytesToUint16s(mu.client.endianness, mbPayload)
+
+	return
+}
+
+// Reads a single 16-bit register (function code 03 or 04).
+func (mu *ModbusUnit) ReadRegister(ctx context.Context, addr uint16, regType RegType) (value uint16, err error) {
+	var values []uint16
+
+	// read 1 uint16 register, as bytes
+	values, err = mu.ReadRegisters(ctx, addr, 1, regType)
+	if err == nil {
+		value = values[0]
+	}
+	return
+}
+
+// Reads multiple 32-bit registers.
+func (mu *ModbusUnit) ReadUint32s(ctx context.Context, addr uint16, quantity uint16, regType RegType) (values []uint32, err error) {
+	var mbPayload []byte
+
+	// read 2 * quantity uint16 registers, as bytes
+	mbPayload, err = mu.readRegisters(ctx, addr, quantity*2, regType)
+	if err != nil {
+		return
+	}
+
+	// decode payload bytes as uint32s
+	values = bytesToUint32s(mu.client.endianness, mu.client.wordOrder, mbPayload)
+
+	return
+}
+
+// Reads a single 32-bit register.
+func (mu *ModbusUnit) ReadUint32(ctx context.Context, addr uint16, regType RegType) (value uint32, err error) {
+	var values []uint32
+
+	values, err = mu.ReadUint32s(ctx, addr, 1, regType)
+	if err == nil {
+		value = values[0]
+	}
+
+	return
+}
+
+// Reads multiple 32-bit float registers.
+func (mu *ModbusUnit) ReadFloat32s(ctx context.Context, addr uint16, quantity uint16, regType RegType) (values []float32, err error) {
+	var mbPayload []byte
+
+	// read 2 * quantity uint16 registers, as bytes
+	mbPayload, err = mu.readRegisters(ctx, addr, quantity*2, regType)
+	if err != nil {
+		return
+	}
+
+	// decode payload bytes as float32s
+	values = bytesToFloat32s(mu.client.endianness, mu.client.wordOrder, mbPayload)
+
+	return
+}
+
+// Reads a single 32-bit float register.
+func (mu *ModbusUnit) ReadFloat32(ctx context.Context, addr uint16, regType RegType) (value float32, err error) {
+	var values []float32
+
+	values, err = mu.ReadFloat32s(ctx, addr, 1, regType)
+	if err == nil {
+		value = values[0]
+	}
+
+	return
+}
+
+// Reads multiple 64-bit registers.
+func (mu *ModbusUnit) ReadUint64s(ctx context.Context, addr uint16, quantity uint16, regType RegType) (values []uint64, err error) {
+	var mbPayload []byte
+
+	// read 4 * quantity uint16 registers, as bytes
+	mbPayload, err = mu.readRegisters(ctx, addr, quantity*4, regType)
+	if err != nil {
+		return
+	}
+
+	// decode payload bytes as uint64s
+	values = bytesToUint64s(mu.client.endianness, mu.client.wordOrder, mbPayload)
+
+	return
+}
+
+// Reads a single 64-bit register.
+func (mu *ModbusUnit) ReadUint64(ctx context.Context, addr uint16, regType RegType) (value uint64, err error) {
+	var values []uint64
+
+	values, err = mu.ReadUint64s(ctx, addr, 1, regType)
+	if err == nil {
+		value = values[0]
+	}
+
+	return
+}
+
+// Reads multiple 64-bit float registers.
+func (mu *ModbusUnit) ReadFloat64s(ctx context.Context, addr uint16, quantity uint16, regType RegType) (values []float64, err error) {
+	var mbPayload []byte
+
+	// read 4 * quantity uint16 registers, as bytes
+	mbPayload, err = mu.readRegisters(ctx, addr, quantity*4, regType)
+	if err != nil {
+		return
+	}
+
+	// decode payload bytes as float64s
+	values = bytesToFloat64s(mu.client.endianness, mu.client.wordOrder, mbPayload)
+
+	return
+}
+
+// Reads a single 64-bit float register.
+func (mu *ModbusUnit) ReadFloat64(ctx context.Context, addr uint16, regType RegType) (value float64, err error) {
+	var values []float64
+
+	values, err = mu.ReadFloat64s(ctx, addr, 1, regType)
+	if err == nil {
+		value = values[0]
+	}
+
+	return
+}
+
+// Reads multiple 16-bit signed registers (function code 03 or 04).
+func (mu *ModbusUnit) ReadInt16s(ctx context.Context, addr uint16, quantity uint16, regType RegType) (values []int16, err error) {
+	var mbPayload []byte
+
+	// read quantity uint16 registers, as bytes
+	mbPayload, err = mu.readRegisters(ctx, addr, quantity, regType)
+	if err != nil {
+		return
+	}
+
+	// decode payload bytes as int16s
+	values = bytesToInt16s(mu.client.endianness, mbPayload)
+
+	return
+}
+
+// Reads a single 16-bit signed register (function code 03 or 04).
+func (mu *ModbusUnit) ReadInt16(ctx context.Context, addr uint16, regType RegType) (value int16, err error) {
+	var values []int16
+
+	values, err = mu.ReadInt16s(ctx, addr, 1, regType)
+	if err == nil {
+		value = values[0]
+	}
+
+	return
+}
+
+// Reads multiple 32-bit signed registers.
+func (mu *ModbusUnit) ReadInt32s(ctx context.Context, addr uint16, quantity uint16, regType RegType) (values []int32, err error) {
+	var mbPayload []byte
+
+	// read 2 * quantity uint16 registers, as bytes
+	mbPayload, err = mu.readRegisters(ctx, addr, quantity*2, regType)
+	if err != nil {
+		return
+	}
+
+	// decode payload bytes as int32s
+	values = bytesToInt32s(mu.client.endianness, mu.client.wordOrder, mbPayload)
+
+	return
+}
+
+// Reads a single 32-bit signed register.
+func (mu *ModbusUnit) ReadInt32(ctx context.Context, addr uint16, regType RegType) (value int32, err error) {
+	var values []int32
+
+	values, err = mu.ReadInt32s(ctx, addr, 1, regType)
+	if err == nil {
+		value = values[0]
+	}
+
+	return
+}
+
+// Reads multiple 64-bit signed registers.
+func (mu *ModbusUnit) ReadInt64s(ctx context.Context, addr uint16, quantity uint16, regType RegType) (values []int64, err error) {
+	var mbPayload []byte
+
+	// read 4 * quantity uint16 registers, as bytes
+	mbPayload, err = mu.readRegisters(ctx, addr, quantity*4, regType)
+	if err != nil {
+		return
+	}
+
+	// decode payload bytes as int64s
+	values = bytesToInt64s(mu.client.endianness, mu.client.wordOrder, mbPayload)
+
+	return
+}
+
+// Reads a single 64-bit signed register.
+func (mu *ModbusUnit) ReadInt64(ctx context.Context, addr uint16, regType RegType) (value int64, err error) {
+	var values []int64
+
+	values, err = mu.ReadInt64s(ctx, addr, 1, regType)
+	if err == nil {
+		value = values[0]
+	}
+
+	return
+}
+
+// Reads quantity 16-bit registers as an ASCII string (e.g. serial numbers or
+// firmware versions), two characters per register.
+// Characters are swapped on register boundaries if endianness is set to
+// LITTLE_ENDIAN. Trailing null bytes and spaces are trimmed.
+func (mu *ModbusUnit) ReadString(ctx context.Context, addr uint16, quantity uint16, regType RegType) (value string, err error) {
+	var mbPayload []byte
+
+	mbPayload, err = mu.readRegisters(ctx, addr, quantity, regType)
+	if err != nil {
+		return
+	}
+
+	value = bytesToString(mu.client.endianness, mbPayload)
+
+	return
+}
+
+// Reads quantity 16-bit registers as a packed BCD value (4 digits per register).
+// Multi-register values are expected with their most significant digits
+// first, or last if word order is set to LOW_WORD_FIRST.
+// Returns ErrBadBCD if the registers hold non-decimal digits.
+func (mu *ModbusUnit) ReadBCD(ctx context.Context, addr uint16, quantity uint16, regType RegType) (value uint64, err error) {
+	var mbPayload []byte
+
+	// 16 digits is all an uint64 can hold without overflowing
+	if quantity == 0 || quantity > 4 {
+		mu.client.logger.Errorf("quantity of BCD registers must be between 1 and 4")
+		err = ErrUnexpectedParameters
+		return
+	}
+
+	mbPayload, err = mu.readRegisters(ctx, addr, quantity, regType)
+	if err != nil {
+		return
+	}
+
+	value, err = bytesToBCD(mu.client.endianness, mu.client.wordOrder, mbPayload)
+
+	return
+}
+
+// Reads the registers spanned by the tagged fields of the struct pointed to
+// by v, starting at addr, and decodes them into it (see Unmarshal()).
+// Blocks of more than 125 registers are read with multiple requests.
+func (mu *ModbusUnit) ReadStruct(ctx context.Context, addr uint16, regType RegType, v interface{}) (err error) {
+	var rv reflect.Value
+	var codecs []*fieldCodec
+	var length int
+	var quantity uint16
+	var payload []byte
+	var chunk []byte
+
+	rv = reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		err = fmt.Errorf("expected a non-nil pointer to a struct, got %T", v)
+		return
+	}
+
+	codecs, err = structCodecs(rv.Elem().Type())
+	if err != nil {
+		return
+	}
+
+	for _, codec := range codecs {
+		if int(codec.offset)+int(codec.length) > length {
+			length = int(codec.offset) + int(codec.length)
+		}
+	}
+
+	if int(addr)+length > 0x10000 {
+		mu.client.logger.Errorf("end register address is past 0xffff")
+		err = ErrUnexpectedParameters
+		return
+	}
+
+	for len(payload) < 2*length {
+		quantity = uint16(length - len(payload)/2)
+		if quantity > maxReadRegisterCount {
+			quantity = maxReadRegisterCount
+		}
+
+		chunk, err = mu.readRegisters(ctx, addr+uint16(len(payload)/2), quantity, regType)
+		if err != nil {
+			return
+		}
+		payload = append(payload, chunk...)
+	}
+
+	err = Unmarshal(bytesToUint16s(BIG_ENDIAN, payload),
+		mu.client.endianness, mu.client.wordOrder, v)
+
+	return
+}
+
+// Reads one or multiple 16-bit registers (function code 03 or 04) as bytes.
+// A per-register byteswap is performed if endianness is set to LITTLE_ENDIAN.
+func (mu *ModbusUnit) ReadBytes(ctx context.Context, addr uint16, quantity uint16, regType RegType) (values []byte, err error) {
+	values, err = mu.readBytes(ctx, addr, quantity, regType, true)
+
+	return
+}
+
+// Reads one or multiple 16-bit registers (function code 03 or 04) as bytes.
+// No byte or word reordering is performed: bytes are returned exactly as they come
+// off the wire, allowing the caller to handle encoding/endianness/word order manually.
+func (mu *ModbusUnit) ReadRawBytes(ctx context.Context, addr uint16, quantity uint16, regType RegType) (values []byte, err error) {
+	values, err = mu.readBytes(ctx, addr, quantity, regType, false)
+
+	return
+}
+
+// Writes a single coil (function code 05)
+func (mu *ModbusUnit) WriteCoil(ctx context.Context, addr uint16, value bool) (err error) {
+	var req *pdu
+	var res *pdu
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	// create and fill in the request object
+	req = &pdu{
+		unitId:       mu.unitId,
+		functionCode: fcWriteSingleCoil,
+	}
+
+	// coil address
+	req.payload = uint16ToBytes(BIG_ENDIAN, addr)
+	// coil value
+	if value {
+		req.payload = append(req.payload, 0xff, 0x00)
+	} else {
+		req.payload = append(req.payload, 0x00, 0x00)
+	}
+
+	// run the request across the transport and wait for a response
+	res, err = mu.client.executeRequest(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect 4 bytes (2 byte of address + 2 bytes of value)
+		if len(res.payload) != 4 ||
+			// bytes 1-2 should be the coil address
+			bytesToUint16(BIG_ENDIAN, res.payload[0:2]) != addr ||
+			// bytes 3-4 should either be {0xff, 0x00} or {0x00, 0x00}
+			// depending on the coil value
+			(value == true && res.payload[2] != 0xff) ||
+			res.payload[3] != 0x00 {
+			err = ErrProtocolError
+			return
+		}
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		err = mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err = ErrProtocolError
+		mu.client.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Writes multiple coils (function code 15)
+func (mu *ModbusUnit) WriteCoils(ctx context.Context, addr uint16, values []bool) (err error) {
+	var req *pdu
+	var res *pdu
+	var quantity uint16
+	var encodedValues []byte
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	quantity = uint16(len(values))
+	if quantity == 0 {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("quantity of coils is 0")
+		return
+	}
+
+	if quantity > 0x7b0 {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("quantity of coils exceeds 1968")
+		return
+	}
+
+	if uint32(addr)+uint32(quantity)-1 > 0xffff {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("end coil address is past 0xffff")
+		return
+	}
+
+	encodedValues = encodeBools(values)
+
+	// create and fill in the request object
+	req = &pdu{
+		unitId:       mu.unitId,
+		functionCode: fcWriteMultipleCoils,
+	}
+
+	// start address
+	req.payload = uint16ToBytes(BIG_ENDIAN, addr)
+	// quantity
+	req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, quantity)...)
+	// byte count
+	req.payload = append(req.payload, byte(len(encodedValues)))
+	// payload
+	req.payload = append(req.payload, encodedValues...)
+
+	// run the request across the transport and wait for a response
+	res, err = mu.client.executeRequest(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect 4 bytes (2 byte of address + 2 bytes of quantity)
+		if len(res.payload) != 4 ||
+			// bytes 1-2 should be the base coil address
+			bytesToUint16(BIG_ENDIAN, res.payload[0:2]) != addr ||
+			// bytes 3-4 should be the quantity of coils
+			bytesToUint16(BIG_ENDIAN, res.payload[2:4]) != quantity {
+			err = ErrProtocolError
+			return
+		}
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		err = mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err = ErrProtocolError
+		mu.client.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Writes a single 16-bit register (function code 06).
+func (mu *ModbusUnit) WriteRegister(ctx context.Context, addr uint16, value uint16) (err error) {
+	var req *pdu
+	var res *pdu
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	// create and fill in the request object
+	req = &pdu{
+		unitId:       mu.unitId,
+		functionCode: fcWriteSingleRegister,
+	}
+
+	// register address
+	req.payload = uint16ToBytes(BIG_ENDIAN, addr)
+	// register value
+	req.payload = append(req.payload, uint16ToBytes(mu.client.endianness, value)...)
+
+	// run the request across the transport and wait for a response
+	res, err = mu.client.executeRequest(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect 4 bytes (2 byte of address + 2 bytes of value)
+		if len(res.payload) != 4 ||
+			// bytes 1-2 should be the register address
+			bytesToUint16(BIG_ENDIAN, res.payload[0:2]) != addr ||
+			// bytes 3-4 should be the value
+			bytesToUint16(mu.client.endianness, res.payload[2:4]) != value {
+			err = ErrProtocolError
+			return
+		}
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		err = mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err = ErrProtocolError
+		mu.client.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Writes multiple 16-bit registers (function code 16).
+func (mu *ModbusUnit) WriteRegisters(ctx context.Context, addr uint16, values []uint16) (err error) {
+	var payload []byte
+
+	// turn registers to bytes
+	for _, value := range values {
+		payload = append(payload, uint16ToBytes(mu.client.endianness, value)...)
+	}
+
+	err = mu.writeRegisters(ctx, addr, payload)
+
+	return
+}
+
+// Writes multiple 32-bit registers.
+func (mu *ModbusUnit) WriteUint32s(ctx context.Context, addr uint16, values []uint32) (err error) {
+	var payload []byte
+
+	// turn registers to bytes
+	for _, value := range values {
+		payload = append(payload, uint32ToBytes(mu.client.endianness, mu.client.wordOrder, value)...)
+	}
+
+	err = mu.writeRegisters(ctx, addr, payload)
+
+	return
+}
+
+// Writes a single 32-bit register.
+func (mu *ModbusUnit) WriteUint32(ctx context.Context, addr uint16, value uint32) (err error) {
+	err = mu.writeRegisters(ctx, addr, uint32ToBytes(mu.client.endianness, mu.client.wordOrder, value))
+
+	return
+}
+
+// Writes multiple 32-bit float registers.
+func (mu *ModbusUnit) WriteFloat32s(ctx context.Context, addr uint16, values []float32) (err error) {
+	var payload []byte
+
+	// turn registers to bytes
+	for _, value := range values {
+		payload = append(payload, float32ToBytes(mu.client.endianness, mu.client.wordOrder, value)...)
+	}
+
+	err = mu.writeRegisters(ctx, addr, payload)
+
+	return
+}
+
+// Writes a single 32-bit float register.
+func (mu *ModbusUnit) WriteFloat32(ctx context.Context, addr uint16, value float32) (err error) {
+	err = mu.writeRegisters(ctx, addr, float32ToBytes(mu.client.endianness, mu.client.wordOrder, value))
+
+	return
+}
+
+// Writes multiple 64-bit registers.
+func (mu *ModbusUnit) WriteUint64s(ctx context.Context, addr uint16, values []uint64) (err error) {
+	var payload []byte
+
+	// turn registers to bytes
+	for _, value := range values {
+		payload = append(payload, uint64ToBytes(mu.client.endianness, mu.client.wordOrder, value)...)
+	}
+
+	err = mu.writeRegisters(ctx, addr, payload)
+
+	return
+}
+
+// Writes a single 64-bit register.
+func (mu *ModbusUnit) WriteUint64(ctx context.Context, addr uint16, value uint64) (err error) {
+	err = mu.writeRegisters(ctx, addr, uint64ToBytes(mu.client.endianness, mu.client.wordOrder, value))
+
+	return
+}
+
+// Writes multiple 64-bit float registers.
+func (mu *ModbusUnit) WriteFloat64s(ctx context.Context, addr uint16, values []float64) (err error) {
+	var payload []byte
+
+	// turn registers to bytes
+	for _, value := range values {
+		payload = append(payload, float64ToBytes(mu.client.endianness, mu.client.wordOrder, value)...)
+	}
+
+	err = mu.writeRegisters(ctx, addr, payload)
+
+	return
+}
+
+// Writes a single 64-bit float register.
+func (mu *ModbusUnit) WriteFloat64(ctx context.Context, addr uint16, value float64) (err error) {
+	err = mu.writeRegisters(ctx, addr, float64ToBytes(mu.client.endianness, mu.client.wordOrder, value))
+
+	return
+}
+
+// Writes multiple 16-bit signed registers (function code 16).
+func (mu *ModbusUnit) WriteInt16s(ctx context.Context, addr uint16, values []int16) (err error) {
+	var payload []byte
+
+	// turn registers to bytes
+	for _, value := range values {
+		payload = append(payload, int16ToBytes(mu.client.endianness, value)...)
+	}
+
+	err = mu.writeRegisters(ctx, addr, payload)
+
+	return
+}
+
+// Writes a single 16-bit signed register (function code 06).
+func (mu *ModbusUnit) WriteInt16(ctx context.Context, addr uint16, value int16) (err error) {
+	err = mu.WriteRegister(ctx, addr, uint16(value))
+
+	return
+}
+
+// Writes multiple 32-bit signed registers.
+func (mu *ModbusUnit) WriteInt32s(ctx context.Context, addr uint16, values []int32) (err error) {
+	var payload []byte
+
+	// turn registers to bytes
+	for _, value := range values {
+		payload = append(payload, int32ToBytes(mu.client.endianness, mu.client.wordOrder, value)...)
+	}
+
+	err = mu.writeRegisters(ctx, addr, payload)
+
+	return
+}
+
+// Writes a single 32-bit signed register.
+func (mu *ModbusUnit) WriteInt32(ctx context.Context, addr uint16, value int32) (err error) {
+	err = mu.writeRegisters(ctx, addr, int32ToBytes(mu.client.endianness, mu.client.wordOrder, value))
+
+	return
+}
+
+// Writes multiple 64-bit signed registers.
+func (mu *ModbusUnit) WriteInt64s(ctx context.Context, addr uint16, values []int64) (err error) {
+	var payload []byte
+
+	// turn registers to bytes
+	for _, value := range values {
+		payload = append(payload, int64ToBytes(mu.client.endianness, mu.client.wordOrder, value)...)
+	}
+
+	err = mu.writeRegisters(ctx, addr, payload)
+
+	return
+}
+
+// Writes a single 64-bit signed register.
+func (mu *ModbusUnit) WriteInt64(ctx context.Context, addr uint16, value int64) (err error) {
+	err = mu.writeRegisters(ctx, addr, int64ToBytes(mu.client.endianness, mu.client.wordOrder, value))
+
+	return
+}
+
+// Writes value as an ASCII string to quantity 16-bit registers starting at
+// addr, padding it with null bytes (see ReadString()).
+// Returns ErrUnexpectedParameters if value is longer than 2 * quantity characters.
+func (mu *ModbusUnit) WriteString(ctx context.Context, addr uint16, quantity uint16, value string) (err error) {
+	var payload []byte
+
+	payload, err = stringToBytes(mu.client.endianness, value, quantity)
+	if err != nil {
+		mu.client.logger.Errorf("string too long for %v registers", quantity)
+		return
+	}
+
+	err = mu.writeRegisters(ctx, addr, payload)
+
+	return
+}
+
+// Writes value as packed BCD to quantity 16-bit registers starting at addr
+// (see ReadBCD()).
+// Returns ErrUnexpectedParameters if value has more than 4 * quantity digits.
+func (mu *ModbusUnit) WriteBCD(ctx context.Context, addr uint16, quantity uint16, value uint64) (err error) {
+	var payload []byte
+
+	if quantity == 0 || quantity > 4 {
+		mu.client.logger.Errorf("quantity of BCD registers must be between 1 and 4")
+		err = ErrUnexpectedParameters
+		return
+	}
+
+	payload, err = bcdToBytes(mu.client.endianness, mu.client.wordOrder, value, quantity)
+	if err != nil {
+		mu.client.logger.Errorf("value %v too large for %v BCD registers", value, quantity)
+		return
+	}
+
+	err = mu.writeRegisters(ctx, addr, payload)
+
+	return
+}
+
+// Writes the given slice of bytes to 16-bit registers starting at addr.
+// A per-register byteswap is performed if endianness is set to LITTLE_ENDIAN.
+// Odd byte quantities are padded with a null byte to fall on 16-bit register boundaries.
+func (mu *ModbusUnit) WriteBytes(ctx context.Context, addr uint16, values []byte) (err error) {
+	err = mu.writeBytes(ctx, addr, values, true)
+
+	return
+}
+
+// Writes the given slice of bytes to 16-bit registers starting at addr.
+// No byte or word reordering is performed: bytes are pushed to the wire as-is,
+// allowing the caller to handle encoding/endianness/word order manually.
+// Odd byte quantities are padded with a null byte to fall on 16-bit register boundaries.
+func (mu *ModbusUnit) WriteRawBytes(ctx context.Context, addr uint16, values []byte) (err error) {
+	err = mu.writeBytes(ctx, addr, values, false)
+
+	return
+}
+
+// Modifies a single 16-bit holding register using a combination of an AND mask,
+// an OR mask and the current register value (function code 22):
+// result = (current AND andMask) OR (orMask AND (NOT andMask)).
+// The modification is performed atomically by the device.
+func (mu *ModbusUnit) MaskWriteRegister(ctx context.Context, addr uint16, andMask uint16, orMask uint16) (err error) {
+	var req *pdu
+	var res *pdu
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	// create and fill in the request object
+	req = &pdu{
+		unitId:       mu.unitId,
+		functionCode: fcMaskWriteRegister,
+	}
+
+	// register address
+	req.payload = uint16ToBytes(BIG_ENDIAN, addr)
+	// AND mask
+	req.payload = append(req.payload, uint16ToBytes(mu.client.endianness, andMask)...)
+	// OR mask
+	req.payload = append(req.payload, uint16ToBytes(mu.client.endianness, orMask)...)
+
+	// run the request across the transport and wait for a response
+	res, err = mu.client.executeRequest(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect an echo of the request (2 bytes of address, 2 bytes of
+		// AND mask and 2 bytes of OR mask)
+		if len(res.payload) != 6 ||
+			bytesToUint16(BIG_ENDIAN, res.payload[0:2]) != addr ||
+			bytesToUint16(mu.client.endianness, res.payload[2:4]) != andMask ||
+			bytesToUint16(mu.client.endianness, res.payload[4:6]) != orMask {
+			err = ErrProtocolError
+			return
+		}
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		err = mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err = ErrProtocolError
+		mu.client.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Writes multiple 16-bit holding registers starting at writeAddr, then reads
+// readQuantity holding registers starting at readAddr, in a single transaction
+// (function code 23). The write is performed before the read.
+func (mu *ModbusUnit) ReadWriteRegisters(ctx context.Context, readAddr uint16, readQuantity uint16,
+	writeAddr uint16, values []uint16) (readValues []uint16, err error) {
+	var req *pdu
+	var res *pdu
+	var writeQuantity uint16
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	writeQuantity = uint16(len(values))
+
+	if readQuantity == 0 {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("quantity of registers to read is 0")
+		return
+	}
+
+	if readQuantity > 0x7d {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("quantity of registers to read exceeds 125")
+		return
+	}
+
+	if uint32(readAddr)+uint32(readQuantity)-1 > 0xffff {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("end register address to read is past 0xffff")
+		return
+	}
+
+	if writeQuantity == 0 {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("quantity of registers to write is 0")
+		return
+	}
+
+	if writeQuantity > 0x79 {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("quantity of registers to write exceeds 121")
+		return
+	}
+
+	if uint32(writeAddr)+uint32(writeQuantity)-1 > 0xffff {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("end register address to write is past 0xffff")
+		return
+	}
+
+	// create and fill in the request object
+	req = &pdu{
+		unitId:       mu.unitId,
+		functionCode: fcReadWriteMultipleRegisters,
+	}
+
+	// read start address
+	req.payload = uint16ToBytes(BIG_ENDIAN, readAddr)
+	// quantity to read
+	req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, readQuantity)...)
+	// write start address
+	req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, writeAddr)...)
+	// quantity to write
+	req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, writeQuantity)...)
+	// write byte count
+	req.payload = append(req.payload, byte(writeQuantity*2))
+	// registers value
+	req.payload = append(req.payload, uint16sToBytes(mu.client.endianness, values)...)
+
+	// run the request across the transport and wait for a response
+	res, err = mu.client.executeRequest(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// make sure the payload length is what we expect
+		// (1 byte of length + 2 bytes per register)
+		if len(res.payload) != 1+2*int(readQuantity) ||
+			uint(res.payload[0]) != 2*uint(readQuantity) {
+			err = ErrProtocolError
+			return
+		}
+
+		// decode payload bytes as uint16s
+		readValues = bytesToUint16s(mu.client.endianness, res.payload[1:])
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		err = mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err = ErrProtocolError
+		mu.client.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Reads the contents of the 8 exception status outputs of the remote device
+// (function code 7, serial line only).
+func (mu *ModbusUnit) ReadExceptionStatus(ctx context.Context) (status uint8, err error) {
+	var req *pdu
+	var res *pdu
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	// create the request object (no payload)
+	req = &pdu{
+		unitId:       mu.unitId,
+		functionCode: fcReadExceptionStatus,
+	}
+
+	// run the request across the transport and wait for a response
+	res, err = mu.client.executeRequest(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect 1 byte of output data
+		if len(res.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		status = res.payload[0]
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		err = mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err = ErrProtocolError
+		mu.client.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Runs a diagnostics sub-function (function code 8, serial line only) and
+// returns the data field of the response.
+// The data field is limited to a single 16-bit word, as the length of
+// the response could not be determined on serial lines otherwise.
+func (mu *ModbusUnit) Diagnostics(ctx context.Context, subFunction DiagnosticSubFunction, data uint16) (res uint16, err error) {
+	var req *pdu
+	var resp *pdu
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	// create and fill in the request object
+	req = &pdu{
+		unitId:       mu.unitId,
+		functionCode: fcDiagnostics,
+	}
+
+	// sub-function
+	req.payload = uint16ToBytes(BIG_ENDIAN, uint16(subFunction))
+	// data
+	req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, data)...)
+
+	// run the request across the transport and wait for a response
+	resp, err = mu.client.executeRequest(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case resp.functionCode == req.functionCode:
+		// expect an echo of the sub-function followed by 2 bytes of data
+		if len(resp.payload) != 4 ||
+			bytesToUint16(BIG_ENDIAN, resp.payload[0:2]) != uint16(subFunction) {
+			err = ErrProtocolError
+			return
+		}
+
+		res = bytesToUint16(BIG_ENDIAN, resp.payload[2:4])
+
+	case resp.functionCode == (req.functionCode | 0x80):
+		if len(resp.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		err = mapExceptionCodeToError(resp.payload[0])
+
+	default:
+		err = ErrProtocolError
+		mu.client.logger.Warningf("unexpected response code (%v)", resp.functionCode)
+	}
+
+	return
+}
+
+// Asks the remote device to echo data back (diagnostics sub-function 0x00).
+func (mu *ModbusUnit) ReturnQueryData(ctx context.Context, data uint16) (err error) {
+	var res uint16
+
+	res, err = mu.Diagnostics(ctx, DIAG_RETURN_QUERY_DATA, data)
+	if err != nil {
+		return
+	}
+
+	if res != data {
+		err = ErrProtocolError
+		mu.client.logger.Warningf("query data mismatch (sent: 0x%04x, received: 0x%04x)",
+			data, res)
+	}
+
+	return
+}
+
+// Restarts the serial line port of the remote device, clearing its
+// communication counters and taking it out of listen only mode (diagnostics
+// sub-function 0x01). The communication event log is cleared as well if
+// clearLog is true.
+// Devices in listen only mode do not respond to this request: expect
+// ErrRequestTimedOut in that case.
+func (mu *ModbusUnit) RestartCommunications(ctx context.Context, clearLog bool) (err error) {
+	var data uint16
+
+	if clearLog {
+		data = 0xff00
+	}
+
+	_, err = mu.Diagnostics(ctx, DIAG_RESTART_COMMUNICATIONS, data)
+
+	return
+}
+
+// Forces the remote device into listen only mode (diagnostics sub-function
+// 0x04), where it stops responding to any request but RestartCommunications().
+// As the remote device does not respond to this request, a timeout is not
+// considered an error.
+func (mu *ModbusUnit) ForceListenOnlyMode(ctx context.Context) (err error) {
+	_, err = mu.Diagnostics(ctx, DIAG_FORCE_LISTEN_ONLY_MODE, 0x0000)
+	if err == ErrRequestTimedOut {
+		err = nil
+	}
+
+	return
+}
+
+// Clears all counters and the diagnostic register of the remote device
+// (diagnostics sub-function 0x0a).
+func (mu *ModbusUnit) ClearDiagnosticCounters(ctx context.Context) (err error) {
+	_, err = mu.Diagnostics(ctx, DIAG_CLEAR_COUNTERS, 0x0000)
+
+	return
+}
+
+// Reads a diagnostic counter of the remote device, e.g. DIAG_BUS_MESSAGE_COUNT
+// or DIAG_BUS_COMM_ERROR_COUNT (CRC errors), or its diagnostic register
+// (DIAG_RETURN_DIAGNOSTIC_REGISTER).
+func (mu *ModbusUnit) ReadDiagnosticCounter(ctx context.Context, counter DiagnosticSubFunction) (value uint16, err error) {
+	if counter != DIAG_RETURN_DIAGNOSTIC_REGISTER &&
+		(counter < DIAG_BUS_MESSAGE_COUNT || counter > DIAG_BUS_CHARACTER_OVERRUN_COUNT) {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Errorf("sub-function 0x%04x is not a counter", uint16(counter))
+		return
+	}
+
+	value, err = mu.Diagnostics(ctx, counter, 0x0000)
+
+	return
+}
+
+// Reads the status word and communication event counter of the remote device
+// (function code 11, serial line only).
+// status is 0xffff if the device is still processing a previous command,
+// 0x0000 otherwise.
+func (mu *ModbusUnit) GetCommEventCounter(ctx context.Context) (status uint16, eventCount uint16, err error) {
+	var req *pdu
+	var res *pdu
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	// create the request object (no payload)
+	req = &pdu{
+		unitId:       mu.unitId,
+		functionCode: fcGetCommEventCounter,
+	}
+
+	// run the request across the transport and wait for a response
+	res, err = mu.client.executeRequest(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect 2 bytes of status and 2 bytes of event count
+		if len(res.payload) != 4 {
+			err = ErrProtocolError
+			return
+		}
+
+		status = bytesToUint16(BIG_ENDIAN, res.payload[0:2])
+		eventCount = bytesToUint16(BIG_ENDIAN, res.payload[2:4])
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		err = mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err = ErrProtocolError
+		mu.client.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Reads the communication event log of the remote device (function code 12,
+// serial line only).
+func (mu *ModbusUnit) GetCommEventLog(ctx context.Context) (eventLog *CommEventLog, err error) {
+	var req *pdu
+	var res *pdu
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	// create the request object (no payload)
+	req = &pdu{
+		unitId:       mu.unitId,
+		functionCode: fcGetCommEventLog,
+	}
+
+	// run the request across the transport and wait for a response
+	res, err = mu.client.executeRequest(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect 1 byte of byte count, 2 bytes of status, 2 bytes of event
+		// count, 2 bytes of message count and up to 64 bytes of events
+		if len(res.payload) < 7 ||
+			len(res.payload) > 7+maxCommEventLogLength ||
+			int(res.payload[0]) != len(res.payload)-1 {
+			err = ErrProtocolError
+			return
+		}
+
+		eventLog = &CommEventLog{
+			Status:       bytesToUint16(BIG_ENDIAN, res.payload[1:3]),
+			EventCount:   bytesToUint16(BIG_ENDIAN, res.payload[3:5]),
+			MessageCount: bytesToUint16(BIG_ENDIAN, res.payload[5:7]),
+			Events:       append([]byte{}, res.payload[7:]...),
+		}
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		err = mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err = ErrProtocolError
+		mu.client.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Reads the description of the remote device (function code 17, serial line
+// only).
+// The returned data holds the device-specific server id, followed by the run
+// indicator status (0x00: off, 0xff: on) and any additional device-specific
+// data. As the length of the server id is device specific, it is up to the
+// caller to split those fields.
+func (mu *ModbusUnit) ReportServerId(ctx context.Context) (data []byte, err error) {
+	var req *pdu
+	var res *pdu
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	// create the request object (no payload)
+	req = &pdu{
+		unitId:       mu.unitId,
+		functionCode: fcReportServerId,
+	}
+
+	// run the request across the transport and wait for a response
+	res, err = mu.client.executeRequest(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect 1 byte of byte count, followed by at least the run
+		// indicator status
+		if len(res.payload) < 2 || int(res.payload[0]) != len(res.payload)-1 {
+			err = ErrProtocolError
+			return
+		}
+
+		data = append([]byte{}, res.payload[1:]...)
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		err = mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err = ErrProtocolError
+		mu.client.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Reads one or more groups of file records in a single transaction
+// (function code 20). Each request must have FileNumber, RecordNumber and
+// RecordLength set, the returned records hold the values read from the device.
+func (mu *ModbusUnit) ReadFileRecords(ctx context.Context, requests []FileRecord) (records []FileRecord, err error) {
+	var req *pdu
+	var res *pdu
+	var responseLength int
+	var subResponseLength int
+	var pos int
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	if len(requests) == 0 {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("no file record to read")
+		return
+	}
+
+	// create and fill in the request object
+	req = &pdu{
+		unitId:       mu.unitId,
+		functionCode: fcReadFileRecord,
+		// byte count (7 bytes per sub-request)
+		payload: []byte{uint8(7 * len(requests))},
+	}
+
+	for _, request := range requests {
+		err = mu.validateFileRecord(request.FileNumber, request.RecordNumber,
+			request.RecordLength)
+		if err != nil {
+			return
+		}
+
+		// each sub-response takes 2 bytes of header and 2 bytes per record
+		responseLength += 2 + 2*int(request.RecordLength)
+
+		// reference type
+		req.payload = append(req.payload, fileRecordReferenceType)
+		// file number
+		req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, request.FileNumber)...)
+		// record number
+		req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, request.RecordNumber)...)
+		// record length
+		req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, request.RecordLength)...)
+	}
+
+	// ensure both the request and the response fit in a PDU
+	if len(req.payload)-1 > maxFileRecordByteCount || responseLength > maxFileRecordByteCount {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("file record request or response exceeds the max. PDU length")
+		return
+	}
+
+	// run the request across the transport and wait for a response
+	res, err = mu.client.executeRequest(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect 1 byte of response data length, followed by the sub-responses
+		if len(res.payload) != 1+responseLength ||
+			int(res.payload[0]) != responseLength {
+			err = ErrProtocolError
+			return
+		}
+
+		pos = 1
+		for _, request := range requests {
+			// sub-response length (covering reference type and record data)
+			// and reference type
+			subResponseLength = int(res.payload[pos])
+			if subResponseLength != 1+2*int(request.RecordLength) ||
+				res.payload[pos+1] != fileRecordReferenceType {
+				err = ErrProtocolError
+				records = nil
+				return
+			}
+
+			records = append(records, FileRecord{
+				FileNumber:   request.FileNumber,
+				RecordNumber: request.RecordNumber,
+				RecordLength: request.RecordLength,
+				Values: bytesToUint16s(mu.client.endianness,
+					res.payload[pos+2:pos+1+subResponseLength]),
+			})
+
+			pos += 1 + subResponseLength
+		}
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		err = mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err = ErrProtocolError
+		mu.client.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Writes one or more groups of file records in a single transaction
+// (function code 21). Each record must have FileNumber, RecordNumber and
+// Values set (RecordLength is ignored).
+func (mu *ModbusUnit) WriteFileRecords(ctx context.Context, records []FileRecord) (err error) {
+	var req *pdu
+	var res *pdu
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	if len(records) == 0 {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("no file record to write")
+		return
+	}
+
+	// create and fill in the request object
+	req = &pdu{
+		unitId:       mu.unitId,
+		functionCode: fcWriteFileRecord,
+		// request data length, filled in below
+		payload: []byte{0x00},
+	}
+
+	for _, record := range records {
+		if len(record.Values) > 0xffff {
+			err = ErrUnexpectedParameters
+			mu.client.logger.Error("quantity of records exceeds 65535")
+			return
+		}
+
+		err = mu.validateFileRecord(record.FileNumber, record.RecordNumber,
+			uint16(len(record.Values)))
+		if err != nil {
+			return
+		}
+
+		// reference type
+		req.payload = append(req.payload, fileRecordReferenceType)
+		// file number
+		req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, record.FileNumber)...)
+		// record number
+		req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, record.RecordNumber)...)
+		// record length
+		req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, uint16(len(record.Values)))...)
+		// record data
+		req.payload = append(req.payload, uint16sToBytes(mu.client.endianness, record.Values)...)
+
+		if len(req.payload)-1 > maxFileRecordWriteByteCount {
+			err = ErrUnexpectedParameters
+			mu.client.logger.Error("file record request exceeds the max. PDU length")
+			return
+		}
+	}
+
+	req.payload[0] = uint8(len(req.payload) - 1)
+
+	// run the request across the transport and wait for a response
+	res, err = mu.client.executeRequest(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect an echo of the request
+		if string(res.payload) != string(req.payload) {
+			err = ErrProtocolError
+			return
+		}
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		err = mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err = ErrProtocolError
+		mu.client.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Reads the contents of a FIFO queue of 16-bit registers (function code 24).
+// addr is the FIFO pointer address, up to 31 queued values are returned.
+func (mu *ModbusUnit) ReadFifoQueue(ctx context.Context, addr uint16) (values []uint16, err error) {
+	var req *pdu
+	var res *pdu
+	var fifoCount int
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	// create and fill in the request object
+	req = &pdu{
+		unitId:       mu.unitId,
+		functionCode: fcReadFifoQueue,
+		// FIFO pointer address
+		payload: uint16ToBytes(BIG_ENDIAN, addr),
+	}
+
+	// run the request across the transport and wait for a response
+	res, err = mu.client.executeRequest(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect 2 bytes of byte count, 2 bytes of FIFO count and
+		// 2 bytes per queued value
+		if len(res.payload) < 4 {
+			err = ErrProtocolError
+			return
+		}
+
+		fifoCount = int(bytesToUint16(BIG_ENDIAN, res.payload[2:4]))
+		if fifoCount > maxFifoCount ||
+			len(res.payload) != 4+2*fifoCount ||
+			int(bytesToUint16(BIG_ENDIAN, res.payload[0:2])) != 2+2*fifoCount {
+			err = ErrProtocolError
+			return
+		}
+
+		values = bytesToUint16s(mu.client.endianness, res.payload[4:])
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		err = mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err = ErrProtocolError
+		mu.client.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Reads all device identification objects of the given category
+// (function code 43 / MEI type 14).
+// Responses split over multiple transactions by the device ("more follows")
+// are reassembled transparently.
+func (mu *ModbusUnit) ReadDeviceIdentification(ctx context.Context, category DeviceIdCategory) (di *DeviceIdentification, err error) {
+	var conformityLevel uint8
+	var moreFollows bool
+	var objectId uint8
+	var nextObjectId uint8
+	var objects map[uint8]string
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	if category != DEVICE_ID_BASIC && category != DEVICE_ID_REGULAR &&
+		category != DEVICE_ID_EXTENDED {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Errorf("unexpected device identification category (%v)", category)
+		return
+	}
+
+	di = &DeviceIdentification{
+		Objects: make(map[uint8]string),
+	}
+
+	for {
+		conformityLevel, moreFollows, nextObjectId, objects, err =
+			mu.readDeviceIdentification(ctx, uint8(category), objectId)
+		if err != nil {
+			di = nil
+			return
+		}
+
+		di.ConformityLevel = conformityLevel
+		for id, value := range objects {
+			di.Objects[id] = value
+		}
+
+		if !moreFollows {
+			break
+		}
+
+		// the device should make progress on every transaction
+		if nextObjectId <= objectId {
+			mu.client.logger.Warningf("unexpected next object id (%v)", nextObjectId)
+			err = ErrProtocolError
+			di = nil
+			return
+		}
+		objectId = nextObjectId
+	}
+
+	return
+}
+
+// Reads a single device identification object (function code 43 / MEI type 14,
+// individual access).
+func (mu *ModbusUnit) ReadDeviceIdentificationObject(ctx context.Context, objectId uint8) (value string, err error) {
+	var objects map[uint8]string
+	var found bool
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	_, _, _, objects, err = mu.readDeviceIdentification(ctx, readDeviceIdIndividual, objectId)
+	if err != nil {
+		return
+	}
+
+	value, found = objects[objectId]
+	if !found || len(objects) != 1 {
+		err = ErrProtocolError
+		return
+	}
+
+	return
+}
+
+/*** unexported methods ***/
+// Reads one or multiple 16-bit registers (function code 03 or 04) as bytes.
+func (mu *ModbusUnit) readBytes(ctx context.Context, addr uint16, quantity uint16, regType RegType, observeEndianness bool) (values []byte, err error) {
+	var regCount uint16
+
+	// read enough registers to get the requested number of bytes
+	// (2 bytes per reg)
+	regCount = (quantity / 2) + (quantity % 2)
+
+	values, err = mu.readRegisters(ctx, addr, regCount, regType)
+	if err != nil {
+		return
+	}
+
+	// swap bytes on register boundaries if requested by the caller
+	// and endianness is set to little endian
+	if observeEndianness && mu.client.endianness == LITTLE_ENDIAN {
+		for i := 0; i < len(values); i += 2 {
+			values[i], values[i+1] = values[i+1], values[i]
+		}
+	}
+
+	// pop the last byte on odd quantities
+	if quantity%2 == 1 {
+		values = values[0 : len(values)-1]
+	}
+
+	return
+}
+
+// Writes the given slice of bytes to 16-bit registers starting at addr.
+func (mu *ModbusUnit) writeBytes(ctx context.Context, addr uint16, values []byte, observeEndianness bool) (err error) {
+	// pad odd quantities to make for full registers
+	if len(values)%2 == 1 {
+		values = append(values, 0x00)
+	}
+
+	// swap bytes on register boundaries if requested by the caller
+	// and endianness is set to little endian
+	if observeEndianness && mu.client.endianness == LITTLE_ENDIAN {
+		for i := 0; i < len(values); i += 2 {
+			values[i], values[i+1] = values[i+1], values[i]
+		}
+	}
+
+	err = mu.writeRegisters(ctx, addr, values)
+
+	return
+}
+
+// Reads and returns quantity booleans.
+// Digital inputs are read if di is true, otherwise coils are read.
+func (mu *ModbusUnit) readBools(ctx context.Context, addr uint16, quantity uint16, di bool) (values []bool, err error) {
+	var req *pdu
+	var res *pdu
+	var expectedLen int
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	if quantity == 0 {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("quantity of coils/discrete inputs is 0")
+		return
+	}
+
+	if quantity > 2000 {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("quantity of coils/discrete inputs exceeds 2000")
+		return
+	}
+
+	if uint32(addr)+uint32(quantity)-1 > 0xffff {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("end coil/discrete input address is past 0xffff")
+		return
+	}
+
+	// create and fill in the request object
+	req = &pdu{
+		unitId: mu.unitId,
+	}
+
+	if di {
+		req.functionCode = fcReadDiscreteInputs
+	} else {
+		req.functionCode = fcReadCoils
+	}
+
+	// start address
+	req.payload = uint16ToBytes(BIG_ENDIAN, addr)
+	// quantity
+	req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, quantity)...)
+
+	// run the request across the transport and wait for a response
+	res, err = mu.client.executeRequest(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect a payload of 1 byte (byte count) + 1 byte for 8 coils/discrete inputs)
+		expectedLen = 1
+		expectedLen += int(quantity) / 8
+		if quantity%8 != 0 {
+			expectedLen++
+		}
+
+		if len(res.payload) != expectedLen {
+			err = ErrProtocolError
+			return
+		}
+
+		// validate the byte count field
+		if int(res.payload[0])+1 != expectedLen {
+			err = ErrProtocolError
+			return
+		}
+
+		// turn bits into a bool slice
+		values = decodeBools(quantity, res.payload[1:])
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		err = mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err = ErrProtocolError
+		mu.client.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Reads and returns quantity registers of type regType, as bytes.
+func (mu *ModbusUnit) readRegisters(ctx context.Context, addr uint16, quantity uint16, regType RegType) (bytes []byte, err error) {
+	var req *pdu
+	var res *pdu
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	// create and fill in the request object
+	req = &pdu{
+		unitId: mu.unitId,
+	}
+
+	switch regType {
+	case HOLDING_REGISTER:
+		req.functionCode = fcReadHoldingRegisters
+	case INPUT_REGISTER:
+		req.functionCode = fcReadInputRegisters
+	default:
+		err = ErrUnexpectedParameters
+		mu.client.logger.Errorf("unexpected register type (%v)", regType)
+		return
+	}
+
+	if quantity == 0 {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("quantity of registers is 0")
+		return
+	}
+
+	if quantity > maxReadRegisterCount {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("quantity of registers exceeds 125")
+		return
+	}
+
+	if uint32(addr)+uint32(quantity)-1 > 0xffff {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("end register address is past 0xffff")
+		return
+	}
+
+	// start address
+	req.payload = uint16ToBytes(BIG_ENDIAN, addr)
+	// quantity
+	req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, quantity)...)
+
+	// run the request across the transport and wait for a response
+	res, err = mu.client.executeRequest(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// make sure the payload length is what we expect
+		// (1 byte of length + 2 bytes per register)
+		if len(res.payload) != 1+2*int(quantity) {
+			err = ErrProtocolError
+			return
+		}
+
+		// validate the byte count field
+		// (2 bytes per register * number of registers)
+		if uint(res.payload[0]) != 2*uint(quantity) {
+			err = ErrProtocolError
+			return
+		}
+
+		// remove the byte count field from the returned slice
+		bytes = res.payload[1:]
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		err = mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err = ErrProtocolError
+		mu.client.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Writes multiple registers starting from base address addr.
+// Register values are passed as bytes, each value being exactly 2 bytes.
+func (mu *ModbusUnit) writeRegisters(ctx context.Context, addr uint16, values []byte) (err error) {
+	var req *pdu
+	var res *pdu
+	var payloadLength uint16
+	var quantity uint16
+
+	mu.client.acquire()
+	defer mu.client.release()
+
+	payloadLength = uint16(len(values))
+	quantity = payloadLength / 2
+
+	if quantity == 0 {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Errorf("quantity of registers is 0")
+		return
+	}
+
+	if quantity > 123 {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Errorf("quantity of registers exceeds 123")
+		return
+	}
+
+	if uint32(addr)+uint32(quantity)-1 > 0xffff {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Errorf("end register address is past 0xffff")
+		return
+	}
+
+	// create and fill in the request object
+	req = &pdu{
+		unitId:       mu.unitId,
+		functionCode: fcWriteMultipleRegisters,
+	}
+
+	// base address
+	req.payload = uint16ToBytes(BIG_ENDIAN, addr)
+	// quantity of registers (2 bytes per register)
+	req.payload = append(req.payload, uint16ToBytes(BIG_ENDIAN, quantity)...)
+	// byte count
+	req.payload = append(req.payload, byte(payloadLength))
+	// registers value
+	req.payload = append(req.payload, values...)
+
+	// run the request across the transport and wait for a response
+	res, err = mu.client.executeRequest(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect 4 bytes (2 byte of address + 2 bytes of quantity)
+		if len(res.payload) != 4 ||
+			// bytes 1-2 should be the base register address
+			bytesToUint16(BIG_ENDIAN, res.payload[0:2]) != addr ||
+			// bytes 3-4 should be the quantity of registers (2 bytes per register)
+			bytesToUint16(BIG_ENDIAN, res.payload[2:4]) != quantity {
+			err = ErrProtocolError
+			return
+		}
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		err = mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err = ErrProtocolError
+		mu.client.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Validates the file number, record number and record length of a file
+// record sub-request.
+func (mu *ModbusUnit) validateFileRecord(fileNumber uint16, recordNumber uint16,
+	recordLength uint16) (err error) {
+	if fileNumber == 0 {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("file number is 0")
+		return
+	}
+
+	if recordNumber > maxFileRecordNumber {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Errorf("record number exceeds %v", maxFileRecordNumber)
+		return
+	}
+
+	if recordLength == 0 {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Error("quantity of records is 0")
+		return
+	}
+
+	if uint32(recordNumber)+uint32(recordLength)-1 > uint32(maxFileRecordNumber) {
+		err = ErrUnexpectedParameters
+		mu.client.logger.Errorf("end record number is past %v", maxFileRecordNumber)
+		return
+	}
+
+	return
+}
+
+// Runs a single read device identification transaction and returns the
+// decoded response fields.
+// The caller is expected to hold the client lock.
+func (mu *ModbusUnit) readDeviceIdentification(ctx context.Context, readDeviceIdCode uint8, objectId uint8) (
+	conformityLevel uint8, moreFollows bool, nextObjectId uint8,
+	objects map[uint8]string, err error) {
+	var req *pdu
+	var res *pdu
+	var objectCount int
+	var objectLength int
+	var pos int
+
+	// create and fill in the request object
+	req = &pdu{
+		unitId:       mu.unitId,
+		functionCode: fcEncapsulatedInterface,
+		payload:      []byte{meiReadDeviceIdentification, readDeviceIdCode, objectId},
+	}
+
+	// run the request across the transport and wait for a response
+	res, err = mu.client.executeRequest(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect at least 6 bytes (MEI type, read device id code, conformity
+		// level, more follows, next object id and number of objects)
+		if len(res.payload) < 6 ||
+			res.payload[0] != meiReadDeviceIdentification ||
+			res.payload[1] != readDeviceIdCode {
+			err = ErrProtocolError
+			return
+		}
+
+		conformityLevel = res.payload[2]
+		moreFollows = (res.payload[3] == 0xff)
+		nextObjectId = res.payload[4]
+		objectCount = int(res.payload[5])
+
+		// decode the object list (object id, length and value)
+		objects = make(map[uint8]string)
+		pos = 6
+		for i := 0; i < objectCount; i++ {
+			if pos+2 > len(res.payload) {
+				err = ErrProtocolError
+				return
+			}
+
+			objectLength = int(res.payload[pos+1])
+			if pos+2+objectLength > len(res.payload) {
+				err = ErrProtocolError
+				return
+			}
+
+			objects[res.payload[pos]] = string(res.payload[pos+2 : pos+2+objectLength])
+			pos += 2 + objectLength
+		}
+
+		// make sure there's no trailing data
+		if pos != len(res.payload) {
+			err = ErrProtocolError
+			return
+		}
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err = ErrProtocolError
+			return
+		}
+
+		err = mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err = ErrProtocolError
+		mu.client.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
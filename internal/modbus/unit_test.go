@@ -0,0 +1,394 @@
+package modbus
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestModbusUnit(t *testing.T) {
+	var err error
+	var server *ModbusServer
+	var client *ModbusClient
+	var th *tcpTestHandler
+	var unit *ModbusUnit
+	var regs []uint16
+
+	th = &tcpTestHandler{}
+	th.holding[1] = 0x1234
+
+	server, err = NewServer(&ServerConfiguration{
+		URL: "tcp://localhost:5502",
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "tcp://localhost:5502",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+	err = client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	// the test handler only answers to unit id #9: the client's own unit id
+	// should not affect requests made through the handle
+	client.SetUnitId(1)
+	unit = client.Unit(9)
+
+	if unit.UnitId() != 9 {
+		t.Errorf("expected unit id 9, got: %v", unit.UnitId())
+	}
+
+	regs, err = unit.ReadRegisters(context.Background(), 1, 1, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("ReadRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 1 || regs[0] != 0x1234 {
+		t.Errorf("expected {0x1234}, got: %v", regs)
+	}
+
+	err = unit.WriteRegister(context.Background(), 2, 0x5678)
+	if err != nil {
+		t.Errorf("WriteRegister() should have succeeded, got: %v", err)
+	}
+	if th.holding[2] != 0x5678 {
+		t.Errorf("expected 0x5678, got: 0x%04x", th.holding[2])
+	}
+
+	_, err = client.ReadRegisters(1, 1, HOLDING_REGISTER)
+	if err != ErrIllegalFunction {
+		t.Errorf("ReadRegisters() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	// requests made with a context which is already done should not be sent
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = unit.ReadRegisters(ctx, 1, 1, HOLDING_REGISTER)
+	if err != context.Canceled {
+		t.Errorf("ReadRegisters() should have returned context.Canceled, got: %v", err)
+	}
+
+	return
+}
+
+func TestModbusUnitCancellation(t *testing.T) {
+	var err error
+	var silentListener net.Listener
+	var client *ModbusClient
+	var ts time.Time
+
+	// start a listener which accepts connections but never answers
+	silentListener, err = net.Listen("tcp", "localhost:5503")
+	if err != nil {
+		t.Errorf("failed to listen: %v", err)
+		return
+	}
+	defer silentListener.Close()
+	go func() {
+		var socks []net.Conn
+
+		for {
+			sock, err := silentListener.Accept()
+			if err != nil {
+				break
+			}
+			socks = append(socks, sock)
+		}
+
+		for _, sock := range socks {
+			sock.Close()
+		}
+	}()
+
+	client, err = NewClient(&ClientConfiguration{
+		URL:     "tcp://localhost:5503",
+		Timeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+	err = client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	// cancelling the context should interrupt the request well before the
+	// client timeout expires
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	ts = time.Now()
+	_, err = client.Unit(1).ReadRegisters(ctx, 0, 1, INPUT_REGISTER)
+	if err != context.Canceled {
+		t.Errorf("ReadRegisters() should have returned context.Canceled, got: %v", err)
+	}
+	if time.Since(ts) > time.Second {
+		t.Errorf("ReadRegisters() should have returned within 1s, took %v", time.Since(ts))
+	}
+
+	// so should an expiring context deadline
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ts = time.Now()
+	_, err = client.Unit(1).ReadRegisters(ctx, 0, 1, INPUT_REGISTER)
+	if err != context.DeadlineExceeded {
+		t.Errorf("ReadRegisters() should have returned context.DeadlineExceeded, got: %v", err)
+	}
+	if time.Since(ts) > time.Second {
+		t.Errorf("ReadRegisters() should have returned within 1s, took %v", time.Since(ts))
+	}
+
+	return
+}
+
+func TestModbusUnitRTUCancellation(t *testing.T) {
+	var err error
+	var client *ModbusClient
+	var p1, p2 net.Conn
+	var ts time.Time
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "rtu:///dev/ttyUSB0",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	// a device swallowing requests without ever answering
+	p1, p2 = net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	client.transport = newRTUTransport(p1, "", 19200, 5*time.Second, nil)
+	go io.Copy(io.Discard, p2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	ts = time.Now()
+	_, err = client.Unit(1).ReadRegisters(ctx, 0, 1, INPUT_REGISTER)
+	if err != context.Canceled {
+		t.Errorf("ReadRegisters() should have returned context.Canceled, got: %v", err)
+	}
+	if time.Since(ts) > time.Second {
+		t.Errorf("ReadRegisters() should have returned within 1s, took %v", time.Since(ts))
+	}
+
+	return
+}
+
+func TestModbusUnitPipelining(t *testing.T) {
+	var err error
+	var server *ModbusServer
+	var client *ModbusClient
+	var th *tcpTestHandler
+	var wg sync.WaitGroup
+
+	// pipelining is only available on modbus TCP
+	_, err = NewClient(&ClientConfiguration{
+		URL:               "rtu:///dev/ttyUSB0",
+		TransactionWindow: 4,
+	})
+	if err != ErrConfigurationError {
+		t.Errorf("NewClient() should have failed with ErrConfigurationError, got: %v", err)
+	}
+
+	th = &tcpTestHandler{}
+	for i := range th.holding {
+		th.holding[i] = uint16(0x1000 + i)
+	}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL: "tcp://localhost:5502",
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client, err = NewClient(&ClientConfiguration{
+		URL:               "tcp://localhost:5502",
+		TransactionWindow: 4,
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+	err = client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	// concurrent requests should all get their own response
+	for i := 0; i < len(th.holding); i++ {
+		wg.Add(1)
+		go func(addr uint16) {
+			var regs []uint16
+			var err error
+
+			defer wg.Done()
+
+			regs, err = client.Unit(9).ReadRegisters(
+				context.Background(), addr, 1, HOLDING_REGISTER)
+			if err != nil {
+				t.Errorf("ReadRegisters() should have succeeded, got: %v", err)
+				return
+			}
+			if len(regs) != 1 || regs[0] != 0x1000+addr {
+				t.Errorf("expected {0x%04x}, got: %v", 0x1000+addr, regs)
+			}
+		}(uint16(i))
+	}
+	wg.Wait()
+
+	return
+}
+
+func TestModbusUnitTypedRegisters(t *testing.T) {
+	var err error
+	var server *ModbusServer
+	var client *ModbusClient
+	var th *tcpTestHandler
+	var unit *ModbusUnit
+	var i32 int32
+	var i16s []int16
+	var str string
+	var bcd uint64
+	var block struct {
+		Power   float32 `modbus:"0,type=int32,scale=0.1"`
+		Serial  string  `modbus:"2,len=3"`
+		Version uint16  `modbus:"5,type=bcd"`
+	}
+
+	th = &tcpTestHandler{}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL: "tcp://localhost:5502",
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "tcp://localhost:5502",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+	err = client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	client.SetEncoding(BIG_ENDIAN, LOW_WORD_FIRST)
+	unit = client.Unit(9)
+
+	err = unit.WriteInt32(context.Background(), 0, -12345)
+	if err != nil {
+		t.Errorf("WriteInt32() should have succeeded, got: %v", err)
+	}
+	if th.holding[0] != 0xcfc7 || th.holding[1] != 0xffff {
+		t.Errorf("expected {0xcfc7, 0xffff}, got: %v", th.holding[0:2])
+	}
+
+	i32, err = unit.ReadInt32(context.Background(), 0, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("ReadInt32() should have succeeded, got: %v", err)
+	}
+	if i32 != -12345 {
+		t.Errorf("expected -12345, got: %v", i32)
+	}
+
+	i16s, err = unit.ReadInt16s(context.Background(), 0, 2, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("ReadInt16s() should have succeeded, got: %v", err)
+	}
+	if len(i16s) != 2 || i16s[0] != -12345 || i16s[1] != -1 {
+		t.Errorf("expected {-12345, -1}, got: %v", i16s)
+	}
+
+	err = unit.WriteString(context.Background(), 2, 3, "SN42")
+	if err != nil {
+		t.Errorf("WriteString() should have succeeded, got: %v", err)
+	}
+	str, err = unit.ReadString(context.Background(), 2, 3, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("ReadString() should have succeeded, got: %v", err)
+	}
+	if str != "SN42" {
+		t.Errorf("expected 'SN42', got: %q", str)
+	}
+
+	err = unit.WriteString(context.Background(), 2, 1, "SN42")
+	if err != ErrUnexpectedParameters {
+		t.Errorf("WriteString() should have failed with ErrUnexpectedParameters, got: %v", err)
+	}
+
+	err = unit.WriteBCD(context.Background(), 5, 1, 1203)
+	if err != nil {
+		t.Errorf("WriteBCD() should have succeeded, got: %v", err)
+	}
+	if th.holding[5] != 0x1203 {
+		t.Errorf("expected 0x1203, got: 0x%04x", th.holding[5])
+	}
+	bcd, err = unit.ReadBCD(context.Background(), 5, 1, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("ReadBCD() should have succeeded, got: %v", err)
+	}
+	if bcd != 1203 {
+		t.Errorf("expected 1203, got: %v", bcd)
+	}
+
+	th.holding[6] = 0x00ab
+	_, err = unit.ReadBCD(context.Background(), 6, 1, HOLDING_REGISTER)
+	if err != ErrBadBCD {
+		t.Errorf("ReadBCD() should have failed with ErrBadBCD, got: %v", err)
+	}
+
+	err = unit.ReadStruct(context.Background(), 0, HOLDING_REGISTER, &block)
+	if err != nil {
+		t.Errorf("ReadStruct() should have succeeded, got: %v", err)
+	}
+	if block.Power != -1234.5 || block.Serial != "SN42" || block.Version != 1203 {
+		t.Errorf("expected {-1234.5 SN42 1203}, got: %+v", block)
+	}
+
+	return
+}
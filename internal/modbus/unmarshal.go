@@ -0,0 +1,321 @@
+package modbus
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Struct field decoding instructions, parsed from a modbus struct tag.
+type fieldCodec struct {
+	index    int
+	name     string
+	offset   uint16
+	dataType string
+	length   uint16
+	scale    float64
+}
+
+// Unmarshal decodes a block of registers into the struct pointed to by v.
+// regs holds register values as returned by ReadRegisters() with the default
+// BIG_ENDIAN encoding, regs[0] being at offset 0 of the block. endianness and
+// wordOrder are then applied as they would be by the typed Read methods.
+//
+// Struct fields are mapped with tags of the form
+// `modbus:"<offset>[,type=<type>][,len=<registers>][,scale=<factor>]"`:
+//   - offset is the register offset of the field within the block,
+//   - type is one of int16, uint16, int32, uint32, float32, int64, uint64,
+//     float64, string or bcd, and defaults to the type of the field,
+//   - len is the number of registers of string (required) and bcd (defaults
+//     to 1) fields,
+//   - scale is a factor applied to the decoded value, typically to turn
+//     fixed point values into float32 or float64 fields (e.g.
+//     `modbus:"12,type=int32,scale=0.001"` for a value in mA read into Amps).
+//
+// Fields without a modbus tag, or tagged with "-", are left untouched.
+func Unmarshal(regs []uint16, endianness Endianness, wordOrder WordOrder, v interface{}) (err error) {
+	var rv reflect.Value
+	var codecs []*fieldCodec
+	var payload []byte
+
+	rv = reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		err = fmt.Errorf("expected a non-nil pointer to a struct, got %T", v)
+		return
+	}
+	rv = rv.Elem()
+
+	codecs, err = structCodecs(rv.Type())
+	if err != nil {
+		return
+	}
+
+	payload = uint16sToBytes(BIG_ENDIAN, regs)
+	for _, codec := range codecs {
+		if int(codec.offset)+int(codec.length) > len(regs) {
+			err = fmt.Errorf("field %v: registers %v to %v out of the %v register block",
+				codec.name, codec.offset, int(codec.offset)+int(codec.length)-1, len(regs))
+			return
+		}
+
+		err = codec.decode(payload[2*int(codec.offset):2*(int(codec.offset)+int(codec.length))],
+			endianness, wordOrder, rv.Field(codec.index))
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+/*** unexported methods ***/
+
+// Returns the codecs of all tagged fields of t.
+func structCodecs(t reflect.Type) (codecs []*fieldCodec, err error) {
+	var codec *fieldCodec
+	var tag string
+
+	for i := 0; i < t.NumField(); i++ {
+		tag = t.Field(i).Tag.Get("modbus")
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		codec, err = parseFieldCodec(t.Field(i), tag)
+		if err != nil {
+			return
+		}
+		codec.index = i
+		codecs = append(codecs, codec)
+	}
+
+	return
+}
+
+// Parses the modbus tag of field.
+func parseFieldCodec(field reflect.StructField, tag string) (codec *fieldCodec, err error) {
+	var opts []string
+	var key, value string
+	var u64 uint64
+
+	codec = &fieldCodec{
+		name: field.Name,
+	}
+
+	if !field.IsExported() {
+		err = fmt.Errorf("field %v: tagged field is not exported", field.Name)
+		return
+	}
+
+	opts = strings.Split(tag, ",")
+	u64, err = strconv.ParseUint(strings.TrimSpace(opts[0]), 0, 16)
+	if err != nil {
+		err = fmt.Errorf("field %v: invalid offset '%v'", field.Name, opts[0])
+		return
+	}
+	codec.offset = uint16(u64)
+
+	for _, opt := range opts[1:] {
+		key, value, _ = strings.Cut(strings.TrimSpace(opt), "=")
+		switch key {
+		case "type":
+			codec.dataType = value
+		case "len":
+			u64, err = strconv.ParseUint(value, 0, 16)
+			if err != nil || u64 == 0 {
+				err = fmt.Errorf("field %v: invalid length '%v'", field.Name, value)
+				return
+			}
+			codec.length = uint16(u64)
+		case "scale":
+			codec.scale, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				err = fmt.Errorf("field %v: invalid scale '%v'", field.Name, value)
+				return
+			}
+		default:
+			err = fmt.Errorf("field %v: unknown option '%v'", field.Name, opt)
+			return
+		}
+	}
+
+	// default to the type of the field
+	if codec.dataType == "" {
+		switch field.Type.Kind() {
+		case reflect.Int8, reflect.Int16:
+			codec.dataType = "int16"
+		case reflect.Uint8, reflect.Uint16:
+			codec.dataType = "uint16"
+		case reflect.Int32:
+			codec.dataType = "int32"
+		case reflect.Uint32:
+			codec.dataType = "uint32"
+		case reflect.Int, reflect.Int64:
+			codec.dataType = "int64"
+		case reflect.Uint, reflect.Uint64:
+			codec.dataType = "uint64"
+		case reflect.Float32:
+			codec.dataType = "float32"
+		case reflect.Float64:
+			codec.dataType = "float64"
+		case reflect.String:
+			codec.dataType = "string"
+		default:
+			err = fmt.Errorf("field %v: unsupported field type %v", field.Name, field.Type)
+			return
+		}
+	}
+
+	switch codec.dataType {
+	case "int16", "uint16", "int32", "uint32", "float32", "int64", "uint64", "float64":
+		if codec.length != 0 {
+			err = fmt.Errorf("field %v: len is only supported by string and bcd fields", field.Name)
+			return
+		}
+		codec.length = dataTypeLength(codec.dataType)
+	case "string":
+		if codec.length == 0 {
+			err = fmt.Errorf("field %v: string fields require a len", field.Name)
+			return
+		}
+	case "bcd":
+		if codec.length == 0 {
+			codec.length = 1
+		}
+		if codec.length > 4 {
+			err = fmt.Errorf("field %v: bcd fields may not span more than 4 registers", field.Name)
+			return
+		}
+	default:
+		err = fmt.Errorf("field %v: unknown type '%v'", field.Name, codec.dataType)
+		return
+	}
+
+	// make sure the decoded value can be stored into the field
+	switch field.Type.Kind() {
+	case reflect.String:
+		if codec.dataType != "string" {
+			err = fmt.Errorf("field %v: %v values need a numeric field", field.Name, codec.dataType)
+			return
+		}
+	case reflect.Float32, reflect.Float64:
+		if codec.dataType == "string" {
+			err = fmt.Errorf("field %v: string values need a string field", field.Name)
+			return
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if codec.dataType == "string" {
+			err = fmt.Errorf("field %v: string values need a string field", field.Name)
+			return
+		}
+		if codec.dataType == "float32" || codec.dataType == "float64" {
+			err = fmt.Errorf("field %v: %v values need a float field", field.Name, codec.dataType)
+			return
+		}
+		if codec.scale != 0 {
+			err = fmt.Errorf("field %v: scaled values need a float field", field.Name)
+			return
+		}
+	default:
+		err = fmt.Errorf("field %v: unsupported field type %v", field.Name, field.Type)
+		return
+	}
+
+	return
+}
+
+// Returns the number of registers holding a value of the given fixed size type.
+func dataTypeLength(dataType string) (length uint16) {
+	switch dataType {
+	case "int16", "uint16":
+		length = 1
+	case "int32", "uint32", "float32":
+		length = 2
+	case "int64", "uint64", "float64":
+		length = 4
+	}
+
+	return
+}
+
+// Decodes in (exactly fc.length registers worth of bytes) into field.
+func (fc *fieldCodec) decode(in []byte, endianness Endianness, wordOrder WordOrder, field reflect.Value) (err error) {
+	var i64 int64
+	var u64 uint64
+	var f64 float64
+	var signed bool
+	var float bool
+
+	switch fc.dataType {
+	case "string":
+		field.SetString(bytesToString(endianness, in))
+		return
+	case "int16":
+		i64, signed = int64(bytesToInt16s(endianness, in)[0]), true
+	case "uint16":
+		u64 = uint64(bytesToUint16s(endianness, in)[0])
+	case "int32":
+		i64, signed = int64(bytesToInt32s(endianness, wordOrder, in)[0]), true
+	case "uint32":
+		u64 = uint64(bytesToUint32s(endianness, wordOrder, in)[0])
+	case "int64":
+		i64, signed = bytesToInt64s(endianness, wordOrder, in)[0], true
+	case "uint64":
+		u64 = bytesToUint64s(endianness, wordOrder, in)[0]
+	case "float32":
+		f64, float = float64(bytesToFloat32s(endianness, wordOrder, in)[0]), true
+	case "float64":
+		f64, float = bytesToFloat64s(endianness, wordOrder, in)[0], true
+	case "bcd":
+		u64, err = bytesToBCD(endianness, wordOrder, in)
+		if err != nil {
+			err = fmt.Errorf("field %v: %w", fc.name, err)
+			return
+		}
+	}
+
+	switch field.Kind() {
+	case reflect.Float32, reflect.Float64:
+		if !float {
+			if signed {
+				f64 = float64(i64)
+			} else {
+				f64 = float64(u64)
+			}
+		}
+		if fc.scale != 0 {
+			f64 *= fc.scale
+		}
+		field.SetFloat(f64)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !signed {
+			if u64 > 1<<63-1 {
+				err = fmt.Errorf("field %v: value %v overflows %v", fc.name, u64, field.Type())
+				return
+			}
+			i64 = int64(u64)
+		}
+		if field.OverflowInt(i64) {
+			err = fmt.Errorf("field %v: value %v overflows %v", fc.name, i64, field.Type())
+			return
+		}
+		field.SetInt(i64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if signed {
+			if i64 < 0 {
+				err = fmt.Errorf("field %v: value %v overflows %v", fc.name, i64, field.Type())
+				return
+			}
+			u64 = uint64(i64)
+		}
+		if field.OverflowUint(u64) {
+			err = fmt.Errorf("field %v: value %v overflows %v", fc.name, u64, field.Type())
+			return
+		}
+		field.SetUint(u64)
+	}
+
+	return
+}
@@ -0,0 +1,116 @@
+package modbus
+
+import (
+	"testing"
+)
+
+func TestUnmarshal(t *testing.T) {
+	var err error
+	var meter struct {
+		Voltage   float32 `modbus:"0,type=int32,scale=0.1"`
+		Current   float64 `modbus:"2,type=int32,scale=0.001"`
+		Power     int32   `modbus:"4"`
+		Model     uint16  `modbus:"6"`
+		Serial    string  `modbus:"7,len=3"`
+		Firmware  uint32  `modbus:"10,type=bcd,len=2"`
+		Frequency float32 `modbus:"12"`
+		Ignored   uint16
+		Skipped   uint16 `modbus:"-"`
+	}
+	var regs []uint16
+
+	regs = []uint16{
+		// 230.5V, as int32 low word first
+		2305, 0,
+		// -1.5A
+		0xfa24, 0xffff,
+		// -100W
+		0xff9c, 0xffff,
+		// model
+		71,
+		// serial number
+		0x4142, 0x3132, 0x3300,
+		// firmware version
+		0x0000, 0x0102,
+		// 50Hz as float32 low word first
+		0x0000, 0x4248,
+	}
+
+	err = Unmarshal(regs, BIG_ENDIAN, LOW_WORD_FIRST, &meter)
+	if err != nil {
+		t.Errorf("Unmarshal() should have succeeded, got: %v", err)
+	}
+	if meter.Voltage != 230.5 {
+		t.Errorf("expected 230.5, got: %v", meter.Voltage)
+	}
+	if meter.Current != -1.5 {
+		t.Errorf("expected -1.5, got: %v", meter.Current)
+	}
+	if meter.Power != -100 {
+		t.Errorf("expected -100, got: %v", meter.Power)
+	}
+	if meter.Model != 71 {
+		t.Errorf("expected 71, got: %v", meter.Model)
+	}
+	if meter.Serial != "AB123" {
+		t.Errorf("expected 'AB123', got: %q", meter.Serial)
+	}
+	if meter.Firmware != 1020000 {
+		t.Errorf("expected 1020000, got: %v", meter.Firmware)
+	}
+	if meter.Frequency != 50 {
+		t.Errorf("expected 50, got: %v", meter.Frequency)
+	}
+
+	// the block must cover all fields
+	err = Unmarshal(regs[0:12], BIG_ENDIAN, LOW_WORD_FIRST, &meter)
+	if err == nil {
+		t.Errorf("Unmarshal() should have failed")
+	}
+
+	// values must fit the field
+	var narrow struct {
+		Power uint16 `modbus:"0,type=int32"`
+	}
+	err = Unmarshal([]uint16{0xffff, 0xff9c}, BIG_ENDIAN, HIGH_WORD_FIRST, &narrow)
+	if err == nil {
+		t.Errorf("Unmarshal() should have failed")
+	}
+	err = Unmarshal([]uint16{0x0000, 0x0064}, BIG_ENDIAN, HIGH_WORD_FIRST, &narrow)
+	if err != nil {
+		t.Errorf("Unmarshal() should have succeeded, got: %v", err)
+	}
+	if narrow.Power != 100 {
+		t.Errorf("expected 100, got: %v", narrow.Power)
+	}
+
+	// invalid tags and targets should be rejected
+	for _, v := range []interface{}{
+		meter,
+		&struct {
+			Serial string `modbus:"0"`
+		}{},
+		&struct {
+			Power int32 `modbus:"0,scale=0.1"`
+		}{},
+		&struct {
+			Power float32 `modbus:"0,type=int24"`
+		}{},
+		&struct {
+			Power float32 `modbus:"x"`
+		}{},
+		&struct {
+			Power float32 `modbus:"0,length=2"`
+		}{},
+		&struct {
+			Flag bool `modbus:"0"`
+		}{},
+	} {
+		err = Unmarshal(regs, BIG_ENDIAN, LOW_WORD_FIRST, v)
+		if err == nil {
+			t.Errorf("Unmarshal() should have failed on %T", v)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,449 @@
+package modbus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// URL parameters accepted by clients, along with the client types they
+// apply to (nil meaning all types).
+var clientURLParams = map[string][]string{
+	"baud":          {"rtu", "ascii", "rtuovertcp", "rtuoverudp"},
+	"databits":      {"rtu", "ascii"},
+	"parity":        {"rtu", "ascii"},
+	"stop":          {"rtu", "ascii"},
+	"rs485":         {"rtu", "ascii"},
+	"rtsdelay":      {"rtu", "ascii"},
+	"rtsdelayafter": {"rtu", "ascii"},
+	"rtsonsend":     {"rtu", "ascii"},
+	"rtsaftersend":  {"rtu", "ascii"},
+	"rxduringtx":    {"rtu", "ascii"},
+	"timeout":       nil,
+	"window":        {"tcp", "tcp+tls"},
+	"reconnect":     nil,
+	"reconnectmin":  nil,
+	"reconnectmax":  nil,
+	"cert":          {"tcp+tls"},
+	"key":           {"tcp+tls"},
+	"ca":            {"tcp+tls"},
+	"capture":       {"rtu", "rtuovertcp", "rtuoverudp", "tcp", "tcp+tls", "udp"},
+}
+
+// URL parameters accepted by servers, along with the server types they
+// apply to (nil meaning all types).
+var serverURLParams = map[string][]string{
+	"baud":          {"rtu", "ascii", "rtuovertcp", "rtuoverudp"},
+	"databits":      {"rtu", "ascii"},
+	"parity":        {"rtu", "ascii"},
+	"stop":          {"rtu", "ascii"},
+	"rs485":         {"rtu", "ascii"},
+	"rtsdelay":      {"rtu", "ascii"},
+	"rtsdelayafter": {"rtu", "ascii"},
+	"rtsonsend":     {"rtu", "ascii"},
+	"rtsaftersend":  {"rtu", "ascii"},
+	"rxduringtx":    {"rtu", "ascii"},
+	"unitids":       {"rtu", "ascii"},
+	"timeout":       nil,
+	"maxclients":    {"tcp", "rtuovertcp", "asciiovertcp", "tcp+tls", "udp", "rtuoverudp"},
+	"cert":          {"tcp+tls"},
+	"key":           {"tcp+tls"},
+	"ca":            {"tcp+tls"},
+	"capture":       {"rtu", "rtuovertcp", "rtuoverudp", "tcp", "tcp+tls", "udp"},
+}
+
+// Splits the query string (e.g. ?baud=9600&parity=E) off the location part
+// of a URL and returns the parsed parameters.
+func splitURLParams(location string) (path string, params url.Values, err error) {
+	var query string
+
+	path, query, _ = strings.Cut(location, "?")
+	params, err = url.ParseQuery(query)
+	if err != nil {
+		err = fmt.Errorf("invalid URL parameters '%s': %v", query, err)
+	}
+
+	return
+}
+
+// Checks that all params are known and apply to the given client or server
+// type.
+func checkURLParams(params url.Values, known map[string][]string, mode string, role string) (err error) {
+	var types []string
+	var ok bool
+
+	for name := range params {
+		types, ok = known[name]
+		if !ok {
+			err = fmt.Errorf("unsupported URL parameter '%s'", name)
+			return
+		}
+
+		if types == nil {
+			continue
+		}
+
+		ok = false
+		for _, t := range types {
+			ok = ok || t == mode
+		}
+		if !ok {
+			err = fmt.Errorf("URL parameter '%s' is not supported on %s %ss", name, mode, role)
+			return
+		}
+	}
+
+	return
+}
+
+// Applies URL parameters to a client configuration. Parameters take
+// precedence over configuration fields:
+//   - baud, databits, parity (N, E or O) and stop: set the serial link
+//     settings,
+//   - timeout: sets the request timeout (e.g. 500ms),
+//   - window: sets the transaction window,
+//   - reconnect, reconnectmin and reconnectmax: set the reconnection
+//     behaviour,
+//   - cert, key and ca: load the client key pair and the CA/server
+//     certificates from files (tcp+tls only),
+//   - capture: sets the file to capture frames to,
+//   - rs485 parameters (see applyRS485Params()).
+func applyClientParams(params url.Values, conf *ClientConfiguration) (err error) {
+	err = applySerialParams(params, &conf.Speed, &conf.DataBits, &conf.Parity, &conf.StopBits)
+	if err != nil {
+		return
+	}
+
+	err = applyRS485Params(params, &conf.RS485)
+	if err != nil {
+		return
+	}
+
+	err = popDurationParam(params, "timeout", &conf.Timeout)
+	if err != nil {
+		return
+	}
+
+	err = popUintParam(params, "window", 1, 0xffff, &conf.TransactionWindow)
+	if err != nil {
+		return
+	}
+
+	err = popBoolParam(params, "reconnect", &conf.AutoReconnect)
+	if err != nil {
+		return
+	}
+
+	err = popDurationParam(params, "reconnectmin", &conf.ReconnectMinDelay)
+	if err != nil {
+		return
+	}
+
+	err = popDurationParam(params, "reconnectmax", &conf.ReconnectMaxDelay)
+	if err != nil {
+		return
+	}
+
+	err = popStringParam(params, "capture", &conf.Capture)
+	if err != nil {
+		return
+	}
+
+	err = applyTLSParams(params, &conf.TLSClientCert, &conf.TLSRootCAs)
+
+	return
+}
+
+// Applies URL parameters to a server configuration. Parameters take
+// precedence over configuration fields:
+//   - baud, databits, parity, stop and timeout: see applyClientParams(),
+//   - unitids: sets the comma-separated unit ids to answer to,
+//   - maxclients: sets the maximum number of client connections,
+//   - cert, key and ca: load the server key pair and the CA/client
+//     certificates from files (tcp+tls only),
+//   - capture: sets the file to capture frames to,
+//   - rs485 parameters (see applyRS485Params()).
+func applyServerParams(params url.Values, conf *ServerConfiguration) (err error) {
+	var value string
+	var found bool
+	var unitId uint64
+
+	err = applySerialParams(params, &conf.Speed, &conf.DataBits, &conf.Parity, &conf.StopBits)
+	if err != nil {
+		return
+	}
+
+	err = applyRS485Params(params, &conf.RS485)
+	if err != nil {
+		return
+	}
+
+	err = popDurationParam(params, "timeout", &conf.Timeout)
+	if err != nil {
+		return
+	}
+
+	err = popUintParam(params, "maxclients", 1, 0xffff, &conf.MaxClients)
+	if err != nil {
+		return
+	}
+
+	err = popStringParam(params, "capture", &conf.Capture)
+	if err != nil {
+		return
+	}
+
+	value, found, err = popParam(params, "unitids")
+	if err != nil {
+		return
+	}
+	if found {
+		conf.UnitIds = nil
+		for _, field := range strings.Split(value, ",") {
+			unitId, err = strconv.ParseUint(strings.TrimSpace(field), 10, 8)
+			if err != nil || unitId == 0 || unitId > 247 {
+				err = fmt.Errorf("invalid value '%s' for URL parameter 'unitids', "+
+					"expected comma-separated unit ids from 1 to 247", value)
+				return
+			}
+			conf.UnitIds = append(conf.UnitIds, uint8(unitId))
+		}
+	}
+
+	err = applyTLSParams(params, &conf.TLSServerCert, &conf.TLSClientCAs)
+
+	return
+}
+
+// Applies the baud, databits, parity and stop URL parameters.
+func applySerialParams(params url.Values, speed *uint, dataBits *uint, parity *uint, stopBits *uint) (err error) {
+	var value string
+	var found bool
+
+	err = popUintParam(params, "baud", 1, 4000000, speed)
+	if err != nil {
+		return
+	}
+
+	err = popUintParam(params, "databits", 5, 8, dataBits)
+	if err != nil {
+		return
+	}
+
+	err = popUintParam(params, "stop", 1, 2, stopBits)
+	if err != nil {
+		return
+	}
+
+	value, found, err = popParam(params, "parity")
+	if err != nil || !found {
+		return
+	}
+
+	switch strings.ToLower(value) {
+	case "n", "none":
+		*parity = PARITY_NONE
+	case "e", "even":
+		*parity = PARITY_EVEN
+	case "o", "odd":
+		*parity = PARITY_ODD
+	default:
+		err = fmt.Errorf("invalid value '%s' for URL parameter 'parity', expected N, E or O", value)
+	}
+
+	return
+}
+
+// Applies the cert, key and ca URL parameters, loading the key pair and the
+// certificate pool from files.
+func applyTLSParams(params url.Values, keyPair **tls.Certificate, certPool **x509.CertPool) (err error) {
+	var certFile string
+	var keyFile string
+	var caFile string
+	var hasCert bool
+	var hasKey bool
+	var hasCA bool
+	var cert tls.Certificate
+
+	certFile, hasCert, err = popParam(params, "cert")
+	if err != nil {
+		return
+	}
+
+	keyFile, hasKey, err = popParam(params, "key")
+	if err != nil {
+		return
+	}
+
+	caFile, hasCA, err = popParam(params, "ca")
+	if err != nil {
+		return
+	}
+
+	if hasCert != hasKey {
+		err = fmt.Errorf("URL parameters 'cert' and 'key' must be given together")
+		return
+	}
+
+	if hasCert {
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			err = fmt.Errorf("failed to load the key pair of URL parameters 'cert' and 'key': %v", err)
+			return
+		}
+		*keyPair = &cert
+	}
+
+	if hasCA {
+		*certPool, err = LoadCertPool(caFile)
+		if err != nil {
+			err = fmt.Errorf("failed to load URL parameter 'ca': %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+// Applies the RS485 URL parameters to rc:
+//   - rs485: enables RS485 mode,
+//   - rtsdelay and rtsdelayafter: set the RTS delays before and after send,
+//   - rtsonsend and rtsaftersend: drive RTS high during/after send,
+//   - rxduringtx: keeps the receiver enabled while sending.
+func applyRS485Params(params url.Values, rc *RS485Configuration) (err error) {
+	for _, p := range []struct {
+		name string
+		dst  *bool
+	}{
+		{"rs485", &rc.Enabled},
+		{"rtsonsend", &rc.RtsHighDuringSend},
+		{"rtsaftersend", &rc.RtsHighAfterSend},
+		{"rxduringtx", &rc.RxDuringTx},
+	} {
+		err = popBoolParam(params, p.name, p.dst)
+		if err != nil {
+			return
+		}
+	}
+
+	err = popDurationParam(params, "rtsdelay", &rc.DelayRtsBeforeSend)
+	if err != nil {
+		return
+	}
+
+	err = popDurationParam(params, "rtsdelayafter", &rc.DelayRtsAfterSend)
+
+	return
+}
+
+// Removes a parameter from params and returns its value. Parameters may
+// only be given once.
+func popParam(params url.Values, name string) (value string, found bool, err error) {
+	var values []string
+
+	values, found = params[name]
+	if !found {
+		return
+	}
+	delete(params, name)
+
+	if len(values) > 1 {
+		err = fmt.Errorf("URL parameter '%s' given more than once", name)
+		return
+	}
+	value = values[0]
+
+	return
+}
+
+// Copies a string parameter into dst.
+func popStringParam(params url.Values, name string, dst *string) (err error) {
+	var value string
+	var found bool
+
+	value, found, err = popParam(params, name)
+	if err != nil || !found {
+		return
+	}
+	*dst = value
+
+	return
+}
+
+// Parses a boolean parameter into dst. A parameter without value
+// (e.g. ?rs485) is true.
+func popBoolParam(params url.Values, name string, dst *bool) (err error) {
+	var value string
+	var found bool
+
+	value, found, err = popParam(params, name)
+	if err != nil || !found {
+		return
+	}
+
+	if value == "" {
+		*dst = true
+		return
+	}
+
+	*dst, err = strconv.ParseBool(value)
+	if err != nil {
+		err = fmt.Errorf("invalid value '%s' for URL parameter '%s', expected 0 or 1",
+			value, name)
+	}
+
+	return
+}
+
+// Parses an unsigned integer parameter within [min, max] into dst.
+func popUintParam(params url.Values, name string, min uint64, max uint64, dst *uint) (err error) {
+	var value string
+	var found bool
+	var n uint64
+
+	value, found, err = popParam(params, name)
+	if err != nil || !found {
+		return
+	}
+
+	n, err = strconv.ParseUint(value, 10, 32)
+	if err != nil || n < min || n > max {
+		err = fmt.Errorf("invalid value '%s' for URL parameter '%s', expected %v to %v",
+			value, name, min, max)
+		return
+	}
+	*dst = uint(n)
+
+	return
+}
+
+// Parses a duration parameter into dst, either as a Go duration (e.g. 1500us)
+// or as a number of milliseconds.
+func popDurationParam(params url.Values, name string, dst *time.Duration) (err error) {
+	var value string
+	var found bool
+	var ms uint64
+
+	value, found, err = popParam(params, name)
+	if err != nil || !found {
+		return
+	}
+
+	ms, err = strconv.ParseUint(value, 10, 32)
+	if err == nil {
+		*dst = time.Duration(ms) * time.Millisecond
+		return
+	}
+
+	*dst, err = time.ParseDuration(value)
+	if err != nil || *dst < 0 {
+		err = fmt.Errorf("invalid value '%s' for URL parameter '%s', expected a duration",
+			value, name)
+	}
+
+	return
+}
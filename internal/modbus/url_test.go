@@ -0,0 +1,245 @@
+package modbus
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestURLParams(t *testing.T) {
+	var err error
+	var client *ModbusClient
+	var server *ModbusServer
+	var caFile string
+
+	client, err = NewClient(&ClientConfiguration{
+		URL:   "rtu:///dev/ttyUSB0?baud=9600&parity=E&timeout=500ms&reconnect=1&reconnectmax=10s",
+		Speed: 19200,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() should have succeeded, got: %v", err)
+	}
+	if client.conf.URL != "/dev/ttyUSB0" {
+		t.Errorf("expected /dev/ttyUSB0, got: %v", client.conf.URL)
+	}
+	// parameters take precedence over fields, defaults still apply
+	if client.conf.Speed != 9600 || client.conf.Parity != PARITY_EVEN ||
+		client.conf.StopBits != 1 || client.conf.DataBits != 8 ||
+		client.conf.Timeout != 500*time.Millisecond || !client.conf.AutoReconnect ||
+		client.conf.ReconnectMinDelay != 500*time.Millisecond ||
+		client.conf.ReconnectMaxDelay != 10*time.Second {
+		t.Errorf("unexpected client configuration: %+v", client.conf)
+	}
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "ascii://COM3?databits=8&parity=none&stop=1&timeout=2000",
+	})
+	if err != nil {
+		t.Fatalf("NewClient() should have succeeded, got: %v", err)
+	}
+	if client.conf.URL != "COM3" || client.conf.DataBits != 8 ||
+		client.conf.Parity != PARITY_NONE || client.conf.StopBits != 1 ||
+		client.conf.Timeout != 2*time.Second {
+		t.Errorf("unexpected client configuration: %+v", client.conf)
+	}
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "tcp://localhost:502?window=4",
+	})
+	if err != nil {
+		t.Fatalf("NewClient() should have succeeded, got: %v", err)
+	}
+	if client.conf.URL != "localhost:502" || client.conf.TransactionWindow != 4 {
+		t.Errorf("unexpected client configuration: %+v", client.conf)
+	}
+
+	// CA certificates loaded from a file
+	caFile = filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(caFile, []byte(validCerts), 0600)
+	if err != nil {
+		t.Fatalf("failed to write CA file: %v", err)
+	}
+	client, err = NewClient(&ClientConfiguration{
+		URL:           "tcp+tls://localhost:802?ca=" + caFile,
+		TLSClientCert: &tls.Certificate{},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() should have succeeded, got: %v", err)
+	}
+	if client.conf.TLSRootCAs == nil {
+		t.Errorf("expected CA certificates to be loaded")
+	}
+
+	for _, url := range []string{
+		// malformed or out of range values
+		"rtu:///dev/ttyUSB0?baud=fast",
+		"rtu:///dev/ttyUSB0?baud=0",
+		"rtu:///dev/ttyUSB0?parity=X",
+		"rtu:///dev/ttyUSB0?stop=3",
+		"rtu:///dev/ttyUSB0?databits=9",
+		"rtu:///dev/ttyUSB0?timeout=-1s",
+		"rtu:///dev/ttyUSB0?reconnect=maybe",
+		"tcp://localhost:502?window=0",
+		"rtu:///dev/ttyUSB0?baud=%zz",
+		// parameters not applying to the client type
+		"tcp://localhost:502?baud=9600",
+		"rtuovertcp://localhost:502?parity=E",
+		"rtu:///dev/ttyUSB0?window=2",
+		"tcp://localhost:502?ca=ca.pem",
+		// parameters of servers
+		"rtu:///dev/ttyUSB0?unitids=1",
+		// missing or unreadable TLS files
+		"tcp+tls://localhost:802?cert=client.pem",
+		"tcp+tls://localhost:802?cert=missing.pem&key=missing.key&ca=" + caFile,
+		"tcp+tls://localhost:802?ca=missing.pem",
+	} {
+		_, err = NewClient(&ClientConfiguration{
+			URL:           url,
+			TLSClientCert: &tls.Certificate{},
+		})
+		if !errors.Is(err, ErrConfigurationError) {
+			t.Errorf("%s: expected ErrConfigurationError, got: %v", url, err)
+		}
+	}
+
+	// errors should tell what is wrong with the URL
+	_, err = NewClient(&ClientConfiguration{
+		URL: "rtu:///dev/ttyUSB0?baud=fast",
+	})
+	if err == nil || err.Error() !=
+		"configuration error: invalid value 'fast' for URL parameter 'baud', expected 1 to 4000000" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL: "rtu:///dev/ttyUSB0?baud=9600&parity=O&unitids=1,%202,247",
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewServer() should have succeeded, got: %v", err)
+	}
+	if server.conf.URL != "/dev/ttyUSB0" || server.conf.Speed != 9600 ||
+		server.conf.Parity != PARITY_ODD || server.conf.StopBits != 1 ||
+		len(server.conf.UnitIds) != 3 || server.conf.UnitIds[1] != 2 {
+		t.Errorf("unexpected server configuration: %+v", server.conf)
+	}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL: "tcp://[::]:502?maxclients=2&timeout=30s",
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewServer() should have succeeded, got: %v", err)
+	}
+	if server.conf.URL != "[::]:502" || server.conf.MaxClients != 2 ||
+		server.conf.Timeout != 30*time.Second {
+		t.Errorf("unexpected server configuration: %+v", server.conf)
+	}
+
+	for _, url := range []string{
+		"rtu:///dev/ttyUSB0?unitids=0",
+		"rtu:///dev/ttyUSB0?unitids=1,x",
+		"rtu:///dev/ttyUSB0?unitids=1&maxclients=2",
+		"tcp://[::]:502?unitids=1",
+		"tcp://[::]:502?window=2",
+	} {
+		_, err = NewServer(&ServerConfiguration{URL: url}, nil)
+		if !errors.Is(err, ErrConfigurationError) {
+			t.Errorf("%s: expected ErrConfigurationError, got: %v", url, err)
+		}
+	}
+
+	return
+}
+
+func TestRS485URLParams(t *testing.T) {
+	var err error
+	var client *ModbusClient
+	var server *ModbusServer
+
+	client, err = NewClient(&ClientConfiguration{
+		URL: "rtu:///dev/ttyUSB0?rs485=1&rtsdelay=2&rtsdelayafter=1ms&rxduringtx",
+	})
+	if err != nil {
+		t.Fatalf("NewClient() should have succeeded, got: %v", err)
+	}
+	if client.conf.URL != "/dev/ttyUSB0" {
+		t.Errorf("expected /dev/ttyUSB0, got: %v", client.conf.URL)
+	}
+	if client.conf.RS485 != (RS485Configuration{
+		Enabled:            true,
+		DelayRtsBeforeSend: 2 * time.Millisecond,
+		DelayRtsAfterSend:  1 * time.Millisecond,
+		RtsHighDuringSend:  true,
+		RxDuringTx:         true,
+	}) {
+		t.Errorf("unexpected RS485 configuration: %+v", client.conf.RS485)
+	}
+
+	// inverted RTS polarity
+	client, err = NewClient(&ClientConfiguration{
+		URL: "ascii:///dev/ttyUSB0?rs485=true&rtsaftersend=1",
+	})
+	if err != nil {
+		t.Fatalf("NewClient() should have succeeded, got: %v", err)
+	}
+	if client.conf.RS485.RtsHighDuringSend || !client.conf.RS485.RtsHighAfterSend {
+		t.Errorf("unexpected RS485 configuration: %+v", client.conf.RS485)
+	}
+
+	// settings from the configuration object are checked as well
+	_, err = NewClient(&ClientConfiguration{
+		URL:   "rtu:///dev/ttyUSB0",
+		RS485: RS485Configuration{Enabled: true, DelayRtsBeforeSend: 500 * time.Microsecond},
+	})
+	if !errors.Is(err, ErrConfigurationError) {
+		t.Errorf("expected ErrConfigurationError, got: %v", err)
+	}
+
+	for _, url := range []string{
+		// malformed values
+		"rtu:///dev/ttyUSB0?rs485=yes",
+		"rtu:///dev/ttyUSB0?rs485=1&rtsdelay=soon",
+		// out of range delays
+		"rtu:///dev/ttyUSB0?rs485=1&rtsdelay=200ms",
+		"rtu:///dev/ttyUSB0?rs485=1&rtsdelayafter=-1ms",
+		// RTS can't be high all the time
+		"rtu:///dev/ttyUSB0?rs485=1&rtsonsend=1&rtsaftersend=1",
+		// settings without RS485 mode
+		"rtu:///dev/ttyUSB0?rtsdelay=1",
+		// repeated and unknown parameters
+		"rtu:///dev/ttyUSB0?rs485=1&rs485=0",
+		"rtu:///dev/ttyUSB0?rs485=1&foo=bar",
+		// RS485 on network transports
+		"tcp://localhost:502?rs485=1",
+		"rtuovertcp://localhost:502?rs485=1",
+	} {
+		_, err = NewClient(&ClientConfiguration{URL: url})
+		if !errors.Is(err, ErrConfigurationError) {
+			t.Errorf("%s: expected ErrConfigurationError, got: %v", url, err)
+		}
+	}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:     "rtu:///dev/ttyUSB0?rs485=1&rtsdelay=5ms",
+		UnitIds: []uint8{1},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewServer() should have succeeded, got: %v", err)
+	}
+	if server.conf.URL != "/dev/ttyUSB0" || !server.conf.RS485.Enabled ||
+		server.conf.RS485.DelayRtsBeforeSend != 5*time.Millisecond {
+		t.Errorf("unexpected server configuration: %+v", server.conf)
+	}
+
+	_, err = NewServer(&ServerConfiguration{
+		URL:   "tcp://localhost:502",
+		RS485: RS485Configuration{Enabled: true},
+	}, nil)
+	if !errors.Is(err, ErrConfigurationError) {
+		t.Errorf("expected ErrConfigurationError, got: %v", err)
+	}
+
+	return
+}
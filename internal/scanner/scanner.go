@@ -0,0 +1,440 @@
+// Package scanner sweeps a modbus bus for devices and tries to identify them.
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"enman/internal/energysource"
+	"enman/internal/modbus"
+	"enman/internal/sunspec"
+)
+
+const (
+	// identification methods
+	METHOD_CARLO_GAVAZZI string = "carlo gavazzi"
+	METHOD_DEVICE_ID     string = "device id"
+	METHOD_SUNSPEC       string = "sunspec"
+	METHOD_VICTRON       string = "victron"
+)
+
+// Carlo Gavazzi meters publish their model code in this input register.
+const carloGavazziModelRegister uint16 = 0x000b
+
+// Victron GX registers used to recognize the services exposed by a unit id.
+var victronProbes = []struct {
+	service  string
+	addr     uint16
+	quantity uint16
+}{
+	// product id of the grid meter
+	{service: "com.victronenergy.grid", addr: 2609, quantity: 1},
+	// serial number of the GX device, exposed on unit id 100
+	{service: "com.victronenergy.system", addr: 800, quantity: 6},
+}
+
+// Scanner configuration object.
+type Configuration struct {
+	// URL sets the bus to scan, in the format accepted by modbus.NewClient()
+	// e.g. tcp://gx:502 or rtu:///dev/ttyUSB0
+	URL string
+	// FirstUnitId and LastUnitId set the (inclusive) range of unit ids to
+	// probe (defaults to 1-247)
+	FirstUnitId uint8
+	LastUnitId  uint8
+	// Timeout sets the time to wait for each response (defaults to 500ms)
+	Timeout time.Duration
+	// Speeds lists the serial link speeds to try (rtu and ascii only).
+	// If empty, the bus is only scanned at the speed set by the baud URL
+	// parameter or else at the modbus client default speed.
+	Speeds []uint
+	// Parities lists the parity modes to try (rtu and ascii only, see
+	// modbus.PARITY_* constants). If empty, only the mode set by the parity
+	// URL parameter or else PARITY_NONE is tried.
+	Parities []uint
+	// Logger provides a custom sink for modbus client log messages.
+	// If nil, messages will be written to stdout.
+	Logger *log.Logger
+}
+
+// Identification object, describing what a probe found out about a device.
+type Identification struct {
+	// Method is the identification method (see METHOD_* constants).
+	Method string
+	// Description is a human readable description of the device.
+	Description string
+}
+
+// Scan result object, describing a device which answered the scanner.
+type Result struct {
+	// Speed and Parity are the serial link settings the device answered
+	// at (rtu and ascii only, Speed is 0 on other links).
+	Speed  uint
+	Parity uint
+	// UnitId is the unit id of the device.
+	UnitId uint8
+	// ResponseTime is the round-trip time of the first request made to
+	// the device.
+	ResponseTime time.Duration
+	// Identifications holds the findings of all successful probes, if any.
+	Identifications []Identification
+}
+
+// Scan probes every unit id of the configured range (for every speed and
+// parity combination on serial links) and reports devices which answered
+// at least one request, modbus exceptions included.
+// If found is not nil, it is called as soon as a device is identified.
+func Scan(ctx context.Context, conf *Configuration, found func(*Result)) (results []*Result, err error) {
+	var serialLink bool
+	var speeds []uint
+	var parities []uint
+	var urlSpeeds []uint
+	var urlParities []uint
+	var res []*Result
+
+	if conf.FirstUnitId == 0 && conf.LastUnitId == 0 {
+		conf.FirstUnitId = 1
+		conf.LastUnitId = 247
+	}
+	if conf.FirstUnitId > conf.LastUnitId {
+		err = fmt.Errorf("invalid unit id range %v-%v", conf.FirstUnitId, conf.LastUnitId)
+		return
+	}
+
+	if conf.Timeout == 0 {
+		conf.Timeout = 500 * time.Millisecond
+	}
+
+	serialLink, err = isSerialLink(conf.URL)
+	if err != nil {
+		return
+	}
+
+	speeds = conf.Speeds
+	parities = conf.Parities
+	if !serialLink && (len(speeds) > 0 || len(parities) > 0) {
+		err = fmt.Errorf("speeds and parities can only be swept on serial links")
+		return
+	}
+
+	// URL parameters take precedence over the settings passed to the client:
+	// they can't be swept, but results should still report them
+	urlSpeeds, urlParities = urlSerialSettings(conf.URL)
+	if len(urlSpeeds) > 0 && len(speeds) > 0 {
+		err = fmt.Errorf("speeds can't be swept on a url with a baud parameter")
+		return
+	}
+	if len(urlParities) > 0 && len(parities) > 0 {
+		err = fmt.Errorf("parities can't be swept on a url with a parity parameter")
+		return
+	}
+	if len(urlSpeeds) > 0 {
+		speeds = urlSpeeds
+	}
+	if len(urlParities) > 0 {
+		parities = urlParities
+	}
+	switch {
+	case len(speeds) > 0:
+	case serialLink:
+		// the modbus.NewClient() default
+		speeds = []uint{19200}
+	default:
+		speeds = []uint{0}
+	}
+	if len(parities) == 0 {
+		parities = []uint{modbus.PARITY_NONE}
+	}
+
+	for _, speed := range speeds {
+		for _, parity := range parities {
+			res, err = scanBus(ctx, conf, speed, parity, found)
+			results = append(results, res...)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+/*** unexported methods ***/
+
+// Returns true if url points to a serial device.
+func isSerialLink(rawUrl string) (serialLink bool, err error) {
+	var u *url.URL
+
+	u, err = url.Parse(rawUrl)
+	if err != nil {
+		err = fmt.Errorf("invalid url '%v': %w", rawUrl, err)
+		return
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "rtu", "ascii":
+		serialLink = true
+	}
+
+	return
+}
+
+// Returns the serial link speed and parity set by the baud and parity
+// parameters of url, if any. Invalid values are left for modbus.NewClient()
+// to report.
+func urlSerialSettings(rawUrl string) (speeds []uint, parities []uint) {
+	var u *url.URL
+	var speed uint64
+	var err error
+
+	u, err = url.Parse(rawUrl)
+	if err != nil {
+		return
+	}
+
+	speed, err = strconv.ParseUint(u.Query().Get("baud"), 10, 32)
+	if err == nil {
+		speeds = []uint{uint(speed)}
+	}
+
+	switch strings.ToLower(u.Query().Get("parity")) {
+	case "n", "none":
+		parities = []uint{modbus.PARITY_NONE}
+	case "e", "even":
+		parities = []uint{modbus.PARITY_EVEN}
+	case "o", "odd":
+		parities = []uint{modbus.PARITY_ODD}
+	}
+
+	return
+}
+
+// Probes all unit ids of the configured range with the given serial link settings.
+func scanBus(ctx context.Context, conf *Configuration, speed uint, parity uint,
+	found func(*Result)) (results []*Result, err error) {
+	var client *modbus.ModbusClient
+	var res *Result
+
+	client, err = modbus.NewClient(&modbus.ClientConfiguration{
+		URL:     conf.URL,
+		Speed:   speed,
+		Parity:  parity,
+		Timeout: conf.Timeout,
+		Logger:  conf.Logger,
+	})
+	if err != nil {
+		return
+	}
+
+	err = client.Open()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	for unitId := int(conf.FirstUnitId); unitId <= int(conf.LastUnitId); unitId++ {
+		res, err = probe(ctx, client.Unit(uint8(unitId)))
+		if err != nil {
+			return
+		}
+		if res == nil {
+			continue
+		}
+
+		res.Speed, res.Parity = speed, parity
+		results = append(results, res)
+		if found != nil {
+			found(res)
+		}
+	}
+
+	return
+}
+
+// Probes a single unit id, returning a nil result if the device did not answer.
+// Only context errors are returned, as a failing probe is part of scanning.
+func probe(ctx context.Context, unit *modbus.ModbusUnit) (res *Result, err error) {
+	var ts time.Time
+	var value uint16
+	var model string
+	var known bool
+	var perr error
+
+	// the first request tells whether the device is there at all
+	ts = time.Now()
+	value, perr = unit.ReadRegister(ctx, carloGavazziModelRegister, modbus.INPUT_REGISTER)
+	if ctx.Err() != nil {
+		err = ctx.Err()
+		return
+	}
+	if !answered(perr) {
+		return
+	}
+
+	res = &Result{
+		UnitId:       unit.UnitId(),
+		ResponseTime: time.Since(ts),
+	}
+
+	if perr == nil {
+		model, known = energysource.CarloGavazziMeterType(value)
+		if known {
+			res.identify(METHOD_CARLO_GAVAZZI, fmt.Sprintf("Carlo Gavazzi %v (model code %v)", model, value))
+		}
+	}
+
+	for _, probe := range []func(context.Context, *modbus.ModbusUnit) []Identification{
+		probeDeviceId, probeSunSpec, probeVictron,
+	} {
+		res.Identifications = append(res.Identifications, probe(ctx, unit)...)
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			res = nil
+			return
+		}
+	}
+
+	return
+}
+
+// Identifies the device through the read device identification (0x2b) function code.
+func probeDeviceId(ctx context.Context, unit *modbus.ModbusUnit) (ids []Identification) {
+	var di *modbus.DeviceIdentification
+	var err error
+
+	di, err = unit.ReadDeviceIdentification(ctx, modbus.DEVICE_ID_BASIC)
+	if err != nil {
+		return
+	}
+
+	ids = append(ids, Identification{
+		Method: METHOD_DEVICE_ID,
+		Description: join(di.Objects[modbus.DEVICE_ID_VENDOR_NAME],
+			di.Objects[modbus.DEVICE_ID_PRODUCT_CODE],
+			di.Objects[modbus.DEVICE_ID_MAJOR_MINOR_REVISION]),
+	})
+
+	return
+}
+
+// Identifies SunSpec devices by their "SunS" marker and common model.
+func probeSunSpec(ctx context.Context, unit *modbus.ModbusUnit) (ids []Identification) {
+	var dev *sunspec.Device
+	var common *sunspec.Common
+	var models []string
+	var err error
+
+	dev, err = sunspec.Discover(ctx, unit)
+	if err != nil {
+		return
+	}
+
+	for _, hdr := range dev.Models {
+		models = append(models, fmt.Sprintf("%v", hdr.Id))
+	}
+
+	common, err = dev.ReadCommon(ctx)
+	if err != nil {
+		common = &sunspec.Common{}
+	}
+
+	ids = append(ids, Identification{
+		Method: METHOD_SUNSPEC,
+		Description: fmt.Sprintf("%v (base address %v, models %v)",
+			join(common.Manufacturer, common.Model, common.Version),
+			dev.BaseAddr, strings.Join(models, ", ")),
+	})
+
+	return
+}
+
+// Identifies the services exposed by Victron GX devices.
+func probeVictron(ctx context.Context, unit *modbus.ModbusUnit) (ids []Identification) {
+	var regs []uint16
+	var description string
+	var err error
+
+	for _, vp := range victronProbes {
+		regs, err = unit.ReadRegisters(ctx, vp.addr, vp.quantity, modbus.INPUT_REGISTER)
+		if err != nil {
+			continue
+		}
+
+		if vp.quantity == 1 {
+			if regs[0] == 0 {
+				continue
+			}
+			description = fmt.Sprintf("%v (product id 0x%04x)", vp.service, regs[0])
+		} else {
+			description = fmt.Sprintf("%v (serial %v)", vp.service, registersToString(regs))
+		}
+
+		ids = append(ids, Identification{
+			Method:      METHOD_VICTRON,
+			Description: description,
+		})
+	}
+
+	return
+}
+
+// Returns true if err shows that a device answered the request.
+// Gateway exceptions are sent by gateways on behalf of devices which are
+// not there.
+func answered(err error) (ok bool) {
+	switch err {
+	case nil,
+		modbus.ErrIllegalFunction,
+		modbus.ErrIllegalDataAddress,
+		modbus.ErrIllegalDataValue,
+		modbus.ErrServerDeviceFailure,
+		modbus.ErrAcknowledge,
+		modbus.ErrServerDeviceBusy,
+		modbus.ErrMemoryParityError:
+		ok = true
+	}
+
+	return
+}
+
+// Adds an identification to the result.
+func (r *Result) identify(method string, description string) {
+	r.Identifications = append(r.Identifications, Identification{
+		Method:      method,
+		Description: description,
+	})
+
+	return
+}
+
+// Joins the non-empty strings of parts with a space.
+func join(parts ...string) (s string) {
+	var nonEmpty []string
+
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	s = strings.Join(nonEmpty, " ")
+
+	return
+}
+
+// Decodes big endian, NUL padded string registers.
+func registersToString(regs []uint16) (s string) {
+	var buf []byte
+
+	for _, reg := range regs {
+		buf = append(buf, byte(reg>>8), byte(reg))
+	}
+	s = strings.TrimRight(string(buf), "\x00 ")
+
+	return
+}
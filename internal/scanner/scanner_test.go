@@ -0,0 +1,190 @@
+package scanner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"enman/internal/modbus"
+)
+
+// Serves a Carlo Gavazzi EM24 on unit id 2 and a device publishing its
+// identification objects on unit id 5. Other unit ids get a gateway path
+// unavailable exception, as a TCP gateway would send.
+type scanTestHandler struct{}
+
+func (th *scanTestHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	err = th.route(req.UnitId)
+	if err == nil {
+		err = modbus.ErrIllegalFunction
+	}
+	return
+}
+
+func (th *scanTestHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	err = th.route(req.UnitId)
+	if err == nil {
+		err = modbus.ErrIllegalFunction
+	}
+	return
+}
+
+func (th *scanTestHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	err = th.route(req.UnitId)
+	if err == nil {
+		err = modbus.ErrIllegalDataAddress
+	}
+	return
+}
+
+func (th *scanTestHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	err = th.route(req.UnitId)
+	if err != nil {
+		return
+	}
+
+	if req.UnitId == 2 && req.Addr == 0x000b && req.Quantity == 1 {
+		res = []uint16{71}
+		return
+	}
+	err = modbus.ErrIllegalDataAddress
+
+	return
+}
+
+func (th *scanTestHandler) HandleDeviceIdentification(req *modbus.DeviceIdentificationRequest) (res map[uint8]string, err error) {
+	err = th.route(req.UnitId)
+	if err != nil {
+		return
+	}
+
+	if req.UnitId != 5 {
+		err = modbus.ErrIllegalFunction
+		return
+	}
+	res = map[uint8]string{
+		modbus.DEVICE_ID_VENDOR_NAME:          "ACME",
+		modbus.DEVICE_ID_PRODUCT_CODE:         "PM-1",
+		modbus.DEVICE_ID_MAJOR_MINOR_REVISION: "1.2",
+	}
+
+	return
+}
+
+func (th *scanTestHandler) route(unitId uint8) (err error) {
+	if unitId != 2 && unitId != 5 {
+		err = modbus.ErrGWPathUnavailable
+	}
+
+	return
+}
+
+func TestScan(t *testing.T) {
+	var err error
+	var server *modbus.ModbusServer
+	var results []*Result
+	var found int
+
+	server, err = modbus.NewServer(&modbus.ServerConfiguration{
+		URL: "tcp://localhost:5522",
+	}, &scanTestHandler{})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	// serial link settings can't be swept on tcp
+	_, err = Scan(context.Background(), &Configuration{
+		URL:    "tcp://localhost:5522",
+		Speeds: []uint{9600},
+	}, nil)
+	if err == nil {
+		t.Errorf("Scan() should have failed")
+	}
+
+	results, err = Scan(context.Background(), &Configuration{
+		URL:         "tcp://localhost:5522",
+		FirstUnitId: 1,
+		LastUnitId:  10,
+		Timeout:     time.Second,
+	}, func(*Result) { found++ })
+	if err != nil {
+		t.Errorf("Scan() should have succeeded, got: %v", err)
+		return
+	}
+	if len(results) != 2 || found != 2 {
+		t.Errorf("expected 2 results, got: %v (%v reported)", len(results), found)
+		return
+	}
+
+	if results[0].UnitId != 2 || results[0].Speed != 0 ||
+		len(results[0].Identifications) != 1 ||
+		results[0].Identifications[0].Method != METHOD_CARLO_GAVAZZI ||
+		results[0].Identifications[0].Description != "Carlo Gavazzi EM24-DIN AV (model code 71)" {
+		t.Errorf("unexpected result for unit id 2: %+v", results[0])
+	}
+	if results[0].ResponseTime <= 0 || results[0].ResponseTime > time.Second {
+		t.Errorf("unexpected response time %v", results[0].ResponseTime)
+	}
+
+	if results[1].UnitId != 5 || len(results[1].Identifications) != 1 ||
+		results[1].Identifications[0].Method != METHOD_DEVICE_ID ||
+		results[1].Identifications[0].Description != "ACME PM-1 1.2" {
+		t.Errorf("unexpected result for unit id 5: %+v", results[1])
+	}
+
+	// a cancelled scan should stop right away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Scan(ctx, &Configuration{
+		URL: "tcp://localhost:5522",
+	}, nil)
+	if err != context.Canceled {
+		t.Errorf("Scan() should have returned context.Canceled, got: %v", err)
+	}
+
+	return
+}
+
+func TestScanURLSerialSettings(t *testing.T) {
+	var err error
+	var speeds []uint
+	var parities []uint
+
+	// URL parameters take precedence over the swept settings
+	_, err = Scan(context.Background(), &Configuration{
+		URL:    "rtu:///dev/ttyUSB0?baud=9600&parity=N",
+		Speeds: []uint{9600, 19200},
+	}, nil)
+	if err == nil {
+		t.Errorf("Scan() should have failed")
+	}
+
+	_, err = Scan(context.Background(), &Configuration{
+		URL:      "rtu:///dev/ttyUSB0?baud=9600&parity=N",
+		Parities: []uint{modbus.PARITY_NONE, modbus.PARITY_EVEN},
+	}, nil)
+	if err == nil {
+		t.Errorf("Scan() should have failed")
+	}
+
+	// results should be labelled with the settings of the URL
+	speeds, parities = urlSerialSettings("rtu:///dev/ttyUSB0?baud=9600&parity=even")
+	if len(speeds) != 1 || speeds[0] != 9600 ||
+		len(parities) != 1 || parities[0] != modbus.PARITY_EVEN {
+		t.Errorf("unexpected settings: %v, %v", speeds, parities)
+	}
+
+	speeds, parities = urlSerialSettings("rtu:///dev/ttyUSB0")
+	if len(speeds) != 0 || len(parities) != 0 {
+		t.Errorf("unexpected settings: %v, %v", speeds, parities)
+	}
+
+	return
+}
@@ -0,0 +1,138 @@
+package simulator
+
+import (
+	"enman/internal/modbus"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	em24ModelCode  = uint16(71)
+	em340ModelCode = uint16(340)
+	et112ModelCode = uint16(120)
+
+	carloGavazziModelRegister         = 0x000B
+	carloGavazziFrontSelectorRegister = 0x0304
+	carloGavazziApplicationRegister   = 0x1101
+	carloGavazziSerialRegister        = 0x5000
+	em24ApplicationH                  = uint16(7)
+)
+
+// CarloGavazziMeter A simulated Carlo Gavazzi energy meter. The same values are served through the holding and
+// input registers, like the real meters do.
+type CarloGavazziMeter struct {
+	modelCode  uint16
+	threePhase bool
+	profile    Profile
+	// Voltage is the line to neutral voltage (V) of all lines, defaults to 230V.
+	Voltage float64
+	// Serial is the serial number of the meter.
+	Serial string
+	lock   sync.Mutex
+	// Application and front selector of EM24 meters, the application is writable.
+	application   uint16
+	frontSelector uint16
+}
+
+// NewEM24 Simulates a three phase EM24-DIN AV meter, configured for application 'H'.
+func NewEM24(profile Profile) *CarloGavazziMeter {
+	return newCarloGavazziMeter(em24ModelCode, true, profile)
+}
+
+// NewEM340 Simulates a three phase EM340-DIN AV2 3 X S1 X meter.
+func NewEM340(profile Profile) *CarloGavazziMeter {
+	return newCarloGavazziMeter(em340ModelCode, true, profile)
+}
+
+// NewET112 Simulates a single phase ET112-DIN AV0 1 x S1 X meter, of which only the power of line 1 is used.
+func NewET112(profile Profile) *CarloGavazziMeter {
+	return newCarloGavazziMeter(et112ModelCode, false, profile)
+}
+
+func newCarloGavazziMeter(modelCode uint16, threePhase bool, profile Profile) *CarloGavazziMeter {
+	return &CarloGavazziMeter{
+		modelCode:   modelCode,
+		threePhase:  threePhase,
+		profile:     profile,
+		Voltage:     230,
+		Serial:      "SIM0000000001",
+		application: em24ApplicationH,
+	}
+}
+
+// SetApplication Sets the application of EM24 meters, e.g. to check that pollers configure application 'H'.
+func (m *CarloGavazziMeter) SetApplication(application uint16) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.application = application
+}
+
+// Application Returns the application of EM24 meters.
+func (m *CarloGavazziMeter) Application() uint16 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.application
+}
+
+// SetFrontSelector Sets the front selector position of EM24 meters, 3 locks the application.
+func (m *CarloGavazziMeter) SetFrontSelector(frontSelector uint16) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.frontSelector = frontSelector
+}
+
+// ReadRegisters Returns the registers of the meter at the given time.
+func (m *CarloGavazziMeter) ReadRegisters(at time.Time, _ modbus.RegType, addr uint16, quantity uint16) ([]uint16, error) {
+	return m.image(at).read(addr, quantity)
+}
+
+// WriteRegisters Only the application of EM24 meters can be written, and only when the front selector allows it.
+func (m *CarloGavazziMeter) WriteRegisters(addr uint16, values []uint16) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.modelCode != em24ModelCode || addr != carloGavazziApplicationRegister || len(values) != 1 {
+		return modbus.ErrIllegalDataAddress
+	}
+	if m.frontSelector == 3 {
+		return modbus.ErrIllegalDataValue
+	}
+	m.application = values[0]
+	return nil
+}
+
+func (m *CarloGavazziMeter) image(at time.Time) registerImage {
+	image := registerImage{}
+	if m.threePhase {
+		// Instantaneous values and energy counters.
+		image.fill(0x0000, 0x0050)
+		var total float64
+		for line := uint8(0); line < 3; line++ {
+			power := m.profile.Power(at, line)
+			total += power
+			offset := 2 * uint16(line)
+			image.setInt32LowFirst(0x0000+offset, m.Voltage*10)
+			image.setInt32LowFirst(0x000C+offset, math.Abs(power)/m.Voltage*1000)
+			image.setInt32LowFirst(0x0012+offset, power*10)
+		}
+		image.setInt32LowFirst(0x0028, total*10)
+	} else {
+		image.fill(0x0000, 0x0022)
+		power := m.profile.Power(at, 0)
+		image.setInt32LowFirst(0x0000, m.Voltage*10)
+		image.setInt32LowFirst(0x0002, math.Abs(power)/m.Voltage*1000)
+		image.setInt32LowFirst(0x0004, power*10)
+	}
+	image[carloGavazziModelRegister] = m.modelCode
+	// Identification registers: versions, front selector, measuring system and serial number.
+	image.fill(0x0302, 3)
+	image.fill(0x1002, 1)
+	image.setString(carloGavazziSerialRegister, 7, m.Serial)
+	if m.modelCode == em24ModelCode {
+		m.lock.Lock()
+		image[carloGavazziFrontSelectorRegister] = m.frontSelector
+		image[carloGavazziApplicationRegister] = m.application
+		m.lock.Unlock()
+	}
+	return image
+}
@@ -0,0 +1,231 @@
+package simulator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Profile Provides the power of a simulated device over time.
+type Profile interface {
+	// Power Returns the power (W) of the given line (0 based) at the given time.
+	Power(at time.Time, line uint8) float64
+}
+
+// ConstantProfile Always returns the same power, per line.
+type ConstantProfile [3]float64
+
+// Power Returns the constant power of the line.
+func (c ConstantProfile) Power(_ time.Time, line uint8) float64 {
+	if int(line) >= len(c) {
+		return 0
+	}
+	return c[line]
+}
+
+// ProfileStep Is a point of a ScriptedProfile.
+type ProfileStep struct {
+	// At is the offset of the step from the start of the script.
+	At time.Duration
+	// Power is the power (W) per line at the step.
+	Power [3]float64
+}
+
+// ScriptedProfile Follows a script of steps, interpolating linearly between them. The script starts when the power
+// is first asked for.
+type ScriptedProfile struct {
+	// Steps of the script, ordered by offset.
+	Steps []ProfileStep
+	// Loop restarts the script after its last step, the power of the last step is kept otherwise.
+	Loop  bool
+	lock  sync.Mutex
+	start time.Time
+}
+
+// Power Returns the power of the line at the given time of the script.
+func (s *ScriptedProfile) Power(at time.Time, line uint8) float64 {
+	if len(s.Steps) == 0 || line >= 3 {
+		return 0
+	}
+	s.lock.Lock()
+	if s.start.IsZero() {
+		s.start = at
+	}
+	offset := at.Sub(s.start)
+	s.lock.Unlock()
+	last := s.Steps[len(s.Steps)-1]
+	if s.Loop && last.At > 0 {
+		offset %= last.At
+	}
+	if offset <= s.Steps[0].At {
+		return s.Steps[0].Power[line]
+	}
+	for ix := 1; ix < len(s.Steps); ix++ {
+		from, to := s.Steps[ix-1], s.Steps[ix]
+		if offset <= to.At {
+			ratio := float64(offset-from.At) / float64(to.At-from.At)
+			return from.Power[line] + ratio*(to.Power[line]-from.Power[line])
+		}
+	}
+	return last.Power[line]
+}
+
+// RandomProfile Walks randomly between a minimum and a maximum power, independently per line.
+type RandomProfile struct {
+	// Min and Max bound the power (W).
+	Min float64
+	Max float64
+	// MaxStep is the maximum change of the power per Interval, defaults to 5% of the range.
+	MaxStep float64
+	// Interval is the time between changes of the power, defaults to 1 second.
+	Interval time.Duration
+	// Seed of the random walk, making it reproducible.
+	Seed  int64
+	lock  sync.Mutex
+	rand  *rand.Rand
+	last  time.Time
+	power [3]float64
+}
+
+// Power Returns the power of the line, taking as many steps as intervals passed since the last call.
+func (r *RandomProfile) Power(at time.Time, line uint8) float64 {
+	if line >= 3 {
+		return 0
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	interval := r.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	maxStep := r.MaxStep
+	if maxStep <= 0 {
+		maxStep = (r.Max - r.Min) / 20
+	}
+	if r.rand == nil {
+		r.rand = rand.New(rand.NewSource(r.Seed))
+		r.last = at
+		for ix := range r.power {
+			r.power[ix] = r.Min + r.rand.Float64()*(r.Max-r.Min)
+		}
+	}
+	for ; !at.Before(r.last.Add(interval)); r.last = r.last.Add(interval) {
+		for ix := range r.power {
+			r.power[ix] = math.Max(r.Min, math.Min(r.Max, r.power[ix]+(2*r.rand.Float64()-1)*maxStep))
+		}
+	}
+	return r.power[line]
+}
+
+// ParseProfile Parses a profile specification:
+//   - constant=<W>[/<W>/<W>] for a constant power, per line when three values are given,
+//   - random=<min W>..<max W>[@<seed>] for a random walk between min and max,
+//   - script=<file> for a scripted profile, see LoadScriptedProfile.
+func ParseProfile(spec string) (Profile, error) {
+	kind, value, _ := strings.Cut(spec, "=")
+	switch kind {
+	case "constant":
+		var profile ConstantProfile
+		values := strings.Split(value, "/")
+		if len(values) != 1 && len(values) != 3 {
+			return nil, fmt.Errorf("invalid constant profile %q, expected 1 or 3 values", value)
+		}
+		for ix := range profile {
+			power, err := strconv.ParseFloat(values[ix%len(values)], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid constant profile %q: %w", value, err)
+			}
+			profile[ix] = power
+		}
+		return profile, nil
+	case "random":
+		bounds, seed, hasSeed := strings.Cut(value, "@")
+		minValue, maxValue, ok := strings.Cut(bounds, "..")
+		if !ok {
+			return nil, fmt.Errorf("invalid random profile %q, expected <min>..<max>", value)
+		}
+		profile := &RandomProfile{}
+		var err error
+		profile.Min, err = strconv.ParseFloat(minValue, 64)
+		if err == nil {
+			profile.Max, err = strconv.ParseFloat(maxValue, 64)
+		}
+		if err == nil && hasSeed {
+			profile.Seed, err = strconv.ParseInt(seed, 10, 64)
+		} else if !hasSeed {
+			profile.Seed = time.Now().UnixNano()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid random profile %q: %w", value, err)
+		}
+		if profile.Min > profile.Max {
+			return nil, fmt.Errorf("invalid random profile %q, min is above max", value)
+		}
+		return profile, nil
+	case "script":
+		return LoadScriptedProfile(value)
+	}
+	return nil, fmt.Errorf("unknown profile %q, expected constant=, random= or script=", spec)
+}
+
+type scriptFile struct {
+	Loop  bool `json:"loop" yaml:"loop"`
+	Steps []struct {
+		// Offset in seconds.
+		At    float64    `json:"at" yaml:"at"`
+		Power [3]float64 `json:"power" yaml:"power"`
+	} `json:"steps" yaml:"steps"`
+}
+
+// LoadScriptedProfile Reads a scripted profile from a JSON (.json) or YAML (.yaml, .yml) file, e.g.
+//
+//	loop: true
+//	steps:
+//	  - {at: 0, power: [-500, -500, -500]}
+//	  - {at: 60, power: [2000, 1500, 1000]}
+//
+// with at the offset of a step in seconds, and power the power per line.
+func LoadScriptedProfile(path string) (*ScriptedProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	script := &scriptFile{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(script)
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(script)
+	default:
+		return nil, fmt.Errorf("%s: unknown script format, expected a .json, .yaml or .yml file", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(script.Steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps defined", path)
+	}
+	profile := &ScriptedProfile{Loop: script.Loop}
+	for ix, step := range script.Steps {
+		at := time.Duration(step.At * float64(time.Second))
+		if ix > 0 && at <= profile.Steps[ix-1].At {
+			return nil, fmt.Errorf("%s: step %d is not after the previous one", path, ix+1)
+		}
+		profile.Steps = append(profile.Steps, ProfileStep{At: at, Power: step.Power})
+	}
+	return profile, nil
+}
@@ -0,0 +1,104 @@
+package simulator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScriptedProfile_Power(t *testing.T) {
+	start := time.Now()
+	steps := []ProfileStep{
+		{At: 0, Power: [3]float64{0, 100, -100}},
+		{At: 10 * time.Second, Power: [3]float64{1000, 100, 100}},
+	}
+	tests := []struct {
+		name   string
+		loop   bool
+		offset time.Duration
+		line   uint8
+		want   float64
+	}{
+		{"first step", false, 0, 0, 0},
+		{"interpolated", false, 2500 * time.Millisecond, 0, 250},
+		{"interpolated negative", false, 5 * time.Second, 2, 0},
+		{"last step", false, 10 * time.Second, 0, 1000},
+		{"after the script", false, time.Minute, 0, 1000},
+		{"looped", true, 12500 * time.Millisecond, 0, 250},
+		{"invalid line", false, 0, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := &ScriptedProfile{Steps: steps, Loop: tt.loop}
+			// The script starts at the first call.
+			profile.Power(start, 0)
+			if got := profile.Power(start.Add(tt.offset), tt.line); got != tt.want {
+				t.Errorf("Power() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRandomProfile_Power(t *testing.T) {
+	start := time.Now()
+	profile := &RandomProfile{Min: -1000, Max: 1000, Seed: 42}
+	other := &RandomProfile{Min: -1000, Max: 1000, Seed: 42}
+	first := profile.Power(start, 0)
+	other.Power(start, 0)
+	if got := profile.Power(start.Add(500*time.Millisecond), 0); got != first {
+		t.Errorf("Power() within the interval = %v, want %v", got, first)
+	}
+	for ix := 1; ix <= 100; ix++ {
+		at := start.Add(time.Duration(ix) * time.Second)
+		got := profile.Power(at, 1)
+		if got < -1000 || got > 1000 {
+			t.Fatalf("Power() = %v, out of bounds", got)
+		}
+		// The same seed walks the same way.
+		if want := other.Power(at, 1); got != want {
+			t.Fatalf("Power() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestParseProfile(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "script.yaml")
+	err := os.WriteFile(script, []byte("loop: true\nsteps:\n  - {at: 0, power: [1, 2, 3]}\n  - {at: 60, power: [4, 5, 6]}\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		spec    string
+		wantErr bool
+		want    [3]float64
+	}{
+		{"constant", "constant=1500", false, [3]float64{1500, 1500, 1500}},
+		{"constant per line", "constant=1/-2/3.5", false, [3]float64{1, -2, 3.5}},
+		{"constant with 2 values", "constant=1/2", true, [3]float64{}},
+		{"random", "random=-10..-10@1", false, [3]float64{-10, -10, -10}},
+		{"random without range", "random=10", true, [3]float64{}},
+		{"random with min above max", "random=10..0", true, [3]float64{}},
+		{"script", "script=" + script, false, [3]float64{1, 2, 3}},
+		{"missing script", "script=" + script + ".missing", true, [3]float64{}},
+		{"unknown", "sine=10", true, [3]float64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, err := ParseProfile(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseProfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			now := time.Now()
+			for line := uint8(0); line < 3; line++ {
+				if got := profile.Power(now, line); got != tt.want[line] {
+					t.Errorf("Power(%d) = %v, want %v", line, got, tt.want[line])
+				}
+			}
+		})
+	}
+}
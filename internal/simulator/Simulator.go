@@ -0,0 +1,201 @@
+// Package simulator emulates modbus energy meters and inverters, so pollers can be run and tested without hardware.
+package simulator
+
+import (
+	"enman/internal/modbus"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Device A simulated modbus device.
+type Device interface {
+	// ReadRegisters Returns quantity registers starting at addr, as they are at the given time.
+	ReadRegisters(at time.Time, regType modbus.RegType, addr uint16, quantity uint16) ([]uint16, error)
+	// WriteRegisters Writes holding registers starting at addr.
+	WriteRegisters(addr uint16, values []uint16) error
+}
+
+// Simulator Serves simulated devices by unit id. It implements modbus.RequestHandler, so it can either be
+// passed to modbus.NewServer or be started with Start.
+type Simulator struct {
+	lock    sync.RWMutex
+	devices map[uint8]Device
+	server  *modbus.ModbusServer
+	// Clock returns the time devices are simulated at, defaults to time.Now.
+	Clock func() time.Time
+}
+
+// NewSimulator Constructs a simulator without any device.
+func NewSimulator() *Simulator {
+	return &Simulator{
+		devices: make(map[uint8]Device),
+		Clock:   time.Now,
+	}
+}
+
+// AddDevice Serves the device at the given unit id, replacing any device served there.
+func (s *Simulator) AddDevice(unitId uint8, device Device) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.devices[unitId] = device
+}
+
+// UnitIds Returns the unit ids of the simulated devices, in ascending order.
+func (s *Simulator) UnitIds() []uint8 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var unitIds []uint8
+	for unitId := range s.devices {
+		unitIds = append(unitIds, unitId)
+	}
+	sort.Slice(unitIds, func(i, j int) bool { return unitIds[i] < unitIds[j] })
+	return unitIds
+}
+
+// Start Starts serving the devices with a modbus server created from config. On serial lines the server only
+// answers to the unit ids of the devices added so far, unless config lists the unit ids itself.
+func (s *Simulator) Start(config *modbus.ServerConfiguration) error {
+	if s.server != nil {
+		return fmt.Errorf("simulator already started")
+	}
+	serverConfig := *config
+	if len(serverConfig.UnitIds) == 0 {
+		serverConfig.UnitIds = s.UnitIds()
+	}
+	server, err := modbus.NewServer(&serverConfig, s)
+	if err != nil {
+		return err
+	}
+	err = server.Start()
+	if err != nil {
+		return err
+	}
+	s.server = server
+	return nil
+}
+
+// Stop Stops serving the devices.
+func (s *Simulator) Stop() error {
+	if s.server == nil {
+		return nil
+	}
+	err := s.server.Stop()
+	s.server = nil
+	return err
+}
+
+// HandleCoils None of the simulated devices have coils.
+func (s *Simulator) HandleCoils(req *modbus.CoilsRequest) ([]bool, error) {
+	_, err := s.device(req.UnitId)
+	if err != nil {
+		return nil, err
+	}
+	return nil, modbus.ErrIllegalFunction
+}
+
+// HandleDiscreteInputs None of the simulated devices have discrete inputs.
+func (s *Simulator) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) ([]bool, error) {
+	_, err := s.device(req.UnitId)
+	if err != nil {
+		return nil, err
+	}
+	return nil, modbus.ErrIllegalFunction
+}
+
+// HandleHoldingRegisters Reads or writes the holding registers of the device.
+func (s *Simulator) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
+	device, err := s.device(req.UnitId)
+	if err != nil {
+		return nil, err
+	}
+	if req.IsWrite {
+		return nil, device.WriteRegisters(req.Addr, req.Args)
+	}
+	return device.ReadRegisters(s.Clock(), modbus.HOLDING_REGISTER, req.Addr, req.Quantity)
+}
+
+// HandleInputRegisters Reads the input registers of the device.
+func (s *Simulator) HandleInputRegisters(req *modbus.InputRegistersRequest) ([]uint16, error) {
+	device, err := s.device(req.UnitId)
+	if err != nil {
+		return nil, err
+	}
+	return device.ReadRegisters(s.Clock(), modbus.INPUT_REGISTER, req.Addr, req.Quantity)
+}
+
+// device Returns the device served at unitId. Requests to other unit ids are answered like a gateway does.
+func (s *Simulator) device(unitId uint8) (Device, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	device, ok := s.devices[unitId]
+	if !ok {
+		return nil, modbus.ErrGWPathUnavailable
+	}
+	return device, nil
+}
+
+// registerImage Holds the registers of a device at a given time, missing registers are illegal addresses.
+type registerImage map[uint16]uint16
+
+// fill Sets quantity registers from addr to 0.
+func (ri registerImage) fill(addr uint16, quantity uint16) {
+	for ix := uint16(0); ix < quantity; ix++ {
+		ri[addr+ix] = 0
+	}
+}
+
+// setInt16 Sets a register to a signed value, saturating at the bounds of an int16.
+func (ri registerImage) setInt16(addr uint16, value float64) {
+	ri[addr] = uint16(int16(clamp(value, -32768, 32767)))
+}
+
+// setUint16 Sets a register to an unsigned value, saturating at the bounds of an uint16.
+func (ri registerImage) setUint16(addr uint16, value float64) {
+	ri[addr] = uint16(clamp(value, 0, 65535))
+}
+
+// setInt32LowFirst Sets two registers to a signed value, low word first.
+func (ri registerImage) setInt32LowFirst(addr uint16, value float64) {
+	raw := uint32(int32(clamp(value, -2147483648, 2147483647)))
+	ri[addr] = uint16(raw)
+	ri[addr+1] = uint16(raw >> 16)
+}
+
+// setString Sets quantity registers to a NUL padded string.
+func (ri registerImage) setString(addr uint16, quantity uint16, value string) {
+	for ix := uint16(0); ix < quantity; ix++ {
+		var high, low byte
+		if int(2*ix) < len(value) {
+			high = value[2*ix]
+		}
+		if int(2*ix+1) < len(value) {
+			low = value[2*ix+1]
+		}
+		ri[addr+ix] = uint16(high)<<8 | uint16(low)
+	}
+}
+
+// read Returns quantity registers from addr.
+func (ri registerImage) read(addr uint16, quantity uint16) ([]uint16, error) {
+	values := make([]uint16, quantity)
+	for ix := uint16(0); ix < quantity; ix++ {
+		value, ok := ri[addr+ix]
+		if !ok {
+			return nil, modbus.ErrIllegalDataAddress
+		}
+		values[ix] = value
+	}
+	return values, nil
+}
+
+func clamp(value float64, min float64, max float64) float64 {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
@@ -0,0 +1,87 @@
+package simulator
+
+import (
+	"enman/internal/modbus"
+	"time"
+)
+
+const (
+	// Product id served by simulated grid meters.
+	victronGridProductId = uint16(0xb002)
+	// Position of simulated pv inverters: AC output.
+	victronPvInverterPosition = uint16(1)
+)
+
+// VictronGrid A simulated grid meter (com.victronenergy.grid) as exposed by a Victron GX device. Positive power is
+// imported from the grid.
+type VictronGrid struct {
+	profile Profile
+	// Voltage is the line to neutral voltage (V) of all lines, defaults to 230V.
+	Voltage float64
+}
+
+// NewVictronGrid Simulates the grid meter of a Victron GX device.
+func NewVictronGrid(profile Profile) *VictronGrid {
+	return &VictronGrid{
+		profile: profile,
+		Voltage: 230,
+	}
+}
+
+// ReadRegisters Returns the registers of the grid meter at the given time. Like a GX device, only input and holding
+// registers within the register list of the service are served.
+func (g *VictronGrid) ReadRegisters(at time.Time, _ modbus.RegType, addr uint16, quantity uint16) ([]uint16, error) {
+	image := registerImage{}
+	// Power, energy counters, product id, ..., voltage and current.
+	image.fill(2600, 22)
+	for line := uint8(0); line < 3; line++ {
+		power := g.profile.Power(at, line)
+		image.setInt16(2600+uint16(line), power)
+		image.setUint16(2616+2*uint16(line), g.Voltage*10)
+		image.setInt16(2617+2*uint16(line), power/g.Voltage*10)
+	}
+	image[2609] = victronGridProductId
+	return image.read(addr, quantity)
+}
+
+// WriteRegisters The grid meter is read only.
+func (g *VictronGrid) WriteRegisters(uint16, []uint16) error {
+	return modbus.ErrIllegalDataAddress
+}
+
+// VictronPvInverter A simulated pv inverter (com.victronenergy.pvinverter) as exposed by a Victron GX device.
+// Negative power of the profile is served as 0, inverters don't consume.
+type VictronPvInverter struct {
+	profile Profile
+	// Voltage is the line to neutral voltage (V) of all lines, defaults to 230V.
+	Voltage float64
+}
+
+// NewVictronPvInverter Simulates a pv inverter connected to a Victron GX device.
+func NewVictronPvInverter(profile Profile) *VictronPvInverter {
+	return &VictronPvInverter{
+		profile: profile,
+		Voltage: 230,
+	}
+}
+
+// ReadRegisters Returns the registers of the pv inverter at the given time.
+func (p *VictronPvInverter) ReadRegisters(at time.Time, _ modbus.RegType, addr uint16, quantity uint16) ([]uint16, error) {
+	image := registerImage{}
+	// Position, then voltage, current, power and energy per line.
+	image.fill(1026, 13)
+	image[1026] = victronPvInverterPosition
+	for line := uint8(0); line < 3; line++ {
+		power := clamp(p.profile.Power(at, line), 0, 65535)
+		offset := 4 * uint16(line)
+		image.setUint16(1027+offset, p.Voltage*10)
+		image.setInt16(1028+offset, power/p.Voltage*10)
+		image.setUint16(1029+offset, power)
+	}
+	return image.read(addr, quantity)
+}
+
+// WriteRegisters The pv inverter is read only.
+func (p *VictronPvInverter) WriteRegisters(uint16, []uint16) error {
+	return modbus.ErrIllegalDataAddress
+}
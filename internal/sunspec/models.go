@@ -0,0 +1,604 @@
+package sunspec
+
+import (
+	"math"
+
+	"enman/internal/modbus"
+)
+
+// Values of points a device does not implement.
+const (
+	notImplementedInt16  uint16 = 0x8000
+	notImplementedUint16 uint16 = 0xffff
+	notImplementedAcc32  uint32 = 0
+	notImplementedSF     uint16 = 0x8000
+)
+
+// Inverter operating states (St point of models 101 to 103 and 111 to 113).
+type InverterState uint16
+
+const (
+	INVERTER_OFF           InverterState = 1
+	INVERTER_SLEEPING      InverterState = 2
+	INVERTER_STARTING      InverterState = 3
+	INVERTER_MPPT          InverterState = 4
+	INVERTER_THROTTLED     InverterState = 5
+	INVERTER_SHUTTING_DOWN InverterState = 6
+	INVERTER_FAULT         InverterState = 7
+	INVERTER_STANDBY       InverterState = 8
+)
+
+// Common model (1) object, identifying the device.
+type Common struct {
+	Manufacturer  string
+	Model         string
+	Options       string
+	Version       string
+	SerialNumber  string
+	DeviceAddress uint16
+}
+
+// Inverter object, decoded from models 101 to 103 (integer and scale factor)
+// or 111 to 113 (float).
+// Points not implemented by the device are set to NaN.
+type Inverter struct {
+	// ModelId is the id of the model the values were decoded from.
+	ModelId uint16
+	// Phases is 1 for single phase, 2 for split phase and 3 for three phase
+	// inverters.
+	Phases uint8
+	// AC current (A), total and per phase
+	Current      float64
+	PhaseCurrent [3]float64
+	// AC voltage (V), phase to neutral and phase to phase (AB, BC, CA)
+	PhaseVoltage [3]float64
+	LineVoltage  [3]float64
+	// AC power (W), apparent power (VA), reactive power (var) and power
+	// factor (%)
+	Power         float64
+	ApparentPower float64
+	ReactivePower float64
+	PowerFactor   float64
+	// Frequency (Hz)
+	Frequency float64
+	// Lifetime energy production (Wh)
+	Energy float64
+	// DC current (A), voltage (V) and power (W)
+	DCCurrent float64
+	DCVoltage float64
+	DCPower   float64
+	// Cabinet temperature (C)
+	Temperature float64
+	State       InverterState
+	Events      uint32
+}
+
+// Multiple MPPT inverter extension model (160) object.
+type MPPT struct {
+	Events  uint32
+	Modules []MPPTModule
+}
+
+// Single MPPT tracker (module) of a multiple MPPT inverter.
+// Points not implemented by the device are set to NaN.
+type MPPTModule struct {
+	Id   uint16
+	Name string
+	// DC current (A), voltage (V), power (W) and lifetime energy (Wh)
+	Current float64
+	Voltage float64
+	Power   float64
+	Energy  float64
+	// Temperature (C)
+	Temperature float64
+	State       uint16
+	Events      uint32
+}
+
+// Meter object, decoded from models 201 (single phase), 202 (split phase),
+// 203 (wye connect three phase) or 204 (delta connect three phase).
+// Points not implemented by the device are set to NaN.
+type Meter struct {
+	// ModelId is the id of the model the values were decoded from.
+	ModelId uint16
+	// Phases is 1 for single phase, 2 for split phase and 3 for three phase
+	// meters.
+	Phases uint8
+	// Current (A), total and per phase
+	Current      float64
+	PhaseCurrent [3]float64
+	// Voltage (V), average and per phase (phase to neutral)
+	Voltage      float64
+	PhaseVoltage [3]float64
+	// Frequency (Hz)
+	Frequency float64
+	// Real power (W), total and per phase. Positive values denote power
+	// imported (i.e. flowing from the grid into the installation).
+	Power      float64
+	PhasePower [3]float64
+	// Apparent power (VA), reactive power (var) and power factor (%)
+	ApparentPower float64
+	ReactivePower float64
+	PowerFactor   float64
+	// Total real energy exported and imported (Wh)
+	EnergyExported float64
+	EnergyImported float64
+	Events         uint32
+}
+
+// Basic storage controls model (124) object.
+// Points not implemented by the device are set to NaN.
+type Storage struct {
+	// Maximum charge power (W) and apparent power (VA)
+	MaxChargePower         float64
+	MaxChargeApparentPower float64
+	// Maximum charge and discharge ramp rates (% of MaxChargePower per second)
+	ChargeRampRate    float64
+	DischargeRampRate float64
+	// Active storage control modes (bit 0: charge, bit 1: discharge)
+	ControlMode uint16
+	// Minimum reserve and currently available energy, as % of capacity
+	MinReserve  float64
+	ChargeLevel float64
+	// Available energy (AH)
+	AvailableEnergy float64
+	// Internal battery voltage (V)
+	BatteryVoltage float64
+	// Charge status (1: off, 2: empty, 3: discharging, 4: charging,
+	// 5: full, 6: holding, 7: testing)
+	ChargeStatus uint16
+	// Discharge and charge rates, as % of max. discharge and charge rates
+	DischargeRate float64
+	ChargeRate    float64
+	// Whether charging from the grid is enabled
+	GridCharging bool
+}
+
+// Register layout of models 101 to 103.
+type inverterRegs struct {
+	A       uint16 `modbus:"0"`
+	AphA    uint16 `modbus:"1"`
+	AphB    uint16 `modbus:"2"`
+	AphC    uint16 `modbus:"3"`
+	A_SF    uint16 `modbus:"4"`
+	PPVphAB uint16 `modbus:"5"`
+	PPVphBC uint16 `modbus:"6"`
+	PPVphCA uint16 `modbus:"7"`
+	PhVphA  uint16 `modbus:"8"`
+	PhVphB  uint16 `modbus:"9"`
+	PhVphC  uint16 `modbus:"10"`
+	V_SF    uint16 `modbus:"11"`
+	W       uint16 `modbus:"12"`
+	W_SF    uint16 `modbus:"13"`
+	Hz      uint16 `modbus:"14"`
+	Hz_SF   uint16 `modbus:"15"`
+	VA      uint16 `modbus:"16"`
+	VA_SF   uint16 `modbus:"17"`
+	VAr     uint16 `modbus:"18"`
+	VAr_SF  uint16 `modbus:"19"`
+	PF      uint16 `modbus:"20"`
+	PF_SF   uint16 `modbus:"21"`
+	WH      uint32 `modbus:"22"`
+	WH_SF   uint16 `modbus:"24"`
+	DCA     uint16 `modbus:"25"`
+	DCA_SF  uint16 `modbus:"26"`
+	DCV     uint16 `modbus:"27"`
+	DCV_SF  uint16 `modbus:"28"`
+	DCW     uint16 `modbus:"29"`
+	DCW_SF  uint16 `modbus:"30"`
+	TmpCab  uint16 `modbus:"31"`
+	Tmp_SF  uint16 `modbus:"35"`
+	St      uint16 `modbus:"36"`
+	Evt1    uint32 `modbus:"38"`
+}
+
+// Register layout of models 111 to 113.
+type floatInverterRegs struct {
+	A       float32 `modbus:"0"`
+	AphA    float32 `modbus:"2"`
+	AphB    float32 `modbus:"4"`
+	AphC    float32 `modbus:"6"`
+	PPVphAB float32 `modbus:"8"`
+	PPVphBC float32 `modbus:"10"`
+	PPVphCA float32 `modbus:"12"`
+	PhVphA  float32 `modbus:"14"`
+	PhVphB  float32 `modbus:"16"`
+	PhVphC  float32 `modbus:"18"`
+	W       float32 `modbus:"20"`
+	Hz      float32 `modbus:"22"`
+	VA      float32 `modbus:"24"`
+	VAr     float32 `modbus:"26"`
+	PF      float32 `modbus:"28"`
+	WH      float32 `modbus:"30"`
+	DCA     float32 `modbus:"32"`
+	DCV     float32 `modbus:"34"`
+	DCW     float32 `modbus:"36"`
+	TmpCab  float32 `modbus:"38"`
+	St      uint16  `modbus:"46"`
+	Evt1    uint32  `modbus:"48"`
+}
+
+// Register layout of models 201 to 204.
+type meterRegs struct {
+	A        uint16 `modbus:"0"`
+	AphA     uint16 `modbus:"1"`
+	AphB     uint16 `modbus:"2"`
+	AphC     uint16 `modbus:"3"`
+	A_SF     uint16 `modbus:"4"`
+	PhV      uint16 `modbus:"5"`
+	PhVphA   uint16 `modbus:"6"`
+	PhVphB   uint16 `modbus:"7"`
+	PhVphC   uint16 `modbus:"8"`
+	V_SF     uint16 `modbus:"13"`
+	Hz       uint16 `modbus:"14"`
+	Hz_SF    uint16 `modbus:"15"`
+	W        uint16 `modbus:"16"`
+	WphA     uint16 `modbus:"17"`
+	WphB     uint16 `modbus:"18"`
+	WphC     uint16 `modbus:"19"`
+	W_SF     uint16 `modbus:"20"`
+	VA       uint16 `modbus:"21"`
+	VA_SF    uint16 `modbus:"25"`
+	VAR      uint16 `modbus:"26"`
+	VAR_SF   uint16 `modbus:"30"`
+	PF       uint16 `modbus:"31"`
+	PF_SF    uint16 `modbus:"35"`
+	TotWhExp uint32 `modbus:"36"`
+	TotWhImp uint32 `modbus:"44"`
+	TotWh_SF uint16 `modbus:"52"`
+	Evt      uint32 `modbus:"103"`
+}
+
+// Register layout of the fixed part of model 160.
+type mpptRegs struct {
+	DCA_SF  uint16 `modbus:"0"`
+	DCV_SF  uint16 `modbus:"1"`
+	DCW_SF  uint16 `modbus:"2"`
+	DCWH_SF uint16 `modbus:"3"`
+	Evt     uint32 `modbus:"4"`
+	N       uint16 `modbus:"6"`
+}
+
+// Register layout of a model 160 repeating block.
+type mpptModuleRegs struct {
+	ID    uint16 `modbus:"0"`
+	IDStr string `modbus:"1,len=8"`
+	DCA   uint16 `modbus:"9"`
+	DCV   uint16 `modbus:"10"`
+	DCW   uint16 `modbus:"11"`
+	DCWH  uint32 `modbus:"12"`
+	Tmp   uint16 `modbus:"16"`
+	DCSt  uint16 `modbus:"17"`
+	DCEvt uint32 `modbus:"18"`
+}
+
+// Register layout of model 124.
+type storageRegs struct {
+	WChaMax          uint16 `modbus:"0"`
+	WChaGra          uint16 `modbus:"1"`
+	WDisChaGra       uint16 `modbus:"2"`
+	StorCtl_Mod      uint16 `modbus:"3"`
+	VAChaMax         uint16 `modbus:"4"`
+	MinRsvPct        uint16 `modbus:"5"`
+	ChaState         uint16 `modbus:"6"`
+	StorAval         uint16 `modbus:"7"`
+	InBatV           uint16 `modbus:"8"`
+	ChaSt            uint16 `modbus:"9"`
+	OutWRte          uint16 `modbus:"10"`
+	InWRte           uint16 `modbus:"11"`
+	ChaGriSet        uint16 `modbus:"15"`
+	WChaMax_SF       uint16 `modbus:"16"`
+	WChaDisChaGra_SF uint16 `modbus:"17"`
+	VAChaMax_SF      uint16 `modbus:"18"`
+	MinRsvPct_SF     uint16 `modbus:"19"`
+	ChaState_SF      uint16 `modbus:"20"`
+	StorAval_SF      uint16 `modbus:"21"`
+	InBatV_SF        uint16 `modbus:"22"`
+	InOutWRte_SF     uint16 `modbus:"23"`
+}
+
+// DecodeCommon decodes the registers of a common model (1).
+func DecodeCommon(regs []uint16) (common *Common, err error) {
+	var raw struct {
+		Mn  string `modbus:"0,len=16"`
+		Md  string `modbus:"16,len=16"`
+		Opt string `modbus:"32,len=8"`
+		Vr  string `modbus:"40,len=8"`
+		SN  string `modbus:"48,len=16"`
+		DA  uint16 `modbus:"64"`
+	}
+
+	err = unmarshal(regs, 65, &raw)
+	if err != nil {
+		return
+	}
+
+	common = &Common{
+		Manufacturer:  raw.Mn,
+		Model:         raw.Md,
+		Options:       raw.Opt,
+		Version:       raw.Vr,
+		SerialNumber:  raw.SN,
+		DeviceAddress: raw.DA,
+	}
+
+	return
+}
+
+// DecodeInverter decodes the registers of an inverter model (101 to 103 or
+// 111 to 113).
+func DecodeInverter(id uint16, regs []uint16) (inverter *Inverter, err error) {
+	var raw inverterRegs
+	var fraw floatInverterRegs
+
+	inverter = &Inverter{
+		ModelId: id,
+	}
+
+	switch id {
+	case 101, 102, 103:
+		inverter.Phases = uint8(id - 100)
+		err = unmarshal(regs, 50, &raw)
+		if err != nil {
+			inverter = nil
+			return
+		}
+
+		inverter.Current = uint16Value(raw.A, raw.A_SF)
+		inverter.PhaseCurrent = [3]float64{
+			uint16Value(raw.AphA, raw.A_SF),
+			uint16Value(raw.AphB, raw.A_SF),
+			uint16Value(raw.AphC, raw.A_SF),
+		}
+		inverter.LineVoltage = [3]float64{
+			uint16Value(raw.PPVphAB, raw.V_SF),
+			uint16Value(raw.PPVphBC, raw.V_SF),
+			uint16Value(raw.PPVphCA, raw.V_SF),
+		}
+		inverter.PhaseVoltage = [3]float64{
+			uint16Value(raw.PhVphA, raw.V_SF),
+			uint16Value(raw.PhVphB, raw.V_SF),
+			uint16Value(raw.PhVphC, raw.V_SF),
+		}
+		inverter.Power = int16Value(raw.W, raw.W_SF)
+		inverter.Frequency = uint16Value(raw.Hz, raw.Hz_SF)
+		inverter.ApparentPower = int16Value(raw.VA, raw.VA_SF)
+		inverter.ReactivePower = int16Value(raw.VAr, raw.VAr_SF)
+		inverter.PowerFactor = int16Value(raw.PF, raw.PF_SF)
+		inverter.Energy = acc32Value(raw.WH, raw.WH_SF)
+		inverter.DCCurrent = uint16Value(raw.DCA, raw.DCA_SF)
+		inverter.DCVoltage = uint16Value(raw.DCV, raw.DCV_SF)
+		inverter.DCPower = int16Value(raw.DCW, raw.DCW_SF)
+		inverter.Temperature = int16Value(raw.TmpCab, raw.Tmp_SF)
+		inverter.State = InverterState(raw.St)
+		inverter.Events = raw.Evt1
+
+	case 111, 112, 113:
+		inverter.Phases = uint8(id - 110)
+		err = unmarshal(regs, 60, &fraw)
+		if err != nil {
+			inverter = nil
+			return
+		}
+
+		inverter.Current = float64(fraw.A)
+		inverter.PhaseCurrent = [3]float64{
+			float64(fraw.AphA), float64(fraw.AphB), float64(fraw.AphC),
+		}
+		inverter.LineVoltage = [3]float64{
+			float64(fraw.PPVphAB), float64(fraw.PPVphBC), float64(fraw.PPVphCA),
+		}
+		inverter.PhaseVoltage = [3]float64{
+			float64(fraw.PhVphA), float64(fraw.PhVphB), float64(fraw.PhVphC),
+		}
+		inverter.Power = float64(fraw.W)
+		inverter.Frequency = float64(fraw.Hz)
+		inverter.ApparentPower = float64(fraw.VA)
+		inverter.ReactivePower = float64(fraw.VAr)
+		inverter.PowerFactor = float64(fraw.PF)
+		inverter.Energy = float64(fraw.WH)
+		inverter.DCCurrent = float64(fraw.DCA)
+		inverter.DCVoltage = float64(fraw.DCV)
+		inverter.DCPower = float64(fraw.DCW)
+		inverter.Temperature = float64(fraw.TmpCab)
+		inverter.State = InverterState(fraw.St)
+		inverter.Events = fraw.Evt1
+
+	default:
+		inverter = nil
+		err = ErrModelNotFound
+	}
+
+	return
+}
+
+// DecodeMPPT decodes the registers of a multiple MPPT inverter extension
+// model (160).
+func DecodeMPPT(regs []uint16) (mppt *MPPT, err error) {
+	var raw mpptRegs
+	var module mpptModuleRegs
+	var offset int
+
+	err = unmarshal(regs, 8, &raw)
+	if err != nil {
+		return
+	}
+
+	if len(regs) < 8+20*int(raw.N) {
+		err = ErrBadModel
+		return
+	}
+
+	mppt = &MPPT{
+		Events: raw.Evt,
+	}
+	for i := 0; i < int(raw.N); i++ {
+		offset = 8 + 20*i
+		err = unmarshal(regs[offset:offset+20], 20, &module)
+		if err != nil {
+			mppt = nil
+			return
+		}
+
+		mppt.Modules = append(mppt.Modules, MPPTModule{
+			Id:          module.ID,
+			Name:        module.IDStr,
+			Current:     uint16Value(module.DCA, raw.DCA_SF),
+			Voltage:     uint16Value(module.DCV, raw.DCV_SF),
+			Power:       uint16Value(module.DCW, raw.DCW_SF),
+			Energy:      acc32Value(module.DCWH, raw.DCWH_SF),
+			Temperature: int16Value(module.Tmp, 0),
+			State:       module.DCSt,
+			Events:      module.DCEvt,
+		})
+	}
+
+	return
+}
+
+// DecodeMeter decodes the registers of a meter model (201 to 204).
+func DecodeMeter(id uint16, regs []uint16) (meter *Meter, err error) {
+	var raw meterRegs
+
+	meter = &Meter{
+		ModelId: id,
+	}
+
+	switch id {
+	case 201:
+		meter.Phases = 1
+	case 202:
+		meter.Phases = 2
+	case 203, 204:
+		meter.Phases = 3
+	default:
+		meter = nil
+		err = ErrModelNotFound
+		return
+	}
+
+	err = unmarshal(regs, 105, &raw)
+	if err != nil {
+		meter = nil
+		return
+	}
+
+	meter.Current = int16Value(raw.A, raw.A_SF)
+	meter.PhaseCurrent = [3]float64{
+		int16Value(raw.AphA, raw.A_SF),
+		int16Value(raw.AphB, raw.A_SF),
+		int16Value(raw.AphC, raw.A_SF),
+	}
+	meter.Voltage = int16Value(raw.PhV, raw.V_SF)
+	meter.PhaseVoltage = [3]float64{
+		int16Value(raw.PhVphA, raw.V_SF),
+		int16Value(raw.PhVphB, raw.V_SF),
+		int16Value(raw.PhVphC, raw.V_SF),
+	}
+	meter.Frequency = int16Value(raw.Hz, raw.Hz_SF)
+	meter.Power = int16Value(raw.W, raw.W_SF)
+	meter.PhasePower = [3]float64{
+		int16Value(raw.WphA, raw.W_SF),
+		int16Value(raw.WphB, raw.W_SF),
+		int16Value(raw.WphC, raw.W_SF),
+	}
+	meter.ApparentPower = int16Value(raw.VA, raw.VA_SF)
+	meter.ReactivePower = int16Value(raw.VAR, raw.VAR_SF)
+	meter.PowerFactor = int16Value(raw.PF, raw.PF_SF)
+	meter.EnergyExported = acc32Value(raw.TotWhExp, raw.TotWh_SF)
+	meter.EnergyImported = acc32Value(raw.TotWhImp, raw.TotWh_SF)
+	meter.Events = raw.Evt
+
+	return
+}
+
+// DecodeStorage decodes the registers of a basic storage controls model (124).
+func DecodeStorage(regs []uint16) (storage *Storage, err error) {
+	var raw storageRegs
+
+	err = unmarshal(regs, 24, &raw)
+	if err != nil {
+		return
+	}
+
+	storage = &Storage{
+		MaxChargePower:         uint16Value(raw.WChaMax, raw.WChaMax_SF),
+		MaxChargeApparentPower: uint16Value(raw.VAChaMax, raw.VAChaMax_SF),
+		ChargeRampRate:         uint16Value(raw.WChaGra, raw.WChaDisChaGra_SF),
+		DischargeRampRate:      uint16Value(raw.WDisChaGra, raw.WChaDisChaGra_SF),
+		ControlMode:            raw.StorCtl_Mod,
+		MinReserve:             uint16Value(raw.MinRsvPct, raw.MinRsvPct_SF),
+		ChargeLevel:            uint16Value(raw.ChaState, raw.ChaState_SF),
+		AvailableEnergy:        uint16Value(raw.StorAval, raw.StorAval_SF),
+		BatteryVoltage:         uint16Value(raw.InBatV, raw.InBatV_SF),
+		ChargeStatus:           raw.ChaSt,
+		DischargeRate:          int16Value(raw.OutWRte, raw.InOutWRte_SF),
+		ChargeRate:             int16Value(raw.InWRte, raw.InOutWRte_SF),
+		GridCharging:           raw.ChaGriSet == 1,
+	}
+
+	return
+}
+
+/*** unexported methods ***/
+
+// Decodes a model block of at least length registers into v.
+func unmarshal(regs []uint16, length int, v interface{}) (err error) {
+	if len(regs) < length {
+		err = ErrBadModel
+		return
+	}
+
+	// sunspec devices are always big endian, high word first
+	err = modbus.Unmarshal(regs, modbus.BIG_ENDIAN, modbus.HIGH_WORD_FIRST, v)
+
+	return
+}
+
+// Applies a sunssf scale factor to value.
+func scale(value float64, sf uint16) (out float64) {
+	if sf == notImplementedSF {
+		out = math.NaN()
+		return
+	}
+
+	out = value * math.Pow10(int(int16(sf)))
+
+	return
+}
+
+// Decodes a scaled int16 point.
+func int16Value(raw uint16, sf uint16) (value float64) {
+	if raw == notImplementedInt16 {
+		value = math.NaN()
+		return
+	}
+
+	value = scale(float64(int16(raw)), sf)
+
+	return
+}
+
+// Decodes a scaled uint16 point.
+func uint16Value(raw uint16, sf uint16) (value float64) {
+	if raw == notImplementedUint16 {
+		value = math.NaN()
+		return
+	}
+
+	value = scale(float64(raw), sf)
+
+	return
+}
+
+// Decodes a scaled acc32 point.
+func acc32Value(raw uint32, sf uint16) (value float64) {
+	if raw == notImplementedAcc32 {
+		value = math.NaN()
+		return
+	}
+
+	value = scale(float64(raw), sf)
+
+	return
+}
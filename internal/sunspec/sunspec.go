@@ -0,0 +1,262 @@
+// Package sunspec discovers and decodes SunSpec devices (PV inverters, meters,
+// storage) on top of a modbus client.
+// See https://sunspec.org for the information model specifications.
+package sunspec
+
+import (
+	"context"
+
+	"enman/internal/modbus"
+)
+
+type Error string
+
+// Error implements the error interface.
+func (se Error) Error() (s string) {
+	s = string(se)
+	return
+}
+
+const (
+	ErrNoSunSpecDevice Error = "no sunspec marker found"
+	ErrModelNotFound   Error = "model not found"
+	ErrBadModel        Error = "bad model length"
+)
+
+const (
+	// "SunS" marker, found at the base address of sunspec devices
+	markerHigh uint16 = 0x5375
+	markerLow  uint16 = 0x6e53
+	// id of the model terminating the model chain
+	endModelId uint16 = 0xffff
+	// max. number of registers covered by a single read request
+	maxReadCount uint16 = 125
+)
+
+// Standard base addresses, in probing order (most common first).
+var BaseAddresses = []uint16{40000, 0, 50000}
+
+// Model header object, locating a model in the register space of a device.
+type ModelHeader struct {
+	// Id is the sunspec model id (e.g. 1 for the common model).
+	Id uint16
+	// Addr is the address of the first register of the model, past its
+	// id and length registers.
+	Addr uint16
+	// Length is the number of registers of the model, past its id and
+	// length registers.
+	Length uint16
+}
+
+// SunSpec device object, as returned by Discover().
+type Device struct {
+	unit *modbus.ModbusUnit
+	// BaseAddr is the address the "SunS" marker was found at.
+	BaseAddr uint16
+	// Models lists the models of the device, in model chain order.
+	Models []ModelHeader
+}
+
+// Discover probes unit for the "SunS" marker at the standard base addresses,
+// then walks the model chain following it.
+// Returns ErrNoSunSpecDevice if the marker could not be found.
+func Discover(ctx context.Context, unit *modbus.ModbusUnit) (dev *Device, err error) {
+	var regs []uint16
+
+	for _, baseAddr := range BaseAddresses {
+		regs, err = unit.ReadRegisters(ctx, baseAddr, 2, modbus.HOLDING_REGISTER)
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
+
+		if err == nil && regs[0] == markerHigh && regs[1] == markerLow {
+			dev = &Device{
+				unit:     unit,
+				BaseAddr: baseAddr,
+			}
+			break
+		}
+	}
+
+	if dev == nil {
+		err = ErrNoSunSpecDevice
+		return
+	}
+
+	err = dev.walkModelChain(ctx)
+	if err != nil {
+		dev = nil
+	}
+
+	return
+}
+
+// Returns the header of the first model with the given id, and whether
+// the device implements it.
+func (dev *Device) Model(id uint16) (hdr ModelHeader, ok bool) {
+	for _, hdr = range dev.Models {
+		if hdr.Id == id {
+			ok = true
+			return
+		}
+	}
+
+	hdr = ModelHeader{}
+
+	return
+}
+
+// Reads all registers of a model, using as many requests as needed.
+func (dev *Device) ReadModel(ctx context.Context, hdr ModelHeader) (regs []uint16, err error) {
+	var quantity uint16
+	var chunk []uint16
+
+	for len(regs) < int(hdr.Length) {
+		quantity = hdr.Length - uint16(len(regs))
+		if quantity > maxReadCount {
+			quantity = maxReadCount
+		}
+
+		chunk, err = dev.unit.ReadRegisters(ctx, hdr.Addr+uint16(len(regs)), quantity, modbus.HOLDING_REGISTER)
+		if err != nil {
+			regs = nil
+			return
+		}
+		regs = append(regs, chunk...)
+	}
+
+	return
+}
+
+// Reads and decodes the common model (1).
+func (dev *Device) ReadCommon(ctx context.Context) (common *Common, err error) {
+	var regs []uint16
+
+	_, regs, err = dev.readFirstModel(ctx, 1)
+	if err != nil {
+		return
+	}
+
+	common, err = DecodeCommon(regs)
+
+	return
+}
+
+// Reads and decodes the first inverter model (101 to 103, or 111 to 113)
+// of the device.
+func (dev *Device) ReadInverter(ctx context.Context) (inverter *Inverter, err error) {
+	var regs []uint16
+	var id uint16
+
+	id, regs, err = dev.readFirstModel(ctx, 101, 102, 103, 111, 112, 113)
+	if err != nil {
+		return
+	}
+
+	inverter, err = DecodeInverter(id, regs)
+
+	return
+}
+
+// Reads and decodes the multiple MPPT inverter extension model (160).
+func (dev *Device) ReadMPPT(ctx context.Context) (mppt *MPPT, err error) {
+	var regs []uint16
+
+	_, regs, err = dev.readFirstModel(ctx, 160)
+	if err != nil {
+		return
+	}
+
+	mppt, err = DecodeMPPT(regs)
+
+	return
+}
+
+// Reads and decodes the first meter model (201 to 204) of the device.
+func (dev *Device) ReadMeter(ctx context.Context) (meter *Meter, err error) {
+	var regs []uint16
+	var id uint16
+
+	id, regs, err = dev.readFirstModel(ctx, 201, 202, 203, 204)
+	if err != nil {
+		return
+	}
+
+	meter, err = DecodeMeter(id, regs)
+
+	return
+}
+
+// Reads and decodes the basic storage controls model (124).
+func (dev *Device) ReadStorage(ctx context.Context) (storage *Storage, err error) {
+	var regs []uint16
+
+	_, regs, err = dev.readFirstModel(ctx, 124)
+	if err != nil {
+		return
+	}
+
+	storage, err = DecodeStorage(regs)
+
+	return
+}
+
+/*** unexported methods ***/
+
+// Reads the model headers following the "SunS" marker, up to the end model
+// or the first unreadable header.
+func (dev *Device) walkModelChain(ctx context.Context) (err error) {
+	var addr uint16
+	var regs []uint16
+
+	addr = dev.BaseAddr + 2
+	for {
+		regs, err = dev.unit.ReadRegisters(ctx, addr, 2, modbus.HOLDING_REGISTER)
+		// some devices omit the end model and reject reads past the
+		// last model instead
+		if err == modbus.ErrIllegalDataAddress && len(dev.Models) > 0 {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		if regs[0] == endModelId {
+			return
+		}
+
+		// the model (and the next header) must fit in the address space
+		if int(addr)+2+int(regs[1])+2 > 0x10000 {
+			err = ErrBadModel
+			return
+		}
+
+		dev.Models = append(dev.Models, ModelHeader{
+			Id:     regs[0],
+			Addr:   addr + 2,
+			Length: regs[1],
+		})
+		addr += 2 + regs[1]
+	}
+}
+
+// Reads the first implemented model of ids.
+func (dev *Device) readFirstModel(ctx context.Context, ids ...uint16) (id uint16, regs []uint16, err error) {
+	var hdr ModelHeader
+	var ok bool
+
+	for _, id = range ids {
+		hdr, ok = dev.Model(id)
+		if ok {
+			regs, err = dev.ReadModel(ctx, hdr)
+			return
+		}
+	}
+
+	id = 0
+	err = ErrModelNotFound
+
+	return
+}
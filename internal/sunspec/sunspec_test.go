@@ -0,0 +1,330 @@
+package sunspec
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+
+	"enman/internal/modbus"
+)
+
+// Serves a sunspec register image from holding registers, rejecting reads
+// outside of it.
+type sunspecTestHandler struct {
+	lock     sync.Mutex
+	baseAddr uint16
+	image    []uint16
+}
+
+func (th *sunspecTestHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	err = modbus.ErrIllegalFunction
+	return
+}
+
+func (th *sunspecTestHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	err = modbus.ErrIllegalFunction
+	return
+}
+
+func (th *sunspecTestHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	th.lock.Lock()
+	defer th.lock.Unlock()
+
+	if req.IsWrite || req.Addr < th.baseAddr ||
+		int(req.Addr-th.baseAddr)+int(req.Quantity) > len(th.image) {
+		err = modbus.ErrIllegalDataAddress
+		return
+	}
+
+	res = append(res, th.image[req.Addr-th.baseAddr:int(req.Addr-th.baseAddr)+int(req.Quantity)]...)
+
+	return
+}
+
+func (th *sunspecTestHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	err = modbus.ErrIllegalFunction
+	return
+}
+
+// Returns a model block with the given id and length, its registers
+// initialized to the not implemented value 0xffff.
+func testModel(id uint16, length uint16) (regs []uint16) {
+	regs = make([]uint16, 2+int(length))
+	regs[0] = id
+	regs[1] = length
+	for i := 2; i < len(regs); i++ {
+		regs[i] = 0xffff
+	}
+
+	return
+}
+
+// Writes s into regs, padded with null bytes.
+func testString(regs []uint16, s string) {
+	for i := range regs {
+		regs[i] = 0
+	}
+	for i := 0; i < len(s); i += 2 {
+		regs[i/2] = uint16(s[i]) << 8
+		if i+1 < len(s) {
+			regs[i/2] |= uint16(s[i+1])
+		}
+	}
+
+	return
+}
+
+// Returns the register image of a three phase inverter with two MPPT
+// trackers, a meter and a battery.
+func testImage() (image []uint16) {
+	var common, inverter, mppt, vendor, meter, storage []uint16
+
+	common = testModel(1, 66)
+	testString(common[34:42], "")
+	testString(common[2:18], "Fronius")
+	testString(common[18:34], "Symo 8.2-3-M")
+	testString(common[42:50], "1.2.3")
+	testString(common[50:66], "SN1234")
+	common[66] = 1
+
+	inverter = testModel(103, 50)
+	// 12.3A, 4.1A per phase (A_SF = -1)
+	inverter[2], inverter[3], inverter[4], inverter[5], inverter[6] = 123, 41, 41, 41, 0xffff
+	// 230.1V per phase (V_SF = -1)
+	inverter[10], inverter[11], inverter[12], inverter[13] = 2301, 2302, 2303, 0xffff
+	// 2830W (W_SF = 1)
+	inverter[14], inverter[15] = 283, 1
+	// 50.01Hz (Hz_SF = -2)
+	inverter[16], inverter[17] = 5001, 0xfffe
+	// unimplemented VA with implemented scale factor
+	inverter[18], inverter[19] = 0x8000, 0
+	// 12345678Wh (WH_SF = 0)
+	inverter[24], inverter[25], inverter[26] = 0x00bc, 0x614e, 0
+	// MPPT state
+	inverter[38] = 4
+
+	mppt = testModel(160, 8+2*20)
+	mppt[2], mppt[3], mppt[4], mppt[5] = 0xfffe, 0xffff, 0, 0
+	mppt[6], mppt[7] = 0, 0
+	mppt[8] = 2
+	for i := 0; i < 2; i++ {
+		mppt[10+20*i] = uint16(i + 1)
+		testString(mppt[11+20*i:19+20*i], "String "+string(rune('A'+i)))
+		// 7.25A, 400.1V, 2900W
+		mppt[19+20*i], mppt[20+20*i], mppt[21+20*i] = 725, 4001, 2900
+		mppt[22+20*i], mppt[23+20*i] = 0, 1000
+	}
+
+	// vendor specific model longer than a single request can read
+	vendor = testModel(64001, 200)
+
+	meter = testModel(203, 105)
+	// -1000W total, per phase (W_SF = 0), 230V average
+	meter[18], meter[19], meter[20], meter[21], meter[22] = 0xfc18, 0xfeac, 0xfeac, 0xfed4, 0
+	meter[7], meter[15] = 230, 0
+
+	storage = testModel(124, 24)
+	// 55.5% charge level (ChaState_SF = -1), charging
+	storage[8], storage[22] = 555, 0xffff
+	storage[11] = 4
+
+	image = []uint16{0x5375, 0x6e53}
+	for _, model := range [][]uint16{common, inverter, mppt, vendor, meter, storage} {
+		image = append(image, model...)
+	}
+	image = append(image, 0xffff, 0)
+
+	return
+}
+
+func TestDiscover(t *testing.T) {
+	var err error
+	var th *sunspecTestHandler
+	var server *modbus.ModbusServer
+	var client *modbus.ModbusClient
+	var dev *Device
+	var common *Common
+	var inverter *Inverter
+	var mppt *MPPT
+	var meter *Meter
+	var storage *Storage
+	var regs []uint16
+
+	th = &sunspecTestHandler{
+		baseAddr: 50000,
+		image:    testImage(),
+	}
+
+	server, err = modbus.NewServer(&modbus.ServerConfiguration{
+		URL: "tcp://localhost:5512",
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client, err = modbus.NewClient(&modbus.ClientConfiguration{
+		URL: "tcp://localhost:5512",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+	err = client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	// the marker should be found at the last base address probed
+	dev, err = Discover(context.Background(), client.Unit(1))
+	if err != nil {
+		t.Errorf("Discover() should have succeeded, got: %v", err)
+		return
+	}
+	if dev.BaseAddr != 50000 {
+		t.Errorf("expected base address 50000, got: %v", dev.BaseAddr)
+	}
+	if len(dev.Models) != 6 {
+		t.Errorf("expected 6 models, got: %v", dev.Models)
+	}
+	if _, ok := dev.Model(203); !ok {
+		t.Errorf("model 203 should have been found")
+	}
+	if _, ok := dev.Model(101); ok {
+		t.Errorf("model 101 should not have been found")
+	}
+
+	common, err = dev.ReadCommon(context.Background())
+	if err != nil {
+		t.Errorf("ReadCommon() should have succeeded, got: %v", err)
+	} else if common.Manufacturer != "Fronius" || common.Model != "Symo 8.2-3-M" ||
+		common.Version != "1.2.3" || common.SerialNumber != "SN1234" || common.DeviceAddress != 1 {
+		t.Errorf("unexpected common model: %+v", common)
+	}
+
+	inverter, err = dev.ReadInverter(context.Background())
+	if err != nil {
+		t.Errorf("ReadInverter() should have succeeded, got: %v", err)
+	} else {
+		if inverter.ModelId != 103 || inverter.Phases != 3 {
+			t.Errorf("expected a three phase inverter, got: %v (%v phases)", inverter.ModelId, inverter.Phases)
+		}
+		if !approximately(inverter.Current, 12.3) || !approximately(inverter.PhaseCurrent[2], 4.1) {
+			t.Errorf("expected 12.3A and 4.1A, got: %v and %v", inverter.Current, inverter.PhaseCurrent[2])
+		}
+		if !approximately(inverter.PhaseVoltage[1], 230.2) {
+			t.Errorf("expected 230.2V, got: %v", inverter.PhaseVoltage[1])
+		}
+		if !math.IsNaN(inverter.LineVoltage[0]) {
+			t.Errorf("expected NaN, got: %v", inverter.LineVoltage[0])
+		}
+		if inverter.Power != 2830 || !approximately(inverter.Frequency, 50.01) {
+			t.Errorf("expected 2830W at 50.01Hz, got: %vW at %vHz", inverter.Power, inverter.Frequency)
+		}
+		if !math.IsNaN(inverter.ApparentPower) {
+			t.Errorf("expected NaN, got: %v", inverter.ApparentPower)
+		}
+		if inverter.Energy != 12345678 {
+			t.Errorf("expected 12345678Wh, got: %v", inverter.Energy)
+		}
+		if inverter.State != INVERTER_MPPT {
+			t.Errorf("expected INVERTER_MPPT, got: %v", inverter.State)
+		}
+	}
+
+	mppt, err = dev.ReadMPPT(context.Background())
+	if err != nil {
+		t.Errorf("ReadMPPT() should have succeeded, got: %v", err)
+	} else if len(mppt.Modules) != 2 {
+		t.Errorf("expected 2 modules, got: %v", len(mppt.Modules))
+	} else {
+		if mppt.Modules[1].Id != 2 || mppt.Modules[1].Name != "String B" {
+			t.Errorf("unexpected module: %+v", mppt.Modules[1])
+		}
+		if !approximately(mppt.Modules[0].Current, 7.25) || !approximately(mppt.Modules[0].Voltage, 400.1) ||
+			mppt.Modules[0].Power != 2900 || mppt.Modules[0].Energy != 1000 {
+			t.Errorf("unexpected module: %+v", mppt.Modules[0])
+		}
+	}
+
+	regs, err = dev.ReadModel(context.Background(), dev.Models[3])
+	if err != nil {
+		t.Errorf("ReadModel() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 200 {
+		t.Errorf("expected 200 registers, got: %v", len(regs))
+	}
+
+	meter, err = dev.ReadMeter(context.Background())
+	if err != nil {
+		t.Errorf("ReadMeter() should have succeeded, got: %v", err)
+	} else {
+		if meter.Phases != 3 || meter.Voltage != 230 {
+			t.Errorf("unexpected meter: %+v", meter)
+		}
+		if meter.Power != -1000 || meter.PhasePower[0] != -340 || meter.PhasePower[2] != -300 {
+			t.Errorf("expected -1000W, -340W and -300W, got: %v, %v and %v",
+				meter.Power, meter.PhasePower[0], meter.PhasePower[2])
+		}
+	}
+
+	storage, err = dev.ReadStorage(context.Background())
+	if err != nil {
+		t.Errorf("ReadStorage() should have succeeded, got: %v", err)
+	} else {
+		if !approximately(storage.ChargeLevel, 55.5) || storage.ChargeStatus != 4 {
+			t.Errorf("expected 55.5%% and charging, got: %v and %v", storage.ChargeLevel, storage.ChargeStatus)
+		}
+		if !math.IsNaN(storage.MaxChargePower) {
+			t.Errorf("expected NaN, got: %v", storage.MaxChargePower)
+		}
+	}
+
+	// devices without the marker should be reported as such
+	th.lock.Lock()
+	th.image[0] = 0
+	th.lock.Unlock()
+	_, err = Discover(context.Background(), client.Unit(1))
+	if err != ErrNoSunSpecDevice {
+		t.Errorf("Discover() should have failed with ErrNoSunSpecDevice, got: %v", err)
+	}
+
+	return
+}
+
+func TestDecodeErrors(t *testing.T) {
+	var err error
+
+	_, err = DecodeInverter(103, make([]uint16, 49))
+	if err != ErrBadModel {
+		t.Errorf("DecodeInverter() should have failed with ErrBadModel, got: %v", err)
+	}
+
+	_, err = DecodeMeter(210, make([]uint16, 105))
+	if err != ErrModelNotFound {
+		t.Errorf("DecodeMeter() should have failed with ErrModelNotFound, got: %v", err)
+	}
+
+	// repeating blocks must all be there
+	_, err = DecodeMPPT([]uint16{0, 0, 0, 0, 0, 0, 2, 0})
+	if err != ErrBadModel {
+		t.Errorf("DecodeMPPT() should have failed with ErrBadModel, got: %v", err)
+	}
+
+	return
+}
+
+func approximately(value float64, expected float64) (ok bool) {
+	ok = math.Abs(value-expected) < 1e-9*math.Max(1, math.Abs(expected))
+
+	return
+}
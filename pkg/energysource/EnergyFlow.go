@@ -1,6 +1,9 @@
 package energysource
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+)
 
 const (
 	// MinVoltage The minimum voltage a grid must have.
@@ -24,16 +27,22 @@ type EnergyFlow interface {
 	Voltage(lineIx uint8) float32
 	Current(lineIx uint8) float32
 	TotalCurrent() float32
+	Stale() bool
 	ToMap() map[string]any
 }
 
 type EnergyFlowBase struct {
+	// Guards the values, which are set by pollers while being read by others.
+	lock    sync.RWMutex
 	current [MaxPhases]float32
 	power   [MaxPhases]float32
 	voltage [MaxPhases]float32
+	stale   bool
 }
 
 func (efb *EnergyFlowBase) Phases() uint8 {
+	efb.lock.RLock()
+	defer efb.lock.RUnlock()
 	for x := MaxPhases; x >= MinPhases; x-- {
 		if efb.voltage[x-1] != 0 {
 			return x
@@ -46,6 +55,8 @@ func (efb *EnergyFlowBase) Power(lineIx uint8) float32 {
 	if !validLineIx(lineIx) {
 		return 0
 	}
+	efb.lock.RLock()
+	defer efb.lock.RUnlock()
 	return efb.power[lineIx]
 }
 
@@ -55,11 +66,15 @@ func (efb *EnergyFlowBase) SetPower(lineIx uint8, power float32) error {
 		return fmt.Errorf("lineIx must be between %d and %d (inclusive), provided %d",
 			MinPhases-1, MaxPhases-1, lineIx)
 	}
+	efb.lock.Lock()
+	defer efb.lock.Unlock()
 	efb.power[lineIx] = power
 	return nil
 }
 
 func (efb *EnergyFlowBase) TotalPower() float32 {
+	efb.lock.RLock()
+	defer efb.lock.RUnlock()
 	totalPower := float32(0)
 	for i := 0; i < len(efb.power); i++ {
 		totalPower += efb.power[i]
@@ -71,6 +86,8 @@ func (efb *EnergyFlowBase) Voltage(lineIx uint8) float32 {
 	if !validLineIx(lineIx) {
 		return 0
 	}
+	efb.lock.RLock()
+	defer efb.lock.RUnlock()
 	return efb.voltage[lineIx]
 }
 
@@ -80,6 +97,8 @@ func (efb *EnergyFlowBase) SetVoltage(lineIx uint8, voltage float32) error {
 		return fmt.Errorf("lineIx must be between %d and %d (inclusive), provided %d",
 			MinPhases-1, MaxPhases-1, lineIx)
 	}
+	efb.lock.Lock()
+	defer efb.lock.Unlock()
 	efb.voltage[lineIx] = voltage
 	return nil
 }
@@ -88,6 +107,8 @@ func (efb *EnergyFlowBase) Current(lineIx uint8) float32 {
 	if !validLineIx(lineIx) {
 		return 0
 	}
+	efb.lock.RLock()
+	defer efb.lock.RUnlock()
 	return efb.current[lineIx]
 }
 
@@ -97,11 +118,15 @@ func (efb *EnergyFlowBase) SetCurrent(lineIx uint8, current float32) error {
 		return fmt.Errorf("lineIx must be between %d and %d (inclusive), provided %d",
 			MinPhases-1, MaxPhases-1, lineIx)
 	}
+	efb.lock.Lock()
+	defer efb.lock.Unlock()
 	efb.current[lineIx] = current
 	return nil
 }
 
 func (efb *EnergyFlowBase) TotalCurrent() float32 {
+	efb.lock.RLock()
+	defer efb.lock.RUnlock()
 	totalCurrent := float32(0)
 	for i := 0; i < len(efb.current); i++ {
 		totalCurrent += efb.current[i]
@@ -109,12 +134,27 @@ func (efb *EnergyFlowBase) TotalCurrent() float32 {
 	return totalCurrent
 }
 
+// Stale Tells whether the values are outdated, for example because the meter providing them can't be reached.
+func (efb *EnergyFlowBase) Stale() bool {
+	efb.lock.RLock()
+	defer efb.lock.RUnlock()
+	return efb.stale
+}
+
+// SetStale Marks the values as outdated, or as up-to-date again.
+func (efb *EnergyFlowBase) SetStale(stale bool) {
+	efb.lock.Lock()
+	defer efb.lock.Unlock()
+	efb.stale = stale
+}
+
 func (efb *EnergyFlowBase) ToMap() map[string]any {
 	phases := efb.Phases()
 	data := map[string]any{
 		"phases":        phases,
 		"total_current": efb.TotalCurrent(),
 		"total_power":   efb.TotalPower(),
+		"stale":         efb.Stale(),
 	}
 	for ix := uint8(0); ix < phases; ix++ {
 		data[fmt.Sprintf("l%d", ix)] = map[string]any{